@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"container/list"
 	"context"
+	"errors"
 	"fmt"
 	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
@@ -24,7 +25,6 @@ import (
 const (
 	INITIAL_BITS        = 0x1e7fffff
 	GENESIS_BLOCK_TIME  = 1669004537 // updated when deployed
-	BLOCK_REWARD        = 1000
 	S_BLOCK_QUEUE       = 100
 	EXPECTED_BLOCK_TIME = 15 // seconds
 	P_BITS_ADJUSTMENT   = 20 // blocks
@@ -36,21 +36,22 @@ const (
 )
 
 type Blockchain struct {
-	RootDir                     string    // root directory of the blockchain data
-	*wallet.DiskWallet                    // built-in persisted wallet
-	*persistence.BlockFile                // current block file
-	*persistence.BlockIndexRepo           // block index repository
-	*persistence.ChainStateRepo           // chain state repository
-	mempool                     list.List // transaction memory pool
+	RootDir                     string                   // root directory of the blockchain data
+	*wallet.DiskWallet                                   // built-in persisted wallet
+	*persistence.BlockFile                               // current block file
+	BlockReader                 *persistence.BlockReader // reads stored blocks, caching the last ones
+	*persistence.BlockIndexRepo                          // block index repository
+	Tree                        *persistence.BlockTree   // every known block, on any branch, and the orphan pool
+	*persistence.ChainStateRepo                          // chain state repository
+	mempool                     list.List                // transaction memory pool
 	mempoolMutex                sync.Mutex
-	*p2p.Network                              // peer-to-peer network
-	branch                      []*core.Block // a possible new branch (orphanage)
-	branchMutex                 sync.Mutex
-	addBlockHandlers            []func(*core.Block)
-	reorgHandlers               []func(*core.Block, []*core.UXTO)
+	*p2p.Network                // peer-to-peer network
+	addBlockHandlers            []func(*core.Block) error
+	reorgHandlers               []func(*core.Block, []*core.UXTO) error
 	MiningCtx                   context.Context // context for mining
 	MingCtxMutex                sync.Mutex
 	blockQueue                  chan *core.Block
+	PruneTarget                 uint64 // bytes the block files may take before the oldest are pruned, 0 to keep all
 }
 
 // NewBlockchain creates a new blockchain at path as root directory.
@@ -65,6 +66,13 @@ func NewBlockchain(rootDir string, hostname string, port int) (*Blockchain, erro
 	if err != nil {
 		return nil, fmt.Errorf("cannot create block index: %w", err)
 	}
+	if err := persistence.MigrateBlockFiles(rootDir, bi); err != nil {
+		return nil, fmt.Errorf("cannot migrate block files: %w", err)
+	}
+	tree, err := persistence.NewBlockTree(bi)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load block tree: %w", err)
+	}
 	cs, err := persistence.NewChainStateRepo(rootDir)
 	if err != nil {
 		return nil, fmt.Errorf("cannot create chain state: %w", err)
@@ -76,6 +84,9 @@ func NewBlockchain(rootDir string, hostname string, port int) (*Blockchain, erro
 		return nil, fmt.Errorf("cannot get current block file id: %w", err)
 	}
 	bf, err := persistence.NewBlockFile(rootDir, bfId)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open block file %d: %w", bfId, err)
+	}
 	net, err := p2p.NewNetwork(hostname, port, 0)
 	if err != nil {
 		return nil, fmt.Errorf("cannot create network: %w", err)
@@ -85,18 +96,27 @@ func NewBlockchain(rootDir string, hostname string, port int) (*Blockchain, erro
 		RootDir:        rootDir,
 		DiskWallet:     w,
 		BlockFile:      bf,
+		BlockReader:    persistence.NewBlockReader(rootDir, persistence.S_BLOCK_CACHE),
 		BlockIndexRepo: bi,
+		Tree:           tree,
 		ChainStateRepo: cs,
 		Network:        net,
 	}
 
 	b.MiningCtx = context.Background()
 
-	// create genesis
+	if err := b.loadPrunedFiles(); err != nil {
+		return nil, err
+	}
+
+	// create genesis, unless the chain state already has a tip
 	genesis := makeGenesisBlock()
-	err = b.addBlockAsTip(genesis)
-	if err != nil {
-		return nil, fmt.Errorf("cannot add genesis block: %w", err)
+	if _, err := cs.GetCurrentBlockHash(); err == persistence.ErrNotFound {
+		if err := b.addBlockAsTip(genesis); err != nil {
+			return nil, fmt.Errorf("cannot add genesis block: %w", err)
+		}
+	} else if err != nil {
+		return nil, fmt.Errorf("cannot get current block hash: %w", err)
 	}
 
 	// initialize wallet
@@ -110,10 +130,23 @@ func NewBlockchain(rootDir string, hostname string, port int) (*Blockchain, erro
 	b.RegisterAddBlockHandler(b.DiskWallet.ProcessBlock)
 	b.RegisterReorgHandler(b.DiskWallet.RollBack)
 
-	// set initial contexts
+	// repair a block connection or disconnection that was interrupted
+	if err := b.replayJournal(); err != nil {
+		return nil, fmt.Errorf("cannot replay journal: %w", err)
+	}
+
+	// set initial contexts; mining continues from the tip
+	tipHash, err := cs.GetCurrentBlockHash()
+	if err != nil {
+		return nil, fmt.Errorf("cannot get current block hash: %w", err)
+	}
+	tipRec, err := bi.GetBlockIndexRecord(tipHash)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get tip record: %w", err)
+	}
 	b.MiningCtx = context.WithValue(b.MiningCtx, CTX_ADDRESS, addr1)
-	b.MiningCtx = context.WithValue(b.MiningCtx, CTX_PREV_HASH, genesis.Hash)
-	b.MiningCtx = context.WithValue(b.MiningCtx, CTX_PREV_HEIGHT, genesis.Height)
+	b.MiningCtx = context.WithValue(b.MiningCtx, CTX_PREV_HASH, tipHash)
+	b.MiningCtx = context.WithValue(b.MiningCtx, CTX_PREV_HEIGHT, tipRec.Height)
 
 	// initialize the block queue
 	b.blockQueue = make(chan *core.Block, S_BLOCK_QUEUE)
@@ -123,7 +156,7 @@ func NewBlockchain(rootDir string, hostname string, port int) (*Blockchain, erro
 
 func makeGenesisBlock() *core.Block {
 	// TODO: hardcode the genesis block, instead of build it (which may lead to non-deterministic genesis block)
-	coinbase := core.NewCoinBaseTransaction([]byte("genesis"), core.Hash160{}, BLOCK_REWARD, 0)
+	coinbase := core.NewCoinBaseTransaction([]byte("genesis"), core.Hash160{}, core.Subsidy(0), 0)
 	bb := core.NewBlockBuilder()
 	bb.BaseOn(core.Hash256{}, 4294967295)
 	bb.AddTransaction(coinbase)
@@ -132,7 +165,7 @@ func makeGenesisBlock() *core.Block {
 	bb.Nonce = 28980
 	mkRoot, _ := bb.CalculateMerkleRoot()
 	bb.HashMerkleRoot = mkRoot
-	bb.Hash = bb.BlockHeader.Hash()
+	bb.Hash = bb.HashAtHeight(bb.Height)
 
 	return bb.Block
 }
@@ -141,7 +174,8 @@ func makeGenesisBlock() *core.Block {
 // 1. The block is max 1 MB in size
 // 2. The block must contain at least one coinbase transaction
 // 3. Transactions with higher fees are preferred
-func (bc *Blockchain) Mine(coinbase []byte, reward uint32) (*core.Block, error) {
+// The coinbase claims the subsidy at the height of the block plus the fees of the selected transactions.
+func (bc *Blockchain) Mine(coinbase []byte) (*core.Block, error) {
 	// read mining parameters from context
 	addr, ok := bc.MiningCtx.Value(CTX_ADDRESS).(core.Hash160)
 	if !ok {
@@ -165,14 +199,20 @@ func (bc *Blockchain) Mine(coinbase []byte, reward uint32) (*core.Block, error)
 	bb.SetNBits(nBits)
 	log.Debugf("Current difficulty: %064x", bb.TargetValue())
 	// transaction selection
-	var txFee uint32
+	var txFee core.Amount
 	var blkSize int
 	var txs []*core.Transaction
 	for e := bc.mempool.Front(); e != nil; e = e.Next() {
 		tx := e.Value.(*core.Transaction)
+		fee, err := tx.CalculateFee(bc.ChainStateRepo)
+		if err == nil {
+			txFee, err = core.AddAmounts(txFee, fee)
+		}
+		if err != nil {
+			log.Warnf("Skipped transaction %s for mining: %s", tx.Hash(), err)
+			continue
+		}
 		txs = append(txs, tx)
-		fee := tx.CalculateFee(bc.ChainStateRepo)
-		txFee += fee
 		blkSize += len(marshal.Transaction(tx))
 
 		log.Infof("Selected transaction for mining from mempool: hash=%s, fee=%d", tx.Hash(), fee)
@@ -182,7 +222,7 @@ func (bc *Blockchain) Mine(coinbase []byte, reward uint32) (*core.Block, error)
 		}
 	}
 
-	coinbaseTx := core.NewCoinBaseTransaction(coinbase, addr, reward, txFee)
+	coinbaseTx := core.NewCoinBaseTransaction(coinbase, addr, core.Subsidy(prevHeight+1), txFee)
 	txs = append([]*core.Transaction{coinbaseTx}, txs...) // prepend coinbase transaction
 
 	for _, tx := range txs {
@@ -202,9 +242,21 @@ func (bc *Blockchain) Mine(coinbase []byte, reward uint32) (*core.Block, error)
 // 3. Transactions in the pool are sorted by fee
 func (bc *Blockchain) ReceiveTransaction(tx *core.Transaction) error {
 	// TODO: can wrap the transaction to include more data, such as the fee, to be more efficient
-	if err := tx.Verify(bc.ChainStateRepo); err != nil {
+	// the transaction is verified against the rules of the next block, which is where it can be mined
+	tipHash, err := bc.GetCurrentBlockHash()
+	if err != nil {
+		return fmt.Errorf("failed to get tip: %w", err)
+	}
+	tipRec, err := bc.GetBlockIndexRecord(tipHash)
+	if err != nil {
+		return fmt.Errorf("failed to get tip record: %w", err)
+	}
+	if err := tx.Verify(bc.ChainStateRepo, tipRec.Height+1); err != nil {
 		return fmt.Errorf("failed to verify transaction: %w", err)
 	}
+	if err := tx.CheckLocks(bc.ChainStateRepo, tipRec.Height+1, bc); err != nil {
+		return fmt.Errorf("transaction is not final: %w", err)
+	}
 
 	for e := bc.mempool.Front(); e != nil; e = e.Next() {
 		if tx.Hash() == e.Value.(*core.Transaction).Hash() {
@@ -218,9 +270,12 @@ func (bc *Blockchain) ReceiveTransaction(tx *core.Transaction) error {
 		return nil
 	}
 
-	fee := tx.CalculateFee(bc.ChainStateRepo)
+	fee, err := tx.CalculateFee(bc.ChainStateRepo)
+	if err != nil {
+		return fmt.Errorf("failed to calculate fee: %w", err)
+	}
 	for e := bc.mempool.Front(); e != nil; e = e.Next() {
-		if fee > e.Value.(*core.Transaction).CalculateFee(bc.ChainStateRepo) {
+		if otherFee, _ := e.Value.(*core.Transaction).CalculateFee(bc.ChainStateRepo); fee > otherFee {
 			bc.mempool.InsertBefore(tx, e)
 			log.Infof("Added transaction input mempool: %s", tx.Hash())
 			break
@@ -235,73 +290,163 @@ func (bc *Blockchain) AddBlockToQueue(b *core.Block) {
 	bc.blockQueue <- b
 }
 
-// ProcessBlockQueue processes a block from the queue according to the following rules:
-// 1. If the block references the current tip, add it to the chain (as the new tip)
-// 2. If the block references a stale block or a block in the orphan pool, add it to the orphan pool (possible fork). Reorganize when necessary.
-// 3. Else drop it
+// ProcessBlockQueue adds the blocks of the queue to the block tree according to the following rules:
+// 1. If the block is already in the tree or the orphan pool, drop it
+// 2. If its header is invalid, drop it
+// 3. If its parent is unknown, keep it in the orphan pool until the parent arrives, evicting the oldest orphan when the
+// pool is full
+// 4. If it references the current tip, add it to the chain (as the new tip)
+// 5. Else store it on its branch
+// The orphans waiting for an added block are added after it. Then the active chain is moved to the best tip of the
+// tree, see activateBestChain.
 //
-// Verification is only performed for the new tip. The verification for orphaned blocks will be performed during reorganization.
+// Verification against the chain state is only performed for the new tip. Blocks on other branches are verified when a
+// reorganization connects them.
 func (bc *Blockchain) ProcessBlockQueue() {
 	for {
 		block := <-bc.blockQueue
 		log.Infof("Processing a block: hash=%s, height=%d, prevBlockHash=%s", block.Hash.String(), block.Height, block.HashPrevBlock.String())
 
-		// check if it references the tip
-		tipHash, err := bc.GetCurrentBlockHash()
-		if err != nil {
-			log.Errorf("failed to get current block hash: %s", err)
-			continue
+		if err := bc.processBlock(block); err != nil {
+			log.Errorf("failed to activate best chain: %s", err)
 		}
+	}
+}
 
-		if block.HashPrevBlock == tipHash {
-			// update blockchain tip
-			if err = bc.addBlockAsTip(block); err != nil {
-				log.Errorf("failed to add block as tip: %s", err)
-			}
-			continue
-		}
+// processBlock accepts a block and the orphans that were waiting for it, then activates the best chain and prunes the
+// block files, see pruneBlockFiles. Rejected blocks and pruning failures are logged; the error is that of the
+// activation.
+func (bc *Blockchain) processBlock(block *core.Block) error {
+	// a connection or disconnection whose last steps failed is completed before the tip moves again
+	if err := bc.replayJournal(); err != nil {
+		return err
+	}
 
-		// check if it references a stale block
-		_, err = bc.BlockIndexRepo.GetBlockIndexRecord(block.HashPrevBlock)
-		if err != nil && err != persistence.ErrNotFound {
-			log.Errorf("failed to get block index record: %s", err)
+	for queue := []*core.Block{block}; len(queue) > 0; queue = queue[1:] {
+		if err := bc.acceptBlock(queue[0]); err != nil {
+			log.Errorf("Rejected block %s: %s", queue[0].Hash, err)
 			continue
 		}
+		queue = append(queue, bc.Tree.TakeOrphans(queue[0].Hash)...)
+	}
 
-		if err == nil {
-			bc.branch = []*core.Block{}
-			bc.branch = append(bc.branch, block)
-			log.Infof("Orphan block %s at %d has a known parent %s at on active chain. Marked as possible new branch", block.Hash, block.Height, block.HashPrevBlock)
-			continue
+	if err := bc.activateBestChain(); err != nil {
+		return err
+	}
+	if err := bc.pruneBlockFiles(); err != nil {
+		log.Errorf("failed to prune block files: %s", err)
+	}
+
+	return nil
+}
+
+// acceptBlock adds a block to the block tree, see ProcessBlockQueue.
+func (bc *Blockchain) acceptBlock(block *core.Block) error {
+	if _, ok := bc.Tree.Get(block.Hash); ok {
+		log.Infof("Already have block %s. Dropped.", block.Hash)
+		return nil
+	}
+
+	// the header is checked before the block can take a slot of the orphan pool
+	if err := block.VerifyHeader(); err != nil {
+		return fmt.Errorf("invalid header: %w", err)
+	}
+
+	parent, ok := bc.Tree.Get(block.HashPrevBlock)
+	if !ok {
+		if bc.Tree.AddOrphan(block) {
+			log.Infof("Orphan block %s at %d waits for its parent %s", block.Hash, block.Height, block.HashPrevBlock)
+		} else {
+			log.Infof("Already have orphan block %s. Dropped.", block.Hash)
 		}
+		return nil
+	}
 
-		// check if it references a block in the orphan pool
-		if err == persistence.ErrNotFound {
-			// this block is a child of the last block in the branch
-			if len(bc.branch) != 0 && bc.branch[len(bc.branch)-1].Hash == block.HashPrevBlock {
-				bc.branch = append(bc.branch, block)
-				log.Infof("Orphan block %s is the tip of new branch. Appended.", block.Hash)
+	if block.Height != parent.Height+1 {
+		return fmt.Errorf("invalid block height: expected %d, got %d", parent.Height+1, block.Height)
+	}
 
-				// if the blockchain tip is lower than the branch tip, reorganize
-				rec, err := bc.GetBlockIndexRecord(tipHash)
-				if err != nil {
-					log.Errorf("failed to get block index record for tip %s: %s", tipHash, err)
-					continue
-				}
-				if rec.Height < bc.branch[len(bc.branch)-1].Height {
-					log.Infof("Fork detected. Reorganizing to new branch...")
-					if err := bc.Reorganize(bc.branch); err != nil {
-						log.Errorf("failed to reorganize: %s", err)
-						continue
-					}
-
-					bc.branch = []*core.Block{}
-				}
-			} else {
-				log.Infof("Orphan block %s is dropped", block.Hash)
+	rec := &persistence.BlockIndexRecord{
+		BlockHeader: block.BlockHeader,
+		Height:      block.Height,
+		TxCount:     uint32(len(block.Transactions)),
+		ChainWork:   new(big.Int).Add(parent.ChainWork, block.Work()),
+		Status:      persistence.BLOCK_HEADER_ONLY,
+	}
+	if parent.Status == persistence.BLOCK_INVALID {
+		if err := bc.Tree.Put(block.Hash, rec); err != nil {
+			return err
+		}
+		return fmt.Errorf("parent %s is invalid", block.HashPrevBlock)
+	}
+
+	tipHash, err := bc.GetCurrentBlockHash()
+	if err != nil {
+		return fmt.Errorf("failed to get current block hash: %w", err)
+	}
+	if block.HashPrevBlock == tipHash {
+		err := bc.addBlockAsTip(block)
+		if errors.As(err, new(blockError)) {
+			rec.Status = persistence.BLOCK_INVALID
+			if err := bc.Tree.Put(block.Hash, rec); err != nil {
+				return err
 			}
 		}
+		return err
+	}
+
+	if err := bc.writeBlock(block, nil, rec); err != nil {
+		return err
+	}
+	rec.Status = persistence.BLOCK_DATA_AVAILABLE
+	if err := bc.Tree.Put(block.Hash, rec); err != nil {
+		return err
 	}
+	log.Infof("Stored block %s at %d on a side branch", block.Hash, block.Height)
+
+	return nil
+}
+
+// activateBestChain reorganizes the active chain to the best tip of the block tree. When a block of the new branch
+// fails verification, it is marked invalid together with its descendants and the next best tip is tried.
+func (bc *Blockchain) activateBestChain() error {
+	for {
+		best, ok := bc.Tree.BestTip()
+		if !ok {
+			return fmt.Errorf("no block can be activated")
+		}
+		tipHash, err := bc.GetCurrentBlockHash()
+		if err != nil {
+			return fmt.Errorf("failed to get current block hash: %w", err)
+		}
+		bestHash := best.Hash()
+		if bestHash == tipHash {
+			return nil
+		}
+
+		log.Infof("Fork detected. Reorganizing to %s at %d...", bestHash, best.Height)
+		err = bc.Reorganize(bestHash)
+		if err == nil {
+			return nil
+		}
+		if !errors.As(err, new(blockError)) {
+			return err
+		}
+		log.Warnf("Branch of %s is invalid: %s", bestHash, err)
+	}
+}
+
+// blockError is returned for blocks that fail verification, as opposed to failures to process a block.
+type blockError struct {
+	err error
+}
+
+func (e blockError) Error() string {
+	return e.err.Error()
+}
+
+func (e blockError) Unwrap() error {
+	return e.err
 }
 
 func (bc *Blockchain) VerifyBlock(block *core.Block) error {
@@ -309,7 +454,7 @@ func (bc *Blockchain) VerifyBlock(block *core.Block) error {
 	if err != nil {
 		return fmt.Errorf("failed to get nBits for block %d: %w", block.Height, err)
 	}
-	if err := block.Verify(bc.ChainStateRepo, nBits, 500, BLOCK_REWARD); err != nil {
+	if err := block.Verify(bc.ChainStateRepo, bc, nBits, 500); err != nil {
 		return err
 	}
 
@@ -330,55 +475,108 @@ func (bc *Blockchain) addBlockAsTip(block *core.Block) error {
 				BlockHeader: core.BlockHeader{
 					NBits: INITIAL_BITS, // TODO: initial difficulty
 				},
-				Height: 4294967295, // overflow it to 0
+				Height:    4294967295, // overflow it to 0
+				ChainWork: new(big.Int),
 			}
 		}
 	} else if err != nil {
-		return fmt.Errorf("failed to get previous block %s: %w", prevBlockIndex.Hash(), err)
+		return fmt.Errorf("failed to get previous block %s: %w", block.HashPrevBlock, err)
 	}
 
 	// verify height and prev block hash
 	if block.Height != prevBlockIndex.Height+1 {
-		return fmt.Errorf("invalid block height: expected %d, got %d", prevBlockIndex.Height+1, block.Height)
+		return blockError{fmt.Errorf("invalid block height: expected %d, got %d", prevBlockIndex.Height+1, block.Height)}
 	} else {
 		if block.Height != 0 { // not genesis block
 			if block.HashPrevBlock != prevBlockIndex.Hash() {
-				return fmt.Errorf("invalid block prev hash: expected %s, got %s", prevBlockIndex.Hash(), block.HashPrevBlock)
+				return blockError{fmt.Errorf("invalid block prev hash: expected %s, got %s", prevBlockIndex.Hash(), block.HashPrevBlock)}
 			}
 		}
 	}
 
 	if err := bc.VerifyBlock(block); err != nil {
-		return fmt.Errorf("failed to verify block %s: %w", block.Hash.String(), err)
+		return blockError{fmt.Errorf("failed to verify block %s: %w", block.Hash.String(), err)}
 	}
 
-	// update chain state
+	// collect the UXTOs the block spends
 	var spent []*core.UXTO
 	for _, tx := range block.Transactions {
-		// process spent UXTOs
 		for _, input := range tx.Ins {
 			if tx.IsCoinbaseTx() {
 				break
 			}
 			spent = append(spent, bc.GetUXTO(input.PrevTxId, input.N))
+		}
+	}
 
-			// remove spent from chain state
-			err := bc.RemoveUXTO(input.PrevTxId, input.N)
-			if err != nil {
-				return fmt.Errorf("failed to remove spent UXTO: %w", err)
-			}
+	// store the block and its undo data before the chain state refers to it, as stale until it is connected;
+	// a stale block keeps the data and undo data from when it was connected, which only depend on its ancestors, and
+	// the data of a block stored on a side branch is kept, so that only its undo data is written
+	rec := &persistence.BlockIndexRecord{
+		BlockHeader: block.BlockHeader,
+		Height:      block.Height,
+		TxCount:     uint32(len(block.Transactions)),
+		ChainWork:   new(big.Int).Add(prevBlockIndex.ChainWork, block.Work()),
+		Status:      persistence.BLOCK_STALE,
+	}
+	known, ok := bc.Tree.Get(block.Hash)
+	if ok && known.Status == persistence.BLOCK_STALE {
+		rec.BlockFileID, rec.BlockPos, rec.UndoPos = known.BlockFileID, known.BlockPos, known.UndoPos
+	} else {
+		if ok && known.Status.HasData() {
+			rec.BlockFileID, rec.BlockPos = known.BlockFileID, known.BlockPos
+			err = bc.writeUndo(spent, rec)
+		} else {
+			err = bc.writeBlock(block, spent, rec)
+		}
+		if err != nil {
+			return err
+		}
+		if err = bc.Tree.Put(block.Hash, rec); err != nil {
+			return fmt.Errorf("failed to save block index record: %w", err)
 		}
+	}
 
-		// record newly created UXTOs
-		for o, output := range tx.Outs {
-			err := bc.PutUXTO(&core.UXTO{
-				TxId:  tx.Hash(),
-				N:     uint32(o),
-				TxOut: output,
-			})
+	// update chain state and tip block at once
+	err = bc.ApplyUpdate(&persistence.ChainStateUpdate{
+		Removed: spent,
+		Added:   core.GenerateUXTOsFromBlock(block),
+		Tip:     block.Hash,
+		Journal: &persistence.JournalEntry{Op: persistence.JOURNAL_CONNECT, BlkId: block.Hash},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update chain state: %w", err)
+	}
 
-			if err != nil {
-				return fmt.Errorf("failed to put UXTO: %w", err)
+	return bc.finishConnect(block, rec)
+}
+
+// finishConnect updates the block index, the mempool, the mining context and the handlers after the chain state
+// change of a connected block is committed, then clears the journal. Every step may be applied again, and is by
+// replayJournal if one fails.
+func (bc *Blockchain) finishConnect(block *core.Block, rec *persistence.BlockIndexRecord) error {
+	// index the block
+	active := *rec
+	active.Status = persistence.BLOCK_ACTIVE
+	if err := bc.Tree.Put(block.Hash, &active); err != nil {
+		return fmt.Errorf("failed to save block index record: %w", err)
+	}
+
+	// index the transactions
+	for i, tx := range block.Transactions {
+		log.Debugf("Indexed transaction %s", tx.Hash())
+		err := bc.BlockIndexRepo.PutTransactionRecord(tx.Hash(), &persistence.TransactionRecord{
+			BlockFileID: rec.BlockFileID,
+			BlockPos:    rec.BlockPos,
+			TxOffset:    uint32(i),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to save transaction index record: %w", err)
+		}
+
+		for _, r := range dataRecordsOf(tx, block.Height) {
+			if err := bc.BlockIndexRepo.PutDataRecord(r); err != nil {
+				return fmt.Errorf("failed to save data index record: %w", err)
 			}
 		}
 
@@ -390,6 +588,123 @@ func (bc *Blockchain) addBlockAsTip(block *core.Block) error {
 		}
 	}
 
+	// update mining context
+	bc.MiningCtx = context.WithValue(bc.MiningCtx, CTX_PREV_HASH, block.Hash)
+	bc.MiningCtx = context.WithValue(bc.MiningCtx, CTX_PREV_HEIGHT, block.Height)
+
+	log.Infof("Blockchain tip changes to: %s, height=%d", block.Hash, block.Height)
+
+	// call handlers; the journal is kept if one fails, so that it is called again
+	for _, handler := range bc.addBlockHandlers {
+		if err := handler(block); err != nil {
+			return fmt.Errorf("failed to handle block %s: %w", block.Hash, err)
+		}
+	}
+
+	if err := bc.ClearJournal(); err != nil {
+		return fmt.Errorf("failed to clear journal: %w", err)
+	}
+
+	return nil
+}
+
+// disconnectTip disconnects the tip of the active chain, which becomes stale, and returns its record.
+func (bc *Blockchain) disconnectTip(tipHash core.Hash256) (*persistence.BlockIndexRecord, error) {
+	tipRec, err := bc.GetBlockIndexRecord(tipHash)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get block index record of %s: %w", tipHash, err)
+	}
+	tipBlk, err := bc.BlockReader.GetBlock(tipRec)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read block %s: %w", tipHash, err)
+	}
+	tipRev, err := bc.BlockReader.GetUndo(tipRec)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read undo data of %s: %w", tipHash, err)
+	}
+
+	// 1. add back revs for that block (uxtos spent)
+	// 2. delete uxtos generated
+	// 3. move the tip to its parent
+	err = bc.ApplyUpdate(&persistence.ChainStateUpdate{
+		Removed: core.GenerateUXTOsFromBlock(tipBlk),
+		Added:   tipRev,
+		Tip:     tipRec.HashPrevBlock,
+		Journal: &persistence.JournalEntry{Op: persistence.JOURNAL_DISCONNECT, BlkId: tipHash},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to update chain state: %w", err)
+	}
+
+	return tipRec, bc.finishDisconnect(tipBlk, tipRev)
+}
+
+// finishDisconnect updates the block index and the handlers after the chain state change of a disconnected block is
+// committed, then clears the journal. Every step may be applied again, and is by replayJournal if one fails.
+func (bc *Blockchain) finishDisconnect(block *core.Block, spent []*core.UXTO) error {
+	for _, tx := range block.Transactions {
+		for _, r := range dataRecordsOf(tx, block.Height) {
+			if err := bc.BlockIndexRepo.DeleteDataRecord(r); err != nil {
+				return fmt.Errorf("failed to delete data index record: %w", err)
+			}
+		}
+	}
+
+	for _, handler := range bc.reorgHandlers {
+		if err := handler(block, spent); err != nil {
+			return fmt.Errorf("failed to handle disconnection of %s: %w", block.Hash, err)
+		}
+	}
+
+	if err := bc.Tree.SetStatus(block.Hash, persistence.BLOCK_STALE); err != nil {
+		return fmt.Errorf("failed to update status of %s: %w", block.Hash, err)
+	}
+
+	if err := bc.ClearJournal(); err != nil {
+		return fmt.Errorf("failed to clear journal: %w", err)
+	}
+
+	return nil
+}
+
+// replayJournal completes the connection or disconnection of a block that a crash or a failed step interrupted. The
+// chain state change of the block is committed together with its journal entry, so only the steps after it are
+// applied again.
+func (bc *Blockchain) replayJournal() error {
+	entry, err := bc.GetJournal()
+	if err == persistence.ErrNotFound {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to read journal: %w", err)
+	}
+
+	log.Warnf("Completing interrupted %s of block %s", entry.Op, entry.BlkId)
+
+	rec, ok := bc.Tree.Get(entry.BlkId)
+	if !ok {
+		return fmt.Errorf("block %s of the journal: %w", entry.BlkId, persistence.ErrNotFound)
+	}
+	block, err := bc.BlockReader.GetBlock(rec)
+	if err != nil {
+		return fmt.Errorf("failed to read block %s: %w", entry.BlkId, err)
+	}
+
+	if entry.Op == persistence.JOURNAL_DISCONNECT {
+		spent, err := bc.BlockReader.GetUndo(rec)
+		if err != nil {
+			return fmt.Errorf("failed to read undo data of %s: %w", entry.BlkId, err)
+		}
+		return bc.finishDisconnect(block, spent)
+	}
+
+	return bc.finishConnect(block, rec)
+}
+
+// writeBlock appends a block and its undo data to the current block file, and records where they were written in rec.
+// The block file is rolled over when full.
+func (bc *Blockchain) writeBlock(block *core.Block, spent []*core.UXTO, rec *persistence.BlockIndexRecord) error {
+	var err error
+
 	// open a new one if the current block file when full
 	if bc.BlockFile.GetBlockFileSize() > 10*1024 { // 10 KB (TODO: parameter)
 		if err := bc.BlockFile.Close(); err != nil {
@@ -406,63 +721,79 @@ func (bc *Blockchain) addBlockAsTip(block *core.Block) error {
 	}
 
 	// save block and rev
-	err = bc.BlockFile.WriteBlock(block, spent)
+	blockPos, undoPos, err := bc.BlockFile.WriteBlock(block, spent)
 	if err != nil {
 		return fmt.Errorf("failed to write block %x to file %d: %w", block.Hash, bc.BlockFile.Id, err)
 	}
 
-	// index the block
-	err = bc.BlockIndexRepo.PutBlockIndexRecord(block.Hash, &persistence.BlockIndexRecord{
-		BlockHeader: block.BlockHeader,
-		Height:      block.Height,
-		TxCount:     uint32(len(block.Transactions)),
-		BlockFileID: bc.BlockFile.Id,
-		Offset:      uint32(bc.BlockFile.GetBlockCount() - 1),
-	})
-	if err != nil {
-		return fmt.Errorf("failed to save block index record: %w", err)
+	// update block file info
+	info, err := bc.BlockIndexRepo.GetFileInfoRecord(bc.BlockFile.Id)
+	if err == persistence.ErrNotFound {
+		info = &persistence.FileInfoRecord{}
+	} else if err != nil {
+		return fmt.Errorf("failed to get file info record: %w", err)
+	}
+	info.BlockCount++
+	info.BlockFileSize = uint32(bc.BlockFile.GetBlockFileSize())
+	info.UndoFileSize = uint32(bc.BlockFile.GetUndoFileSize())
+	if err = bc.BlockIndexRepo.PutFileInfoRecord(bc.BlockFile.Id, info); err != nil {
+		return fmt.Errorf("failed to save file info record: %w", err)
 	}
 
-	// index the transactions
-	for i, tx := range block.Transactions {
-		log.Debugf("Indexed transaction %s", tx.Hash())
-		err = bc.BlockIndexRepo.PutTransactionRecord(tx.Hash(), &persistence.TransactionRecord{
-			BlockFileID: bc.BlockFile.Id,
-			BlockOffset: uint32(bc.BlockFile.GetBlockCount() - 1),
-			TxOffset:    uint32(i),
-		})
-		if err != nil {
-			return fmt.Errorf("failed to save transaction index record: %w", err)
+	rec.BlockFileID, rec.BlockPos, rec.UndoPos = bc.BlockFile.Id, blockPos, undoPos
+
+	return nil
+}
+
+// writeUndo appends the undo data of a block whose data is already stored to the rev file of its block file, and
+// records where it was written in rec.
+func (bc *Blockchain) writeUndo(spent []*core.UXTO, rec *persistence.BlockIndexRecord) error {
+	blockFile := bc.BlockFile
+	if rec.BlockFileID != bc.BlockFile.Id {
+		var err error
+		if blockFile, err = persistence.NewBlockFile(bc.RootDir, rec.BlockFileID); err != nil {
+			return fmt.Errorf("failed to open block file %d: %w", rec.BlockFileID, err)
 		}
+		defer blockFile.Close()
 	}
 
-	// update block file info
-	err = bc.BlockIndexRepo.PutFileInfoRecord(bc.BlockFile.Id, &persistence.FileInfoRecord{
-		BlockCount:    uint32(bc.BlockFile.GetBlockCount()),
-		BlockFileSize: uint32(bc.BlockFile.GetBlockFileSize()),
-		UndoFileSize:  uint32(bc.BlockFile.GetUndoFileSize()),
-	})
+	undoPos, err := blockFile.WriteUndo(spent)
 	if err != nil {
-		return fmt.Errorf("failed to save file info record: %w", err)
+		return fmt.Errorf("failed to write undo data to file %d: %w", blockFile.Id, err)
 	}
 
-	// update tip block
-	if err = bc.SetCurrentBlockHash(block.Hash); err != nil {
-		return fmt.Errorf("failed to update current block hash: %w", err)
+	info, err := bc.BlockIndexRepo.GetFileInfoRecord(blockFile.Id)
+	if err == persistence.ErrNotFound {
+		info = &persistence.FileInfoRecord{}
+	} else if err != nil {
+		return fmt.Errorf("failed to get file info record: %w", err)
+	}
+	info.UndoFileSize = uint32(blockFile.GetUndoFileSize())
+	if err = bc.BlockIndexRepo.PutFileInfoRecord(blockFile.Id, info); err != nil {
+		return fmt.Errorf("failed to save file info record: %w", err)
 	}
 
-	// update mining context
-	bc.MiningCtx = context.WithValue(bc.MiningCtx, CTX_PREV_HASH, block.Hash)
-	bc.MiningCtx = context.WithValue(bc.MiningCtx, CTX_PREV_HEIGHT, block.Height)
+	rec.UndoPos = undoPos
 
-	log.Infof("Blockchain tip changes to: %s, height=%d", block.Hash, block.Height)
+	return nil
+}
 
-	// call handlers
-	for _, handler := range bc.addBlockHandlers {
-		handler(block)
+// dataRecordsOf returns the index records of the data outputs of tx.
+func dataRecordsOf(tx *core.Transaction, height uint32) []*persistence.DataRecord {
+	var records []*persistence.DataRecord
+
+	for o, output := range tx.Outs {
+		if data, ok := output.Data(); ok {
+			records = append(records, &persistence.DataRecord{
+				Data:   data,
+				TxId:   tx.Hash(),
+				N:      uint32(o),
+				Height: height,
+			})
+		}
 	}
 
-	return nil
+	return records
 }
 
 func (bc *Blockchain) GetNBitsAtHeight(height uint32) (uint32, error) {
@@ -493,6 +824,28 @@ func (bc *Blockchain) GetNBitsAtHeight(height uint32) (uint32, error) {
 	}
 }
 
+// MedianTimePast returns the median time of the block at height on the active chain and the blocks before it.
+func (bc *Blockchain) MedianTimePast(height uint32) (int64, error) {
+	var times []int64
+
+	from := uint32(0)
+	if height >= core.MEDIAN_TIME_SPAN {
+		from = height - core.MEDIAN_TIME_SPAN + 1
+	}
+	err := bc.IterateActiveChain(from, height, func(_ core.Hash256, rec *persistence.BlockIndexRecord) bool {
+		times = append(times, rec.Time)
+		return true
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to get block index records of heights %d to %d: %w", from, height, err)
+	}
+	if len(times) != int(height-from+1) {
+		return 0, fmt.Errorf("block index record of height %d: %w", from+uint32(len(times)), persistence.ErrNotFound)
+	}
+
+	return core.MedianTime(times), nil
+}
+
 // For each connection, read the header and delegates to the proper handler
 func (bc *Blockchain) handleStream(s network.Stream) {
 	ctx := context.Background()
@@ -507,7 +860,12 @@ func (bc *Blockchain) handleStream(s network.Stream) {
 		log.Errorf("Error reading header: %s", err)
 		return
 	}
-	h := p2p.ReceiveHeader(buf)
+	h, err := p2p.ReceiveHeader(buf)
+	if err != nil {
+		log.Errorf("Malformed header from %s: %s", s.Conn().RemotePeer(), err)
+		bc.Network.DropPeer(s.Conn().RemotePeer())
+		return
+	}
 
 	switch h.Command {
 	case p2p.CMD_GETADDR:
@@ -653,73 +1011,47 @@ func (bc *Blockchain) getPeersFrom(target string) error {
 	return nil
 }
 
-// Reorganize the blockchain to the new active tip. The given blocks should be a series of new blocks of the longest chain.
-// The first one in the list should be the branch point, and the last one should be the new tip.
-// After reorganization, the mempool is cleared.
-func (bc *Blockchain) Reorganize(blocks []*core.Block) error {
-	// TODO: Mark the records as stale instead of deleting them
-	// TODO: or else we will never find these blocks again
+// Reorganize the active chain to end at the given block, which may be on any branch of the block tree.
+// The blocks of the active chain after the branch point are disconnected and stay in the tree as stale blocks, with
+// their data and undo data, so that switching back to them needs no download. Then the blocks of the new branch are
+// connected. A block failing verification is marked invalid together with its
+// descendants, leaving the active chain at its parent.
+func (bc *Blockchain) Reorganize(target core.Hash256) error {
+	fork, path, err := bc.Tree.PathFromActive(target)
+	if err != nil {
+		return fmt.Errorf("failed to find branch of %s: %w", target, err)
+	}
+
 	tipHash, err := bc.GetCurrentBlockHash()
 	if err != nil {
 		return fmt.Errorf("failed to get current block hash: %w", err)
 	}
 
-	for {
-		// for every block:
-		// 1. remove the block index
-		// 2. add back revs for that block (uxtos spent)
-		// 3. delete uxtos generated
-		tipRec, err := bc.GetBlockIndexRecord(tipHash)
-		if err != nil {
-			return fmt.Errorf("failed to get block index record of %s: %w", tipHash, err)
-		}
-
-		tipFile, err := persistence.NewBlockFile(bc.RootDir, tipRec.BlockFileID)
-		if err != nil {
-			return fmt.Errorf("failed to open block file %d: %w", tipRec.BlockFileID, err)
-		}
-
-		tipRev := tipFile.Revs[tipRec.Offset]
-		tipBlk := tipFile.Blocks[tipRec.Offset]
-		for _, u := range tipRev {
-			err = bc.ChainStateRepo.PutUXTO(u)
-			if err != nil {
-				return fmt.Errorf("failed to put uxto: %w", err)
-			}
-		}
-
-		generatedUXTOs := core.GenerateUXTOsFromBlock(tipBlk)
-		for _, u := range generatedUXTOs {
-			err = bc.ChainStateRepo.RemoveUXTO(u.TxId, u.N)
-			if err != nil {
-				return fmt.Errorf("failed to delete uxto: %w", err)
-			}
-		}
-
-		for _, handler := range bc.reorgHandlers {
-			handler(tipBlk, tipRev)
-		}
-
-		err = bc.BlockIndexRepo.DeleteBlockIndexRecord(tipHash)
+	for tipHash != fork {
+		tipRec, err := bc.disconnectTip(tipHash)
 		if err != nil {
-			return fmt.Errorf("failed to delete block index record of %s: %w", tipHash, err)
+			return fmt.Errorf("failed to disconnect block %s: %w", tipHash, err)
 		}
 
 		tipHash = tipRec.HashPrevBlock
-		if tipHash == blocks[0].HashPrevBlock {
-			// break at branching height
-			break
-		}
-	}
-
-	err = bc.ChainStateRepo.SetCurrentBlockHash(blocks[0].HashPrevBlock)
-	if err != nil {
-		return fmt.Errorf("failed to set current block hash: %w", err)
+		bc.MingCtxMutex.Lock()
+		bc.MiningCtx = context.WithValue(bc.MiningCtx, CTX_PREV_HASH, tipHash)
+		bc.MiningCtx = context.WithValue(bc.MiningCtx, CTX_PREV_HEIGHT, tipRec.Height-1)
+		bc.MingCtxMutex.Unlock()
 	}
 
-	for _, block := range blocks {
-		err = bc.addBlockAsTip(block)
+	for _, rec := range path {
+		block, err := bc.BlockReader.GetBlock(rec)
 		if err != nil {
+			return fmt.Errorf("failed to read block %s: %w", rec.Hash(), err)
+		}
+
+		if err := bc.addBlockAsTip(block); err != nil {
+			if errors.As(err, new(blockError)) {
+				if err := bc.Tree.Invalidate(block.Hash); err != nil {
+					return fmt.Errorf("failed to invalidate block %s: %w", block.Hash, err)
+				}
+			}
 			return fmt.Errorf("failed to add block %s as tip: %w", block.Hash, err)
 		}
 	}
@@ -727,10 +1059,10 @@ func (bc *Blockchain) Reorganize(blocks []*core.Block) error {
 	return nil
 }
 
-func (bc *Blockchain) RegisterAddBlockHandler(handler func(*core.Block)) {
+func (bc *Blockchain) RegisterAddBlockHandler(handler func(*core.Block) error) {
 	bc.addBlockHandlers = append(bc.addBlockHandlers, handler)
 }
 
-func (bc *Blockchain) RegisterReorgHandler(handler func(*core.Block, []*core.UXTO)) {
+func (bc *Blockchain) RegisterReorgHandler(handler func(*core.Block, []*core.UXTO) error) {
 	bc.reorgHandlers = append(bc.reorgHandlers, handler)
 }
@@ -4,12 +4,14 @@ import (
 	"bufio"
 	"container/list"
 	"context"
+	"errors"
 	"github.com/libp2p/go-libp2p/core/peer"
 	log "github.com/sirupsen/logrus"
 	"gocoin/core"
 	"gocoin/p2p"
 	"gocoin/persistence"
 	"io"
+	"math"
 )
 
 func handleGetAddr(ctx context.Context, bc *Blockchain, rw *bufio.ReadWriter, _ p2p.Header) {
@@ -46,7 +48,12 @@ func handleGetBlocks(ctx context.Context, bc *Blockchain, rw *bufio.ReadWriter,
 		log.Errorf("Error reading payload: %s", err)
 		return
 	}
-	msg := p2p.ReceiveGetBlocks(buf)
+	msg, err := p2p.ReceiveGetBlocks(buf)
+	if err != nil {
+		log.Errorf("Malformed getblocks from %s: %s", ctx.Value("addr").(string), err)
+		bc.Network.DropPeer(ctx.Value("peerId").(peer.ID))
+		return
+	}
 
 	// find the most recent block we have in common with the peer
 	// the block hashes is ordered from most recent to oldest
@@ -54,7 +61,8 @@ func handleGetBlocks(ctx context.Context, bc *Blockchain, rw *bufio.ReadWriter,
 	var rec *persistence.BlockIndexRecord
 	for i = 0; i < len(msg.BlockHashes); i++ {
 		rec, err = bc.BlockIndexRepo.GetBlockIndexRecord(msg.BlockHashes[i])
-		if err == persistence.ErrNotFound {
+		if err == persistence.ErrNotFound || (err == nil && rec.Status != persistence.BLOCK_ACTIVE) {
+			rec = nil
 			continue
 		} else if err != nil {
 			log.Errorf("Error getting block index record: %s", err)
@@ -74,32 +82,18 @@ func handleGetBlocks(ctx context.Context, bc *Blockchain, rw *bufio.ReadWriter,
 	}
 
 	// send to requested endpoint
-	// ordered from oldest to most recent
-	tipHash, err := bc.GetCurrentBlockHash()
-	if err != nil {
-		log.Errorf("Error getting current block hash: %s", err)
-		return
-	}
-
+	// ordered from oldest to most recent, up to the end hash or the tip
 	invs := make([]p2p.Inventory, 0)
-	for {
-		hash := rec.Hash()
-		height := rec.Height
+	err = bc.IterateActiveChain(rec.Height, math.MaxUint32, func(hash core.Hash256, _ *persistence.BlockIndexRecord) bool {
 		invs = append(invs, p2p.Inventory{
 			TypeId: p2p.INV_BLOCK,
 			Hash:   hash,
 		})
-
-		if hash == msg.EndHash || hash == tipHash {
-			break
-		} else {
-			// TODO: bulk query
-			rec, err = bc.GetBlockIndexRecordOfHeight(height + 1)
-			if err != nil {
-				log.Errorf("Error getting block index record at height %d: %s", height+1, err)
-				return
-			}
-		}
+		return hash != msg.EndHash
+	})
+	if err != nil {
+		log.Errorf("Error getting block index records from height %d: %s", rec.Height, err)
+		return
 	}
 
 	log.Infof("Sending invs of size %d", len(invs))
@@ -125,7 +119,12 @@ func handleGetData(ctx context.Context, bc *Blockchain, rw *bufio.ReadWriter, h
 		log.Errorf("Error reading payload: %s", err)
 		return
 	}
-	invs := p2p.ReceiveInv(buf)
+	invs, err := p2p.ReceiveGetData(buf)
+	if err != nil {
+		log.Errorf("Malformed getdata from %s: %s", ctx.Value("addr").(string), err)
+		bc.Network.DropPeer(ctx.Value("peerId").(peer.ID))
+		return
+	}
 
 	if len(invs) == 0 {
 		log.Errorf("Received empty invs")
@@ -141,23 +140,30 @@ func handleGetData(ctx context.Context, bc *Blockchain, rw *bufio.ReadWriter, h
 	}
 }
 
+// sendBlocks sends the requested blocks in order. If the data of one is not stored, whether it was pruned or never
+// downloaded, the peer is told which of the blocks were not sent.
 func sendBlocks(bc *Blockchain, rw *bufio.ReadWriter, invs []p2p.Inventory) {
-	for _, inv := range invs {
+	for i, inv := range invs {
 		blockIndex, err := bc.BlockIndexRepo.GetBlockIndexRecord(inv.Hash)
 		if err != nil {
 			log.Errorf("Error getting block index: %s", err)
 			return
 		}
-
-		bf, err := persistence.NewBlockFile(bc.RootDir, blockIndex.BlockFileID)
-		if err != nil {
-			log.Errorf("Error opening block file: %s", err)
+		if !blockIndex.Status.HasData() {
+			log.Infof("Block %s of height %d is %s", inv.Hash, blockIndex.Height, blockIndex.Status)
+			sendPruned(rw, invs[i:])
 			return
 		}
 
-		block := bf.Blocks[blockIndex.Offset]
-		block.Height = blockIndex.Height
-		block.Hash = blockIndex.Hash()
+		block, err := bc.BlockReader.GetBlock(blockIndex)
+		if errors.Is(err, persistence.ErrPruned) {
+			log.Infof("Block %s of height %d is pruned", inv.Hash, blockIndex.Height)
+			sendPruned(rw, invs[i:])
+			return
+		} else if err != nil {
+			log.Errorf("Error reading block %s: %s", inv.Hash, err)
+			return
+		}
 
 		_, err = rw.Write(p2p.SendBlock(block))
 		if err != nil {
@@ -174,11 +180,18 @@ func sendBlocks(bc *Blockchain, rw *bufio.ReadWriter, invs []p2p.Inventory) {
 	}
 }
 
+func sendPruned(rw *bufio.ReadWriter, invs []p2p.Inventory) {
+	if _, err := rw.Write(p2p.SendPruned(invs)); err != nil {
+		log.Errorf("Error writing pruned: %s", err)
+		return
+	}
+	if err := rw.Flush(); err != nil {
+		log.Errorf("Error flushing pruned: %s", err)
+	}
+}
+
 func handleBroadcastBlock(ctx context.Context, bc *Blockchain, rw *bufio.ReadWriter, h p2p.Header) {
 	// TODO: interrupt current mining
-	// TODO: wait for reorg to complete
-	bc.branchMutex.Lock()
-
 	buf := make([]byte, h.SPayload)
 	_, err := io.ReadFull(rw, buf)
 	if err != nil {
@@ -186,25 +199,22 @@ func handleBroadcastBlock(ctx context.Context, bc *Blockchain, rw *bufio.ReadWri
 		return
 	}
 
-	block := p2p.ReceiveBlock(buf)
+	block, err := p2p.ReceiveBlock(buf)
+	if err != nil {
+		log.Errorf("Malformed block from %s: %s", ctx.Value("addr").(string), err)
+		bc.Network.DropPeer(ctx.Value("peerId").(peer.ID))
+		return
+	}
 	log.Infof("Received block %s at height %d", block.Hash, block.Height)
 
-	// check if we already have the block
-	_, err = bc.BlockIndexRepo.GetBlockIndexRecord(block.Hash)
-	if err == nil {
-		// we already have the block
+	// check if we already have the block, on any branch
+	if _, ok := bc.Tree.Get(block.Hash); ok {
 		log.Infof("Already have block %s at height %d. Dropped.", block.Hash, block.Height)
 		return
-	} else if err != persistence.ErrNotFound {
-		log.Errorf("Error getting block index record: %s", err)
-		return
 	}
-	for _, b := range bc.branch {
-		if b.Hash == block.Hash {
-			// we already have the block
-			log.Infof("Already received block %s at %d as orphan. Dropped", block.Hash, block.Height)
-			return
-		}
+	if bc.Tree.HasOrphan(block.Hash) {
+		log.Infof("Already received block %s at %d as orphan. Dropped", block.Hash, block.Height)
+		return
 	}
 
 	// we don't have the block
@@ -217,12 +227,11 @@ func handleBroadcastBlock(ctx context.Context, bc *Blockchain, rw *bufio.ReadWri
 
 	// broadcast
 	go bc.Network.BroadcastBlock(block, ctx.Value("peerId").(peer.ID))
-
-	bc.branchMutex.Unlock()
 }
 
 func handleBroadcastTx(ctx context.Context, bc *Blockchain, rw *bufio.ReadWriter, h p2p.Header) {
 	bc.mempoolMutex.Lock()
+	defer bc.mempoolMutex.Unlock()
 
 	buf := make([]byte, h.SPayload)
 	_, err := io.ReadFull(rw, buf)
@@ -231,7 +240,12 @@ func handleBroadcastTx(ctx context.Context, bc *Blockchain, rw *bufio.ReadWriter
 		return
 	}
 
-	tx := p2p.ReceiveTx(buf)
+	tx, err := p2p.ReceiveTx(buf)
+	if err != nil {
+		log.Errorf("Malformed tx from %s: %s", ctx.Value("addr").(string), err)
+		bc.Network.DropPeer(ctx.Value("peerId").(peer.ID))
+		return
+	}
 	log.Infof("Received tx %s", tx.Hash())
 
 	var e *list.Element
@@ -249,6 +263,4 @@ func handleBroadcastTx(ctx context.Context, bc *Blockchain, rw *bufio.ReadWriter
 
 		go bc.Network.BroadcastTx(tx, ctx.Value("peerId").(peer.ID))
 	}
-
-	bc.mempoolMutex.Unlock()
 }
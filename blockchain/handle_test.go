@@ -52,7 +52,7 @@ func init() {
 
 	// Add ten blocks to bc1
 	for i := 0; i < 10; i++ {
-		b, err := bc1.Mine(getCoinbase(), bc1.DiskWallet.ListAddresses()[0], BLOCK_REWARD)
+		b, err := bc1.Mine(getCoinbase(), bc1.DiskWallet.ListAddresses()[0])
 		shouldFail(err)
 		err = bc1.addBlockAsTip(b)
 		shouldFail(err)
@@ -101,7 +101,7 @@ func TestHandleBroadcast(t *testing.T) {
 
 	// mine 5 blocks at bc2 and send them to bc1
 	for i := 0; i < 5; i++ {
-		b, err := bc2.Mine(getCoinbase(), addr, BLOCK_REWARD)
+		b, err := bc2.Mine(getCoinbase(), addr)
 		shouldFail(err)
 		err = bc2.addBlockAsTip(b)
 		shouldFail(err)
@@ -125,7 +125,7 @@ func TestHandleReorg(t *testing.T) {
 
 	// mine 5 blocks at bc2 and send them to bc1
 	for i := 0; i < 5; i++ {
-		b, err := bc2.Mine(getCoinbase(), addr, BLOCK_REWARD)
+		b, err := bc2.Mine(getCoinbase(), addr)
 		shouldFail(err)
 
 		err = bc2.addBlockAsTip(b)
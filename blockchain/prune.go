@@ -0,0 +1,95 @@
+package blockchain
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"gocoin/persistence"
+	"math/big"
+)
+
+// PRUNE_SAFETY_DEPTH is the number of blocks below the tip whose files are never pruned, so that the undo data needed
+// to reorganize that deep is kept.
+const PRUNE_SAFETY_DEPTH = 288
+
+// pruneBlockFiles deletes the oldest blk and rev file pairs while the files take more than PruneTarget bytes, as long
+// as every block stored in them is deeper than PRUNE_SAFETY_DEPTH. The current block file is kept, and so are the files
+// holding blocks of another branch whose work is within PRUNE_SAFETY_DEPTH blocks of the tip, as it may still be
+// activated.
+func (bc *Blockchain) pruneBlockFiles() error {
+	if bc.PruneTarget == 0 {
+		return nil
+	}
+
+	tipHash, err := bc.GetCurrentBlockHash()
+	if err != nil {
+		return fmt.Errorf("failed to get current block hash: %w", err)
+	}
+	tip, ok := bc.Tree.Get(tipHash)
+	if !ok {
+		return fmt.Errorf("tip %s is not in the block tree", tipHash)
+	}
+	reach := new(big.Int).Mul(tip.Work(), big.NewInt(PRUNE_SAFETY_DEPTH))
+	contenders := bc.Tree.ContenderFiles(new(big.Int).Sub(tip.ChainWork, reach))
+
+	heights := bc.Tree.FileHeights()
+
+	infos := make(map[uint32]*persistence.FileInfoRecord)
+	var total uint64
+	for id := uint32(0); id <= bc.BlockFile.Id; id++ {
+		info, err := bc.BlockIndexRepo.GetFileInfoRecord(id)
+		if err == persistence.ErrNotFound {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("failed to get file info record: %w", err)
+		}
+		if !info.Pruned {
+			infos[id] = info
+			total += uint64(info.BlockFileSize) + uint64(info.UndoFileSize)
+		}
+	}
+
+	for id := uint32(0); id < bc.BlockFile.Id && total > bc.PruneTarget; id++ {
+		info, ok := infos[id]
+		if !ok || contenders[id] {
+			continue
+		}
+		if heights[id]+PRUNE_SAFETY_DEPTH > tip.Height {
+			break
+		}
+
+		// mark the file pruned before deleting it, so that an interrupted prune is finished on restart
+		bc.BlockReader.SetPruned(id)
+		if err := bc.Tree.PruneFile(id); err != nil {
+			return fmt.Errorf("failed to update blocks of file %d: %w", id, err)
+		}
+		info.Pruned = true
+		if err := bc.BlockIndexRepo.PutFileInfoRecord(id, info); err != nil {
+			return fmt.Errorf("failed to save file info record: %w", err)
+		}
+		if err := persistence.DeleteBlockFile(bc.RootDir, id); err != nil {
+			return err
+		}
+
+		total -= uint64(info.BlockFileSize) + uint64(info.UndoFileSize)
+		log.Infof("Pruned block file %d with %d blocks up to height %d", id, info.BlockCount, heights[id])
+	}
+
+	return nil
+}
+
+// loadPrunedFiles marks the pruned block files on the reader, and deletes those left behind by an interrupted prune.
+func (bc *Blockchain) loadPrunedFiles() error {
+	ids, err := bc.BlockIndexRepo.PrunedFiles()
+	if err != nil {
+		return fmt.Errorf("failed to get pruned files: %w", err)
+	}
+
+	for _, id := range ids {
+		bc.BlockReader.SetPruned(id)
+		if err := persistence.DeleteBlockFile(bc.RootDir, id); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,63 @@
+package blockchain
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"gocoin/core"
+	"gocoin/persistence"
+)
+
+// P_REINDEX_PROGRESS is the number of blocks between progress reports of a reindex.
+const P_REINDEX_PROGRESS = 100
+
+// Reindex rebuilds the block index, the chain state and the wallet from the block files moved aside by
+// persistence.PrepareReindex, by processing their blocks as if they were received from peers, then deletes the files.
+// The position of the next block is saved after every block, so an interrupted reindex resumes where it stopped.
+func (bc *Blockchain) Reindex() error {
+	from, err := bc.GetReindexPos()
+	if err == persistence.ErrNotFound {
+		// no block has been processed yet, and the wallet still holds what it learned from them before
+		if err := bc.DiskWallet.ResetChainState(); err != nil {
+			return fmt.Errorf("failed to reset wallet: %w", err)
+		}
+		if err := bc.PutReindexPos(from); err != nil {
+			return fmt.Errorf("failed to save reindex position: %w", err)
+		}
+	} else if err != nil {
+		return fmt.Errorf("failed to get reindex position: %w", err)
+	} else {
+		log.Infof("Resuming reindex at offset %d of block file %d", from.Offset, from.FileId)
+	}
+
+	n := 0
+	err = persistence.ForEachReindexBlock(bc.RootDir, from, func(block *core.Block, next persistence.ReindexPos) error {
+		if err := bc.processBlock(block); err != nil {
+			return fmt.Errorf("failed to activate best chain: %w", err)
+		}
+		if err := bc.PutReindexPos(next); err != nil {
+			return fmt.Errorf("failed to save reindex position: %w", err)
+		}
+
+		if n++; n%P_REINDEX_PROGRESS == 0 {
+			tip, _ := bc.MiningCtx.Value(CTX_PREV_HEIGHT).(uint32)
+			log.Infof("Reindexed %d blocks, the tip is at height %d", n, tip)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// the position goes last, as a reindex without one starts over
+	if err := persistence.FinishReindex(bc.RootDir); err != nil {
+		return err
+	}
+	if err := bc.DeleteReindexPos(); err != nil {
+		return fmt.Errorf("failed to delete reindex position: %w", err)
+	}
+
+	tip, _ := bc.MiningCtx.Value(CTX_PREV_HEIGHT).(uint32)
+	log.Infof("Reindex done: processed %d blocks, the tip is at height %d", n, tip)
+
+	return nil
+}
@@ -6,6 +6,8 @@ import (
 	"fmt"
 	log "github.com/sirupsen/logrus"
 	"gocoin/blockchain"
+	"gocoin/core"
+	"gocoin/persistence"
 	"gocoin/rpc"
 	"gocoin/wallet"
 	"os"
@@ -63,20 +65,70 @@ func main() {
 	p2pPort := flag.Int("p2p-port", 8844, "p2p port")
 	rpcPort := flag.Int("rpc-port", 8080, "rpc port")
 	seedFlag := flag.String("seed", "", "seed node multi-address")
+	hashFixFlag := flag.Uint("header-hash-fix-height", uint(core.DefaultConsensusParams.HeaderHashFixHeight),
+		"first height hashed over the full header; set above the tip of a chain mined with the legacy hash")
+	secpFlag := flag.Uint("secp256k1-height", uint(core.DefaultConsensusParams.Secp256k1Height),
+		"first height accepting secp256k1 signatures; set above the tip of a chain signed with RSA keys")
+	schnorrFlag := flag.Uint("schnorr-height", uint(core.DefaultConsensusParams.SchnorrHeight),
+		"first height accepting Schnorr signatures")
+	sighashFlag := flag.Uint("sighash-height", uint(core.DefaultConsensusParams.SighashHeight),
+		"first height whose signatures carry a hash type; set above the tip of a chain signed without one")
+	witnessFlag := flag.Uint("witness-height", uint(core.DefaultConsensusParams.WitnessHeight),
+		"first height whose coinbase commits to the signatures of the block; set above the tip of a chain mined without")
+	maturityFlag := flag.Uint("maturity-height", uint(core.DefaultConsensusParams.MaturityHeight),
+		"first height enforcing coinbase maturity; set above the tip of a chain that spent young coinbase outputs")
+	coinbaseMaturityFlag := flag.Uint("coinbase-maturity", uint(core.DefaultConsensusParams.CoinbaseMaturity),
+		"number of blocks before a coinbase output can be spent")
+	reindexFlag := flag.Bool("reindex", false,
+		"rebuild the block index, the chain state and the wallet from the block files of the root directory")
+	verifyFlag := flag.Bool("verify-datadir", false,
+		"check the block files of the root directory against the block index, then exit")
+	truncateFlag := flag.Bool("truncate-torn-tails", false,
+		"with -verify-datadir, cut off damaged data at the end of block files, as left by a crash")
+	pruneFlag := flag.Uint64("prune", 0,
+		"delete the oldest block files once they take more than this many MiB; 0 keeps every block")
+	halvingFlag := flag.Uint("halving-interval", uint(core.DefaultConsensusParams.HalvingInterval),
+		"number of blocks between halvings of the block subsidy; 0 keeps it flat")
 
 	flag.Parse()
 
-	if *cFlag {
+	core.Params.HeaderHashFixHeight = uint32(*hashFixFlag)
+	core.Params.Secp256k1Height = uint32(*secpFlag)
+	core.Params.SchnorrHeight = uint32(*schnorrFlag)
+	core.Params.SighashHeight = uint32(*sighashFlag)
+	core.Params.WitnessHeight = uint32(*witnessFlag)
+	core.Params.MaturityHeight = uint32(*maturityFlag)
+	core.Params.CoinbaseMaturity = uint32(*coinbaseMaturityFlag)
+	core.Params.HalvingInterval = uint32(*halvingFlag)
+
+	if *verifyFlag {
+		os.Exit(verifyDataDir(*rootFlag, *truncateFlag))
+	}
+
+	// an interrupted reindex resumes unless the root directory is cleaned up
+	reindex := *reindexFlag || (!*cFlag && persistence.ReindexInProgress(*rootFlag))
+	if *cFlag && !reindex {
 		cleanup(*rootFlag)
 		initDirs(*rootFlag)
 	}
+	if reindex {
+		if err := persistence.PrepareReindex(*rootFlag); err != nil {
+			log.Fatalf("Cannot prepare reindex: %v", err)
+		}
+	}
 
 	bc, err := blockchain.NewBlockchain(*rootFlag, *p2pHostName, *p2pPort)
 	shouldLog(err)
-	if *cFlag {
+	bc.PruneTarget = *pruneFlag * 1024 * 1024
+	if *cFlag && !reindex {
 		err = initWallet(bc.DiskWallet)
 		shouldLog(err)
 	}
+	if reindex {
+		if err := bc.Reindex(); err != nil {
+			log.Fatalf("Cannot reindex: %v", err)
+		}
+	}
 
 	// start up servers
 	go startRPC(*rpcPort, bc)
@@ -97,7 +149,7 @@ func main() {
 			var timestamp [10]byte
 			binary.PutVarint(timestamp[:], time.Now().UnixNano())
 			coinbase := append(timestamp[:], []byte("coinbase")...)
-			b, err := bc.Mine(coinbase, blockchain.BLOCK_REWARD)
+			b, err := bc.Mine(coinbase)
 			shouldLog(err)
 			bc.AddBlockToQueue(b)
 			go bc.Network.BroadcastBlock(b)
@@ -118,6 +170,35 @@ func startRPC(port int, bc *blockchain.Blockchain) {
 	}
 }
 
+// verifyDataDir checks the block files of a data directory against its block index and returns the exit status.
+func verifyDataDir(rootDir string, truncate bool) int {
+	repo, err := persistence.NewBlockIndexRepo(rootDir)
+	if err != nil {
+		log.Errorf("%v", err)
+		return 1
+	}
+	if err := persistence.MigrateBlockFiles(rootDir, repo); err != nil {
+		log.Errorf("%v", err)
+		return 1
+	}
+
+	report, err := persistence.VerifyDataDir(rootDir, repo, truncate)
+	if err != nil {
+		log.Errorf("%v", err)
+		return 1
+	}
+	for _, problem := range report.Problems {
+		log.Warnf("%s", problem)
+	}
+	log.Infof("Checked %d records and %d blocks: %d problems, %d bytes truncated",
+		report.Records, report.Blocks, len(report.Problems), report.Truncated)
+
+	if len(report.Problems) > 0 {
+		return 1
+	}
+	return 0
+}
+
 func initDirs(rootDir string) {
 	err := os.Mkdir(rootDir, 0777)
 	err = os.Mkdir(rootDir+"/data", 0777)
@@ -8,7 +8,7 @@ import (
 )
 
 func main() {
-	coinbase := core.NewCoinBaseTransaction([]byte("genesis"), core.Hash160{}, blockchain.BLOCK_REWARD, 0)
+	coinbase := core.NewCoinBaseTransaction([]byte("genesis"), core.Hash160{}, core.Subsidy(0), 0)
 	bb := core.NewBlockBuilder()
 	bb.BaseOn(core.Hash256{}, 4294967295)
 	bb.AddTransaction(coinbase)
@@ -23,14 +23,14 @@ func main() {
 
 	target := bb.TargetValue()
 	for {
-		if bb.BlockHeader.Hash().Int().Cmp(target) == -1 {
+		if bb.HashAtHeight(bb.Height).Int().Cmp(target) == -1 {
 			break
 		}
 
 		bb.Nonce++
 	}
 
-	bb.Hash = bb.BlockHeader.Hash()
+	bb.Hash = bb.HashAtHeight(bb.Height)
 	spew.Dump(bb.Block)
 
 	//		Time: (int64) 1669004537,
@@ -0,0 +1,70 @@
+package core
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// Amount is a number of coins. Valid amounts lie between 0 and MAX_MONEY, so the sum of two valid
+// amounts never overflows an int64.
+type Amount int64
+
+// MAX_MONEY bounds every output, and the inputs and outputs of a transaction or block taken together.
+const MAX_MONEY Amount = 21_000_000 * 100_000_000
+
+func (a Amount) Valid() bool {
+	return a >= 0 && a <= MAX_MONEY
+}
+
+// AddAmounts returns a + b, failing if either is invalid or the sum exceeds MAX_MONEY.
+func AddAmounts(a, b Amount) (Amount, error) {
+	if !a.Valid() || !b.Valid() {
+		return 0, fmt.Errorf("amount out of range")
+	}
+	if a+b > MAX_MONEY {
+		return 0, fmt.Errorf("sum of amounts exceeds %d", MAX_MONEY)
+	}
+
+	return a + b, nil
+}
+
+// SubAmounts returns a - b, failing if either is invalid or b is bigger than a.
+func SubAmounts(a, b Amount) (Amount, error) {
+	if !a.Valid() || !b.Valid() {
+		return 0, fmt.Errorf("amount out of range")
+	}
+	if b > a {
+		return 0, fmt.Errorf("amount %d is less than %d", a, b)
+	}
+
+	return a - b, nil
+}
+
+// SumAmounts adds up amounts with AddAmounts.
+func SumAmounts(amounts ...Amount) (Amount, error) {
+	var sum Amount
+
+	for _, a := range amounts {
+		var err error
+		if sum, err = AddAmounts(sum, a); err != nil {
+			return 0, err
+		}
+	}
+
+	return sum, nil
+}
+
+// amountBytes is how an amount enters txids and signing digests.
+// Amounts below math.MaxUint32 take the 4 bytes they did before amounts were 64-bit, which keeps existing txids;
+// larger amounts are escaped with 4 0xff bytes and follow in 8 bytes.
+func amountBytes(a Amount) []byte {
+	if a >= 0 && a < math.MaxUint32 {
+		return UintToBytes(uint32(a))
+	}
+
+	buf := []byte{0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0, 0, 0, 0, 0}
+	binary.LittleEndian.PutUint64(buf[4:], uint64(a))
+
+	return buf
+}
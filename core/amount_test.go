@@ -0,0 +1,68 @@
+package core
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestAmounts(t *testing.T) {
+	if sum, err := AddAmounts(MAX_MONEY-1, 1); err != nil || sum != MAX_MONEY {
+		t.Fatalf("AddAmounts(MAX_MONEY-1, 1) = %d, %v", sum, err)
+	}
+	if _, err := AddAmounts(MAX_MONEY, 1); err == nil {
+		t.Fatalf("sum above MAX_MONEY accepted")
+	}
+	if _, err := AddAmounts(-1, 2); err == nil {
+		t.Fatalf("negative amount accepted")
+	}
+	if _, err := SubAmounts(1, 2); err == nil {
+		t.Fatalf("negative difference accepted")
+	}
+	if _, err := SumAmounts(MAX_MONEY/2, MAX_MONEY/2, MAX_MONEY/2); err == nil {
+		t.Fatalf("sum above MAX_MONEY accepted")
+	}
+
+	// amounts that fit in 32 bits keep their encoding, and with it the txids of existing transactions
+	if !bytes.Equal(amountBytes(100), UintToBytes(100)) {
+		t.Fatalf("small amount changed encoding")
+	}
+	if bytes.Equal(amountBytes(0xffff_ffff), UintToBytes(0xffff_ffff)) {
+		t.Fatalf("escape value is ambiguous")
+	}
+}
+
+func TestTransaction_VerifyAmounts(t *testing.T) {
+	PopulateTestData()
+
+	tests := []struct {
+		name string
+		outs []Amount
+	}{
+		{"negative output", []Amount{-10, 110}},
+		{"output above MAX_MONEY", []Amount{MAX_MONEY + 1}},
+		{"outputs wrapping around", []Amount{MAX_MONEY, MAX_MONEY, -2*MAX_MONEY + 50}},
+		{"more out than in", []Amount{150, 51}},
+	}
+
+	for _, tt := range tests {
+		txb := NewTransactionBuilder().
+			AddInputFrom(USET.First(TXID[0])).
+			AddInputFrom(USET.First(TXID[1]))
+		for _, v := range tt.outs {
+			txb.AddOutput(v, ADDR[1])
+		}
+		tx := txb.Sign(SK[0])
+
+		if err := tx.Verify(USET, 1); err == nil {
+			t.Errorf("%s: transaction verified", tt.name)
+		}
+		if _, err := tx.CalculateFee(USET); err == nil {
+			t.Errorf("%s: fee calculated", tt.name)
+		}
+	}
+
+	coinbase := NewCoinBaseTransaction([]byte("coinbase"), ADDR[0], MAX_MONEY, 1)
+	if err := coinbase.Verify(USET, 1); err == nil {
+		t.Errorf("coinbase above MAX_MONEY verified")
+	}
+}
@@ -35,7 +35,38 @@ func (header *BlockHeader) TargetValue() *big.Int {
 	return target
 }
 
+// Serialized returns the 80-byte header encoding committed to by the block hash.
+// marshal.BlockHeader uses the same layout.
+func (header *BlockHeader) Serialized() []byte {
+	data := make([]byte, 80)
+
+	copy(data[0:32], header.HashPrevBlock[:])                       // PrevBlockHash, 32
+	copy(data[32:64], header.HashMerkleRoot[:])                     // MerkleRootHash, 32
+	binary.LittleEndian.PutUint64(data[64:72], uint64(header.Time)) // Time, 8
+	binary.LittleEndian.PutUint32(data[72:76], header.NBits)        // NBits, 4
+	binary.LittleEndian.PutUint32(data[76:80], header.Nonce)        // Nonce, 4
+
+	return data
+}
+
+// Hash returns the hash of the full header.
 func (header *BlockHeader) Hash() Hash256 {
+	return HashTo256(header.Serialized())
+}
+
+// HashAtHeight returns the hash identifying a block at the given height under Params.
+func (header *BlockHeader) HashAtHeight(height uint32) Hash256 {
+	if height < Params.HeaderHashFixHeight {
+		return header.LegacyHash()
+	}
+
+	return header.Hash()
+}
+
+// LegacyHash is the block hash before HeaderHashFixHeight.
+// Time, NBits and Nonce are all written at offset 0, so it only commits to the nonce, half of the time
+// and the two hashes. It must only be used to validate blocks below the activation height.
+func (header *BlockHeader) LegacyHash() Hash256 {
 	data := make([]byte, 8+4+4+32+32)
 
 	binary.BigEndian.PutUint64(data, uint64(header.Time))
@@ -80,38 +111,26 @@ func (block *Block) ContainsTransaction(txId Hash256) bool {
 	return false
 }
 
-func (block *Block) CalculateFee(uSet UXTOSet) (fee uint32, overflow bool) {
-	var inValue, outValue uint32
+// CalculateFee sums up the fees of all transactions but the coinbase.
+func (block *Block) CalculateFee(uSet UXTOSet) (Amount, error) {
+	var fee Amount
 
 	for _, tx := range block.Transactions {
-		if !tx.IsCoinbaseTx() {
-			tmp, _ := tx.CalculateOutValue() // ignore individual overflow, as this will be caught by individual tx verification
-			outValue += tmp
-
-			for _, txIn := range tx.Ins {
-				inValue += uSet.GetUXTO(txIn.PrevTxId, txIn.N).Value
-			}
+		txFee, err := tx.CalculateFee(uSet)
+		if err != nil {
+			return 0, fmt.Errorf("transaction %s: %w", tx.Hash(), err)
+		}
+		if fee, err = AddAmounts(fee, txFee); err != nil {
+			return 0, err
 		}
 	}
 
-	fee = inValue - outValue
-	overflow = inValue < outValue
-
-	return fee, overflow
+	return fee, nil
 }
 
-func (block *Block) Verify(uSet UXTOSet, currentBits uint32, timeWindow int64, blockReward uint32) error {
-	// verify header
-	//if math.Abs(float64(time.Now().Unix()-block.Time)) > float64(timeWindow) {
-	//	return fmt.Errorf("invalid timestamp")
-	//}
-	// commented out for demo
-
-	//if block.NBits != currentBits {
-	//	return fmt.Errorf("invalid NBits")
-	//}
-	// commented out for demo
-
+// VerifyHeader runs the checks that need no chain state: the merkle root, the PoW and the presence of a coinbase.
+// A block passing them can be stored on any branch before it is verified against the UXTOs of its parent.
+func (block *Block) VerifyHeader() error {
 	if mr, err := block.CalculateMerkleRoot(); err != nil {
 		log.Warnf("Error calculating MerkleRoot for block %X: %s", block.Hash[:], err)
 	} else {
@@ -121,7 +140,7 @@ func (block *Block) Verify(uSet UXTOSet, currentBits uint32, timeWindow int64, b
 	}
 
 	// verify PoW
-	if block.Hash != block.BlockHeader.Hash() {
+	if block.Hash != block.HashAtHeight(block.Height) {
 		return fmt.Errorf("header does not match PoW")
 	}
 
@@ -137,22 +156,63 @@ func (block *Block) Verify(uSet UXTOSet, currentBits uint32, timeWindow int64, b
 	if !block.Transactions[0].IsCoinbaseTx() {
 		return fmt.Errorf("first transaction is not coinbase")
 	}
+	// only the first transaction may be coinbase, as only its value is checked against the subsidy
+	for _, tx := range block.Transactions[1:] {
+		if tx.IsCoinbaseTx() {
+			return fmt.Errorf("transaction %s after the first is coinbase", tx.Hash())
+		}
+	}
+
+	return nil
+}
+
+// Verify checks the block against uSet. chain provides the median times that time-based locks are checked against.
+func (block *Block) Verify(uSet UXTOSet, chain ChainContext, currentBits uint32, timeWindow int64) error {
+	// verify header
+	//if math.Abs(float64(time.Now().Unix()-block.Time)) > float64(timeWindow) {
+	//	return fmt.Errorf("invalid timestamp")
+	//}
+	// commented out for demo
+
+	//if block.NBits != currentBits {
+	//	return fmt.Errorf("invalid NBits")
+	//}
+	// commented out for demo
+
+	if err := block.VerifyHeader(); err != nil {
+		return err
+	}
+
+	if err := block.verifyWitnessCommitment(); err != nil {
+		return err
+	}
+
+	// Schnorr signatures are verified as one batch once every script has run
+	batch := NewSchnorrBatch()
 
 	for _, tx := range block.Transactions {
-		if err := tx.Verify(uSet); err != nil {
+		if err := tx.verify(uSet, block.Height, batch); err != nil {
+			return fmt.Errorf("failed to verify transaction %s: %w", tx.Hash(), err)
+		}
+		if err := tx.CheckLocks(uSet, block.Height, chain); err != nil {
 			return fmt.Errorf("failed to verify transaction %s: %w", tx.Hash(), err)
 		}
 	}
 
+	if batch.Len() > 0 {
+		if err := batch.Verify(); err != nil {
+			return fmt.Errorf("failed to verify signatures: %w", err)
+		}
+	}
+
 	// verify balance
-	if fee, overflow := block.CalculateFee(uSet); overflow { // this should not happen as we have verified each transaction
-		return fmt.Errorf("transaction fee is negative")
+	if fee, err := block.CalculateFee(uSet); err != nil { // this should not happen as we have verified each transaction
+		return fmt.Errorf("invalid transaction fee: %w", err)
 	} else {
-		coinbase, _ := block.Transactions[0].CalculateOutValue()
-		if coinbase > blockReward+fee {
-			fmt.Printf("reward %d; fee %d; coinbase %d\n", blockReward, fee, coinbase)
-
-			return fmt.Errorf("invalid output value in coinbase")
+		coinbase, _ := block.Transactions[0].CalculateOutValue() // verified above
+		if maxCoinbase, err := AddAmounts(Subsidy(block.Height), fee); err != nil || coinbase > maxCoinbase {
+			return fmt.Errorf("invalid output value in coinbase: %d exceeds subsidy %d plus fees %d",
+				coinbase, Subsidy(block.Height), fee)
 		}
 	}
 
@@ -221,12 +281,21 @@ func (bb *BlockBuilder) AddTransaction(tx *Transaction) *BlockBuilder {
 // Build returns a full block
 // A block is built through the following process:
 //  1. set the timestamp to current time
-//  2. calculate and set the HashMerkleTree in the block header
-//  3. set the nonce until the header hashes to lower than value implied by NBits (PoW)
-//  4. set the block hash
+//  2. commit the coinbase to the witness root, from Params.WitnessHeight on
+//  3. calculate and set the HashMerkleTree in the block header
+//  4. set the nonce until the header hashes to lower than value implied by NBits (PoW)
+//  5. set the block hash
 func (bb *BlockBuilder) Build() *Block {
 	bb.Time = time.Now().Unix()
 
+	if bb.Height >= Params.WitnessHeight && len(bb.Transactions) > 0 && bb.Transactions[0].IsCoinbaseTx() {
+		if witnessRoot, err := bb.CalculateWitnessRoot(); err != nil {
+			log.Warn(err)
+		} else {
+			bb.Transactions[0].SetWitnessCommitment(witnessRoot)
+		}
+	}
+
 	if merkleRoot, err := bb.CalculateMerkleRoot(); err != nil {
 		log.Warn(err)
 	} else {
@@ -235,13 +304,13 @@ func (bb *BlockBuilder) Build() *Block {
 
 	target := bb.TargetValue()
 	for {
-		if bb.BlockHeader.Hash().Int().Cmp(target) == -1 {
+		if bb.HashAtHeight(bb.Height).Int().Cmp(target) == -1 {
 			break
 		}
 
 		bb.Nonce++
 	}
 
-	bb.Hash = bb.BlockHeader.Hash()
+	bb.Hash = bb.HashAtHeight(bb.Height)
 	return bb.Block
 }
@@ -1,16 +1,18 @@
 package core
 
 import (
-	"crypto/rsa"
 	"math/big"
 	"testing"
 )
 
-func NewTransaction(uxto *UXTO, sk *rsa.PrivateKey, to Hash160, value, fee uint32) *Transaction {
+// EASY_BITS is a target most hashes meet, so that test blocks are mined instantly.
+const EASY_BITS = 0x1f7fffff
+
+func NewTransaction(uxto *UXTO, sk PrivateKey, to Hash160, value, fee Amount) *Transaction {
 	return NewTransactionBuilder().
-		AddInputFrom(uxto, &sk.PublicKey).
+		AddInputFrom(uxto).
 		AddOutput(value, to).
-		AddChange(fee).
+		AddChange(uxto.Script, fee).
 		Sign(sk)
 }
 
@@ -25,27 +27,27 @@ func TestBlock_BuildAndVerify(t *testing.T) {
 	// valid transaction
 	b := NewBlockBuilder().
 		BaseOn(Hash256{}, 0).
-		SetNBits(20).
+		SetNBits(EASY_BITS).
 		AddTransaction(coinbaseNoFee).
 		AddTransaction(tx1).
 		AddTransaction(tx2).
 		Build()
 
-	if err := b.Verify(USET, 20, 1000, 100); err != nil {
+	if err := b.Verify(USET, nil, EASY_BITS, 1000); err != nil {
 		t.Fatalf("failed to verify block: %s", err)
 	}
 
 	// block with invalid transactions
 	b = NewBlockBuilder().
 		BaseOn(Hash256{}, 0).
-		SetNBits(20).
+		SetNBits(EASY_BITS).
 		AddTransaction(coinbaseNoFee).
 		AddTransaction(tx1).
 		AddTransaction(tx2).
 		AddTransaction(txInvalid).
 		Build()
 
-	if err := b.Verify(USET, 20, 1000, 100); err == nil {
+	if err := b.Verify(USET, nil, EASY_BITS, 1000); err == nil {
 		t.Fatalf("verification passed; expected transaction validation error")
 	} else {
 		t.Log(err)
@@ -54,12 +56,13 @@ func TestBlock_BuildAndVerify(t *testing.T) {
 	// block with incorrect header
 	b = NewBlockBuilder().
 		BaseOn(Hash256{}, 0).
-		SetNBits(10).
+		SetNBits(EASY_BITS).
 		AddTransaction(coinbaseNoFee).
 		Build()
+	b.Time++
 
-	if err := b.Verify(USET, 20, 1000, 100); err == nil {
-		t.Fatalf("verification passed; expected NBits error")
+	if err := b.Verify(USET, nil, EASY_BITS, 1000); err == nil {
+		t.Fatalf("verification passed; expected header mismatch")
 	} else {
 		t.Log(err)
 	}
@@ -67,13 +70,13 @@ func TestBlock_BuildAndVerify(t *testing.T) {
 	// block contains a transaction not included in merkle root
 	b = NewBlockBuilder().
 		BaseOn(Hash256{}, 0).
-		SetNBits(20).
+		SetNBits(EASY_BITS).
 		AddTransaction(coinbaseNoFee).
 		Build()
 
 	b.Transactions = append(b.Transactions, tx1)
 
-	if err := b.Verify(USET, 20, 1000, 100); err == nil {
+	if err := b.Verify(USET, nil, EASY_BITS, 1000); err == nil {
 		t.Fatalf("verification passed; expected invalid merkle root")
 	} else {
 		t.Log(err)
@@ -82,10 +85,10 @@ func TestBlock_BuildAndVerify(t *testing.T) {
 	// block contains zero transactions
 	b = NewBlockBuilder().
 		BaseOn(Hash256{}, 0).
-		SetNBits(20).
+		SetNBits(EASY_BITS).
 		Build()
 
-	if err := b.Verify(USET, 20, 1000, 100); err == nil {
+	if err := b.Verify(USET, nil, EASY_BITS, 1000); err == nil {
 		t.Fatalf("verification passed; expected no transaction found")
 	} else {
 		t.Log(err)
@@ -94,33 +97,87 @@ func TestBlock_BuildAndVerify(t *testing.T) {
 	// block contains no coinbase
 	b = NewBlockBuilder().
 		BaseOn(Hash256{}, 0).
-		SetNBits(20).
+		SetNBits(EASY_BITS).
 		AddTransaction(tx1).
 		Build()
 
-	if err := b.Verify(USET, 20, 1000, 100); err == nil {
+	if err := b.Verify(USET, nil, EASY_BITS, 1000); err == nil {
 		t.Fatalf("verification passed; expected no coinbase transaction")
 	} else {
 		t.Log(err)
 	}
 
-	// balance not matched
-	txPayFee := NewTransaction(USET.First(TXID[0]), SK[0], ADDR[3], 50, 60)
-	coinbaseWithFee := NewCoinBaseTransaction([]byte("coinbase"), ADDR[0], 100, 20)
+	// block contains a second coinbase, which would mint coins without a subsidy check
 	b = NewBlockBuilder().
 		BaseOn(Hash256{}, 0).
-		SetNBits(20).
+		SetNBits(EASY_BITS).
+		AddTransaction(coinbaseNoFee).
+		AddTransaction(NewCoinBaseTransaction([]byte("coinbase2"), ADDR[0], 1000000, 0)).
+		Build()
+
+	if err := b.Verify(USET, nil, EASY_BITS, 1000); err == nil {
+		t.Fatalf("verification passed; expected a second coinbase transaction")
+	} else {
+		t.Log(err)
+	}
+
+	// balance not matched: the coinbase claims more fees than the block pays
+	txPayFee := NewTransaction(USET.First(TXID[0]), SK[0], ADDR[3], 50, 10)
+	coinbaseWithFee := NewCoinBaseTransaction([]byte("coinbase"), ADDR[0], Subsidy(0), 20)
+	b = NewBlockBuilder().
+		BaseOn(Hash256{}, 0).
+		SetNBits(EASY_BITS).
 		AddTransaction(coinbaseWithFee).
 		AddTransaction(txPayFee).
 		Build()
 
-	if err := b.Verify(USET, 20, 1000, 100); err == nil {
+	if err := b.Verify(USET, nil, EASY_BITS, 1000); err == nil {
 		t.Fatalf("verification passed; expected invalid coinbase")
 	} else {
 		t.Log(err)
 	}
 }
 
+func TestBlockHeader_Hash(t *testing.T) {
+	bh := BlockHeader{
+		Time:           1669004537,
+		NBits:          EASY_BITS,
+		Nonce:          1,
+		HashPrevBlock:  RandomHash256(),
+		HashMerkleRoot: RandomHash256(),
+	}
+
+	// every field must change the hash
+	mutations := map[string]func(h *BlockHeader){
+		"Time":           func(h *BlockHeader) { h.Time++ },
+		"NBits":          func(h *BlockHeader) { h.NBits++ },
+		"Nonce":          func(h *BlockHeader) { h.Nonce++ },
+		"HashPrevBlock":  func(h *BlockHeader) { h.HashPrevBlock[0]++ },
+		"HashMerkleRoot": func(h *BlockHeader) { h.HashMerkleRoot[31]++ },
+	}
+	for field, mutate := range mutations {
+		mutated := bh
+		mutate(&mutated)
+		if mutated.Hash() == bh.Hash() {
+			t.Errorf("hash does not commit to %s", field)
+		}
+	}
+
+	// the legacy hash ignores NBits, which lets a block below the activation height claim any difficulty
+	mutated := bh
+	mutated.NBits++
+	if mutated.LegacyHash() != bh.LegacyHash() {
+		t.Errorf("legacy hash changed")
+	}
+
+	if bh.HashAtHeight(Params.HeaderHashFixHeight-1) != bh.LegacyHash() {
+		t.Errorf("expected legacy hash below activation height")
+	}
+	if bh.HashAtHeight(Params.HeaderHashFixHeight) != bh.Hash() {
+		t.Errorf("expected fixed hash at activation height")
+	}
+}
+
 func TestNBits(t *testing.T) {
 	bb := NewBlockBuilder()
 
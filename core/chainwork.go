@@ -0,0 +1,34 @@
+package core
+
+import (
+	"bytes"
+	"math/big"
+)
+
+// Work returns the number of hashes expected to mine a block at the difficulty of the header, 2^256 / target.
+func (header *BlockHeader) Work() *big.Int {
+	target := header.TargetValue()
+	if target.Sign() <= 0 {
+		return big.NewInt(0)
+	}
+
+	work := new(big.Int).Lsh(big.NewInt(1), 256)
+	return work.Div(work, target)
+}
+
+// ChainTip is the last block of a chain together with the work of every block up to and including it.
+type ChainTip struct {
+	Hash      Hash256
+	ChainWork *big.Int
+}
+
+// Better reports whether t should be the active tip rather than other. The chain with the most work wins, so that a
+// long branch of easy blocks cannot replace a shorter one that took more hashes to mine. Equal work is broken by the
+// lower block hash, so that every node picks the same tip whichever it received first.
+func (t ChainTip) Better(other ChainTip) bool {
+	if c := t.ChainWork.Cmp(other.ChainWork); c != 0 {
+		return c > 0
+	}
+
+	return bytes.Compare(t.Hash[:], other.Hash[:]) < 0
+}
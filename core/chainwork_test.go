@@ -0,0 +1,45 @@
+package core
+
+import (
+	"math/big"
+	"testing"
+)
+
+func TestBlockHeader_Work(t *testing.T) {
+	easy := BlockHeader{NBits: EASY_BITS}
+	hard := BlockHeader{NBits: 0x1e7fffff} // a 256 times smaller target
+
+	if c := new(big.Int).Mul(easy.Work(), big.NewInt(256)).Cmp(hard.Work()); c != 0 {
+		t.Fatalf("work of hard header is not 256 times that of easy header: %s, %s", easy.Work(), hard.Work())
+	}
+	if work := (&BlockHeader{}).Work(); work.Sign() != 0 {
+		t.Fatalf("work of a zero target = %s; want 0", work)
+	}
+}
+
+func TestChainTip_Better(t *testing.T) {
+	// two branches off a common base: a long one of easy blocks and a short one of hard blocks
+	chainWork := func(base *big.Int, nBits uint32, n int) *big.Int {
+		work := new(big.Int).Set(base)
+		for i := 0; i < n; i++ {
+			work.Add(work, (&BlockHeader{NBits: nBits}).Work())
+		}
+		return work
+	}
+	base := chainWork(new(big.Int), EASY_BITS, 10)
+	long := ChainTip{Hash: Hash256{0x01}, ChainWork: chainWork(base, EASY_BITS, 20)}
+	short := ChainTip{Hash: Hash256{0x02}, ChainWork: chainWork(base, 0x1e7fffff, 2)}
+
+	if !short.Better(long) || long.Better(short) {
+		t.Fatalf("long branch of easy blocks beats shorter branch with more work")
+	}
+
+	// equal work goes to the lower hash, whichever side asks
+	tied := ChainTip{Hash: Hash256{0x00, 0x01}, ChainWork: new(big.Int).Set(short.ChainWork)}
+	if !tied.Better(short) || short.Better(tied) {
+		t.Fatalf("tie not broken by the lower hash")
+	}
+	if short.Better(short) {
+		t.Fatalf("tip is better than itself")
+	}
+}
@@ -0,0 +1,65 @@
+package core
+
+// ConsensusParams holds the heights at which consensus rule changes activate.
+// A rule applies to every block at or above its activation height, so a chain started under the old
+// rules keeps validating its history while new blocks follow the new ones.
+type ConsensusParams struct {
+	// HeaderHashFixHeight is the first height whose block hash commits to the full 80-byte header.
+	// Blocks below it are identified by the legacy hash, see BlockHeader.LegacyHash.
+	HeaderHashFixHeight uint32
+
+	// Secp256k1Height is the first height whose transactions may be signed with secp256k1 keys.
+	// RSA signatures stay valid at every height so that outputs paid to RSA addresses can still be spent.
+	Secp256k1Height uint32
+
+	// SchnorrHeight is the first height whose transactions may be signed with Schnorr signatures.
+	SchnorrHeight uint32
+
+	// SighashHeight is the first height whose signatures end with a SigHashType byte.
+	// Signatures below it carry none and commit to the whole transaction, see Transaction.legacySigningDigest.
+	SighashHeight uint32
+
+	// WitnessHeight is the first height whose coinbase commits to the signatures of the block, see WitnessHash.
+	WitnessHeight uint32
+
+	// MaturityHeight is the first height whose transactions may only spend coinbase outputs CoinbaseMaturity
+	// blocks deep, see UXTO.MatureAt.
+	MaturityHeight   uint32
+	CoinbaseMaturity uint32
+
+	// InitialSubsidy is the subsidy of the first HalvingInterval blocks, see Subsidy. A HalvingInterval of
+	// zero keeps the subsidy flat, as it was before halvings were introduced.
+	InitialSubsidy  Amount
+	HalvingInterval uint32
+}
+
+// KeyTypeActive reports whether signatures of the given key type are valid in a block at height.
+func (p *ConsensusParams) KeyTypeActive(keyType byte, height uint32) bool {
+	switch keyType {
+	case KEY_RSA:
+		return true
+	case KEY_SECP256K1:
+		return height >= p.Secp256k1Height
+	case KEY_SCHNORR:
+		return height >= p.SchnorrHeight
+	default:
+		return false
+	}
+}
+
+// DefaultConsensusParams keeps the hard-coded genesis block, which was mined under the legacy hash,
+// valid and activates every rule change from the block after it.
+var DefaultConsensusParams = ConsensusParams{
+	HeaderHashFixHeight: 1,
+	Secp256k1Height:     1,
+	SchnorrHeight:       1,
+	SighashHeight:       1,
+	WitnessHeight:       1,
+	MaturityHeight:      1,
+	CoinbaseMaturity:    100,
+	InitialSubsidy:      1000,
+	HalvingInterval:     210_000,
+}
+
+// Params are the consensus parameters this node validates and mines with.
+var Params = DefaultConsensusParams
@@ -0,0 +1,444 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Engine runs the scripts of one transaction input.
+//
+// A signature on the stack is the key type followed by the signature bytes and, from Params.SighashHeight on,
+// the SigHashType it was made with, so that OP_CHECKSIG knows how to parse the public key next to it and which
+// digest to check. A signature check with a non-empty signature that does not verify fails the script instead
+// of pushing false; this lets Schnorr signatures be deferred to a batch without changing which scripts succeed.
+type Engine struct {
+	tx     *Transaction
+	uxto   *UXTO
+	height uint32 // height of the block the spending transaction is included in
+	batch  *SchnorrBatch
+	stack  [][]byte
+}
+
+// NewEngine prepares to run the scripts spending uxto in tx, as if tx were included in a block at height.
+// Schnorr signatures are added to batch rather than checked right away, unless batch is nil.
+func NewEngine(tx *Transaction, uxto *UXTO, height uint32, batch *SchnorrBatch) *Engine {
+	return &Engine{
+		tx:     tx,
+		uxto:   uxto,
+		height: height,
+		batch:  batch,
+		stack:  [][]byte{},
+	}
+}
+
+// Execute runs scriptSig and then scriptPubKey on the same stack, succeeding if a true value is left on top.
+// For a P2SH scriptPubKey, the redeem script pushed last by scriptSig then runs on the rest of the stack and
+// must leave a true value as well.
+func (e *Engine) Execute(scriptSig Script, scriptPubKey Script) error {
+	if !scriptSig.IsPushOnly() {
+		return fmt.Errorf("script sig is not push-only")
+	}
+
+	if err := e.run(scriptSig); err != nil {
+		return fmt.Errorf("script sig: %w", err)
+	}
+
+	_, isP2SH := scriptPubKey.P2SHHash()
+	var redeemStack [][]byte
+	if isP2SH {
+		if len(e.stack) == 0 {
+			return fmt.Errorf("script sig has no redeem script")
+		}
+		redeemStack = append([][]byte{}, e.stack...)
+	}
+
+	if err := e.run(scriptPubKey); err != nil {
+		return fmt.Errorf("script pubkey: %w", err)
+	}
+	if err := e.checkResult(); err != nil {
+		return err
+	}
+
+	if isP2SH {
+		redeemScript := Script(redeemStack[len(redeemStack)-1])
+		e.stack = redeemStack[:len(redeemStack)-1]
+
+		if err := e.run(redeemScript); err != nil {
+			return fmt.Errorf("redeem script: %w", err)
+		}
+		if err := e.checkResult(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (e *Engine) checkResult() error {
+	if len(e.stack) == 0 || !asBool(e.stack[len(e.stack)-1]) {
+		return fmt.Errorf("script evaluated to false")
+	}
+
+	return nil
+}
+
+func (e *Engine) run(script Script) error {
+	if len(script) > MAX_SCRIPT_SIZE {
+		return fmt.Errorf("script of %d bytes exceeds %d", len(script), MAX_SCRIPT_SIZE)
+	}
+
+	ins, err := script.parse()
+	if err != nil {
+		return err
+	}
+
+	for i := range ins {
+		if err := e.step(&ins[i]); err != nil {
+			return fmt.Errorf("%s: %w", Script([]byte{ins[i].op}).String(), err)
+		}
+		if len(e.stack) > MAX_STACK_SIZE {
+			return fmt.Errorf("stack size exceeds %d", MAX_STACK_SIZE)
+		}
+	}
+
+	return nil
+}
+
+func (e *Engine) step(ins *instruction) error {
+	switch op := ins.op; {
+	case op <= OP_PUSHDATA4:
+		if len(ins.data) > MAX_SCRIPT_ELEMENT_SIZE {
+			return fmt.Errorf("element of %d bytes exceeds %d", len(ins.data), MAX_SCRIPT_ELEMENT_SIZE)
+		}
+		e.push(append([]byte{}, ins.data...))
+	case op >= OP_1 && op <= OP_16:
+		e.push(encodeScriptNum(int64(op - OP_1 + 1)))
+	case op == OP_NOP:
+	case op == OP_VERIFY:
+		return e.verify()
+	case op == OP_RETURN:
+		return fmt.Errorf("output is unspendable")
+	case op == OP_DROP:
+		_, err := e.pop()
+		return err
+	case op == OP_DUP:
+		top, err := e.peek()
+		if err != nil {
+			return err
+		}
+		e.push(append([]byte{}, top...))
+	case op == OP_EQUAL, op == OP_EQUALVERIFY:
+		a, err := e.pop()
+		if err != nil {
+			return err
+		}
+		b, err := e.pop()
+		if err != nil {
+			return err
+		}
+		e.pushBool(bytes.Equal(a, b))
+		if op == OP_EQUALVERIFY {
+			return e.verify()
+		}
+	case op == OP_HASH160:
+		top, err := e.pop()
+		if err != nil {
+			return err
+		}
+		h := HashTo160(top)
+		e.push(h[:])
+	case op == OP_CHECKSIG, op == OP_CHECKSIGVERIFY:
+		if err := e.checkSig(); err != nil {
+			return err
+		}
+		if op == OP_CHECKSIGVERIFY {
+			return e.verify()
+		}
+	case op == OP_CHECKMULTISIG, op == OP_CHECKMULTISIGVERIFY:
+		if err := e.checkMultiSig(); err != nil {
+			return err
+		}
+		if op == OP_CHECKMULTISIGVERIFY {
+			return e.verify()
+		}
+	case op == OP_CHECKLOCKTIMEVERIFY:
+		return e.checkLockTime()
+	case op == OP_CHECKSEQUENCEVERIFY:
+		return e.checkSequence()
+	default:
+		return fmt.Errorf("unknown opcode")
+	}
+
+	return nil
+}
+
+// --- stack ---
+
+func (e *Engine) push(v []byte) {
+	e.stack = append(e.stack, v)
+}
+
+func (e *Engine) pushBool(b bool) {
+	if b {
+		e.push([]byte{1})
+	} else {
+		e.push([]byte{})
+	}
+}
+
+func (e *Engine) pop() ([]byte, error) {
+	if len(e.stack) == 0 {
+		return nil, fmt.Errorf("stack is empty")
+	}
+
+	v := e.stack[len(e.stack)-1]
+	e.stack = e.stack[:len(e.stack)-1]
+
+	return v, nil
+}
+
+func (e *Engine) peek() ([]byte, error) {
+	if len(e.stack) == 0 {
+		return nil, fmt.Errorf("stack is empty")
+	}
+
+	return e.stack[len(e.stack)-1], nil
+}
+
+func (e *Engine) popInt(maxLen int) (int64, error) {
+	v, err := e.pop()
+	if err != nil {
+		return 0, err
+	}
+
+	return decodeScriptNum(v, maxLen)
+}
+
+func (e *Engine) verify() error {
+	v, err := e.pop()
+	if err != nil {
+		return err
+	}
+	if !asBool(v) {
+		return fmt.Errorf("verification failed")
+	}
+
+	return nil
+}
+
+// asBool is false for empty values and any encoding of zero, including negative zero.
+func asBool(v []byte) bool {
+	for i, b := range v {
+		if b != 0 {
+			return !(i == len(v)-1 && b == 0x80)
+		}
+	}
+
+	return false
+}
+
+// --- signatures ---
+
+func (e *Engine) checkSig() error {
+	pkBytes, err := e.pop()
+	if err != nil {
+		return err
+	}
+	sig, err := e.pop()
+	if err != nil {
+		return err
+	}
+
+	if len(sig) == 0 {
+		e.pushBool(false)
+		return nil
+	}
+
+	pk, err := e.parseKey(sig[0], pkBytes)
+	if err != nil {
+		return err
+	}
+
+	rawSig, digest, err := e.signingDigest(sig)
+	if err != nil {
+		return err
+	}
+	if spk, ok := pk.(*SchnorrPublicKey); ok && e.batch != nil {
+		e.batch.Add(spk, digest, rawSig)
+	} else if err := pk.Verify(digest, rawSig); err != nil {
+		return fmt.Errorf("cannot verify signature: %w", err)
+	}
+	e.pushBool(true)
+
+	return nil
+}
+
+// checkMultiSig pops <sig 1> ... <sig m> <m> <pk 1> ... <pk n> <n> and checks that the signatures were made by
+// keys in the same order. Signatures are checked right away since a failed match against one key is expected.
+func (e *Engine) checkMultiSig() error {
+	n, err := e.popInt(MAX_SCRIPT_NUM_SIZE)
+	if err != nil {
+		return err
+	}
+	if n < 0 || n > MAX_MULTISIG_KEYS {
+		return fmt.Errorf("invalid key count %d", n)
+	}
+	pks := make([][]byte, n)
+	for i := n - 1; i >= 0; i-- {
+		if pks[i], err = e.pop(); err != nil {
+			return err
+		}
+	}
+
+	m, err := e.popInt(MAX_SCRIPT_NUM_SIZE)
+	if err != nil {
+		return err
+	}
+	if m < 0 || m > n {
+		return fmt.Errorf("invalid signature count %d of %d keys", m, n)
+	}
+	sigs := make([][]byte, m)
+	for i := m - 1; i >= 0; i-- {
+		if sigs[i], err = e.pop(); err != nil {
+			return err
+		}
+	}
+
+	iSig, iKey := 0, 0
+	for iSig < len(sigs) && len(sigs)-iSig <= len(pks)-iKey {
+		if e.matches(sigs[iSig], pks[iKey]) {
+			iSig++
+		}
+		iKey++
+	}
+
+	success := iSig == len(sigs)
+	if !success {
+		for _, sig := range sigs {
+			if len(sig) > 0 {
+				return fmt.Errorf("signatures do not match the keys")
+			}
+		}
+	}
+	e.pushBool(success)
+
+	return nil
+}
+
+// matches reports whether sig is a valid signature of the key pkBytes.
+func (e *Engine) matches(sig []byte, pkBytes []byte) bool {
+	if len(sig) == 0 {
+		return false
+	}
+	pk, err := e.parseKey(sig[0], pkBytes)
+	if err != nil {
+		return false
+	}
+	rawSig, digest, err := e.signingDigest(sig)
+	if err != nil {
+		return false
+	}
+
+	return pk.Verify(digest, rawSig) == nil
+}
+
+// signingDigest splits the signature of a non-empty <keyType|sig|hashType> element off and returns the digest
+// it commits to. Below Params.SighashHeight the element has no hash type and signs the legacy digest.
+func (e *Engine) signingDigest(elem []byte) ([]byte, []byte, error) {
+	if e.height < Params.SighashHeight {
+		return elem[1:], e.tx.legacySigningDigest(e.uxto), nil
+	}
+
+	if len(elem) < 2 {
+		return nil, nil, fmt.Errorf("signature has no hash type")
+	}
+	hashType := SigHashType(elem[len(elem)-1])
+	digest, err := e.tx.SignatureHash(e.uxto, hashType)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return elem[1 : len(elem)-1], digest, nil
+}
+
+func (e *Engine) parseKey(keyType byte, buf []byte) (PublicKey, error) {
+	if !Params.KeyTypeActive(keyType, e.height) {
+		return nil, fmt.Errorf("key type %d is not active at height %d", keyType, e.height)
+	}
+
+	return ParsePublicKey(keyType, buf)
+}
+
+// --- timelocks ---
+
+// checkLockTime fails unless the spending transaction has a lock time of the same kind, height or time, and at least
+// as late as the number on top of the stack, and the input is not final, so that IsFinal enforces it, following BIP65.
+func (e *Engine) checkLockTime() error {
+	top, err := e.peek()
+	if err != nil {
+		return err
+	}
+	lock, err := decodeScriptNum(top, MAX_LOCKTIME_NUM_SIZE)
+	if err != nil {
+		return err
+	}
+
+	if lock < 0 {
+		return fmt.Errorf("negative lock time")
+	}
+	if (lock < int64(LOCKTIME_THRESHOLD)) != (e.tx.LockTime < LOCKTIME_THRESHOLD) {
+		return fmt.Errorf("transaction lock time %d is of a different kind than the lock %d", e.tx.LockTime, lock)
+	}
+	if lock > int64(e.tx.LockTime) {
+		return fmt.Errorf("transaction lock time %d is before the lock %d", e.tx.LockTime, lock)
+	}
+
+	txIn := e.tx.InputOf(e.uxto.TxId, e.uxto.N)
+	if txIn == nil {
+		return fmt.Errorf("no txIn matches the given uxto")
+	}
+	if txIn.Sequence == SEQUENCE_FINAL {
+		return fmt.Errorf("input is final, which disables the lock time")
+	}
+
+	return nil
+}
+
+// checkSequence fails unless the input carries a relative lock of the same kind and at least as long as the number
+// on top of the stack. Consensus then holds the input back until that lock has passed, see CheckLocks.
+func (e *Engine) checkSequence() error {
+	top, err := e.peek()
+	if err != nil {
+		return err
+	}
+	lock, err := decodeScriptNum(top, MAX_LOCKTIME_NUM_SIZE)
+	if err != nil {
+		return err
+	}
+
+	if lock < 0 {
+		return fmt.Errorf("negative relative lock")
+	}
+	if uint32(lock)&SEQUENCE_LOCKTIME_DISABLE_FLAG != 0 {
+		return nil
+	}
+
+	txIn := e.tx.InputOf(e.uxto.TxId, e.uxto.N)
+	if txIn == nil {
+		return fmt.Errorf("no txIn matches the given uxto")
+	}
+	if txIn.Sequence&SEQUENCE_LOCKTIME_DISABLE_FLAG != 0 {
+		return fmt.Errorf("input sequence disables relative locks")
+	}
+
+	typeMask := SEQUENCE_LOCKTIME_TYPE_FLAG | SEQUENCE_LOCKTIME_MASK
+	want, have := uint32(lock)&typeMask, txIn.Sequence&typeMask
+	if want&SEQUENCE_LOCKTIME_TYPE_FLAG != have&SEQUENCE_LOCKTIME_TYPE_FLAG {
+		return fmt.Errorf("input sequence locks by a different unit")
+	}
+	if want > have {
+		return fmt.Errorf("input sequence %d is shorter than the relative lock %d", have&SEQUENCE_LOCKTIME_MASK, want&SEQUENCE_LOCKTIME_MASK)
+	}
+
+	return nil
+}
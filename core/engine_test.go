@@ -0,0 +1,210 @@
+package core
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+// spendScript builds a transaction spending an output locked by script, and a function producing
+// signatures over it as they are pushed in a ScriptSig.
+func spendScript(script Script) (*Transaction, *UXTO, func(sk PrivateKey) []byte) {
+	uxto := &UXTO{
+		TxId:  RandomHash256(),
+		N:     0,
+		TxOut: &TxOut{Value: 100, ScriptPubKey: ScriptPubKey{Script: script}},
+	}
+	tx := NewTransactionBuilder().
+		AddInputFrom(uxto).
+		AddOutput(90, RandomHash160()).
+		Build()
+
+	sign := func(sk PrivateKey) []byte {
+		sig, _ := tx.signatureOf(uxto, sk, SIGHASH_ALL)
+		return append([]byte{sk.PublicKey().Type()}, sig...)
+	}
+
+	return tx, uxto, sign
+}
+
+func TestScriptNum(t *testing.T) {
+	for _, n := range []int64{0, 1, -1, 127, 128, -128, 255, 256, 32767, -32768, 1 << 31, 1<<32 - 1} {
+		got, err := decodeScriptNum(encodeScriptNum(n), MAX_LOCKTIME_NUM_SIZE)
+		if err != nil || got != n {
+			t.Errorf("round trip of %d: got %d, %v", n, got, err)
+		}
+	}
+
+	for _, buf := range [][]byte{{0x00}, {0x80}, {0x01, 0x00}, {0x7f, 0x80}} {
+		if _, err := decodeScriptNum(buf, MAX_SCRIPT_NUM_SIZE); err == nil {
+			t.Errorf("accepted non-minimal number %X", buf)
+		}
+	}
+
+	if _, err := decodeScriptNum([]byte{1, 2, 3, 4, 5}, MAX_SCRIPT_NUM_SIZE); err == nil {
+		t.Errorf("accepted oversized number")
+	}
+}
+
+func TestScript_P2PKH(t *testing.T) {
+	addr := RandomHash160()
+	script := NewP2PKHScript(addr)
+
+	if got, ok := script.P2PKHAddress(); !ok || got != addr {
+		t.Fatalf("P2PKH address not recognized")
+	}
+	if want := "OP_DUP OP_HASH160 " + hex.EncodeToString(addr[:]) + " OP_EQUALVERIFY OP_CHECKSIG"; script.String() != want {
+		t.Fatalf("disassembly is %q; want %q", script.String(), want)
+	}
+	if _, ok := append(script, OP_NOP).P2PKHAddress(); ok {
+		t.Fatalf("recognized a script with trailing opcodes as P2PKH")
+	}
+
+	sk, _ := GenerateSecp256k1Key()
+	tx, uxto, sign := spendScript(NewP2PKHScript(HashPubKey(sk.PublicKey())))
+
+	tx.Ins[0].Script = NewScriptBuilder().AddData(sign(sk)).AddData(sk.PublicKey().Bytes()).Script()
+	if err := tx.VerifyTxIn(uxto, 1); err != nil {
+		t.Fatalf("failed to verify: %s", err)
+	}
+
+	other, _ := GenerateSecp256k1Key()
+	tx.Ins[0].Script = NewScriptBuilder().AddData(sign(other)).AddData(other.PublicKey().Bytes()).Script()
+	if err := tx.VerifyTxIn(uxto, 1); err == nil {
+		t.Fatalf("verified a signature by another key")
+	}
+
+	// ScriptSigs may only push data
+	tx.Ins[0].Script = NewScriptBuilder().AddData(sign(sk)).AddData(sk.PublicKey().Bytes()).AddOp(OP_NOP).Script()
+	if err := tx.VerifyTxIn(uxto, 1); err == nil {
+		t.Fatalf("verified a ScriptSig with opcodes")
+	}
+}
+
+func TestEngine_CheckMultiSig(t *testing.T) {
+	var sks []PrivateKey
+	sb := NewScriptBuilder().AddInt(2)
+	for i := 0; i < 3; i++ {
+		sk, _ := GenerateSecp256k1Key()
+		sks = append(sks, sk)
+		sb.AddData(sk.PublicKey().Bytes())
+	}
+	script := sb.AddInt(3).AddOp(OP_CHECKMULTISIG).Script()
+
+	tx, uxto, sign := spendScript(script)
+
+	tests := []struct {
+		name  string
+		sigs  [][]byte
+		valid bool
+	}{
+		{"keys 0 and 2", [][]byte{sign(sks[0]), sign(sks[2])}, true},
+		{"keys 1 and 2", [][]byte{sign(sks[1]), sign(sks[2])}, true},
+		{"out of order", [][]byte{sign(sks[2]), sign(sks[0])}, false},
+		{"same key twice", [][]byte{sign(sks[1]), sign(sks[1])}, false},
+		{"one signature", [][]byte{sign(sks[1])}, false},
+		{"empty signatures", [][]byte{{}, {}}, false},
+	}
+
+	for _, tt := range tests {
+		sb := NewScriptBuilder()
+		for _, sig := range tt.sigs {
+			sb.AddData(sig)
+		}
+		tx.Ins[0].Script = sb.Script()
+
+		if err := tx.VerifyTxIn(uxto, 1); (err == nil) != tt.valid {
+			t.Errorf("%s: error = %v; want valid = %v", tt.name, err, tt.valid)
+		}
+	}
+}
+
+func TestEngine_CheckLockTime(t *testing.T) {
+	sk, _ := GenerateSecp256k1Key()
+	lockedBy := func(lock int64) Script {
+		return NewScriptBuilder().
+			AddInt(lock).AddOp(OP_CHECKLOCKTIMEVERIFY).AddOp(OP_DROP).
+			AddData(sk.PublicKey().Bytes()).AddOp(OP_CHECKSIG).
+			Script()
+	}
+	lockTime := int64(LOCKTIME_THRESHOLD) + 1000
+
+	tests := []struct {
+		name     string
+		lock     int64
+		lockTime uint32
+		sequence uint32
+		valid    bool
+	}{
+		{"height reached", 100, 100, MAX_SEQUENCE_NONFINAL, true},
+		{"height later", 100, 150, MAX_SEQUENCE_NONFINAL, true},
+		{"height not reached", 100, 99, MAX_SEQUENCE_NONFINAL, false},
+		{"final input", 100, 100, SEQUENCE_FINAL, false},
+		{"time reached", lockTime, uint32(lockTime), MAX_SEQUENCE_NONFINAL, true},
+		{"time not reached", lockTime, uint32(lockTime) - 1, MAX_SEQUENCE_NONFINAL, false},
+		{"time against height", lockTime, 100, MAX_SEQUENCE_NONFINAL, false},
+		{"height against time", 100, uint32(lockTime), MAX_SEQUENCE_NONFINAL, false},
+	}
+
+	for _, tt := range tests {
+		tx, uxto, sign := spendScript(lockedBy(tt.lock))
+		tx.LockTime, tx.Ins[0].Sequence = tt.lockTime, tt.sequence
+		tx.Ins[0].Script = NewScriptBuilder().AddData(sign(sk)).Script()
+
+		// the height of the block is left to IsFinal
+		if err := tx.VerifyTxIn(uxto, 1); (err == nil) != tt.valid {
+			t.Errorf("%s: error = %v; want valid = %v", tt.name, err, tt.valid)
+		}
+	}
+}
+
+func TestEngine_Failures(t *testing.T) {
+	sk, _ := GenerateSecp256k1Key()
+
+	tests := []struct {
+		name      string
+		scriptSig func(sign func(PrivateKey) []byte) Script
+		script    Script
+	}{
+		{
+			name:      "OP_RETURN",
+			scriptSig: func(func(PrivateKey) []byte) Script { return Script{} },
+			script:    NewScriptBuilder().AddOp(OP_RETURN).AddData([]byte("data")).Script(),
+		},
+		{
+			name:      "false on top",
+			scriptSig: func(func(PrivateKey) []byte) Script { return NewScriptBuilder().AddInt(0).Script() },
+			script:    Script{},
+		},
+		{
+			name:      "unknown opcode",
+			scriptSig: func(func(PrivateKey) []byte) Script { return NewScriptBuilder().AddInt(1).Script() },
+			script:    Script{0xff},
+		},
+		{
+			name:      "truncated push",
+			scriptSig: func(func(PrivateKey) []byte) Script { return NewScriptBuilder().AddInt(1).Script() },
+			script:    Script{OP_PUSHDATA1, 10, 1},
+		},
+		{
+			// a failed signature check aborts the script rather than leaving false to be inverted
+			name: "invalid signature",
+			scriptSig: func(sign func(PrivateKey) []byte) Script {
+				sig := sign(sk)
+				sig[len(sig)-1] ^= 1
+				return NewScriptBuilder().AddData(sig).Script()
+			},
+			script: NewScriptBuilder().AddData(sk.PublicKey().Bytes()).AddOp(OP_CHECKSIG).AddInt(0).AddOp(OP_EQUAL).Script(),
+		},
+	}
+
+	for _, tt := range tests {
+		tx, uxto, sign := spendScript(tt.script)
+		tx.Ins[0].Script = tt.scriptSig(sign)
+
+		if err := tx.VerifyTxIn(uxto, 1); err == nil {
+			t.Errorf("%s: script succeeded", tt.name)
+		} else {
+			t.Logf("%s: %s", tt.name, err)
+		}
+	}
+}
@@ -77,6 +77,28 @@ func (hash *Hash160) String() string {
 	return base58.Encode(hash[:])
 }
 
+// P2SH_ADDRESS_PREFIX starts the decoded form of a P2SH address. A P2PKH address is the bare key hash.
+const P2SH_ADDRESS_PREFIX byte = 0x05
+
+// P2SHString encodes a script hash as a P2SH address.
+func (hash *Hash160) P2SHString() string {
+	return base58.Encode(append([]byte{P2SH_ADDRESS_PREFIX}, hash[:]...))
+}
+
+// ParseAddressScript decodes a P2PKH or a P2SH address into the script that pays to it.
+func ParseAddressScript(str string) (Script, error) {
+	decoded := base58.Decode(str)
+
+	switch {
+	case len(decoded) == 20:
+		return NewP2PKHScript(Hash160FromSlice(decoded)), nil
+	case len(decoded) == 21 && decoded[0] == P2SH_ADDRESS_PREFIX:
+		return NewP2SHScript(Hash160FromSlice(decoded[1:])), nil
+	default:
+		return nil, fmt.Errorf("invalid address")
+	}
+}
+
 func (hash *Hash160) ParseAddress(str string) error {
 	decoded := base58.Decode(str)
 	if len(decoded) != 20 {
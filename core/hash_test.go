@@ -19,3 +19,27 @@ func TestParseHash256(t *testing.T) {
 	parsed, _ := ParseHash256(txId)
 	fmt.Printf("%s", parsed.String())
 }
+
+func TestParseAddressScript(t *testing.T) {
+	addr := RandomHash160()
+
+	script, err := ParseAddressScript(addr.String())
+	if err != nil || script.Address() != addr.String() {
+		t.Fatalf("P2PKH address round trip failed: %v", err)
+	}
+	if got, ok := script.P2PKHAddress(); !ok || got != addr {
+		t.Fatalf("parsed %s; want a P2PKH script", script)
+	}
+
+	script, err = ParseAddressScript(addr.P2SHString())
+	if err != nil || script.Address() != addr.P2SHString() {
+		t.Fatalf("P2SH address round trip failed: %v", err)
+	}
+	if got, ok := script.P2SHHash(); !ok || got != addr {
+		t.Fatalf("parsed %s; want a P2SH script", script)
+	}
+
+	if _, err := ParseAddressScript("1"); err == nil {
+		t.Fatalf("parsed an invalid address")
+	}
+}
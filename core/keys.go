@@ -0,0 +1,174 @@
+package core
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/binary"
+	"fmt"
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+	"github.com/decred/dcrd/dcrec/secp256k1/v4/ecdsa"
+	"math/big"
+)
+
+// Key types a ScriptSig can carry.
+// The key type also tags the signature scheme of the input: ECDSA for KEY_SECP256K1, BIP340 for KEY_SCHNORR.
+const (
+	KEY_RSA       byte = 0 // legacy, only kept so that outputs paid to RSA addresses stay spendable
+	KEY_SECP256K1 byte = 1
+	KEY_SCHNORR   byte = 2
+
+	S_SECP256K1_PUBKEY  = 33 // compressed
+	S_SECP256K1_PRIVKEY = 32
+)
+
+type PublicKey interface {
+	Type() byte
+	// Bytes returns the encoding of the key that is hashed into its address.
+	Bytes() []byte
+	Verify(digest []byte, sig []byte) error
+}
+
+type PrivateKey interface {
+	PublicKey() PublicKey
+	Sign(digest []byte) ([]byte, error)
+}
+
+// ParsePublicKey decodes a key of the given type from its Bytes encoding.
+func ParsePublicKey(keyType byte, buf []byte) (PublicKey, error) {
+	switch keyType {
+	case KEY_SECP256K1:
+		if len(buf) != S_SECP256K1_PUBKEY {
+			return nil, fmt.Errorf("invalid secp256k1 public key size %d", len(buf))
+		}
+		pk, err := secp256k1.ParsePubKey(buf)
+		if err != nil {
+			return nil, fmt.Errorf("invalid secp256k1 public key: %w", err)
+		}
+
+		return &Secp256k1PublicKey{key: pk}, nil
+	case KEY_SCHNORR:
+		return newSchnorrPublicKey(buf)
+	case KEY_RSA:
+		if len(buf) < 5 || buf[0] == 0 {
+			return nil, fmt.Errorf("invalid RSA public key")
+		}
+		pk := &rsa.PublicKey{
+			N: big.NewInt(0).SetBytes(buf[:len(buf)-4]),
+			E: int(binary.LittleEndian.Uint32(buf[len(buf)-4:])),
+		}
+
+		return &RSAPublicKey{key: pk}, nil
+	default:
+		return nil, fmt.Errorf("unknown key type %d", keyType)
+	}
+}
+
+// --- secp256k1 ---
+
+type Secp256k1PublicKey struct {
+	key *secp256k1.PublicKey
+}
+
+func (pk *Secp256k1PublicKey) Type() byte {
+	return KEY_SECP256K1
+}
+
+func (pk *Secp256k1PublicKey) Bytes() []byte {
+	return pk.key.SerializeCompressed()
+}
+
+// Verify checks a DER-encoded ECDSA signature.
+// Only the canonical low-S encoding produced by Sign is accepted, so a signature cannot be altered
+// without invalidating it.
+func (pk *Secp256k1PublicKey) Verify(digest []byte, sig []byte) error {
+	s, err := ecdsa.ParseDERSignature(sig)
+	if err != nil {
+		return fmt.Errorf("invalid signature encoding: %w", err)
+	}
+	if !bytes.Equal(s.Serialize(), sig) {
+		return fmt.Errorf("non-canonical signature")
+	}
+	if !s.Verify(digest, pk.key) {
+		return fmt.Errorf("invalid signature")
+	}
+
+	return nil
+}
+
+type Secp256k1PrivateKey struct {
+	key *secp256k1.PrivateKey
+}
+
+func GenerateSecp256k1Key() (*Secp256k1PrivateKey, error) {
+	sk, err := secp256k1.GeneratePrivateKey()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Secp256k1PrivateKey{key: sk}, nil
+}
+
+func ParseSecp256k1PrivateKey(buf []byte) (*Secp256k1PrivateKey, error) {
+	if len(buf) != S_SECP256K1_PRIVKEY {
+		return nil, fmt.Errorf("invalid secp256k1 private key size %d", len(buf))
+	}
+
+	return &Secp256k1PrivateKey{key: secp256k1.PrivKeyFromBytes(buf)}, nil
+}
+
+func (sk *Secp256k1PrivateKey) Bytes() []byte {
+	return sk.key.Serialize()
+}
+
+func (sk *Secp256k1PrivateKey) PublicKey() PublicKey {
+	return &Secp256k1PublicKey{key: sk.key.PubKey()}
+}
+
+func (sk *Secp256k1PrivateKey) Sign(digest []byte) ([]byte, error) {
+	return ecdsa.Sign(sk.key, digest).Serialize(), nil
+}
+
+// --- RSA (legacy) ---
+
+type RSAPublicKey struct {
+	key *rsa.PublicKey
+}
+
+func NewRSAPublicKey(pk *rsa.PublicKey) *RSAPublicKey {
+	return &RSAPublicKey{key: pk}
+}
+
+func (pk *RSAPublicKey) Type() byte {
+	return KEY_RSA
+}
+
+// Bytes returns N followed by E as 4 little-endian bytes, which is what RSA addresses were hashed from.
+func (pk *RSAPublicKey) Bytes() []byte {
+	return append(pk.key.N.Bytes(), UintToBytes(uint32(pk.key.E))...)
+}
+
+func (pk *RSAPublicKey) Verify(digest []byte, sig []byte) error {
+	if err := rsa.VerifyPKCS1v15(pk.key, crypto.SHA256, digest, sig); err != nil {
+		return fmt.Errorf("invalid signature: %w", err)
+	}
+
+	return nil
+}
+
+type RSAPrivateKey struct {
+	key *rsa.PrivateKey
+}
+
+func NewRSAPrivateKey(sk *rsa.PrivateKey) *RSAPrivateKey {
+	return &RSAPrivateKey{key: sk}
+}
+
+func (sk *RSAPrivateKey) PublicKey() PublicKey {
+	return &RSAPublicKey{key: &sk.key.PublicKey}
+}
+
+func (sk *RSAPrivateKey) Sign(digest []byte) ([]byte, error) {
+	return sk.key.Sign(rand.Reader, digest, crypto.SHA256)
+}
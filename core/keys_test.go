@@ -0,0 +1,146 @@
+package core
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+	"math/big"
+	"testing"
+)
+
+func TestSecp256k1_SignAndVerify(t *testing.T) {
+	sk, err := GenerateSecp256k1Key()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk := sk.PublicKey()
+	digest := RandomHash256()
+
+	if len(pk.Bytes()) != S_SECP256K1_PUBKEY {
+		t.Fatalf("public key is %d bytes; expected compressed key", len(pk.Bytes()))
+	}
+
+	sig, err := sk.Sign(digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pk.Verify(digest[:], sig); err != nil {
+		t.Fatalf("failed to verify signature: %s", err)
+	}
+
+	other := RandomHash256()
+	if err := pk.Verify(other[:], sig); err == nil {
+		t.Fatalf("verified signature over another digest")
+	}
+
+	// the same signature with S replaced by N-S is valid ECDSA but must be rejected
+	rLen := int(sig[3])
+	r := sig[4 : 4+rLen]
+	s := big.NewInt(0).SetBytes(sig[4+rLen+2:])
+	s.Sub(secp256k1.S256().N, s)
+	if err := pk.Verify(digest[:], encodeDER(r, s.Bytes())); err == nil {
+		t.Fatalf("verified high-S signature")
+	}
+	if err := pk.Verify(digest[:], append(sig, 0)); err == nil {
+		t.Fatalf("verified signature with trailing bytes")
+	}
+
+	// round trip through the wire encoding
+	parsedPk, err := ParsePublicKey(KEY_SECP256K1, pk.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if HashPubKey(parsedPk) != HashPubKey(pk) {
+		t.Fatalf("address changed after parsing")
+	}
+
+	skBytes := sk.Bytes()
+	sk2, err := ParseSecp256k1PrivateKey(skBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if HashPubKey(sk2.PublicKey()) != HashPubKey(pk) {
+		t.Fatalf("address changed after parsing private key")
+	}
+
+	if _, err := ParsePublicKey(KEY_SECP256K1, secp256k1.PrivKeyFromBytes(skBytes).PubKey().SerializeUncompressed()); err == nil {
+		t.Fatalf("accepted uncompressed key")
+	}
+}
+
+func TestRSA_LegacyAddress(t *testing.T) {
+	rsk, _ := rsa.GenerateKey(rand.Reader, 512)
+	sk := NewRSAPrivateKey(rsk)
+	pk := sk.PublicKey()
+
+	// the address RSA keys were hashed into before key types existed
+	var raw []byte
+	raw = append(raw, rsk.PublicKey.N.Bytes()...)
+	raw = append(raw, UintToBytes(uint32(rsk.PublicKey.E))...)
+	if HashPubKey(pk) != HashTo160(raw) {
+		t.Fatalf("RSA address changed")
+	}
+
+	parsed, err := ParsePublicKey(KEY_RSA, pk.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if HashPubKey(parsed) != HashPubKey(pk) {
+		t.Fatalf("address changed after parsing")
+	}
+
+	digest := RandomHash256()
+	sig, _ := sk.Sign(digest[:])
+	if err := parsed.Verify(digest[:], sig); err != nil {
+		t.Fatalf("failed to verify signature: %s", err)
+	}
+}
+
+func TestTransaction_KeyTypeActivation(t *testing.T) {
+	PopulateTestData()
+
+	defer func(p ConsensusParams) { Params = p }(Params)
+	Params.Secp256k1Height = 10
+
+	tx := NewTransactionBuilder().
+		AddInputFrom(USET.First(TXID[0])).
+		AddOutput(50, ADDR[2]).
+		AddChange(NewP2PKHScript(ADDR[0]), 1).
+		Sign(SK[0])
+
+	if err := tx.Verify(USET, 9); err == nil {
+		t.Fatalf("secp256k1 signature accepted below activation height")
+	}
+	if err := tx.Verify(USET, 10); err != nil {
+		t.Fatalf("failed to verify at activation height: %s", err)
+	}
+
+	// an output paid to an RSA address stays spendable after activation
+	rsk, _ := rsa.GenerateKey(rand.Reader, 512)
+	sk := NewRSAPrivateKey(rsk)
+	uxto := NewUXTO(HashPubKey(sk.PublicKey()), 100)
+	USET.Add(uxto)
+
+	tx = NewTransactionBuilder().
+		AddInputFrom(uxto).
+		AddOutput(50, ADDR[2]).
+		AddChange(uxto.Script, 1).
+		Sign(sk)
+
+	if err := tx.Verify(USET, 100); err != nil {
+		t.Fatalf("failed to spend RSA output: %s", err)
+	}
+}
+
+// encodeDER encodes a signature without the low-S normalization done by ecdsa.Signature.Serialize.
+func encodeDER(r, s []byte) []byte {
+	integer := func(b []byte) []byte {
+		if b[0] >= 0x80 {
+			b = append([]byte{0}, b...)
+		}
+		return append([]byte{0x02, byte(len(b))}, b...)
+	}
+
+	body := append(integer(r), integer(s)...)
+	return append([]byte{0x30, byte(len(body))}, body...)
+}
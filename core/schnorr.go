@@ -0,0 +1,311 @@
+package core
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+)
+
+// Schnorr signatures as specified by BIP340: 32-byte x-only public keys and 64-byte signatures R.x || s.
+// Keys and nonces are always taken with an even y, so a point is fully described by its x coordinate.
+
+const (
+	S_SCHNORR_PUBKEY = 32
+	S_SCHNORR_SIG    = 64
+)
+
+type SchnorrPublicKey struct {
+	x     [32]byte
+	point secp256k1.JacobianPoint
+}
+
+func newSchnorrPublicKey(x []byte) (*SchnorrPublicKey, error) {
+	if len(x) != S_SCHNORR_PUBKEY {
+		return nil, fmt.Errorf("invalid Schnorr public key size %d", len(x))
+	}
+
+	point, err := liftX(x)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Schnorr public key: %w", err)
+	}
+
+	pk := &SchnorrPublicKey{point: *point}
+	copy(pk.x[:], x)
+
+	return pk, nil
+}
+
+func (pk *SchnorrPublicKey) Type() byte {
+	return KEY_SCHNORR
+}
+
+func (pk *SchnorrPublicKey) Bytes() []byte {
+	return append([]byte{}, pk.x[:]...)
+}
+
+func (pk *SchnorrPublicKey) Verify(digest []byte, sig []byte) error {
+	r, s, err := parseSchnorrSig(sig)
+	if err != nil {
+		return err
+	}
+	e := schnorrChallenge(sig[:32], pk.x[:], digest)
+
+	// R = s*G - e*P
+	var sG, eP, R secp256k1.JacobianPoint
+	secp256k1.ScalarBaseMultNonConst(s, &sG)
+	secp256k1.ScalarMultNonConst(e.Negate(), &pk.point, &eP)
+	secp256k1.AddNonConst(&sG, &eP, &R)
+
+	if isInfinity(&R) {
+		return fmt.Errorf("invalid signature")
+	}
+	R.ToAffine()
+	if R.Y.IsOdd() || !R.X.Equals(r) {
+		return fmt.Errorf("invalid signature")
+	}
+
+	return nil
+}
+
+type SchnorrPrivateKey struct {
+	key *secp256k1.PrivateKey
+}
+
+func GenerateSchnorrKey() (*SchnorrPrivateKey, error) {
+	sk, err := secp256k1.GeneratePrivateKey()
+	if err != nil {
+		return nil, err
+	}
+
+	return &SchnorrPrivateKey{key: sk}, nil
+}
+
+func ParseSchnorrPrivateKey(buf []byte) (*SchnorrPrivateKey, error) {
+	if len(buf) != S_SECP256K1_PRIVKEY {
+		return nil, fmt.Errorf("invalid Schnorr private key size %d", len(buf))
+	}
+
+	return &SchnorrPrivateKey{key: secp256k1.PrivKeyFromBytes(buf)}, nil
+}
+
+func (sk *SchnorrPrivateKey) Bytes() []byte {
+	return sk.key.Serialize()
+}
+
+func (sk *SchnorrPrivateKey) PublicKey() PublicKey {
+	var P secp256k1.JacobianPoint
+	secp256k1.ScalarBaseMultNonConst(&sk.key.Key, &P)
+	P.ToAffine()
+
+	pk, _ := newSchnorrPublicKey(P.X.Bytes()[:]) // the x coordinate of a point on the curve always lifts
+
+	return pk
+}
+
+func (sk *SchnorrPrivateKey) Sign(digest []byte) ([]byte, error) {
+	var aux [32]byte
+	if _, err := rand.Read(aux[:]); err != nil {
+		return nil, fmt.Errorf("failed to read randomness: %w", err)
+	}
+
+	return schnorrSign(&sk.key.Key, digest, aux[:])
+}
+
+// schnorrSign is the BIP340 signing algorithm with the auxiliary randomness aux.
+func schnorrSign(key *secp256k1.ModNScalar, msg []byte, aux []byte) ([]byte, error) {
+	if key.IsZero() {
+		return nil, fmt.Errorf("invalid private key")
+	}
+
+	d := *key
+	var P secp256k1.JacobianPoint
+	secp256k1.ScalarBaseMultNonConst(&d, &P)
+	P.ToAffine()
+	if P.Y.IsOdd() {
+		d.Negate()
+	}
+	px := P.X.Bytes()
+
+	dBytes := d.Bytes()
+	t := taggedHash("BIP0340/aux", aux)
+	for i := range t {
+		t[i] ^= dBytes[i]
+	}
+
+	nonce := taggedHash("BIP0340/nonce", t[:], px[:], msg)
+	var k secp256k1.ModNScalar
+	k.SetBytes(&nonce)
+	if k.IsZero() {
+		return nil, fmt.Errorf("nonce is zero")
+	}
+
+	var R secp256k1.JacobianPoint
+	secp256k1.ScalarBaseMultNonConst(&k, &R)
+	R.ToAffine()
+	if R.Y.IsOdd() {
+		k.Negate()
+	}
+	rx := R.X.Bytes()
+
+	e := schnorrChallenge(rx[:], px[:], msg)
+	s := new(secp256k1.ModNScalar).Mul2(e, &d).Add(&k)
+	sBytes := s.Bytes()
+
+	return append(rx[:], sBytes[:]...), nil
+}
+
+// SchnorrBatch collects Schnorr signatures and verifies them together.
+// Each signature is weighted by a random factor, so that invalid signatures cannot cancel each other out,
+// and the s values share a single base point multiplication.
+type SchnorrBatch struct {
+	items []schnorrBatchItem
+}
+
+type schnorrBatchItem struct {
+	pk     *SchnorrPublicKey
+	digest []byte
+	sig    []byte
+}
+
+func NewSchnorrBatch() *SchnorrBatch {
+	return &SchnorrBatch{}
+}
+
+func (b *SchnorrBatch) Add(pk *SchnorrPublicKey, digest []byte, sig []byte) {
+	b.items = append(b.items, schnorrBatchItem{pk: pk, digest: digest, sig: sig})
+}
+
+func (b *SchnorrBatch) Len() int {
+	return len(b.items)
+}
+
+// Verify checks (sum a_i*s_i)*G == sum a_i*R_i + sum a_i*e_i*P_i with a_0 = 1 and random a_i otherwise.
+// It only reports whether every signature in the batch is valid, not which one failed.
+func (b *SchnorrBatch) Verify() error {
+	var sSum secp256k1.ModNScalar
+	var rhs secp256k1.JacobianPoint // the zero value is the point at infinity
+
+	for i, item := range b.items {
+		_, s, err := parseSchnorrSig(item.sig)
+		if err != nil {
+			return fmt.Errorf("signature %d: %w", i, err)
+		}
+		R, err := liftX(item.sig[:32])
+		if err != nil {
+			return fmt.Errorf("signature %d: invalid R: %w", i, err)
+		}
+		e := schnorrChallenge(item.sig[:32], item.pk.x[:], item.digest)
+
+		a := new(secp256k1.ModNScalar).SetInt(1)
+		if i > 0 {
+			if a, err = randomScalar(); err != nil {
+				return err
+			}
+		}
+
+		sSum.Add(new(secp256k1.ModNScalar).Mul2(a, s))
+
+		var aR, aeP, sum secp256k1.JacobianPoint
+		secp256k1.ScalarMultNonConst(a, R, &aR)
+		secp256k1.ScalarMultNonConst(e.Mul(a), &item.pk.point, &aeP)
+		secp256k1.AddNonConst(&aR, &aeP, &sum)
+		secp256k1.AddNonConst(&rhs, &sum, &rhs)
+	}
+
+	var lhs secp256k1.JacobianPoint
+	secp256k1.ScalarBaseMultNonConst(&sSum, &lhs)
+
+	if isInfinity(&lhs) || isInfinity(&rhs) {
+		if isInfinity(&lhs) && isInfinity(&rhs) {
+			return nil
+		}
+		return fmt.Errorf("invalid signature in batch")
+	}
+	lhs.ToAffine()
+	rhs.ToAffine()
+	if !lhs.X.Equals(&rhs.X) || !lhs.Y.Equals(&rhs.Y) {
+		return fmt.Errorf("invalid signature in batch")
+	}
+
+	return nil
+}
+
+func taggedHash(tag string, msgs ...[]byte) [32]byte {
+	tagHash := sha256.Sum256([]byte(tag))
+
+	h := sha256.New()
+	h.Write(tagHash[:])
+	h.Write(tagHash[:])
+	for _, m := range msgs {
+		h.Write(m)
+	}
+
+	var out [32]byte
+	copy(out[:], h.Sum(nil))
+
+	return out
+}
+
+func schnorrChallenge(rx, px, msg []byte) *secp256k1.ModNScalar {
+	h := taggedHash("BIP0340/challenge", rx, px, msg)
+
+	var e secp256k1.ModNScalar
+	e.SetBytes(&h)
+
+	return &e
+}
+
+// parseSchnorrSig splits a signature into R.x, which must be below the field prime, and s, which must be
+// below the group order.
+func parseSchnorrSig(sig []byte) (*secp256k1.FieldVal, *secp256k1.ModNScalar, error) {
+	if len(sig) != S_SCHNORR_SIG {
+		return nil, nil, fmt.Errorf("invalid signature size %d", len(sig))
+	}
+
+	var r secp256k1.FieldVal
+	if overflow := r.SetByteSlice(sig[:32]); overflow {
+		return nil, nil, fmt.Errorf("signature R is not below the field prime")
+	}
+
+	var s secp256k1.ModNScalar
+	if overflow := s.SetByteSlice(sig[32:]); overflow {
+		return nil, nil, fmt.Errorf("signature s is not below the group order")
+	}
+
+	return &r, &s, nil
+}
+
+// liftX returns the point with the given x coordinate and an even y.
+func liftX(x []byte) (*secp256k1.JacobianPoint, error) {
+	var p secp256k1.JacobianPoint
+
+	if overflow := p.X.SetByteSlice(x); overflow {
+		return nil, fmt.Errorf("x is not below the field prime")
+	}
+	if !secp256k1.DecompressY(&p.X, false, &p.Y) {
+		return nil, fmt.Errorf("x is not on the curve")
+	}
+	p.Y.Normalize()
+	p.Z.SetInt(1)
+
+	return &p, nil
+}
+
+func isInfinity(p *secp256k1.JacobianPoint) bool {
+	return (p.X.IsZero() && p.Y.IsZero()) || p.Z.IsZero()
+}
+
+func randomScalar() (*secp256k1.ModNScalar, error) {
+	var buf [32]byte
+	var a secp256k1.ModNScalar
+
+	for a.IsZero() {
+		if _, err := rand.Read(buf[:]); err != nil {
+			return nil, fmt.Errorf("failed to read randomness: %w", err)
+		}
+		a.SetBytes(&buf)
+	}
+
+	return &a, nil
+}
@@ -0,0 +1,182 @@
+package core
+
+import (
+	"encoding/hex"
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+	"strings"
+	"testing"
+)
+
+func fromHex(s string) []byte {
+	b, err := hex.DecodeString(strings.ToLower(s))
+	if err != nil {
+		panic(err)
+	}
+
+	return b
+}
+
+// test vectors from BIP340
+func TestSchnorr_BIP340Vectors(t *testing.T) {
+	vectors := []struct {
+		sk, pk, aux, msg, sig string
+	}{
+		{
+			sk:  "0000000000000000000000000000000000000000000000000000000000000003",
+			pk:  "F9308A019258C31049344F85F89D5229B531C845836F99B08601F113BCE036F9",
+			aux: "0000000000000000000000000000000000000000000000000000000000000000",
+			msg: "0000000000000000000000000000000000000000000000000000000000000000",
+			sig: "E907831F80848D1069A5371B402410364BDF1C5F8307B0084C55F1CE2DCA821525F66A4A85EA8B71E482A74F382D2CE5EBEEE8FDB2172F477DF4900D310536C0",
+		},
+		{
+			sk:  "B7E151628AED2A6ABF7158809CF4F3C762E7160F38B4DA56A784D9045190CFEF",
+			pk:  "DFF1D77F2A671C5F36183726DB2341BE58FEAE1DA2DECED843240F7B502BA659",
+			aux: "0000000000000000000000000000000000000000000000000000000000000001",
+			msg: "243F6A8885A308D313198A2E03707344A4093822299F31D0082EFA98EC4E6C89",
+			sig: "6896BD60EEAE296DB48A229FF71DFE071BDE413E6D43F917DC8DCF8C78DE33418906D11AC976ABCCB20B091292BFF4EA897EFCB639EA871CFA95F6DE339E4B0A",
+		},
+	}
+
+	for i, v := range vectors {
+		sk, err := ParseSchnorrPrivateKey(fromHex(v.sk))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pk := sk.PublicKey().Bytes(); hex.EncodeToString(pk) != strings.ToLower(v.pk) {
+			t.Fatalf("vector %d: public key is %X; want %s", i, pk, v.pk)
+		}
+
+		sig, err := schnorrSign(&sk.key.Key, fromHex(v.msg), fromHex(v.aux))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hex.EncodeToString(sig) != strings.ToLower(v.sig) {
+			t.Fatalf("vector %d: signature is %X; want %s", i, sig, v.sig)
+		}
+
+		pk, err := ParsePublicKey(KEY_SCHNORR, fromHex(v.pk))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := pk.Verify(fromHex(v.msg), sig); err != nil {
+			t.Fatalf("vector %d: failed to verify: %s", i, err)
+		}
+	}
+}
+
+func TestSchnorr_SignAndVerify(t *testing.T) {
+	sk, _ := GenerateSchnorrKey()
+	pk := sk.PublicKey()
+	digest := RandomHash256()
+
+	sig, err := sk.Sign(digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pk.Verify(digest[:], sig); err != nil {
+		t.Fatalf("failed to verify signature: %s", err)
+	}
+
+	other := RandomHash256()
+	if err := pk.Verify(other[:], sig); err == nil {
+		t.Fatalf("verified signature over another digest")
+	}
+
+	// s + N is the same scalar but must not be accepted
+	tampered := append([]byte{}, sig...)
+	copy(tampered[32:], secp256k1.S256().N.Bytes())
+	if err := pk.Verify(digest[:], tampered); err == nil {
+		t.Fatalf("verified signature with s out of range")
+	}
+	if err := pk.Verify(digest[:], sig[:63]); err == nil {
+		t.Fatalf("verified truncated signature")
+	}
+
+	if _, err := ParsePublicKey(KEY_SCHNORR, make([]byte, S_SCHNORR_PUBKEY)); err == nil {
+		t.Fatalf("accepted x coordinate off the curve")
+	}
+}
+
+func TestSchnorrBatch_Verify(t *testing.T) {
+	batch := NewSchnorrBatch()
+	for i := 0; i < 5; i++ {
+		sk, _ := GenerateSchnorrKey()
+		digest := RandomHash256()
+		sig, _ := sk.Sign(digest[:])
+		batch.Add(sk.PublicKey().(*SchnorrPublicKey), digest[:], sig)
+	}
+
+	if err := batch.Verify(); err != nil {
+		t.Fatalf("failed to verify batch: %s", err)
+	}
+
+	// a signature over another digest spoils the batch
+	sk, _ := GenerateSchnorrKey()
+	digest, other := RandomHash256(), RandomHash256()
+	sig, _ := sk.Sign(digest[:])
+	batch.Add(sk.PublicKey().(*SchnorrPublicKey), other[:], sig)
+
+	if err := batch.Verify(); err == nil {
+		t.Fatalf("verified batch with an invalid signature")
+	}
+}
+
+func TestBlock_VerifySchnorrBatch(t *testing.T) {
+	PopulateTestData()
+
+	var sks []PrivateKey
+	for i := 0; i < 3; i++ {
+		sk, _ := GenerateSchnorrKey()
+		uxto := NewUXTO(HashPubKey(sk.PublicKey()), 100)
+		USET.Add(uxto)
+		TXID = append(TXID, uxto.TxId)
+		sks = append(sks, sk)
+	}
+	n := len(TXID)
+
+	coinbase := NewCoinBaseTransaction([]byte("coinbase"), ADDR[5], 100, 0)
+	tx1 := NewTransaction(USET.First(TXID[n-3]), sks[0], ADDR[3], 60, 0)
+	tx2 := NewTransaction(USET.First(TXID[n-2]), sks[1], ADDR[3], 60, 0)
+
+	b := NewBlockBuilder().
+		BaseOn(Hash256{}, 0).
+		SetNBits(EASY_BITS).
+		AddTransaction(coinbase).
+		AddTransaction(tx1).
+		AddTransaction(tx2).
+		Build()
+
+	if err := b.Verify(USET, nil, EASY_BITS, 1000); err != nil {
+		t.Fatalf("failed to verify block: %s", err)
+	}
+
+	// a bad Schnorr signature is caught by the batch
+	txBad := NewTransaction(USET.First(TXID[n-1]), sks[2], ADDR[3], 60, 0)
+	sigPush := txBad.Ins[0].Script[1 : 1+txBad.Ins[0].Script[0]] // <keyType|sig>
+	sigPush[len(sigPush)-1] ^= 1
+	b = NewBlockBuilder().
+		BaseOn(Hash256{}, 0).
+		SetNBits(EASY_BITS).
+		AddTransaction(coinbase).
+		AddTransaction(tx1).
+		AddTransaction(txBad).
+		Build()
+
+	if err := b.Verify(USET, nil, EASY_BITS, 1000); err == nil {
+		t.Fatalf("verification passed; expected signature error")
+	}
+
+	// in mixed blocks only the Schnorr signatures are batched
+	txEcdsa := NewTransaction(USET.First(TXID[0]), SK[0], ADDR[3], 60, 0)
+	b = NewBlockBuilder().
+		BaseOn(Hash256{}, 0).
+		SetNBits(EASY_BITS).
+		AddTransaction(coinbase).
+		AddTransaction(tx1).
+		AddTransaction(txEcdsa).
+		Build()
+
+	if err := b.Verify(USET, nil, EASY_BITS, 1000); err != nil {
+		t.Fatalf("failed to verify block: %s", err)
+	}
+}
@@ -0,0 +1,424 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// Script is a program for the stack machine run by Engine.
+// An output is locked by its ScriptPubKey and spent by a ScriptSig that leaves the ScriptPubKey with a true
+// value on top of the stack.
+type Script []byte
+
+// Opcodes understood by Engine. Byte values follow Bitcoin script, so scripts disassemble the same way.
+const (
+	OP_0         byte = 0x00
+	OP_DATA_75   byte = 0x4b // 0x01 to 0x4b push that many bytes
+	OP_PUSHDATA1 byte = 0x4c
+	OP_PUSHDATA2 byte = 0x4d
+	OP_PUSHDATA4 byte = 0x4e
+	OP_1         byte = 0x51 // OP_1 to OP_16 push the numbers 1 to 16
+	OP_16        byte = 0x60
+	OP_NOP       byte = 0x61
+	OP_VERIFY    byte = 0x69
+	OP_RETURN    byte = 0x6a
+	OP_DROP      byte = 0x75
+	OP_DUP       byte = 0x76
+	OP_EQUAL     byte = 0x87
+
+	OP_EQUALVERIFY         byte = 0x88
+	OP_HASH160             byte = 0xa9
+	OP_CHECKSIG            byte = 0xac
+	OP_CHECKSIGVERIFY      byte = 0xad
+	OP_CHECKMULTISIG       byte = 0xae
+	OP_CHECKMULTISIGVERIFY byte = 0xaf
+	OP_CHECKLOCKTIMEVERIFY byte = 0xb1
+	OP_CHECKSEQUENCEVERIFY byte = 0xb2
+)
+
+var opNames = map[byte]string{
+	OP_0:                   "OP_0",
+	OP_PUSHDATA1:           "OP_PUSHDATA1",
+	OP_PUSHDATA2:           "OP_PUSHDATA2",
+	OP_PUSHDATA4:           "OP_PUSHDATA4",
+	OP_NOP:                 "OP_NOP",
+	OP_VERIFY:              "OP_VERIFY",
+	OP_RETURN:              "OP_RETURN",
+	OP_DROP:                "OP_DROP",
+	OP_DUP:                 "OP_DUP",
+	OP_EQUAL:               "OP_EQUAL",
+	OP_EQUALVERIFY:         "OP_EQUALVERIFY",
+	OP_HASH160:             "OP_HASH160",
+	OP_CHECKSIG:            "OP_CHECKSIG",
+	OP_CHECKSIGVERIFY:      "OP_CHECKSIGVERIFY",
+	OP_CHECKMULTISIG:       "OP_CHECKMULTISIG",
+	OP_CHECKMULTISIGVERIFY: "OP_CHECKMULTISIGVERIFY",
+	OP_CHECKLOCKTIMEVERIFY: "OP_CHECKLOCKTIMEVERIFY",
+	OP_CHECKSEQUENCEVERIFY: "OP_CHECKSEQUENCEVERIFY",
+}
+
+const (
+	MAX_SCRIPT_SIZE         = 10000
+	MAX_SCRIPT_ELEMENT_SIZE = 520
+	MAX_STACK_SIZE          = 1000
+	MAX_MULTISIG_KEYS       = 20
+	MAX_SCRIPT_NUM_SIZE     = 4
+	MAX_LOCKTIME_NUM_SIZE   = 5 // lock heights use the full uint32 range
+	MAX_DATA_CARRIER_SIZE   = 80
+)
+
+type instruction struct {
+	op   byte
+	data []byte // the pushed bytes of a push opcode
+}
+
+func (ins *instruction) isPush() bool {
+	return ins.op <= OP_PUSHDATA4 || (ins.op >= OP_1 && ins.op <= OP_16)
+}
+
+// parse splits the script into instructions, failing on pushes that run past its end.
+func (s Script) parse() ([]instruction, error) {
+	var ins []instruction
+
+	for p := 0; p < len(s); {
+		op := s[p]
+		p++
+
+		var n int
+		switch {
+		case op >= 0x01 && op <= OP_DATA_75:
+			n = int(op)
+		case op == OP_PUSHDATA1:
+			if p+1 > len(s) {
+				return nil, fmt.Errorf("truncated push at %d", p-1)
+			}
+			n = int(s[p])
+			p++
+		case op == OP_PUSHDATA2:
+			if p+2 > len(s) {
+				return nil, fmt.Errorf("truncated push at %d", p-1)
+			}
+			n = int(binary.LittleEndian.Uint16(s[p:]))
+			p += 2
+		case op == OP_PUSHDATA4:
+			if p+4 > len(s) {
+				return nil, fmt.Errorf("truncated push at %d", p-1)
+			}
+			n = int(binary.LittleEndian.Uint32(s[p:]))
+			p += 4
+		default:
+			ins = append(ins, instruction{op: op})
+			continue
+		}
+
+		if n < 0 || n > len(s)-p {
+			return nil, fmt.Errorf("truncated push at %d", p-1)
+		}
+		ins = append(ins, instruction{op: op, data: s[p : p+n]})
+		p += n
+	}
+
+	return ins, nil
+}
+
+// IsPushOnly reports whether the script only pushes data, as every ScriptSig must.
+func (s Script) IsPushOnly() bool {
+	ins, err := s.parse()
+	if err != nil {
+		return false
+	}
+
+	for _, in := range ins {
+		if !in.isPush() {
+			return false
+		}
+	}
+
+	return true
+}
+
+// String disassembles the script, e.g. "OP_DUP OP_HASH160 <hash> OP_EQUALVERIFY OP_CHECKSIG".
+func (s Script) String() string {
+	ins, err := s.parse()
+	if err != nil {
+		return "[invalid script " + hex.EncodeToString(s) + "]"
+	}
+
+	var words []string
+	for _, in := range ins {
+		switch {
+		case in.op > OP_0 && in.op <= OP_PUSHDATA4:
+			words = append(words, hex.EncodeToString(in.data))
+		case in.op >= OP_1 && in.op <= OP_16:
+			words = append(words, fmt.Sprintf("OP_%d", in.op-OP_1+1))
+		case opNames[in.op] != "":
+			words = append(words, opNames[in.op])
+		default:
+			words = append(words, fmt.Sprintf("OP_UNKNOWN_%02x", in.op))
+		}
+	}
+
+	return strings.Join(words, " ")
+}
+
+type ScriptBuilder struct {
+	script Script
+}
+
+func NewScriptBuilder() *ScriptBuilder {
+	return &ScriptBuilder{script: Script{}}
+}
+
+func (sb *ScriptBuilder) AddOp(op byte) *ScriptBuilder {
+	sb.script = append(sb.script, op)
+	return sb
+}
+
+// AddData pushes data with the smallest push opcode that fits it.
+func (sb *ScriptBuilder) AddData(data []byte) *ScriptBuilder {
+	n := len(data)
+
+	switch {
+	case n == 0:
+		sb.script = append(sb.script, OP_0)
+	case n <= int(OP_DATA_75):
+		sb.script = append(sb.script, byte(n))
+	case n <= 0xff:
+		sb.script = append(sb.script, OP_PUSHDATA1, byte(n))
+	case n <= 0xffff:
+		sb.script = append(sb.script, OP_PUSHDATA2, byte(n), byte(n>>8))
+	default:
+		sb.script = append(sb.script, OP_PUSHDATA4)
+		sb.script = append(sb.script, UintToBytes(uint32(n))...)
+	}
+	sb.script = append(sb.script, data...)
+
+	return sb
+}
+
+// AddInt pushes a number, using OP_0 and OP_1 to OP_16 for small values.
+func (sb *ScriptBuilder) AddInt(n int64) *ScriptBuilder {
+	if n == 0 {
+		return sb.AddOp(OP_0)
+	}
+	if n >= 1 && n <= 16 {
+		return sb.AddOp(OP_1 + byte(n-1))
+	}
+
+	return sb.AddData(encodeScriptNum(n))
+}
+
+func (sb *ScriptBuilder) Script() Script {
+	return sb.script
+}
+
+// --- standard templates ---
+
+// NewP2PKHScript locks an output to the key hashing to addr:
+// OP_DUP OP_HASH160 <addr> OP_EQUALVERIFY OP_CHECKSIG
+func NewP2PKHScript(addr Hash160) Script {
+	return NewScriptBuilder().
+		AddOp(OP_DUP).
+		AddOp(OP_HASH160).
+		AddData(addr[:]).
+		AddOp(OP_EQUALVERIFY).
+		AddOp(OP_CHECKSIG).
+		Script()
+}
+
+// P2PKHAddress returns the address of a P2PKH script.
+func (s Script) P2PKHAddress() (Hash160, bool) {
+	var addr Hash160
+
+	if len(s) != 25 || s[0] != OP_DUP || s[1] != OP_HASH160 || s[2] != byte(len(addr)) ||
+		s[23] != OP_EQUALVERIFY || s[24] != OP_CHECKSIG {
+		return addr, false
+	}
+	copy(addr[:], s[3:23])
+
+	return addr, true
+}
+
+// NewP2PKHScriptSig unlocks a P2PKH output: <keyType|sig> <pk>
+func NewP2PKHScriptSig(sig []byte, pk PublicKey) Script {
+	return NewScriptBuilder().
+		AddData(append([]byte{pk.Type()}, sig...)).
+		AddData(pk.Bytes()).
+		Script()
+}
+
+// NewP2SHScript locks an output to the script hashing to scriptHash: OP_HASH160 <scriptHash> OP_EQUAL
+// The spending ScriptSig pushes that redeem script last; it is then run on the rest of the stack.
+func NewP2SHScript(scriptHash Hash160) Script {
+	return NewScriptBuilder().
+		AddOp(OP_HASH160).
+		AddData(scriptHash[:]).
+		AddOp(OP_EQUAL).
+		Script()
+}
+
+// P2SHHash returns the redeem script hash of a P2SH script.
+func (s Script) P2SHHash() (Hash160, bool) {
+	var h Hash160
+
+	if len(s) != 23 || s[0] != OP_HASH160 || s[1] != byte(len(h)) || s[22] != OP_EQUAL {
+		return h, false
+	}
+	copy(h[:], s[2:22])
+
+	return h, true
+}
+
+// Address encodes the address a P2PKH or P2SH script pays to, or returns an empty string for other scripts.
+func (s Script) Address() string {
+	if addr, ok := s.P2PKHAddress(); ok {
+		return addr.String()
+	}
+	if h, ok := s.P2SHHash(); ok {
+		return h.P2SHString()
+	}
+
+	return ""
+}
+
+// NewDataScript makes a provably unspendable script carrying data: OP_RETURN <data>
+func NewDataScript(data []byte) (Script, error) {
+	if len(data) > MAX_DATA_CARRIER_SIZE {
+		return nil, fmt.Errorf("data of %d bytes exceeds %d", len(data), MAX_DATA_CARRIER_SIZE)
+	}
+
+	return NewScriptBuilder().AddOp(OP_RETURN).AddData(data).Script(), nil
+}
+
+// IsUnspendable reports whether s fails whatever the ScriptSig, as scripts starting with OP_RETURN do.
+// Outputs locked by such scripts are left out of the UXTO set.
+func (s Script) IsUnspendable() bool {
+	return len(s) > 0 && s[0] == OP_RETURN
+}
+
+// DataPayload returns the data carried by a data script.
+func (s Script) DataPayload() ([]byte, bool) {
+	if !s.IsUnspendable() {
+		return nil, false
+	}
+
+	ins, err := s.parse()
+	if err != nil || len(ins) != 2 || ins[1].op > OP_PUSHDATA4 {
+		return nil, false
+	}
+
+	return ins[1].data, true
+}
+
+// NewMultiSigScript requires signatures by m of the given keys: <m> <pk 1> ... <pk n> <n> OP_CHECKMULTISIG
+func NewMultiSigScript(m int, pks []PublicKey) (Script, error) {
+	if len(pks) == 0 || len(pks) > MAX_MULTISIG_KEYS {
+		return nil, fmt.Errorf("invalid key count %d", len(pks))
+	}
+	if m < 1 || m > len(pks) {
+		return nil, fmt.Errorf("invalid signature count %d of %d keys", m, len(pks))
+	}
+
+	sb := NewScriptBuilder().AddInt(int64(m))
+	for _, pk := range pks {
+		sb.AddData(pk.Bytes())
+	}
+
+	return sb.AddInt(int64(len(pks))).AddOp(OP_CHECKMULTISIG).Script(), nil
+}
+
+// MultiSigKeys returns the signature count and the keys of a multisig script.
+func (s Script) MultiSigKeys() (int, [][]byte, bool) {
+	ins, err := s.parse()
+	if err != nil || len(ins) < 4 || ins[len(ins)-1].op != OP_CHECKMULTISIG {
+		return 0, nil, false
+	}
+
+	smallInt := func(in instruction) int {
+		if in.op >= OP_1 && in.op <= OP_16 {
+			return int(in.op-OP_1) + 1
+		}
+		return -1
+	}
+
+	m, n := smallInt(ins[0]), smallInt(ins[len(ins)-2])
+	if m < 1 || n < m || n != len(ins)-3 {
+		return 0, nil, false
+	}
+
+	var pks [][]byte
+	for _, in := range ins[1 : len(ins)-2] {
+		if in.op == OP_0 || in.op > OP_PUSHDATA4 {
+			return 0, nil, false
+		}
+		pks = append(pks, in.data)
+	}
+
+	return m, pks, true
+}
+
+// --- numbers ---
+
+// encodeScriptNum encodes n as little-endian sign-magnitude with the fewest bytes.
+func encodeScriptNum(n int64) []byte {
+	if n == 0 {
+		return []byte{}
+	}
+
+	negative := n < 0
+	abs := uint64(n)
+	if negative {
+		abs = uint64(-n)
+	}
+
+	var buf []byte
+	for abs > 0 {
+		buf = append(buf, byte(abs))
+		abs >>= 8
+	}
+
+	if buf[len(buf)-1]&0x80 != 0 {
+		if negative {
+			buf = append(buf, 0x80)
+		} else {
+			buf = append(buf, 0x00)
+		}
+	} else if negative {
+		buf[len(buf)-1] |= 0x80
+	}
+
+	return buf
+}
+
+// decodeScriptNum is the inverse of encodeScriptNum. Encodings longer than maxLen or not minimal are rejected.
+func decodeScriptNum(buf []byte, maxLen int) (int64, error) {
+	if len(buf) > maxLen {
+		return 0, fmt.Errorf("number of %d bytes exceeds %d", len(buf), maxLen)
+	}
+	if len(buf) == 0 {
+		return 0, nil
+	}
+	if !bytes.Equal(buf, encodeScriptNum(decodeScriptNumUnchecked(buf))) {
+		return 0, fmt.Errorf("non-minimal number encoding")
+	}
+
+	return decodeScriptNumUnchecked(buf), nil
+}
+
+func decodeScriptNumUnchecked(buf []byte) int64 {
+	var n int64
+	for i, b := range buf {
+		n |= int64(b) << (8 * i)
+	}
+
+	last := buf[len(buf)-1]
+	if last&0x80 != 0 {
+		n &^= int64(0x80) << (8 * (len(buf) - 1))
+		return -n
+	}
+
+	return n
+}
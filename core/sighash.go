@@ -0,0 +1,156 @@
+package core
+
+import (
+	"fmt"
+	"strings"
+)
+
+// SigHashType selects the parts of a transaction a signature commits to. From Params.SighashHeight on, it is the
+// last byte of every signature pushed in a ScriptSig.
+//
+// SIGHASH_ALL commits to every input and output. SIGHASH_NONE commits to no output, so that whoever completes
+// the transaction decides where the coins go. SIGHASH_SINGLE commits to the output at the index of the signed
+// input only. Combined with any of them, SIGHASH_ANYONECANPAY commits to the signed input alone, so that others
+// can add inputs of their own, e.g. to fund a crowdfunding output.
+type SigHashType byte
+
+const (
+	SIGHASH_ALL          SigHashType = 0x01
+	SIGHASH_NONE         SigHashType = 0x02
+	SIGHASH_SINGLE       SigHashType = 0x03
+	SIGHASH_ANYONECANPAY SigHashType = 0x80
+)
+
+func (t SigHashType) base() SigHashType {
+	return t &^ SIGHASH_ANYONECANPAY
+}
+
+func (t SigHashType) anyoneCanPay() bool {
+	return t&SIGHASH_ANYONECANPAY != 0
+}
+
+// Valid reports whether t is one of the base types, optionally combined with SIGHASH_ANYONECANPAY.
+func (t SigHashType) Valid() bool {
+	return t.base() >= SIGHASH_ALL && t.base() <= SIGHASH_SINGLE
+}
+
+func (t SigHashType) String() string {
+	var s string
+	switch t.base() {
+	case SIGHASH_ALL:
+		s = "ALL"
+	case SIGHASH_NONE:
+		s = "NONE"
+	case SIGHASH_SINGLE:
+		s = "SINGLE"
+	default:
+		return fmt.Sprintf("0x%02x", byte(t))
+	}
+
+	if t.anyoneCanPay() {
+		s += "|ANYONECANPAY"
+	}
+
+	return s
+}
+
+// ParseSigHashType parses the String form of a hash type, e.g. "SINGLE|ANYONECANPAY".
+func ParseSigHashType(s string) (SigHashType, error) {
+	base, modifier, combined := strings.Cut(strings.ToUpper(s), "|")
+
+	var t SigHashType
+	switch base {
+	case "ALL":
+		t = SIGHASH_ALL
+	case "NONE":
+		t = SIGHASH_NONE
+	case "SINGLE":
+		t = SIGHASH_SINGLE
+	default:
+		return 0, fmt.Errorf("unknown hash type %q", s)
+	}
+
+	if combined {
+		if modifier != "ANYONECANPAY" {
+			return 0, fmt.Errorf("unknown hash type modifier %q", modifier)
+		}
+		t |= SIGHASH_ANYONECANPAY
+	}
+
+	return t, nil
+}
+
+// SignatureHash returns the digest a signature of the input spending uxto commits to under hashType.
+//
+// Inputs and outputs left out by hashType do not enter the digest, and neither do the sequences of the other
+// inputs under SIGHASH_NONE and SIGHASH_SINGLE, so that their owners can still update them. Outputs before the
+// one committed to by SIGHASH_SINGLE are blanked instead of left out, which keeps the committed one in place.
+func (tx *Transaction) SignatureHash(uxto *UXTO, hashType SigHashType) ([]byte, error) {
+	if !hashType.Valid() {
+		return nil, fmt.Errorf("invalid hash type 0x%02x", byte(hashType))
+	}
+
+	index := -1
+	for i, txIn := range tx.Ins {
+		if txIn.PrevTxId == uxto.TxId && txIn.N == uxto.N {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		return nil, fmt.Errorf("no txIn matches the given uxto")
+	}
+
+	base := hashType.base()
+	if base == SIGHASH_SINGLE && index >= len(tx.Outs) {
+		return nil, fmt.Errorf("no output %d to commit to with %s", index, hashType)
+	}
+
+	ins := tx.Ins
+	if hashType.anyoneCanPay() {
+		ins = tx.Ins[index : index+1]
+	}
+
+	var data []byte
+	for _, txIn := range ins {
+		data = append(data, txIn.PrevTxId[:]...)
+		data = append(data, UintToBytes(txIn.N)...)
+
+		if txIn == tx.Ins[index] {
+			data = append(data, uxto.ScriptPubKey.serialized()...)
+		}
+	}
+
+	var outs []*TxOut
+	switch base {
+	case SIGHASH_ALL:
+		outs = tx.Outs
+	case SIGHASH_SINGLE:
+		outs = tx.Outs[:index+1]
+	}
+	for i, txOut := range outs {
+		if i < len(outs)-1 && base == SIGHASH_SINGLE {
+			blank := ScriptPubKey{Script: Script{}}
+			data = append(data, blank.serialized()...)
+			data = append(data, amountBytes(-1)...)
+			continue
+		}
+
+		data = append(data, txOut.ScriptPubKey.serialized()...)
+		data = append(data, amountBytes(txOut.Value)...)
+	}
+
+	data = append(data, UintToBytes(tx.LockTime)...)
+	for _, txIn := range ins {
+		if txIn != tx.Ins[index] && base != SIGHASH_ALL {
+			data = append(data, UintToBytes(0)...)
+			continue
+		}
+		data = append(data, UintToBytes(txIn.Sequence)...)
+	}
+
+	data = append(data, byte(hashType))
+	digest := DoubleHashTo256(data)
+
+	return digest[:], nil
+}
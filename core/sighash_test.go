@@ -0,0 +1,137 @@
+package core
+
+import (
+	"testing"
+)
+
+func TestTransaction_SigHashTypes(t *testing.T) {
+	PopulateTestData()
+
+	// each change is made to a transaction whose first input was signed, spending TXID[0] and TXID[2] into
+	// two outputs
+	changes := []struct {
+		name   string
+		change func(tx *Transaction)
+	}{
+		{"change own output", func(tx *Transaction) { tx.Outs[0].Value-- }},
+		{"change other output", func(tx *Transaction) { tx.Outs[1].Value-- }},
+		{"add output", func(tx *Transaction) {
+			tx.Outs = append(tx.Outs, &TxOut{Value: 1, ScriptPubKey: NewP2PKHScriptPubKey(ADDR[3])})
+		}},
+		{"remove other output", func(tx *Transaction) { tx.Outs = tx.Outs[:1] }},
+		{"add input", func(tx *Transaction) {
+			tx.Ins = append(tx.Ins, &TxIn{PrevTxId: TXID[4], Sequence: SEQUENCE_FINAL})
+		}},
+		{"remove other input", func(tx *Transaction) { tx.Ins = tx.Ins[:1] }},
+		{"change other sequence", func(tx *Transaction) { tx.Ins[1].Sequence = 0 }},
+		{"change own sequence", func(tx *Transaction) { tx.Ins[0].Sequence = 0 }},
+		{"change lock time", func(tx *Transaction) { tx.LockTime = 1 }},
+	}
+
+	// whether the signature stays valid after each change, in the order above
+	tests := []struct {
+		hashType SigHashType
+		valid    []bool
+	}{
+		{SIGHASH_ALL, []bool{false, false, false, false, false, false, false, false, false}},
+		{SIGHASH_NONE, []bool{true, true, true, true, false, false, true, false, false}},
+		{SIGHASH_SINGLE, []bool{false, true, true, true, false, false, true, false, false}},
+		{SIGHASH_ALL | SIGHASH_ANYONECANPAY, []bool{false, false, false, false, true, true, true, false, false}},
+		{SIGHASH_NONE | SIGHASH_ANYONECANPAY, []bool{true, true, true, true, true, true, true, false, false}},
+		{SIGHASH_SINGLE | SIGHASH_ANYONECANPAY, []bool{false, true, true, true, true, true, true, false, false}},
+	}
+
+	uxto := USET.First(TXID[0])
+	for _, tt := range tests {
+		for i, c := range changes {
+			tx := NewTransactionBuilder().
+				AddInputFrom(uxto).
+				AddInputFrom(USET.First(TXID[2])).
+				AddOutput(150, ADDR[1]).
+				AddOutput(40, ADDR[2]).
+				Build()
+			if err := tx.SignTxIn(uxto, SK[0], tt.hashType); err != nil {
+				t.Fatalf("%s: failed to sign: %s", tt.hashType, err)
+			}
+			if err := tx.VerifyTxIn(uxto, 1); err != nil {
+				t.Fatalf("%s: failed to verify: %s", tt.hashType, err)
+			}
+
+			c.change(tx)
+			if err := tx.VerifyTxIn(uxto, 1); (err == nil) != tt.valid[i] {
+				t.Errorf("%s, %s: error = %v; want valid = %v", tt.hashType, c.name, err, tt.valid[i])
+			}
+		}
+	}
+}
+
+func TestTransaction_SigHashSingleWithoutOutput(t *testing.T) {
+	PopulateTestData()
+
+	second := USET.First(TXID[1])
+	tx := NewTransactionBuilder().
+		AddInputFrom(USET.First(TXID[0])).
+		AddInputFrom(second).
+		AddOutput(190, ADDR[1]).
+		Build()
+
+	if err := tx.SignTxIn(second, SK[0], SIGHASH_SINGLE); err == nil {
+		t.Fatalf("signed an input without a matching output with SIGHASH_SINGLE")
+	}
+	if err := tx.SignTxIn(second, SK[0], SIGHASH_ALL); err != nil {
+		t.Fatalf("failed to sign: %s", err)
+	}
+
+	// the hash type is the last byte of the signature, right before the public key
+	sig := tx.Ins[1].Script
+	for _, hashType := range []byte{byte(SIGHASH_SINGLE), 0x00, 0x04, 0x7f} {
+		sig[len(sig)-S_SECP256K1_PUBKEY-2] = hashType
+		if err := tx.VerifyTxIn(second, 1); err == nil {
+			t.Errorf("verified a signature with hash type 0x%02x", hashType)
+		}
+	}
+}
+
+func TestTransaction_SigHashActivation(t *testing.T) {
+	PopulateTestData()
+
+	defer func(p ConsensusParams) { Params = p }(Params)
+	Params.SighashHeight = 10
+
+	uxto := USET.First(TXID[0])
+	tx := NewTransactionBuilder().
+		AddInputFrom(uxto).
+		AddOutput(90, ADDR[1]).
+		Build()
+
+	legacySig, _ := SK[0].Sign(tx.legacySigningDigest(uxto))
+	tx.Ins[0].Script = NewP2PKHScriptSig(legacySig, PK[0])
+	if err := tx.VerifyTxIn(uxto, 9); err != nil {
+		t.Fatalf("failed to verify a legacy signature below activation height: %s", err)
+	}
+	if err := tx.VerifyTxIn(uxto, 10); err == nil {
+		t.Fatalf("legacy signature accepted at activation height")
+	}
+
+	_ = tx.SignTxIn(uxto, SK[0], SIGHASH_ALL)
+	if err := tx.VerifyTxIn(uxto, 9); err == nil {
+		t.Fatalf("signature with a hash type accepted below activation height")
+	}
+	if err := tx.VerifyTxIn(uxto, 10); err != nil {
+		t.Fatalf("failed to verify at activation height: %s", err)
+	}
+}
+
+func TestParseSigHashType(t *testing.T) {
+	for _, hashType := range []SigHashType{SIGHASH_ALL, SIGHASH_NONE, SIGHASH_SINGLE, SIGHASH_SINGLE | SIGHASH_ANYONECANPAY} {
+		if parsed, err := ParseSigHashType(hashType.String()); err != nil || parsed != hashType {
+			t.Errorf("round trip of %s: got %s, %v", hashType, parsed, err)
+		}
+	}
+
+	for _, s := range []string{"", "ANYONECANPAY", "ALL|NONE", "SOME"} {
+		if _, err := ParseSigHashType(s); err == nil {
+			t.Errorf("parsed %q", s)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package core
+
+import "math"
+
+// Subsidy returns the coins a coinbase at height may create on top of the fees of its block.
+// It starts at InitialSubsidy and halves every HalvingInterval blocks until it reaches zero.
+func (p *ConsensusParams) Subsidy(height uint32) Amount {
+	if p.HalvingInterval == 0 {
+		return p.InitialSubsidy
+	}
+
+	halvings := height / p.HalvingInterval
+	if halvings >= 63 {
+		return 0
+	}
+
+	return p.InitialSubsidy >> halvings
+}
+
+// MaxIssuedCoins returns the sum of the subsidies of every height up to and including height: the most coins a chain
+// of that height can have issued, as a coinbase may claim less than the subsidy.
+func (p *ConsensusParams) MaxIssuedCoins(height uint32) Amount {
+	blocks := uint64(height) + 1
+	if p.HalvingInterval == 0 {
+		return p.InitialSubsidy * Amount(blocks)
+	}
+
+	var issued Amount
+	for halvings := 0; blocks > 0 && halvings < 63; halvings++ {
+		inEra := uint64(p.HalvingInterval)
+		if blocks < inEra {
+			inEra = blocks
+		}
+		issued += (p.InitialSubsidy >> halvings) * Amount(inEra)
+		blocks -= inEra
+	}
+
+	return issued
+}
+
+// SupplyCap returns the coins issued once every height has been mined, which no chain can exceed.
+func (p *ConsensusParams) SupplyCap() Amount {
+	return p.MaxIssuedCoins(math.MaxUint32)
+}
+
+// Subsidy returns the subsidy at height under Params.
+func Subsidy(height uint32) Amount {
+	return Params.Subsidy(height)
+}
@@ -0,0 +1,67 @@
+package core
+
+import (
+	"testing"
+)
+
+func TestConsensusParams_Subsidy(t *testing.T) {
+	p := ConsensusParams{InitialSubsidy: 1000, HalvingInterval: 10}
+
+	tests := []struct {
+		height  uint32
+		subsidy Amount
+		issued  Amount
+	}{
+		{0, 1000, 1000},
+		{9, 1000, 10000},
+		{10, 500, 10500},
+		{19, 500, 15000},
+		{20, 250, 15250},
+		{99, 1, 19940},
+		{100, 0, 19940},
+	}
+
+	for _, tt := range tests {
+		if subsidy := p.Subsidy(tt.height); subsidy != tt.subsidy {
+			t.Errorf("subsidy at %d = %d; want %d", tt.height, subsidy, tt.subsidy)
+		}
+		if issued := p.MaxIssuedCoins(tt.height); issued != tt.issued {
+			t.Errorf("issued coins at %d = %d; want %d", tt.height, issued, tt.issued)
+		}
+	}
+	if supplyCap := p.SupplyCap(); supplyCap != 19940 {
+		t.Errorf("supply cap = %d; want 19940", supplyCap)
+	}
+
+	p.HalvingInterval = 0
+	if subsidy, issued := p.Subsidy(1_000_000), p.MaxIssuedCoins(9); subsidy != 1000 || issued != 10000 {
+		t.Errorf("flat schedule: subsidy = %d, issued = %d", subsidy, issued)
+	}
+
+	if supplyCap := DefaultConsensusParams.SupplyCap(); !supplyCap.Valid() {
+		t.Errorf("default supply cap %d exceeds MAX_MONEY", supplyCap)
+	}
+}
+
+func TestBlock_VerifySubsidy(t *testing.T) {
+	PopulateTestData()
+
+	defer func(p ConsensusParams) { Params = p }(Params)
+	Params.HalvingInterval = 10
+
+	for _, tt := range []struct {
+		height uint32
+		valid  bool
+	}{{9, true}, {10, false}} {
+		coinbase := NewCoinBaseTransaction([]byte("coinbase"), ADDR[5], 1000, 0)
+		b := NewBlockBuilder().
+			BaseOn(Hash256{}, tt.height-1).
+			SetNBits(EASY_BITS).
+			AddTransaction(coinbase).
+			Build()
+
+		if err := b.Verify(USET, nil, EASY_BITS, 1000); (err == nil) != tt.valid {
+			t.Errorf("coinbase of 1000 at height %d: error = %v; want valid = %v", tt.height, err, tt.valid)
+		}
+	}
+}
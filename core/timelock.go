@@ -0,0 +1,169 @@
+package core
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Absolute and relative timelocks, following BIP65, BIP68, BIP112 and BIP113.
+//
+// A transaction whose LockTime is not 0 cannot be included before that height or, from LOCKTIME_THRESHOLD on,
+// that time, unless all its inputs are final. An input whose sequence has SEQUENCE_LOCKTIME_DISABLE_FLAG unset
+// cannot be included until its UXTO is a number of blocks or 512-second units old. Times are compared with the
+// median time past of the previous blocks rather than the block time, which miners can move.
+//
+// Transactions carry no version to opt in to relative locks, as BIP68 requires: the lock time and sequences were
+// added with encoding format 5, and inputs decoded from earlier formats get SEQUENCE_FINAL, which disables them. So
+// transactions from before timelocks existed are never held back, and their txids do not change, see
+// timelocksSerialized.
+
+const (
+	SEQUENCE_FINAL        uint32 = 0xffff_ffff
+	MAX_SEQUENCE_NONFINAL uint32 = SEQUENCE_FINAL - 1
+
+	SEQUENCE_LOCKTIME_DISABLE_FLAG uint32 = 1 << 31
+	SEQUENCE_LOCKTIME_TYPE_FLAG    uint32 = 1 << 22 // set for a time, unset for a number of blocks
+	SEQUENCE_LOCKTIME_MASK         uint32 = 0x0000_ffff
+	SEQUENCE_LOCKTIME_GRANULARITY         = 9 // time locks count units of 1 << 9 seconds
+
+	LOCKTIME_THRESHOLD uint32 = 500_000_000 // lock times below are heights, above are unix times
+	MEDIAN_TIME_SPAN          = 11
+)
+
+// ChainContext looks up the chain a block or transaction is validated against.
+type ChainContext interface {
+	// MedianTimePast returns the median time of the block at height and the MEDIAN_TIME_SPAN-1 blocks before it.
+	MedianTimePast(height uint32) (int64, error)
+}
+
+// MedianTime returns the median of the given block times.
+func MedianTime(times []int64) int64 {
+	if len(times) == 0 {
+		return 0
+	}
+
+	sorted := append([]int64{}, times...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	return sorted[len(sorted)/2]
+}
+
+// RelativeLockBlocks is the sequence of an input that is final once its UXTO is n blocks deep.
+func RelativeLockBlocks(n uint16) uint32 {
+	return uint32(n)
+}
+
+// RelativeLockTime is the sequence of an input that is final once its UXTO is seconds old, rounded up to 512 seconds.
+func RelativeLockTime(seconds uint32) uint32 {
+	units := (seconds + 1<<SEQUENCE_LOCKTIME_GRANULARITY - 1) >> SEQUENCE_LOCKTIME_GRANULARITY
+	if units > SEQUENCE_LOCKTIME_MASK {
+		units = SEQUENCE_LOCKTIME_MASK
+	}
+
+	return SEQUENCE_LOCKTIME_TYPE_FLAG | units
+}
+
+// IsFinal reports whether the lock time of tx has passed in a block at height with the given median time past.
+func (tx *Transaction) IsFinal(height uint32, mtp int64) bool {
+	if tx.LockTime == 0 {
+		return true
+	}
+
+	if tx.LockTime < LOCKTIME_THRESHOLD {
+		if tx.LockTime < height {
+			return true
+		}
+	} else if int64(tx.LockTime) < mtp {
+		return true
+	}
+
+	for _, txIn := range tx.Ins {
+		if txIn.Sequence != SEQUENCE_FINAL {
+			return false
+		}
+	}
+
+	return true
+}
+
+// CheckLocks fails unless tx can be included in a block at height: its lock time and the relative locks of its
+// inputs must have passed. chain is only asked for median times if a lock needs them.
+func (tx *Transaction) CheckLocks(uSet UXTOSet, height uint32, chain ChainContext) error {
+	// the median time past of the block before the one at height
+	mtpBefore := func(height uint32) (int64, error) {
+		if height == 0 {
+			return 0, nil
+		}
+		if chain == nil {
+			return 0, fmt.Errorf("no chain to look up median time past")
+		}
+		return chain.MedianTimePast(height - 1)
+	}
+
+	var mtp int64
+	if tx.LockTime >= LOCKTIME_THRESHOLD {
+		var err error
+		if mtp, err = mtpBefore(height); err != nil {
+			return err
+		}
+	}
+	if !tx.IsFinal(height, mtp) {
+		return fmt.Errorf("transaction is locked until %d", tx.LockTime)
+	}
+
+	if tx.IsCoinbaseTx() {
+		return nil
+	}
+
+	for i, txIn := range tx.Ins {
+		if txIn.Sequence&SEQUENCE_LOCKTIME_DISABLE_FLAG != 0 {
+			continue
+		}
+
+		uxto := uSet.GetUXTO(txIn.PrevTxId, txIn.N)
+		if uxto == nil {
+			return fmt.Errorf("transaction input not found in UXTO set")
+		}
+		lock := int64(txIn.Sequence & SEQUENCE_LOCKTIME_MASK)
+
+		if txIn.Sequence&SEQUENCE_LOCKTIME_TYPE_FLAG == 0 {
+			if int64(uxto.Height)+lock-1 >= int64(height) {
+				return fmt.Errorf("input %d is locked until height %d", i, int64(uxto.Height)+lock)
+			}
+			continue
+		}
+
+		coinTime, err := mtpBefore(uxto.Height)
+		if err != nil {
+			return err
+		}
+		blockTime, err := mtpBefore(height)
+		if err != nil {
+			return err
+		}
+		if minTime := coinTime + lock<<SEQUENCE_LOCKTIME_GRANULARITY - 1; minTime >= blockTime {
+			return fmt.Errorf("input %d is locked until time %d", i, minTime+1)
+		}
+	}
+
+	return nil
+}
+
+// timelocksSerialized is how the lock time and sequences enter txids and signing digests.
+// It is empty for transactions without timelocks, so that their txids stay as they were before these fields existed.
+func (tx *Transaction) timelocksSerialized() []byte {
+	timelocked := tx.LockTime != 0
+	for _, txIn := range tx.Ins {
+		timelocked = timelocked || txIn.Sequence != SEQUENCE_FINAL
+	}
+	if !timelocked {
+		return nil
+	}
+
+	data := UintToBytes(tx.LockTime)
+	for _, txIn := range tx.Ins {
+		data = append(data, UintToBytes(txIn.Sequence)...)
+	}
+
+	return data
+}
@@ -0,0 +1,164 @@
+package core
+
+import (
+	"testing"
+)
+
+// testChain has a block every 10 minutes, so the median time past of a height is height * 600.
+type testChain struct{}
+
+func (testChain) MedianTimePast(height uint32) (int64, error) {
+	return int64(height) * 600, nil
+}
+
+func TestTransaction_IsFinal(t *testing.T) {
+	tx := &Transaction{Ins: []*TxIn{{Sequence: MAX_SEQUENCE_NONFINAL}}}
+
+	tests := []struct {
+		lockTime uint32
+		height   uint32
+		mtp      int64
+		final    bool
+	}{
+		{0, 0, 0, true},
+		{100, 100, 0, false},
+		{100, 101, 0, true},
+		{LOCKTIME_THRESHOLD + 1000, 1 << 30, int64(LOCKTIME_THRESHOLD) + 1000, false},
+		{LOCKTIME_THRESHOLD + 1000, 0, int64(LOCKTIME_THRESHOLD) + 1001, true},
+	}
+
+	for _, tt := range tests {
+		tx.LockTime = tt.lockTime
+		if final := tx.IsFinal(tt.height, tt.mtp); final != tt.final {
+			t.Errorf("lock time %d at height %d and time %d: final = %v; want %v", tt.lockTime, tt.height, tt.mtp, final, tt.final)
+		}
+	}
+
+	// final inputs disable the lock time
+	tx.LockTime = 100
+	tx.Ins[0].Sequence = SEQUENCE_FINAL
+	if !tx.IsFinal(1, 0) {
+		t.Errorf("lock time applied to a transaction with final inputs")
+	}
+}
+
+func TestTransaction_CheckLocks(t *testing.T) {
+	PopulateTestData()
+
+	uxto := USET.First(TXID[0])
+	uxto.Height = 50
+
+	tests := []struct {
+		name     string
+		lockTime uint32
+		sequence uint32
+		height   uint32
+		valid    bool
+	}{
+		{"no locks", 0, SEQUENCE_FINAL, 51, true},
+		{"lock height not reached", 60, MAX_SEQUENCE_NONFINAL, 60, false},
+		{"lock height reached", 60, MAX_SEQUENCE_NONFINAL, 61, true},
+		{"relative blocks not reached", 0, RelativeLockBlocks(10), 59, false},
+		{"relative blocks reached", 0, RelativeLockBlocks(10), 60, true},
+		{"relative lock disabled", 0, SEQUENCE_LOCKTIME_DISABLE_FLAG | 10, 51, true},
+		// the UXTO's time is the median time past of height 49: 29400; each height adds 600 seconds
+		{"relative time not reached", 0, RelativeLockTime(3072), 55, false},
+		{"relative time reached", 0, RelativeLockTime(3072), 56, true},
+	}
+
+	for _, tt := range tests {
+		tx := NewTransactionBuilder().
+			AddInputFrom(uxto).
+			AddOutput(90, ADDR[1]).
+			SetSequence(uxto, tt.sequence)
+		if tt.lockTime != 0 {
+			tx.SetLockTime(tt.lockTime)
+		}
+
+		if err := tx.Sign(SK[0]).CheckLocks(USET, tt.height, testChain{}); (err == nil) != tt.valid {
+			t.Errorf("%s: error = %v; want valid = %v", tt.name, err, tt.valid)
+		}
+	}
+}
+
+func TestTransactionBuilder_Timelocks(t *testing.T) {
+	PopulateTestData()
+
+	txb := NewTransactionBuilder().AddInputFrom(USET.First(TXID[0]))
+	plain := txb.Build().Hash()
+
+	txb.SetLockTime(100).AddInputFrom(USET.First(TXID[1]))
+	for i, txIn := range txb.Ins {
+		if txIn.Sequence != MAX_SEQUENCE_NONFINAL {
+			t.Fatalf("input %d has sequence %X after setting a lock time", i, txIn.Sequence)
+		}
+	}
+	if txb.Build().Hash() == plain {
+		t.Fatalf("txid does not commit to the lock time")
+	}
+
+	// signatures commit to sequences
+	tx := NewTransactionBuilder().
+		AddInputFrom(USET.First(TXID[0])).
+		AddOutput(90, ADDR[1]).
+		SetSequence(USET.First(TXID[0]), RelativeLockBlocks(10)).
+		Sign(SK[0])
+	tx.Ins[0].Sequence = RelativeLockBlocks(1)
+	if err := tx.Verify(USET, 1); err == nil {
+		t.Fatalf("verified a signature after its sequence changed")
+	}
+}
+
+func TestEngine_CheckSequence(t *testing.T) {
+	sk, _ := GenerateSecp256k1Key()
+	script := NewScriptBuilder().
+		AddInt(10).AddOp(OP_CHECKSEQUENCEVERIFY).AddOp(OP_DROP).
+		AddData(sk.PublicKey().Bytes()).AddOp(OP_CHECKSIG).
+		Script()
+
+	tests := []struct {
+		name     string
+		sequence uint32
+		valid    bool
+	}{
+		{"equal lock", RelativeLockBlocks(10), true},
+		{"longer lock", RelativeLockBlocks(11), true},
+		{"shorter lock", RelativeLockBlocks(9), false},
+		{"time lock", RelativeLockTime(10 << SEQUENCE_LOCKTIME_GRANULARITY), false},
+		{"final input", SEQUENCE_FINAL, false},
+	}
+
+	for _, tt := range tests {
+		tx, uxto, sign := spendScript(script)
+		tx.Ins[0].Sequence = tt.sequence
+		tx.Ins[0].Script = NewScriptBuilder().AddData(sign(sk)).Script()
+
+		if err := tx.VerifyTxIn(uxto, 1); (err == nil) != tt.valid {
+			t.Errorf("%s: error = %v; want valid = %v", tt.name, err, tt.valid)
+		}
+	}
+}
+
+func TestBlock_VerifyLocks(t *testing.T) {
+	PopulateTestData()
+
+	coinbase := NewCoinBaseTransaction([]byte("coinbase"), ADDR[5], 100, 0)
+	tx := NewTransactionBuilder().
+		AddInputFrom(USET.First(TXID[0])).
+		AddOutput(90, ADDR[1]).
+		SetLockTime(10).
+		Sign(SK[0])
+
+	for _, height := range []uint32{10, 11} {
+		b := NewBlockBuilder().
+			BaseOn(Hash256{}, height-1).
+			SetNBits(EASY_BITS).
+			AddTransaction(coinbase).
+			AddTransaction(tx).
+			Build()
+
+		if err := b.Verify(USET, testChain{}, EASY_BITS, 1000); (err == nil) != (height > 10) {
+			t.Errorf("block at height %d: error = %v", height, err)
+		}
+	}
+}
@@ -1,24 +1,38 @@
 package core
 
 import (
-	"crypto"
-	"crypto/rand"
-	"crypto/rsa"
+	"bytes"
 	"fmt"
 	"github.com/cbergoon/merkletree"
+	log "github.com/sirupsen/logrus"
 )
 
 type ScriptPubKey struct {
-	PubKeyHash Hash160
+	Script Script
 }
 
-func (spk *ScriptPubKey) IsGeneratedFrom(pk *rsa.PublicKey) bool {
-	return spk.PubKeyHash == HashPubKey(pk)
+func NewP2PKHScriptPubKey(addr Hash160) ScriptPubKey {
+	return ScriptPubKey{Script: NewP2PKHScript(addr)}
+}
+
+func (spk *ScriptPubKey) IsGeneratedFrom(pk PublicKey) bool {
+	addr, ok := spk.Script.P2PKHAddress()
+	return ok && addr == HashPubKey(pk)
+}
+
+// serialized is how the script enters transaction ids and signing digests.
+// P2PKH scripts keep the bare 20-byte address they had before outputs carried scripts, so that existing
+// transaction ids do not change.
+func (spk *ScriptPubKey) serialized() []byte {
+	if addr, ok := spk.Script.P2PKHAddress(); ok {
+		return addr[:]
+	}
+
+	return append(UintToBytes(uint32(len(spk.Script))), spk.Script...)
 }
 
 type ScriptSig struct {
-	PK        *rsa.PublicKey
-	Signature []byte
+	Script Script
 }
 
 type TxIn struct {
@@ -26,32 +40,80 @@ type TxIn struct {
 	N        uint32 // output index
 	ScriptSig
 	Coinbase []byte
+	Sequence uint32 // relative lock, see SEQUENCE_FINAL
 }
 
+// SpentBy returns the address of the key in a P2PKH ScriptSig, or an empty address for other scripts.
 func (txIn *TxIn) SpentBy() Hash160 {
-	return HashPubKey(txIn.PK)
+	ins, err := txIn.ScriptSig.Script.parse()
+	if err != nil || len(ins) != 2 {
+		return Hash160{}
+	}
+
+	return HashTo160(ins[1].data)
 }
 
 type TxOut struct {
-	Value uint32 // number of coins
+	Value Amount // number of coins
 	ScriptPubKey
 }
 
+// Data returns the payload of a data output, see NewDataScript.
+func (txOut *TxOut) Data() ([]byte, bool) {
+	return txOut.Script.DataPayload()
+}
+
+// verifyData checks that an unspendable output is a data output carrying no coins, which could never be spent.
+func (txOut *TxOut) verifyData() error {
+	data, ok := txOut.Data()
+	if !ok {
+		return fmt.Errorf("malformed data output")
+	}
+	if len(data) > MAX_DATA_CARRIER_SIZE {
+		return fmt.Errorf("data of %d bytes exceeds %d", len(data), MAX_DATA_CARRIER_SIZE)
+	}
+	if txOut.Value != 0 {
+		return fmt.Errorf("data output carries %d coins", txOut.Value)
+	}
+
+	return nil
+}
+
+// AddressedTo returns the key hash paid by a P2PKH output or the script hash paid by a P2SH output,
+// or an empty hash for other scripts.
 func (txOut *TxOut) AddressedTo() Hash160 {
-	return txOut.PubKeyHash
+	if addr, ok := txOut.Script.P2PKHAddress(); ok {
+		return addr
+	}
+
+	h, _ := txOut.Script.P2SHHash()
+	return h
 }
 
 // CanBeSpentBy checks whether the given pubKey is entitled to this output
-func (txOut *TxOut) CanBeSpentBy(pk *rsa.PublicKey) bool {
+func (txOut *TxOut) CanBeSpentBy(pk PublicKey) bool {
 	return txOut.ScriptPubKey.IsGeneratedFrom(pk)
 }
 
 type UXTO struct {
-	TxId Hash256
-	N    uint32
+	TxId     Hash256
+	N        uint32
+	Height   uint32 // height of the block that created the output
+	Coinbase bool   // whether the output was created by a coinbase transaction
 	*TxOut
 }
 
+// MatureAt reports whether uxto can be spent in a block at height. From Params.MaturityHeight on, coinbase
+// outputs must be Params.CoinbaseMaturity blocks deep, so that a short reorganization, which drops the coinbase,
+// cannot invalidate the transactions spending it.
+func (u *UXTO) MatureAt(height uint32) bool {
+	if !u.Coinbase || height < Params.MaturityHeight {
+		return true
+	}
+
+	return height >= u.Height && height-u.Height >= Params.CoinbaseMaturity
+}
+
 type UXTOSet interface {
 	GetUXTO(txId Hash256, n uint32) *UXTO
 }
@@ -101,8 +163,9 @@ func (uSet *InMemUXTOSet) GetUXTO(txId Hash256, n uint32) *UXTO {
 }
 
 type Transaction struct {
-	Ins  []*TxIn
-	Outs []*TxOut
+	Ins      []*TxIn
+	Outs     []*TxOut
+	LockTime uint32 // height or time before which the transaction cannot be included, see LOCKTIME_THRESHOLD
 }
 
 func (tx *Transaction) Hash() Hash256 {
@@ -122,9 +185,10 @@ func (tx *Transaction) Serialized() []byte {
 	}
 
 	for _, txOut := range tx.Outs {
-		data = append(data, txOut.PubKeyHash[:]...)
-		data = append(data, UintToBytes(txOut.Value)[:]...)
+		data = append(data, txOut.ScriptPubKey.serialized()...)
+		data = append(data, amountBytes(txOut.Value)...)
 	}
+	data = append(data, tx.timelocksSerialized()...)
 
 	return data
 }
@@ -139,10 +203,11 @@ func (tx *Transaction) InputOf(prevTxId Hash256, n uint32) *TxIn {
 	return nil
 }
 
-func (tx *Transaction) generateSigningDigest(uxto *UXTO) []byte {
+// legacySigningDigest is what signatures commit to below Params.SighashHeight: every input and output.
+func (tx *Transaction) legacySigningDigest(uxto *UXTO) []byte {
 	var data []byte
 
-	subScript := uxto.PubKeyHash
+	subScript := uxto.ScriptPubKey.serialized()
 
 	for _, txIn := range tx.Ins {
 		data = append(data, txIn.PrevTxId[:]...)
@@ -154,40 +219,62 @@ func (tx *Transaction) generateSigningDigest(uxto *UXTO) []byte {
 	}
 
 	for _, txOut := range tx.Outs {
-		data = append(data, txOut.PubKeyHash[:]...)
-		data = append(data, UintToBytes(txOut.Value)[:]...)
+		data = append(data, txOut.ScriptPubKey.serialized()...)
+		data = append(data, amountBytes(txOut.Value)...)
 	}
+	data = append(data, tx.timelocksSerialized()...)
 
 	digest := DoubleHashTo256(data)
 
 	return digest[:]
 }
 
-func (tx *Transaction) SignTxIn(uxto *UXTO, sk *rsa.PrivateKey) error {
-	digest := tx.generateSigningDigest(uxto)
+// SignTxIn signs the input spending uxto with sk, committing to the parts of tx selected by hashType.
+// Only P2PKH outputs can be signed this way.
+func (tx *Transaction) SignTxIn(uxto *UXTO, sk PrivateKey, hashType SigHashType) error {
+	if _, ok := uxto.Script.P2PKHAddress(); !ok {
+		return fmt.Errorf("uxto is not locked by a P2PKH script")
+	}
 
-	if sig, err := sk.Sign(rand.Reader, digest[:], crypto.SHA256); err != nil {
+	txIn := tx.InputOf(uxto.TxId, uxto.N)
+	if txIn == nil {
+		return fmt.Errorf("no txIn matches the given uxto")
+	}
+
+	sig, err := tx.signatureOf(uxto, sk, hashType)
+	if err != nil {
 		return err
-	} else {
-		if txIn := tx.InputOf(uxto.TxId, uxto.N); txIn != nil {
-			txIn.Signature = sig
-			return nil
-		} else { // no input matched
-			return fmt.Errorf("no txIn matches the given uxto")
-		}
 	}
+	txIn.ScriptSig.Script = NewP2PKHScriptSig(sig, sk.PublicKey())
+
+	return nil
 }
 
-func (tx *Transaction) VerifyTxIn(uxto *UXTO, pk *rsa.PublicKey) error { // this is equivalent to running Script in Bitcoin
-	digest := tx.generateSigningDigest(uxto)
+// signatureOf signs the input spending uxto with sk and appends hashType, as the signature is pushed after the
+// key type.
+func (tx *Transaction) signatureOf(uxto *UXTO, sk PrivateKey, hashType SigHashType) ([]byte, error) {
+	digest, err := tx.SignatureHash(uxto, hashType)
+	if err != nil {
+		return nil, err
+	}
 
-	if txIn := tx.InputOf(uxto.TxId, uxto.N); txIn != nil {
-		if !uxto.CanBeSpentBy(pk) {
-			return fmt.Errorf("uxto cannot be spent")
-		}
+	sig, err := sk.Sign(digest)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(sig, byte(hashType)), nil
+}
+
+// VerifyTxIn runs the scripts of the input spending uxto, as if tx were included in a block at height.
+func (tx *Transaction) VerifyTxIn(uxto *UXTO, height uint32) error {
+	return tx.verifyTxIn(uxto, height, nil)
+}
 
-		if err := rsa.VerifyPKCS1v15(pk, crypto.SHA256, digest, txIn.Signature); err != nil {
-			return fmt.Errorf("cannot verify signature: %w", err)
+func (tx *Transaction) verifyTxIn(uxto *UXTO, height uint32, batch *SchnorrBatch) error {
+	if txIn := tx.InputOf(uxto.TxId, uxto.N); txIn != nil {
+		if err := NewEngine(tx, uxto, height, batch).Execute(txIn.ScriptSig.Script, uxto.Script); err != nil {
+			return fmt.Errorf("script failed: %w", err)
 		}
 
 		return nil
@@ -196,8 +283,13 @@ func (tx *Transaction) VerifyTxIn(uxto *UXTO, pk *rsa.PublicKey) error { // this
 	}
 }
 
-func (tx *Transaction) Verify(uSet UXTOSet) error {
-	var inValue uint32
+// Verify checks the transaction against uSet as if it were included in a block at the given height.
+func (tx *Transaction) Verify(uSet UXTOSet, height uint32) error {
+	return tx.verify(uSet, height, nil)
+}
+
+func (tx *Transaction) verify(uSet UXTOSet, height uint32, batch *SchnorrBatch) error {
+	var inValue Amount
 
 	// size
 	if len(tx.Ins) == 0 {
@@ -208,82 +300,93 @@ func (tx *Transaction) Verify(uSet UXTOSet) error {
 		return fmt.Errorf("transaction contains 0 output")
 	}
 
-	// sender
-	if !tx.IsCoinbaseTx() {
-		sender := tx.Ins[0].SpentBy()
-		for _, txIn := range tx.Ins {
-			if txIn.SpentBy() != sender {
-				return fmt.Errorf("transaction has multiple senders")
-			}
+	outValue, err := tx.CalculateOutValue()
+	if err != nil {
+		return err
+	}
+
+	for i, txOut := range tx.Outs {
+		if !txOut.Script.IsUnspendable() {
+			continue
 		}
-	} else {
-		if len(tx.Ins) != 1 {
-			return fmt.Errorf("coinbase transaction has more than 1 input")
+		if err := txOut.verifyData(); err != nil {
+			return fmt.Errorf("invalid output %d: %w", i, err)
 		}
 	}
 
-	// skip for coinbase tx
-	if !tx.IsCoinbaseTx() { // in a coinbase tx, input value is essentially zero
-		for _, txIn := range tx.Ins {
-			if uxto := uSet.GetUXTO(txIn.PrevTxId, txIn.N); uxto == nil { // no double-spend
-				return fmt.Errorf("transaction input not found in UXTO set")
-			} else {
-				// "running Script"
-				if err := tx.VerifyTxIn(uxto, txIn.PK); err != nil {
-					return fmt.Errorf("txIn verification failed: %w", err)
-				}
+	if tx.IsCoinbaseTx() {
+		// in a coinbase tx, input value is essentially zero
+		return nil
+	}
 
-				// accumulate inValue
-				inValue += uxto.Value
+	// each input is authorized by its own scripts; inputs may belong to different payers
+	for _, txIn := range tx.Ins {
+		if uxto := uSet.GetUXTO(txIn.PrevTxId, txIn.N); uxto == nil { // no double-spend
+			return fmt.Errorf("transaction input not found in UXTO set")
+		} else {
+			if !uxto.MatureAt(height) {
+				return fmt.Errorf("coinbase output %s:%d is immature until height %d", uxto.TxId, uxto.N, uint64(uxto.Height)+uint64(Params.CoinbaseMaturity))
+			}
+
+			if err := tx.verifyTxIn(uxto, height, batch); err != nil {
+				return fmt.Errorf("txIn verification failed: %w", err)
 			}
-		}
 
-		// balance
-		if outValue, overflow := tx.CalculateOutValue(); inValue < outValue || overflow {
-			return fmt.Errorf("out-value is bigger than in-value")
+			// accumulate inValue
+			if inValue, err = AddAmounts(inValue, uxto.Value); err != nil {
+				return fmt.Errorf("invalid in-value: %w", err)
+			}
 		}
 	}
 
-	return nil
-}
-
-// From returns the address of the transaction payer.
-// There is no a "To()" counterpart as a transaction can be sent to multiple addresses (e.g., change).
-func (tx *Transaction) From() Hash160 {
-	if tx.IsCoinbaseTx() {
-		return Hash160{}
+	// balance
+	if inValue < outValue {
+		return fmt.Errorf("out-value is bigger than in-value")
 	}
 
-	return tx.Ins[0].SpentBy()
+	return nil
 }
 
-func (tx *Transaction) CalculateOutValue() (outValue uint32, overflow bool) {
-	for _, txOut := range tx.Outs {
-		// overflow check
-		twoSum := outValue + txOut.Value
-		overflow = twoSum < outValue || twoSum < txOut.Value
-		outValue = twoSum
+// CalculateOutValue sums up the outputs, failing if any of them or the sum is not a valid amount.
+func (tx *Transaction) CalculateOutValue() (Amount, error) {
+	var outValue Amount
+
+	for i, txOut := range tx.Outs {
+		var err error
+		if outValue, err = AddAmounts(outValue, txOut.Value); err != nil {
+			return 0, fmt.Errorf("invalid out-value at output %d: %w", i, err)
+		}
 	}
 
-	return outValue, overflow
+	return outValue, nil
 }
 
-func (tx *Transaction) CalculateFee(uset UXTOSet) uint32 {
+// CalculateFee returns what the inputs found in uset leave after the outputs.
+func (tx *Transaction) CalculateFee(uset UXTOSet) (Amount, error) {
 	if tx.IsCoinbaseTx() {
-		return 0
+		return 0, nil
 	}
 
-	var inValue uint32
+	var inValue Amount
 
 	for _, txIn := range tx.Ins {
-		if uxto := uset.GetUXTO(txIn.PrevTxId, txIn.N); uxto != nil {
-			inValue += uxto.Value
+		uxto := uset.GetUXTO(txIn.PrevTxId, txIn.N)
+		if uxto == nil {
+			return 0, fmt.Errorf("transaction input not found in UXTO set")
+		}
+
+		var err error
+		if inValue, err = AddAmounts(inValue, uxto.Value); err != nil {
+			return 0, fmt.Errorf("invalid in-value: %w", err)
 		}
 	}
 
-	outValue, _ := tx.CalculateOutValue()
+	outValue, err := tx.CalculateOutValue()
+	if err != nil {
+		return 0, err
+	}
 
-	return inValue - outValue
+	return SubAmounts(inValue, outValue)
 }
 
 func (tx *Transaction) IsCoinbaseTx() bool {
@@ -313,15 +416,22 @@ func (tx *Transaction) Equals(other merkletree.Content) (bool, error) {
 }
 
 type TransactionBuilder struct {
-	uxtos   map[Hash256][]*UXTO
-	inValue uint32
+	uxtos         map[Hash256][]*UXTO
+	redeemScripts map[Hash160]Script       // P2SH script hash -> redeem script
+	multiSigs     map[*TxIn]map[int][]byte // multisig input -> signatures collected so far, by key index
+	sequence      uint32                   // sequence of new inputs
+	inValue       Amount
+	err           error // first amount out of range, see Err
 	*Transaction
 }
 
 func NewTransactionBuilder() *TransactionBuilder {
 	return &TransactionBuilder{
-		uxtos:   make(map[Hash256][]*UXTO),
-		inValue: 0,
+		uxtos:         make(map[Hash256][]*UXTO),
+		redeemScripts: make(map[Hash160]Script),
+		multiSigs:     make(map[*TxIn]map[int][]byte),
+		sequence:      SEQUENCE_FINAL,
+		inValue:       0,
 		Transaction: &Transaction{
 			Ins:  nil,
 			Outs: nil,
@@ -329,41 +439,108 @@ func NewTransactionBuilder() *TransactionBuilder {
 	}
 }
 
-// AddInputFrom adds uxto to the tx input set
-func (txb *TransactionBuilder) AddInputFrom(uxto *UXTO, pk *rsa.PublicKey) *TransactionBuilder {
+// AddInputFrom adds uxto to the tx input set. Its ScriptSig is filled in by Sign.
+func (txb *TransactionBuilder) AddInputFrom(uxto *UXTO) *TransactionBuilder {
 	txIn := &TxIn{
-		PrevTxId: uxto.TxId,
-		N:        uxto.N,
-		ScriptSig: ScriptSig{
-			PK: pk,
-		},
-		Coinbase: nil,
+		PrevTxId:  uxto.TxId,
+		N:         uxto.N,
+		ScriptSig: ScriptSig{Script: Script{}},
+		Coinbase:  nil,
+		Sequence:  txb.sequence,
 	}
 
 	txb.Ins = append(txb.Ins, txIn)
-	txb.inValue += uxto.Value
 	txb.uxtos[uxto.TxId] = append(txb.uxtos[uxto.TxId], uxto)
+	if inValue, err := AddAmounts(txb.inValue, uxto.Value); err != nil {
+		txb.fail(fmt.Errorf("invalid input value %d: %w", uxto.Value, err))
+	} else {
+		txb.inValue = inValue
+	}
 	return txb
 }
 
-func (txb *TransactionBuilder) AddOutput(v uint32, pubKeyHash Hash160) *TransactionBuilder {
+// AddP2SHInputFrom adds a uxto locked by the P2SH script of redeemScript.
+func (txb *TransactionBuilder) AddP2SHInputFrom(uxto *UXTO, redeemScript Script) *TransactionBuilder {
+	txb.redeemScripts[HashTo160(redeemScript)] = redeemScript
+	return txb.AddInputFrom(uxto)
+}
+
+// AddOutput pays v to the P2PKH address pubKeyHash.
+func (txb *TransactionBuilder) AddOutput(v Amount, pubKeyHash Hash160) *TransactionBuilder {
+	return txb.AddScriptOutput(v, NewP2PKHScript(pubKeyHash))
+}
+
+// AddScriptOutput locks v with an arbitrary script.
+func (txb *TransactionBuilder) AddScriptOutput(v Amount, script Script) *TransactionBuilder {
 	txOut := &TxOut{
-		Value: v,
-		ScriptPubKey: ScriptPubKey{
-			PubKeyHash: pubKeyHash,
-		},
+		Value:        v,
+		ScriptPubKey: ScriptPubKey{Script: script},
 	}
 
 	txb.Outs = append(txb.Outs, txOut)
 	return txb
 }
 
-func (txb *TransactionBuilder) AddChange(txFee uint32) *TransactionBuilder {
-	currentOut, _ := txb.CalculateOutValue()
-	change := txb.inValue - currentOut - txFee
+// AddChange pays what is left of the inputs after the outputs so far and txFee to changeTo.
+// If the inputs do not cover the outputs and txFee, or an amount is out of range, Err reports it and no change is
+// added.
+func (txb *TransactionBuilder) AddChange(changeTo Script, txFee Amount) *TransactionBuilder {
+	if txb.err != nil {
+		return txb
+	}
+	spent, err := txb.CalculateOutValue()
+	if err == nil {
+		spent, err = AddAmounts(spent, txFee)
+	}
+	var change Amount
+	if err == nil {
+		change, err = SubAmounts(txb.inValue, spent)
+	}
+	if err != nil {
+		txb.fail(fmt.Errorf("invalid change: %w", err))
+		return txb
+	}
 
 	if change != 0 {
-		txb.AddOutput(change, txb.From())
+		txb.AddScriptOutput(change, changeTo)
+	}
+
+	return txb
+}
+
+// Err returns the first error of the amounts added to the builder, e.g. inputs whose sum is out of range or change
+// that would be negative.
+func (txb *TransactionBuilder) Err() error {
+	return txb.err
+}
+
+func (txb *TransactionBuilder) fail(err error) {
+	if txb.err == nil {
+		txb.err = err
+	}
+}
+
+// SetLockTime sets the height or time before which the transaction cannot be included.
+// A lock time only applies if some input is not final, so inputs at SEQUENCE_FINAL, including those added later,
+// are moved to MAX_SEQUENCE_NONFINAL.
+func (txb *TransactionBuilder) SetLockTime(lockTime uint32) *TransactionBuilder {
+	txb.LockTime = lockTime
+	txb.sequence = MAX_SEQUENCE_NONFINAL
+
+	for _, txIn := range txb.Ins {
+		if txIn.Sequence == SEQUENCE_FINAL {
+			txIn.Sequence = MAX_SEQUENCE_NONFINAL
+		}
+	}
+
+	return txb
+}
+
+// SetSequence sets the sequence of the input spending uxto, e.g. a relative lock made by
+// RelativeLockBlocks or RelativeLockTime.
+func (txb *TransactionBuilder) SetSequence(uxto *UXTO, sequence uint32) *TransactionBuilder {
+	if txIn := txb.InputOf(uxto.TxId, uxto.N); txIn != nil {
+		txIn.Sequence = sequence
 	}
 
 	return txb
@@ -373,28 +550,99 @@ func (txb *TransactionBuilder) Build() *Transaction {
 	return txb.Transaction
 }
 
-func (txb *TransactionBuilder) Sign(privKey *rsa.PrivateKey) *Transaction {
+// Sign signs every input privKey can sign for with SIGHASH_ALL.
+// Multisig inputs collect signatures over several calls, one per key, until enough keys have signed.
+func (txb *TransactionBuilder) Sign(privKey PrivateKey) *Transaction {
+	return txb.SignWith(privKey, SIGHASH_ALL)
+}
+
+// SignWith is Sign committing to the parts of the transaction selected by hashType.
+func (txb *TransactionBuilder) SignWith(privKey PrivateKey, hashType SigHashType) *Transaction {
 	for _, uxtos := range txb.uxtos {
 		for _, uxto := range uxtos {
-			txb.SignTxIn(uxto, privKey) // shouldn't err
+			if _, ok := uxto.Script.P2PKHAddress(); ok {
+				if !uxto.CanBeSpentBy(privKey.PublicKey()) {
+					continue
+				}
+				if err := txb.SignTxIn(uxto, privKey, hashType); err != nil {
+					log.Warnf("Cannot sign input %s:%d: %s", uxto.TxId, uxto.N, err)
+				}
+				continue
+			}
+
+			if err := txb.signMultiSig(uxto, privKey, hashType); err != nil {
+				log.Warnf("Cannot sign input %s:%d: %s", uxto.TxId, uxto.N, err)
+			}
 		}
 	}
 
 	return txb.Transaction
 }
 
-func NewCoinBaseTransaction(coinbase []byte, payTo Hash160, blockReward uint32, txFee uint32) *Transaction {
+// signMultiSig adds the signature of privKey to the input spending a bare or P2SH multisig uxto and rebuilds
+// its ScriptSig from the signatures collected so far, in the order of the keys.
+func (txb *TransactionBuilder) signMultiSig(uxto *UXTO, privKey PrivateKey, hashType SigHashType) error {
+	txIn := txb.InputOf(uxto.TxId, uxto.N)
+	if txIn == nil {
+		return fmt.Errorf("no txIn matches the given uxto")
+	}
+
+	script := uxto.Script
+	redeemScript, isP2SH := Script(nil), false
+	if h, ok := uxto.Script.P2SHHash(); ok {
+		if redeemScript, isP2SH = txb.redeemScripts[h]; !isP2SH {
+			return fmt.Errorf("unknown redeem script %X", h)
+		}
+		script = redeemScript
+	}
+
+	m, pks, ok := script.MultiSigKeys()
+	if !ok {
+		return fmt.Errorf("not a multisig script")
+	}
+
+	pk := privKey.PublicKey()
+	for k := range pks {
+		if !bytes.Equal(pks[k], pk.Bytes()) {
+			continue
+		}
+
+		sig, err := txb.signatureOf(uxto, privKey, hashType)
+		if err != nil {
+			return err
+		}
+		if txb.multiSigs[txIn] == nil {
+			txb.multiSigs[txIn] = make(map[int][]byte)
+		}
+		txb.multiSigs[txIn][k] = append([]byte{pk.Type()}, sig...)
+	}
+
+	sb := NewScriptBuilder()
+	for k, n := 0, 0; k < len(pks) && n < m; k++ {
+		if sig, ok := txb.multiSigs[txIn][k]; ok {
+			sb.AddData(sig)
+			n++
+		}
+	}
+	if isP2SH {
+		sb.AddData(redeemScript)
+	}
+	txIn.ScriptSig.Script = sb.Script()
+
+	return nil
+}
+
+func NewCoinBaseTransaction(coinbase []byte, payTo Hash160, blockReward Amount, txFee Amount) *Transaction {
 	txIn := &TxIn{
 		PrevTxId: Hash256{},
 		N:        0xcafebabe,
 		Coinbase: coinbase,
+		Sequence: SEQUENCE_FINAL,
 	}
 
 	txOut := &TxOut{
-		Value: blockReward + txFee,
-		ScriptPubKey: ScriptPubKey{
-			PubKeyHash: payTo,
-		},
+		Value:        blockReward + txFee,
+		ScriptPubKey: NewP2PKHScriptPubKey(payTo),
 	}
 
 	// no signature is required since there's no ScriptPubKey
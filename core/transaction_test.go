@@ -1,29 +1,28 @@
 package core
 
 import (
-	"crypto/rand"
-	"crypto/rsa"
+	"bytes"
 	"testing"
 )
 
-var SK []*rsa.PrivateKey
-var PK []*rsa.PublicKey
+var SK []PrivateKey
+var PK []PublicKey
 var ADDR []Hash160
 
 var TXID []Hash256
 var USET *InMemUXTOSet
 
 func PopulateTestData() {
-	SK = []*rsa.PrivateKey{}
-	PK = []*rsa.PublicKey{}
+	SK = []PrivateKey{}
+	PK = []PublicKey{}
 	ADDR = []Hash160{}
 	TXID = []Hash256{}
 	USET = NewUXTOSet()
 
 	// 10 accounts
 	for i := 0; i < 10; i++ {
-		sk, _ := rsa.GenerateKey(rand.Reader, 512)
-		pk := &sk.PublicKey
+		sk, _ := GenerateSecp256k1Key()
+		pk := sk.PublicKey()
 		addr := HashPubKey(pk)
 
 		SK = append(SK, sk)
@@ -41,13 +40,13 @@ func PopulateTestData() {
 	}
 }
 
-func NewUXTO(to Hash160, v uint32) *UXTO {
+func NewUXTO(to Hash160, v Amount) *UXTO {
 	return &UXTO{
 		TxId: RandomHash256(),
 		N:    0,
 		TxOut: &TxOut{
 			Value:        v,
-			ScriptPubKey: ScriptPubKey{to},
+			ScriptPubKey: NewP2PKHScriptPubKey(to),
 		},
 	}
 }
@@ -58,36 +57,33 @@ func TestTransaction_SignAndVerify(t *testing.T) {
 	tx := Transaction{
 		Ins: []*TxIn{
 			{
-				PrevTxId: TXID[0],
-				N:        0,
-				ScriptSig: ScriptSig{
-					PK:        PK[0],
-					Signature: nil,
-				},
-				Coinbase: nil,
+				PrevTxId:  TXID[0],
+				N:         0,
+				ScriptSig: ScriptSig{},
+				Coinbase:  nil,
 			},
 		},
 		Outs: []*TxOut{
 			{
 				Value:        USET.First(TXID[0]).Value,
-				ScriptPubKey: ScriptPubKey{PubKeyHash: ADDR[0]},
+				ScriptPubKey: NewP2PKHScriptPubKey(ADDR[0]),
 			},
 		},
 	}
 
-	if err := tx.SignTxIn(USET.First(TXID[0]), SK[0]); err != nil {
+	if err := tx.SignTxIn(USET.First(TXID[0]), SK[0], SIGHASH_ALL); err != nil {
 		t.Fatalf("failed to sign txIn: %s", err)
 	}
 
-	if err := tx.VerifyTxIn(USET.First(TXID[0]), PK[0]); err != nil {
+	if err := tx.VerifyTxIn(USET.First(TXID[0]), 1); err != nil {
 		t.Fatalf("failed to verify txIn: %s", err)
 	}
 
-	if err := tx.VerifyTxIn(USET.First(TXID[1]), PK[0]); err == nil {
+	if err := tx.VerifyTxIn(USET.First(TXID[1]), 1); err == nil {
 		t.Fatalf("expected verification error; got nil")
 	}
 
-	if err := tx.Verify(USET); err != nil {
+	if err := tx.Verify(USET, 1); err != nil {
 		t.Fatalf("failed to verify transaction: %s", err)
 	}
 }
@@ -98,14 +94,66 @@ func TestTransactionBuilder(t *testing.T) {
 	txb := NewTransactionBuilder()
 
 	tx := txb.
-		AddInputFrom(USET.First(TXID[0]), PK[0]).
+		AddInputFrom(USET.First(TXID[0])).
 		AddOutput(50, ADDR[2]).
-		AddChange(1).
+		AddChange(NewP2PKHScript(ADDR[0]), 1).
 		Sign(SK[0])
 
-	if err := tx.Verify(USET); err != nil {
+	if err := tx.Verify(USET, 1); err != nil {
 		t.Fatalf("failed to verify built transaction: %s", err)
 	}
+	if err := txb.Err(); err != nil {
+		t.Fatalf("builder failed: %s", err)
+	}
+
+	// change that would be negative is not added
+	txb = NewTransactionBuilder().
+		AddInputFrom(USET.First(TXID[0])).
+		AddOutput(100, ADDR[2]).
+		AddChange(NewP2PKHScript(ADDR[0]), 1)
+	if txb.Err() == nil || len(txb.Outs) != 1 {
+		t.Fatalf("added change to inputs that do not cover the outputs")
+	}
+
+	// inputs whose sum is out of range do not wrap into the change
+	huge := &UXTO{TxId: RandomHash256(), TxOut: &TxOut{Value: MAX_MONEY}}
+	txb = NewTransactionBuilder().
+		AddInputFrom(huge).
+		AddInputFrom(huge).
+		AddChange(NewP2PKHScript(ADDR[0]), 0)
+	if txb.Err() == nil || len(txb.Outs) != 0 {
+		t.Fatalf("added change from inputs out of range")
+	}
+}
+
+func TestTransactionBuilder_MultiplePayers(t *testing.T) {
+	PopulateTestData()
+
+	// three payers join one transaction, each taking back their own change
+	txb := NewTransactionBuilder().
+		AddInputFrom(USET.First(TXID[0])).
+		AddInputFrom(USET.First(TXID[2])).
+		AddInputFrom(USET.First(TXID[4])).
+		AddOutput(150, ADDR[9]).
+		AddOutput(50, ADDR[0]).
+		AddOutput(50, ADDR[1]).
+		AddChange(NewP2PKHScript(ADDR[2]), 10)
+
+	if n := len(txb.Outs); n != 4 || txb.Outs[3].Value != 40 {
+		t.Fatalf("expected a change output of 40")
+	}
+
+	// a transaction missing one payer's signature is rejected
+	txb.Sign(SK[0])
+	txb.Sign(SK[1])
+	if err := txb.Build().Verify(USET, 1); err == nil {
+		t.Fatalf("verified a transaction with an unsigned input")
+	}
+
+	txb.Sign(SK[2])
+	if err := txb.Build().Verify(USET, 1); err != nil {
+		t.Fatalf("failed to verify transaction with multiple payers: %s", err)
+	}
 }
 
 func TestNewCoinBaseTransaction(t *testing.T) {
@@ -117,7 +165,127 @@ func TestNewCoinBaseTransaction(t *testing.T) {
 		t.Fatalf("cb is not of type coinbase")
 	}
 
-	if err := cb.Verify(USET); err != nil {
+	if err := cb.Verify(USET, 1); err != nil {
 		t.Fatalf("cb is not verified: %s", err)
 	}
 }
+
+func TestTransactionBuilder_MultiSig(t *testing.T) {
+	PopulateTestData()
+
+	redeemScript, err := NewMultiSigScript(2, PK[:3])
+	if err != nil {
+		t.Fatal(err)
+	}
+	scriptHash := HashTo160(redeemScript)
+
+	tests := []struct {
+		name  string
+		uxto  *UXTO
+		p2sh  bool
+		keys  []PrivateKey
+		valid bool
+	}{
+		{"bare, keys 0 and 2", &UXTO{TxId: RandomHash256(), TxOut: &TxOut{Value: 100, ScriptPubKey: ScriptPubKey{Script: redeemScript}}}, false, []PrivateKey{SK[2], SK[0]}, true},
+		{"p2sh, keys 1 and 2", &UXTO{TxId: RandomHash256(), TxOut: &TxOut{Value: 100, ScriptPubKey: ScriptPubKey{Script: NewP2SHScript(scriptHash)}}}, true, []PrivateKey{SK[1], SK[2]}, true},
+		{"p2sh, all keys", &UXTO{TxId: RandomHash256(), TxOut: &TxOut{Value: 100, ScriptPubKey: ScriptPubKey{Script: NewP2SHScript(scriptHash)}}}, true, []PrivateKey{SK[0], SK[1], SK[2]}, true},
+		{"p2sh, one key", &UXTO{TxId: RandomHash256(), TxOut: &TxOut{Value: 100, ScriptPubKey: ScriptPubKey{Script: NewP2SHScript(scriptHash)}}}, true, []PrivateKey{SK[1]}, false},
+		{"p2sh, foreign keys", &UXTO{TxId: RandomHash256(), TxOut: &TxOut{Value: 100, ScriptPubKey: ScriptPubKey{Script: NewP2SHScript(scriptHash)}}}, true, []PrivateKey{SK[1], SK[5]}, false},
+	}
+
+	for _, tt := range tests {
+		USET.Add(tt.uxto)
+
+		txb := NewTransactionBuilder()
+		if tt.p2sh {
+			txb.AddP2SHInputFrom(tt.uxto, redeemScript)
+		} else {
+			txb.AddInputFrom(tt.uxto)
+		}
+		txb.AddOutput(90, ADDR[5])
+
+		// each key signs on its own, as if passed around between co-signers
+		for _, sk := range tt.keys {
+			txb.Sign(sk)
+		}
+
+		if err := txb.Build().Verify(USET, 1); (err == nil) != tt.valid {
+			t.Errorf("%s: error = %v; want valid = %v", tt.name, err, tt.valid)
+		}
+	}
+}
+
+func TestTransaction_DataOutputs(t *testing.T) {
+	PopulateTestData()
+
+	data := RandomHash256()
+	script, err := NewDataScript(data[:])
+	if err != nil {
+		t.Fatalf("failed to make data script: %s", err)
+	}
+	if got, ok := script.DataPayload(); !ok || !bytes.Equal(got, data[:]) {
+		t.Fatalf("data payload is %X; want %X", got, data)
+	}
+	if _, err := NewDataScript(make([]byte, MAX_DATA_CARRIER_SIZE+1)); err == nil {
+		t.Fatalf("made a data script above MAX_DATA_CARRIER_SIZE")
+	}
+
+	oversized := NewScriptBuilder().AddOp(OP_RETURN).AddData(make([]byte, MAX_DATA_CARRIER_SIZE+1)).Script()
+	tests := []struct {
+		name   string
+		script Script
+		value  Amount
+		valid  bool
+	}{
+		{"data output", script, 0, true},
+		{"data output with coins", script, 1, false},
+		{"oversized data", oversized, 0, false},
+		{"malformed data", Script{OP_RETURN, OP_DUP}, 0, false},
+	}
+
+	for _, tt := range tests {
+		tx := NewTransactionBuilder().
+			AddInputFrom(USET.First(TXID[0])).
+			AddScriptOutput(tt.value, tt.script).
+			AddOutput(90, ADDR[1]).
+			Sign(SK[0])
+
+		if err := tx.Verify(USET, 1); (err == nil) != tt.valid {
+			t.Errorf("%s: error = %v; want valid = %v", tt.name, err, tt.valid)
+		}
+
+		// data outputs never enter the UXTO set
+		if uxtos := GenerateUXTOsFromTx(tx); len(uxtos) != 1 || uxtos[0].N != 1 {
+			t.Errorf("%s: generated %d UXTOs", tt.name, len(uxtos))
+		}
+	}
+}
+
+func TestTransaction_CoinbaseMaturity(t *testing.T) {
+	PopulateTestData()
+
+	defer func(p ConsensusParams) { Params = p }(Params)
+	Params.CoinbaseMaturity = 100
+
+	coinbase := NewCoinBaseTransaction([]byte("coinbase"), ADDR[0], 100, 0)
+	uxto := GenerateUXTOsFromTx(coinbase)[0]
+	uxto.Height = 10
+	USET.Add(uxto)
+
+	if !uxto.Coinbase {
+		t.Fatalf("coinbase output not flagged")
+	}
+
+	tx := NewTransaction(uxto, SK[0], ADDR[1], 90, 0)
+	if err := tx.Verify(USET, 109); err == nil {
+		t.Fatalf("spent a coinbase output 99 blocks deep")
+	}
+	if err := tx.Verify(USET, 110); err != nil {
+		t.Fatalf("failed to spend a mature coinbase output: %s", err)
+	}
+
+	Params.MaturityHeight = 200
+	if err := tx.Verify(USET, 109); err != nil {
+		t.Fatalf("maturity enforced below activation height: %s", err)
+	}
+}
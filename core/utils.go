@@ -2,7 +2,6 @@ package core
 
 import (
 	"crypto/rand"
-	"crypto/rsa"
 	"encoding/binary"
 )
 
@@ -13,12 +12,10 @@ func UintToBytes(i uint32) []byte {
 	return valueBytes
 }
 
-func HashPubKey(pubKey *rsa.PublicKey) Hash160 {
-	var raw []byte
-	raw = append(raw, pubKey.N.Bytes()...)
-	raw = append(raw, UintToBytes(uint32(pubKey.E))...)
-
-	return HashTo160(raw)
+// HashPubKey returns the address of a public key.
+// For secp256k1 keys it is the hash of the 33-byte compressed key.
+func HashPubKey(pubKey PublicKey) Hash160 {
+	return HashTo160(pubKey.Bytes())
 }
 
 func RandomHash256() Hash256 {
@@ -44,14 +41,19 @@ func Contains(s []uint32, e uint32) bool {
 	return false
 }
 
+// GenerateUXTOsFromTx returns the outputs of tx that can be spent; data outputs are left out.
 func GenerateUXTOsFromTx(tx *Transaction) []*UXTO {
 	var uxto []*UXTO
 
 	for i, out := range tx.Outs {
+		if out.Script.IsUnspendable() {
+			continue
+		}
 		uxto = append(uxto, &UXTO{
-			TxId:  tx.Hash(),
-			TxOut: out,
-			N:     uint32(i),
+			TxId:     tx.Hash(),
+			TxOut:    out,
+			N:        uint32(i),
+			Coinbase: tx.IsCoinbaseTx(),
 		})
 	}
 
@@ -62,7 +64,10 @@ func GenerateUXTOsFromBlock(block *Block) []*UXTO {
 	var uxto []*UXTO
 
 	for _, tx := range block.Transactions {
-		uxto = append(uxto, GenerateUXTOsFromTx(tx)...)
+		for _, u := range GenerateUXTOsFromTx(tx) {
+			u.Height = block.Height
+			uxto = append(uxto, u)
+		}
 	}
 
 	return uxto
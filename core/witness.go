@@ -0,0 +1,116 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/cbergoon/merkletree"
+)
+
+// Witness commitments.
+//
+// A txid leaves the ScriptSigs out, so that a transaction can be referred to before it is signed and cannot be
+// renamed by swapping its signatures. The merkle root in the header is built from txids and so does not commit to
+// signatures either; from Params.WitnessHeight on, the coinbase data therefore ends with the root of a second tree
+// over wtxids, which do cover the ScriptSigs. The coinbase takes a zero leaf in that tree, as its wtxid would
+// depend on the commitment it carries.
+
+// WITNESS_COMMITMENT_HEADER tags a witness root at the end of the coinbase data.
+var WITNESS_COMMITMENT_HEADER = []byte{0xaa, 0x21, 0xa9, 0xed}
+
+const WITNESS_COMMITMENT_SIZE = 4 + 32
+
+// WitnessHash returns the wtxid of tx, which commits to its ScriptSigs on top of everything its txid commits to.
+func (tx *Transaction) WitnessHash() Hash256 {
+	data := tx.Serialized()
+
+	for _, txIn := range tx.Ins {
+		data = append(data, UintToBytes(uint32(len(txIn.ScriptSig.Script)))...)
+		data = append(data, txIn.ScriptSig.Script...)
+	}
+
+	return HashTo256(data)
+}
+
+// WitnessCommitment returns the witness root a coinbase transaction commits to, if any.
+func (tx *Transaction) WitnessCommitment() (Hash256, bool) {
+	if !tx.IsCoinbaseTx() {
+		return Hash256{}, false
+	}
+
+	data := tx.Ins[0].Coinbase
+	if len(data) < WITNESS_COMMITMENT_SIZE {
+		return Hash256{}, false
+	}
+	commitment := data[len(data)-WITNESS_COMMITMENT_SIZE:]
+	if !bytes.Equal(commitment[:len(WITNESS_COMMITMENT_HEADER)], WITNESS_COMMITMENT_HEADER) {
+		return Hash256{}, false
+	}
+
+	return Hash256FromSlice(commitment[len(WITNESS_COMMITMENT_HEADER):]), true
+}
+
+// SetWitnessCommitment makes a coinbase transaction commit to root, replacing its previous commitment if any.
+func (tx *Transaction) SetWitnessCommitment(root Hash256) {
+	data := tx.Ins[0].Coinbase
+	if _, ok := tx.WitnessCommitment(); ok {
+		data = data[:len(data)-WITNESS_COMMITMENT_SIZE]
+	}
+
+	commitment := append(append([]byte{}, WITNESS_COMMITMENT_HEADER...), root[:]...)
+	tx.Ins[0].Coinbase = append(append([]byte{}, data...), commitment...)
+}
+
+type witnessLeaf Hash256
+
+func (l witnessLeaf) CalculateHash() ([]byte, error) {
+	return l[:], nil
+}
+
+func (l witnessLeaf) Equals(other merkletree.Content) (bool, error) {
+	otherHash, err := other.CalculateHash()
+	if err != nil {
+		return false, err
+	}
+
+	return bytes.Equal(l[:], otherHash), nil
+}
+
+// CalculateWitnessRoot returns the root of the merkle tree over the wtxids of the block, the coinbase's being zero.
+func (block *Block) CalculateWitnessRoot() (Hash256, error) {
+	var leaves []merkletree.Content
+	for i, tx := range block.Transactions {
+		if i == 0 {
+			leaves = append(leaves, witnessLeaf{})
+			continue
+		}
+		leaves = append(leaves, witnessLeaf(tx.WitnessHash()))
+	}
+
+	if tree, err := merkletree.NewTree(leaves); err != nil {
+		return Hash256{}, err
+	} else {
+		return Hash256FromSlice(tree.MerkleRoot()), nil
+	}
+}
+
+// verifyWitnessCommitment checks the witness root in the coinbase, which must be the first transaction.
+func (block *Block) verifyWitnessCommitment() error {
+	if block.Height < Params.WitnessHeight {
+		return nil
+	}
+
+	commitment, ok := block.Transactions[0].WitnessCommitment()
+	if !ok {
+		return fmt.Errorf("coinbase has no witness commitment")
+	}
+
+	root, err := block.CalculateWitnessRoot()
+	if err != nil {
+		return fmt.Errorf("failed to calculate witness root: %w", err)
+	}
+	if commitment != root {
+		return fmt.Errorf("invalid witness commitment")
+	}
+
+	return nil
+}
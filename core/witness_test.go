@@ -0,0 +1,95 @@
+package core
+
+import (
+	"testing"
+)
+
+func TestTransaction_WitnessHash(t *testing.T) {
+	PopulateTestData()
+
+	uxto := USET.First(TXID[0])
+	tx := NewTransactionBuilder().
+		AddInputFrom(uxto).
+		AddOutput(90, ADDR[1]).
+		Build()
+	txId, wtxId := tx.Hash(), tx.WitnessHash()
+
+	_ = tx.SignTxIn(uxto, SK[0], SIGHASH_ALL)
+	if tx.Hash() != txId {
+		t.Fatalf("signing changed the txid")
+	}
+	if tx.WitnessHash() == wtxId {
+		t.Fatalf("signing did not change the wtxid")
+	}
+}
+
+func TestBlock_VerifyWitnessCommitment(t *testing.T) {
+	PopulateTestData()
+
+	uxto := USET.First(TXID[0])
+	coinbase := NewCoinBaseTransaction([]byte("coinbase"), ADDR[5], 100, 0)
+	tx := NewTransaction(uxto, SK[0], ADDR[3], 60, 0)
+
+	b := NewBlockBuilder().
+		BaseOn(Hash256{}, 0).
+		SetNBits(EASY_BITS).
+		AddTransaction(coinbase).
+		AddTransaction(tx).
+		Build()
+
+	if _, ok := coinbase.WitnessCommitment(); !ok {
+		t.Fatalf("built a coinbase without witness commitment")
+	}
+	if err := b.Verify(USET, nil, EASY_BITS, 1000); err != nil {
+		t.Fatalf("failed to verify block: %s", err)
+	}
+
+	// a different valid signature leaves the txid, and so the header, as it was
+	_ = tx.SignTxIn(uxto, SK[0], SIGHASH_ALL|SIGHASH_ANYONECANPAY)
+	if err := tx.VerifyTxIn(uxto, b.Height); err != nil {
+		t.Fatalf("failed to verify the new signature: %s", err)
+	}
+	if mr, _ := b.CalculateMerkleRoot(); mr != b.HashMerkleRoot {
+		t.Fatalf("new signature changed the merkle root")
+	}
+	if err := b.Verify(USET, nil, EASY_BITS, 1000); err == nil {
+		t.Fatalf("verified a block whose signatures were swapped")
+	}
+
+	// rebuilding the block replaces the commitment
+	b = NewBlockBuilder().
+		BaseOn(Hash256{}, 0).
+		SetNBits(EASY_BITS).
+		AddTransaction(coinbase).
+		AddTransaction(tx).
+		Build()
+	if err := b.Verify(USET, nil, EASY_BITS, 1000); err != nil {
+		t.Fatalf("failed to verify rebuilt block: %s", err)
+	}
+}
+
+func TestBlock_WitnessActivation(t *testing.T) {
+	PopulateTestData()
+
+	defer func(p ConsensusParams) { Params = p }(Params)
+	Params.WitnessHeight = 10
+
+	coinbase := NewCoinBaseTransaction([]byte("coinbase"), ADDR[5], 100, 0)
+	b := NewBlockBuilder().
+		BaseOn(Hash256{}, 0).
+		SetNBits(EASY_BITS).
+		AddTransaction(coinbase).
+		Build()
+
+	if _, ok := coinbase.WitnessCommitment(); ok {
+		t.Fatalf("committed to witnesses below activation height")
+	}
+	if err := b.Verify(USET, nil, EASY_BITS, 1000); err != nil {
+		t.Fatalf("failed to verify block below activation height: %s", err)
+	}
+
+	Params.WitnessHeight = 1
+	if err := b.Verify(USET, nil, EASY_BITS, 1000); err == nil {
+		t.Fatalf("verified a block without witness commitment")
+	}
+}
@@ -1,32 +1,40 @@
 package marshal
 
 import (
-	"bytes"
+	"fmt"
 	"gocoin/core"
 )
 
-const MAGIC_TX uint32 = 0xefefefef
+// FORMAT_VERSION is the version of the canonical encoding produced by this package.
+// It is the first byte of every encoded block, transaction and UXTO.
+// Versions down to MIN_FORMAT_VERSION can still be decoded:
+//   - 1: ScriptSig holds an RSA key as N and E
+//   - 2: ScriptSig holds a key type and the key bytes
+//   - 3: ScriptSig and ScriptPubKey are scripts
+//   - 4: TxOut values take 8 bytes
+//   - 5: transactions carry a lock time, inputs a sequence and UXTOs their height
+//   - 6: UXTOs carry whether they were created by a coinbase
+const (
+	FORMAT_VERSION     byte = 6
+	MIN_FORMAT_VERSION byte = 1
+)
 const S_BLOCKHEADER = 80
 
-var TX_SEP []byte
-
-func init() {
-	TX_SEP = Uint32ToBytes(MAGIC_TX)
-}
-
 func BlockHeader(bh *core.BlockHeader) []byte {
-	var buf []byte
+	return bh.Serialized() // PrevBlockHash 32, MerkleRootHash 32, Time 8, NBits 4, Nonce 4
+}
 
-	buf = append(buf, bh.HashPrevBlock[:]...)      // PrevBlockHash, 32
-	buf = append(buf, bh.HashMerkleRoot[:]...)     // MerkleRootHash, 32
-	buf = append(buf, IntToBytes(int(bh.Time))...) // Time, 8
-	buf = append(buf, Uint32ToBytes(bh.NBits)...)  // NBits, 4
-	buf = append(buf, Uint32ToBytes(bh.Nonce)...)  // Nonce, 4
+func UBlockHeader(buf []byte) (*core.BlockHeader, error) {
+	r := newReader(buf)
+	bh := readBlockHeader(r)
+	if err := r.finish(); err != nil {
+		return nil, fmt.Errorf("cannot decode block header: %w", err)
+	}
 
-	return buf
+	return bh, nil
 }
 
-func UBlockHeader(buf []byte) *core.BlockHeader {
+func readBlockHeader(r *reader) *core.BlockHeader {
 	bh := &core.BlockHeader{
 		Time:           0,
 		NBits:          0,
@@ -35,20 +43,11 @@ func UBlockHeader(buf []byte) *core.BlockHeader {
 		HashMerkleRoot: core.Hash256{},
 	}
 
-	p := 0
-	bh.HashPrevBlock = core.Hash256FromSlice(buf[:32])
-
-	p += 32
-	bh.HashMerkleRoot = core.Hash256FromSlice(buf[p : p+32])
-
-	p += 32
-	bh.Time = int64(IntFromBytes(buf[p : p+8]))
-
-	p += 8
-	bh.NBits = Uint32FromBytes(buf[p : p+4])
-
-	p += 4
-	bh.Nonce = Uint32FromBytes(buf[p : p+4])
+	bh.HashPrevBlock = r.hash256()
+	bh.HashMerkleRoot = r.hash256()
+	bh.Time = int64(r.uint64())
+	bh.NBits = r.uint32()
+	bh.Nonce = r.uint32()
 
 	return bh
 }
@@ -56,20 +55,29 @@ func UBlockHeader(buf []byte) *core.BlockHeader {
 func Block(block *core.Block) []byte {
 	var buf []byte
 
-	buf = append(buf, Uint32ToBytes(block.Height)...)         // Height, 4
-	buf = append(buf, BlockHeader(&block.BlockHeader)...)     // Header, 80
-	buf = append(buf, IntToBytes(len(block.Transactions))...) // Tx GetBlockFileSize, 8
+	buf = append(buf, FORMAT_VERSION)                                    // Version, 1
+	buf = append(buf, Uint32ToBytes(block.Height)...)                    // Height, 4
+	buf = append(buf, BlockHeader(&block.BlockHeader)...)                // Header, 80
+	buf = append(buf, VarIntToBytes(uint64(len(block.Transactions)))...) // Tx Count, variable
 
 	for _, tx := range block.Transactions {
-		txSlice := Transaction(tx)
-		buf = append(buf, txSlice...) // Tx, variable
-		buf = append(buf, TX_SEP...)  // Separator, 4
+		buf = append(buf, Transaction(tx)...) // Tx, variable
 	}
 
 	return buf
 }
 
-func UBlock(buf []byte) *core.Block {
+func UBlock(buf []byte) (*core.Block, error) {
+	r := newReader(buf)
+	block := readBlock(r)
+	if err := r.finish(); err != nil {
+		return nil, fmt.Errorf("cannot decode block: %w", err)
+	}
+
+	return block, nil
+}
+
+func readBlock(r *reader) *core.Block {
 	block := &core.Block{
 		Hash:   core.Hash256{},
 		Height: 0,
@@ -83,21 +91,15 @@ func UBlock(buf []byte) *core.Block {
 		Transactions: []*core.Transaction{},
 	}
 
-	p := 0
-	block.Height = Uint32FromBytes(buf[:4])
-
-	p += 4
-	block.BlockHeader = *UBlockHeader(buf[p : p+S_BLOCKHEADER])
-
-	p += S_BLOCKHEADER
-	txCount := IntFromBytes(buf[p : p+8])
+	r.version()
+	block.Height = r.uint32()
+	block.BlockHeader = *readBlockHeader(r)
 
-	p += 8
-	txs := bytes.Split(buf[p:], TX_SEP)
+	txCount := r.count(S_TX_MIN)
 	for i := 0; i < txCount; i++ {
-		block.Transactions = append(block.Transactions, UTransaction(txs[i]))
+		block.Transactions = append(block.Transactions, readTransaction(r))
 	}
 
-	block.Hash = block.BlockHeader.Hash()
+	block.Hash = block.HashAtHeight(block.Height)
 	return block
 }
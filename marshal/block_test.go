@@ -1,6 +1,7 @@
 package marshal
 
 import (
+	"errors"
 	"github.com/davecgh/go-spew/spew"
 	core2 "gocoin/core"
 	"reflect"
@@ -18,7 +19,10 @@ func TestDeserializeBlockHeader(t *testing.T) {
 	}
 
 	buf := BlockHeader(bh)
-	bhDes := UBlockHeader(buf)
+	bhDes, err := UBlockHeader(buf)
+	if err != nil {
+		t.Fatalf("UBlockHeader: %s", err)
+	}
 
 	t.Log(spew.Sdump(bh))
 	t.Log(spew.Sdump(bhDes))
@@ -33,27 +37,30 @@ func TestDeserializeBlock(t *testing.T) {
 
 	tx1 := core2.NewCoinBaseTransaction([]byte("COINBASE"), core2.RandomHash160(), 1000, 100)
 	tx2 := core2.NewTransactionBuilder().
-		AddInputFrom(USET.First(TXID[1]), PK[0]).
-		AddInputFrom(USET.First(TXID[0]), PK[0]).
+		AddInputFrom(USET.First(TXID[1])).
+		AddInputFrom(USET.First(TXID[0])).
 		AddOutput(100, ADDR[2]).
-		AddChange(50).
+		AddChange(core2.NewP2PKHScript(ADDR[0]), 50).
 		Sign(SK[0])
 	tx3 := core2.NewTransactionBuilder().
-		AddInputFrom(USET.First(TXID[2]), PK[1]).
-		AddInputFrom(USET.First(TXID[3]), PK[1]).
+		AddInputFrom(USET.First(TXID[2])).
+		AddInputFrom(USET.First(TXID[3])).
 		AddOutput(100, ADDR[5]).
-		AddChange(50).
+		AddChange(core2.NewP2PKHScript(ADDR[1]), 50).
 		Sign(SK[0])
 	b := core2.NewBlockBuilder().
 		BaseOn(core2.EmptyHash256(), 1000).
-		SetNBits(20).
+		SetNBits(0x1f7fffff).
 		AddTransaction(tx1).
 		AddTransaction(tx2).
 		AddTransaction(tx3).
 		Build()
 
 	buf := Block(b)
-	bDes := UBlock(buf)
+	bDes, err := UBlock(buf)
+	if err != nil {
+		t.Fatalf("UBlock: %s", err)
+	}
 
 	// not read from serialize
 	bDes.Height = b.Height
@@ -65,4 +72,37 @@ func TestDeserializeBlock(t *testing.T) {
 	if !reflect.DeepEqual(b, bDes) {
 		t.Errorf("Objects not equal")
 	}
+
+	if _, err := UBlock(buf[:len(buf)-1]); !errors.Is(err, ErrTruncated) {
+		t.Errorf("truncated block: error = %v; want ErrTruncated", err)
+	}
+	if _, err := UBlock(append(buf, 0)); !errors.Is(err, ErrTrailingBytes) {
+		t.Errorf("block with trailing bytes: error = %v; want ErrTrailingBytes", err)
+	}
+
+	buf[0] = FORMAT_VERSION + 1
+	if _, err := UBlock(buf); !errors.Is(err, ErrUnknownVersion) {
+		t.Errorf("unknown version: error = %v; want ErrUnknownVersion", err)
+	}
+}
+
+func TestDeserializeBlockWithSeparatorBytes(t *testing.T) {
+	// coinbase data that contains the magic values the legacy encoding split on
+	coinbase := append(Uint32ToBytes(LEGACY_MAGIC_TX), Uint32ToBytes(LEGACY_MAGIC_TXIN)...)
+
+	tx := core2.NewCoinBaseTransaction(coinbase, core2.RandomHash160(), 1000, 0)
+	b := core2.NewBlockBuilder().
+		BaseOn(core2.EmptyHash256(), 0).
+		SetNBits(0x1f7fffff).
+		AddTransaction(tx).
+		Build()
+
+	bDes, err := UBlock(Block(b))
+	if err != nil {
+		t.Fatalf("UBlock: %s", err)
+	}
+
+	if !reflect.DeepEqual(b, bDes) {
+		t.Errorf("Objects not equal")
+	}
 }
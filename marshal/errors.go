@@ -0,0 +1,13 @@
+package marshal
+
+import "errors"
+
+// Errors returned by the decoders of this package. They are wrapped with the offset they occurred at,
+// so use errors.Is to test for them.
+var (
+	ErrTruncated      = errors.New("truncated data")
+	ErrTrailingBytes  = errors.New("trailing bytes after value")
+	ErrOversizedCount = errors.New("count exceeds remaining data")
+	ErrNonCanonical   = errors.New("non-canonical encoding")
+	ErrUnknownVersion = errors.New("unknown format version")
+)
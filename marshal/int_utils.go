@@ -32,3 +32,78 @@ func Uint64ToBytes(v uint64) []byte {
 func Uint64FromBytes(buf []byte) uint64 {
 	return binary.LittleEndian.Uint64(buf)
 }
+
+// VarIntToBytes encodes v as a variable-length integer (Bitcoin's CompactSize).
+// Values below 0xfd take a single byte; larger values are prefixed with 0xfd, 0xfe or 0xff
+// followed by 2, 4 or 8 little-endian bytes. Only the shortest encoding is canonical.
+func VarIntToBytes(v uint64) []byte {
+	switch {
+	case v < 0xfd:
+		return []byte{byte(v)}
+	case v <= 0xffff:
+		buf := make([]byte, 3)
+		buf[0] = 0xfd
+		binary.LittleEndian.PutUint16(buf[1:], uint16(v))
+		return buf
+	case v <= 0xffff_ffff:
+		buf := make([]byte, 5)
+		buf[0] = 0xfe
+		binary.LittleEndian.PutUint32(buf[1:], uint32(v))
+		return buf
+	default:
+		buf := make([]byte, 9)
+		buf[0] = 0xff
+		binary.LittleEndian.PutUint64(buf[1:], v)
+		return buf
+	}
+}
+
+// VarIntFromBytes decodes a variable-length integer from the front of buf.
+// It returns the value and the number of bytes consumed. Non-minimal encodings are rejected.
+func VarIntFromBytes(buf []byte) (uint64, int, error) {
+	if len(buf) == 0 {
+		return 0, 0, ErrTruncated
+	}
+
+	n := VarIntSize(buf[0])
+	if len(buf) < n {
+		return 0, 0, ErrTruncated
+	}
+
+	var v, min uint64
+	switch n {
+	case 3:
+		v, min = uint64(binary.LittleEndian.Uint16(buf[1:3])), 0xfd
+	case 5:
+		v, min = uint64(binary.LittleEndian.Uint32(buf[1:5])), 0x1_0000
+	case 9:
+		v, min = binary.LittleEndian.Uint64(buf[1:9]), 0x1_0000_0000
+	default:
+		return uint64(buf[0]), 1, nil
+	}
+
+	if v < min {
+		return 0, 0, ErrNonCanonical
+	}
+
+	return v, n, nil
+}
+
+// VarIntSize returns the length of a variable-length integer from its first byte.
+func VarIntSize(prefix byte) int {
+	switch prefix {
+	case 0xfd:
+		return 3
+	case 0xfe:
+		return 5
+	case 0xff:
+		return 9
+	default:
+		return 1
+	}
+}
+
+// VarBytes prefixes data with its length as a variable-length integer.
+func VarBytes(data []byte) []byte {
+	return append(VarIntToBytes(uint64(len(data))), data...)
+}
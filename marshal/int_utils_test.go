@@ -1,6 +1,9 @@
 package marshal
 
-import "testing"
+import (
+	"errors"
+	"testing"
+)
 
 func TestIntToAndFromBytes(t *testing.T) {
 	var v int = 0x123456
@@ -10,3 +13,39 @@ func TestIntToAndFromBytes(t *testing.T) {
 		t.Errorf("IntFromBytes(bi) = %d; expected %d", i, v)
 	}
 }
+
+func TestVarIntToAndFromBytes(t *testing.T) {
+	values := []uint64{0, 0xfc, 0xfd, 0xffff, 0x10000, 0xffff_ffff, 0x1_0000_0000}
+	sizes := []int{1, 1, 3, 3, 5, 5, 9}
+
+	for i, v := range values {
+		buf := VarIntToBytes(v)
+		if len(buf) != sizes[i] {
+			t.Errorf("len(VarIntToBytes(%d)) = %d; expected %d", v, len(buf), sizes[i])
+		}
+
+		if got, n, err := VarIntFromBytes(buf); err != nil || got != v || n != len(buf) {
+			t.Errorf("VarIntFromBytes(%x) = %d, %d, %v; expected %d, %d", buf, got, n, err, v, len(buf))
+		}
+	}
+}
+
+func TestVarIntFromBytesMalformed(t *testing.T) {
+	cases := []struct {
+		buf []byte
+		err error
+	}{
+		{[]byte{}, ErrTruncated},
+		{[]byte{0xfd, 0x00}, ErrTruncated},
+		{[]byte{0xff, 0, 0, 0, 0, 0, 0, 0}, ErrTruncated},
+		{[]byte{0xfd, 0xfc, 0x00}, ErrNonCanonical},
+		{[]byte{0xfe, 0xff, 0xff, 0x00, 0x00}, ErrNonCanonical},
+		{[]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0}, ErrNonCanonical},
+	}
+
+	for _, c := range cases {
+		if _, _, err := VarIntFromBytes(c.buf); !errors.Is(err, c.err) {
+			t.Errorf("VarIntFromBytes(%x) error = %v; expected %v", c.buf, err, c.err)
+		}
+	}
+}
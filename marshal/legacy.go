@@ -0,0 +1,174 @@
+package marshal
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"fmt"
+	"gocoin/core"
+	"math/big"
+)
+
+// Decoders for the separator-based encoding used before FORMAT_VERSION 1.
+// They are only kept to migrate existing data directories and must not be used for new data.
+
+const (
+	LEGACY_MAGIC_TX   uint32 = 0xef_ef_ef_ef
+	LEGACY_MAGIC_TXIN uint32 = 0xff_ff_ff_ff
+	LEGACY_S_UXTO            = 60 // size of a legacy UXTO
+)
+
+var LEGACY_TX_SEP []byte
+var LEGACY_SEP []byte
+
+func init() {
+	LEGACY_TX_SEP = Uint32ToBytes(LEGACY_MAGIC_TX)
+	LEGACY_SEP = Uint32ToBytes(LEGACY_MAGIC_TXIN)
+}
+
+func ULegacyBlock(buf []byte) (*core.Block, error) {
+	block := &core.Block{
+		Transactions: []*core.Transaction{},
+	}
+
+	r := newReader(buf)
+	block.Height = r.uint32()
+	block.BlockHeader = *readBlockHeader(r)
+	txCount := r.uint64()
+	if r.err != nil {
+		return nil, fmt.Errorf("cannot decode legacy block: %w", r.err)
+	}
+
+	txs := bytes.Split(buf[r.p:], LEGACY_TX_SEP)
+	if txCount > uint64(len(txs)) {
+		return nil, fmt.Errorf("cannot decode legacy block: %w: %d", ErrOversizedCount, txCount)
+	}
+	for i := 0; i < int(txCount); i++ {
+		tx, err := ULegacyTransaction(txs[i])
+		if err != nil {
+			return nil, fmt.Errorf("cannot decode legacy block: %w", err)
+		}
+		block.Transactions = append(block.Transactions, tx)
+	}
+
+	block.Hash = block.HashAtHeight(block.Height)
+	return block, nil
+}
+
+func ULegacyTransaction(buf []byte) (*core.Transaction, error) {
+	tx := &core.Transaction{
+		Ins:  []*core.TxIn{},
+		Outs: []*core.TxOut{},
+	}
+
+	r := newReader(buf)
+	inputSize := r.uint64()
+	if r.err != nil {
+		return nil, fmt.Errorf("cannot decode legacy transaction: %w", r.err)
+	}
+
+	txIns := bytes.Split(buf[r.p:], LEGACY_SEP)
+	if inputSize > uint64(len(txIns)) {
+		return nil, fmt.Errorf("cannot decode legacy transaction: %w: %d", ErrOversizedCount, inputSize)
+	}
+	for i := 0; i < int(inputSize); i++ {
+		txIn, err := deserializeLegacyTxIn(txIns[i])
+		if err != nil {
+			return nil, fmt.Errorf("cannot decode legacy transaction: %w", err)
+		}
+		tx.Ins = append(tx.Ins, txIn)
+		r.p += len(txIns[i]) + 4 // separator
+	}
+
+	if !r.need(0) {
+		return nil, fmt.Errorf("cannot decode legacy transaction: %w", r.err)
+	}
+	outputSize := r.uint64()
+	if outputSize > uint64(r.remaining()/24) {
+		return nil, fmt.Errorf("cannot decode legacy transaction: %w: %d", ErrOversizedCount, outputSize)
+	}
+	for i := 0; i < int(outputSize); i++ {
+		tx.Outs = append(tx.Outs, readLegacyTxOut(r))
+	}
+
+	if r.err != nil {
+		return nil, fmt.Errorf("cannot decode legacy transaction: %w", r.err)
+	}
+
+	return tx, nil
+}
+
+func deserializeLegacyScriptSig(buf []byte) (*core.ScriptSig, error) {
+	ss := &core.ScriptSig{}
+	pk := &rsa.PublicKey{
+		N: big.NewInt(0),
+		E: 0,
+	}
+
+	r := newReader(buf)
+	pknSize := r.uint64()
+	if pknSize > uint64(r.remaining()) {
+		return nil, ErrTruncated
+	}
+	pk.N.SetBytes(r.bytes(int(pknSize)))
+	pk.E = int(r.uint64())
+	sig := r.bytes(r.remaining())
+	if r.err != nil {
+		return nil, r.err
+	}
+	ss.Script = core.NewP2PKHScriptSig(sig, core.NewRSAPublicKey(pk))
+
+	return ss, nil
+}
+
+func deserializeLegacyTxIn(buf []byte) (*core.TxIn, error) {
+	txIn := &core.TxIn{Sequence: core.SEQUENCE_FINAL}
+
+	r := newReader(buf)
+	txIn.PrevTxId = r.hash256()
+	txIn.N = r.uint32()
+	scripSigSize := r.uint64()
+	if r.err != nil {
+		return nil, r.err
+	}
+	if scripSigSize > uint64(r.remaining()) {
+		return nil, ErrTruncated
+	}
+	scriptSig := r.bytes(int(scripSigSize))
+
+	if txIn.PrevTxId != core.EmptyHash256() {
+		ss, err := deserializeLegacyScriptSig(scriptSig)
+		if err != nil {
+			return nil, err
+		}
+		txIn.ScriptSig = *ss
+	} else {
+		txIn.Coinbase = scriptSig
+	}
+
+	return txIn, nil
+}
+
+func readLegacyTxOut(r *reader) *core.TxOut {
+	pubKeyHash := r.hash160()
+	value := r.uint32()
+
+	return &core.TxOut{
+		Value:        core.Amount(value),
+		ScriptPubKey: core.NewP2PKHScriptPubKey(pubKeyHash),
+	}
+}
+
+func DeserializeLegacyUXTO(buf []byte) (*core.UXTO, error) {
+	r := newReader(buf)
+	u := &core.UXTO{
+		TxId: r.hash256(),
+		N:    r.uint32(),
+	}
+	u.TxOut = readLegacyTxOut(r)
+
+	if err := r.finish(); err != nil {
+		return nil, fmt.Errorf("cannot decode legacy UXTO: %w", err)
+	}
+
+	return u, nil
+}
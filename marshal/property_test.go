@@ -0,0 +1,198 @@
+package marshal
+
+import (
+	"crypto/rsa"
+	core2 "gocoin/core"
+	"math/big"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+const N_PROPERTY_ROUNDS = 200
+
+func newRand(seed int64) *rand.Rand {
+	return rand.New(rand.NewSource(seed))
+}
+
+func randomBytes(rnd *rand.Rand, max int) []byte {
+	buf := make([]byte, rnd.Intn(max+1))
+	rnd.Read(buf)
+
+	return buf
+}
+
+func randomHash256(rnd *rand.Rand) core2.Hash256 {
+	var h core2.Hash256
+	rnd.Read(h[:])
+
+	return h
+}
+
+func randomHash160(rnd *rand.Rand) core2.Hash160 {
+	var h core2.Hash160
+	rnd.Read(h[:])
+
+	return h
+}
+
+func randomScriptSig(rnd *rand.Rand) *core2.ScriptSig {
+	if rnd.Intn(4) == 0 { // any bytes are a script, if not necessarily a valid one
+		return &core2.ScriptSig{Script: randomBytes(rnd, 100)}
+	}
+
+	var pk core2.PublicKey
+	buf := make([]byte, core2.S_SECP256K1_PRIVKEY)
+	rnd.Read(buf)
+
+	switch rnd.Intn(4) {
+	case 0:
+		n := append([]byte{byte(1 + rnd.Intn(255))}, randomBytes(rnd, 127)...)
+		pk = core2.NewRSAPublicKey(&rsa.PublicKey{N: big.NewInt(0).SetBytes(n), E: rnd.Intn(1 << 20)})
+	case 1:
+		sk, _ := core2.ParseSchnorrPrivateKey(buf)
+		pk = sk.PublicKey()
+	default:
+		sk, _ := core2.ParseSecp256k1PrivateKey(buf)
+		pk = sk.PublicKey()
+	}
+
+	return &core2.ScriptSig{
+		Script: core2.NewP2PKHScriptSig(randomBytes(rnd, 100), pk),
+	}
+}
+
+func randomTxIn(rnd *rand.Rand) *core2.TxIn {
+	if rnd.Intn(8) == 0 {
+		return &core2.TxIn{
+			PrevTxId: core2.EmptyHash256(),
+			N:        rnd.Uint32(),
+			Coinbase: randomBytes(rnd, 100),
+			Sequence: rnd.Uint32(),
+		}
+	}
+
+	return &core2.TxIn{
+		PrevTxId:  randomHash256(rnd),
+		N:         rnd.Uint32(),
+		ScriptSig: *randomScriptSig(rnd),
+		Sequence:  rnd.Uint32(),
+	}
+}
+
+func randomTxOut(rnd *rand.Rand) *core2.TxOut {
+	return &core2.TxOut{
+		Value:        core2.Amount(rnd.Int63n(int64(core2.MAX_MONEY) + 1)),
+		ScriptPubKey: randomScriptPubKey(rnd),
+	}
+}
+
+func randomScriptPubKey(rnd *rand.Rand) core2.ScriptPubKey {
+	if rnd.Intn(4) == 0 {
+		return core2.ScriptPubKey{Script: randomBytes(rnd, 100)}
+	}
+
+	return core2.NewP2PKHScriptPubKey(randomHash160(rnd))
+}
+
+func randomTransaction(rnd *rand.Rand) *core2.Transaction {
+	tx := &core2.Transaction{
+		Ins:      []*core2.TxIn{},
+		Outs:     []*core2.TxOut{},
+		LockTime: rnd.Uint32(),
+	}
+
+	for i := rnd.Intn(5); i > 0; i-- {
+		tx.Ins = append(tx.Ins, randomTxIn(rnd))
+	}
+	for i := rnd.Intn(5); i > 0; i-- {
+		tx.Outs = append(tx.Outs, randomTxOut(rnd))
+	}
+
+	return tx
+}
+
+func randomBlock(rnd *rand.Rand) *core2.Block {
+	b := &core2.Block{
+		Height: rnd.Uint32(),
+		BlockHeader: core2.BlockHeader{
+			HashPrevBlock:  randomHash256(rnd),
+			HashMerkleRoot: randomHash256(rnd),
+			Time:           rnd.Int63(),
+			NBits:          rnd.Uint32(),
+			Nonce:          rnd.Uint32(),
+		},
+		Transactions: []*core2.Transaction{},
+	}
+	for i := rnd.Intn(5); i > 0; i-- {
+		b.Transactions = append(b.Transactions, randomTransaction(rnd))
+	}
+	b.Hash = b.HashAtHeight(b.Height)
+
+	return b
+}
+
+func TestPropertyBlockRoundTrip(t *testing.T) {
+	rnd := newRand(1)
+
+	for i := 0; i < N_PROPERTY_ROUNDS; i++ {
+		b := randomBlock(rnd)
+
+		bDes, err := UBlock(Block(b))
+		if err != nil {
+			t.Fatalf("round %d: UBlock: %s", i, err)
+		}
+		if !reflect.DeepEqual(b, bDes) {
+			t.Fatalf("round %d: objects not equal", i)
+		}
+	}
+}
+
+func TestPropertyTransactionRoundTrip(t *testing.T) {
+	rnd := newRand(2)
+
+	for i := 0; i < N_PROPERTY_ROUNDS; i++ {
+		tx := randomTransaction(rnd)
+
+		txDes, err := UTransaction(Transaction(tx))
+		if err != nil {
+			t.Fatalf("round %d: UTransaction: %s", i, err)
+		}
+		if !reflect.DeepEqual(tx, txDes) {
+			t.Fatalf("round %d: objects not equal", i)
+		}
+	}
+}
+
+func TestPropertyUXTOsRoundTrip(t *testing.T) {
+	rnd := newRand(3)
+
+	for i := 0; i < N_PROPERTY_ROUNDS; i++ {
+		uxtos := make([]*core2.UXTO, 0)
+		for j := rnd.Intn(5); j > 0; j-- {
+			uxtos = append(uxtos, &core2.UXTO{TxId: randomHash256(rnd), N: rnd.Uint32(), Height: rnd.Uint32(), Coinbase: rnd.Intn(2) == 1, TxOut: randomTxOut(rnd)})
+		}
+
+		uxtosDes, err := DeserializeUXTOs(SerializeUXTOs(uxtos))
+		if err != nil {
+			t.Fatalf("round %d: DeserializeUXTOs: %s", i, err)
+		}
+		if !reflect.DeepEqual(uxtos, uxtosDes) {
+			t.Fatalf("round %d: objects not equal", i)
+		}
+	}
+}
+
+// Every proper prefix of a valid encoding must be rejected rather than decoded into something else.
+func TestPropertyTruncatedTransactionRejected(t *testing.T) {
+	rnd := newRand(4)
+
+	for i := 0; i < N_PROPERTY_ROUNDS; i++ {
+		buf := Transaction(randomTransaction(rnd))
+
+		n := rnd.Intn(len(buf))
+		if _, err := UTransaction(buf[:n]); err == nil {
+			t.Fatalf("round %d: prefix of %d/%d bytes decoded", i, n, len(buf))
+		}
+	}
+}
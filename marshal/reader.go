@@ -0,0 +1,185 @@
+package marshal
+
+import (
+	"fmt"
+	"gocoin/core"
+)
+
+// reader walks a canonical encoding front to back.
+// The first failure is recorded in err; every later read is a no-op returning zero values,
+// so decoders only need to check the error once at the end.
+type reader struct {
+	buf []byte
+	p   int
+	err error
+	ver byte // format version of the value being read
+}
+
+func newReader(buf []byte) *reader {
+	return &reader{buf: buf, p: 0, err: nil, ver: FORMAT_VERSION}
+}
+
+// sub returns a reader over buf that decodes in the same format version as r.
+func (r *reader) sub(buf []byte) *reader {
+	return &reader{buf: buf, p: 0, err: nil, ver: r.ver}
+}
+
+func (r *reader) fail(err error) {
+	if r.err == nil {
+		r.err = fmt.Errorf("at offset %d: %w", r.p, err)
+	}
+}
+
+// need reports whether n more bytes can be read, recording ErrTruncated otherwise.
+func (r *reader) need(n int) bool {
+	if r.err != nil {
+		return false
+	}
+	if n < 0 || len(r.buf)-r.p < n {
+		r.fail(ErrTruncated)
+		return false
+	}
+
+	return true
+}
+
+func (r *reader) remaining() int {
+	return len(r.buf) - r.p
+}
+
+// finish returns the first error, or ErrTrailingBytes if the value did not use up the buffer.
+func (r *reader) finish() error {
+	if r.err == nil && r.p != len(r.buf) {
+		r.fail(ErrTrailingBytes)
+	}
+
+	return r.err
+}
+
+// bytes returns the next n bytes. The returned slice is a copy.
+func (r *reader) bytes(n int) []byte {
+	if !r.need(n) {
+		return nil
+	}
+
+	ret := make([]byte, n)
+	copy(ret, r.buf[r.p:r.p+n])
+	r.p += n
+
+	return ret
+}
+
+func (r *reader) byte() byte {
+	if !r.need(1) {
+		return 0
+	}
+
+	b := r.buf[r.p]
+	r.p++
+
+	return b
+}
+
+// version reads the format version byte that the rest of the value is decoded with.
+func (r *reader) version() {
+	v := r.byte()
+	if r.err != nil {
+		return
+	}
+
+	if v < MIN_FORMAT_VERSION || v > FORMAT_VERSION {
+		r.p--
+		r.fail(fmt.Errorf("%w: %d", ErrUnknownVersion, v))
+		return
+	}
+	r.ver = v
+}
+
+func (r *reader) uint32() uint32 {
+	if !r.need(4) {
+		return 0
+	}
+
+	v := Uint32FromBytes(r.buf[r.p : r.p+4])
+	r.p += 4
+
+	return v
+}
+
+func (r *reader) uint64() uint64 {
+	if !r.need(8) {
+		return 0
+	}
+
+	v := Uint64FromBytes(r.buf[r.p : r.p+8])
+	r.p += 8
+
+	return v
+}
+
+func (r *reader) varInt() uint64 {
+	if r.err != nil {
+		return 0
+	}
+
+	v, n, err := VarIntFromBytes(r.buf[r.p:])
+	if err != nil {
+		r.fail(err)
+		return 0
+	}
+	r.p += n
+
+	return v
+}
+
+// count reads an element count and checks that that many elements of at least minSize bytes each
+// can still follow, so a hostile count cannot make the decoder allocate or loop without bound.
+func (r *reader) count(minSize int) int {
+	v := r.varInt()
+	if r.err != nil {
+		return 0
+	}
+
+	if v > uint64(r.remaining()/minSize) {
+		r.fail(fmt.Errorf("%w: %d", ErrOversizedCount, v))
+		return 0
+	}
+
+	return int(v)
+}
+
+func (r *reader) varBytes() []byte {
+	size := r.varInt()
+	if r.err != nil {
+		return nil
+	}
+
+	if size > uint64(r.remaining()) {
+		r.fail(ErrTruncated)
+		return nil
+	}
+
+	return r.bytes(int(size))
+}
+
+func (r *reader) hash256() core.Hash256 {
+	if !r.need(32) {
+		return core.Hash256{}
+	}
+
+	h := core.Hash256FromSlice(r.buf[r.p : r.p+32])
+	r.p += 32
+
+	return h
+}
+
+func (r *reader) hash160() core.Hash160 {
+	if !r.need(20) {
+		return core.Hash160{}
+	}
+
+	h := core.Hash160FromSlice(r.buf[r.p : r.p+20])
+	r.p += 20
+
+	return h
+}
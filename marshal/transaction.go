@@ -1,65 +1,63 @@
 package marshal
 
 import (
-	"bytes"
+	"fmt"
 	"gocoin/core"
 )
 
-const (
-	MAGIC_TXIN uint32 = 0xff_ff_ff_ff
-)
-
-var SEP []byte
-
-func init() {
-	SEP = Uint32ToBytes(MAGIC_TXIN)
-}
+const S_TX_MIN = 3 // version and two empty counts
 
 func Transaction(tx *core.Transaction) []byte {
 	var buf []byte
 
-	inputSize := IntToBytes(len(tx.Ins))
-	outPutSize := IntToBytes(len(tx.Outs))
-
-	buf = append(buf, inputSize...) // Input GetBlockFileSize, 8
+	buf = append(buf, FORMAT_VERSION)                        // Version, 1
+	buf = append(buf, VarIntToBytes(uint64(len(tx.Ins)))...) // Input Count, variable
 
 	for _, txIn := range tx.Ins {
 		buf = append(buf, SerializeTxIn(txIn)...) // TxIn, variable
-		buf = append(buf, SEP...)                 // Separator, 4
 	}
 
-	buf = append(buf, outPutSize...) // Output GetBlockFileSize, 8
+	buf = append(buf, VarIntToBytes(uint64(len(tx.Outs)))...) // Output Count, variable
 
 	for _, txOut := range tx.Outs {
-		buf = append(buf, SerializeTxOut(txOut)...) // TxOut, 24
+		buf = append(buf, SerializeTxOut(txOut)...) // TxOut, variable
 	}
 
+	buf = append(buf, Uint32ToBytes(tx.LockTime)...) // LockTime, 4
+
 	return buf
 }
 
-func UTransaction(buf []byte) *core.Transaction {
+func UTransaction(buf []byte) (*core.Transaction, error) {
+	r := newReader(buf)
+	tx := readTransaction(r)
+	if err := r.finish(); err != nil {
+		return nil, fmt.Errorf("cannot decode transaction: %w", err)
+	}
+
+	return tx, nil
+}
+
+func readTransaction(r *reader) *core.Transaction {
 	tx := &core.Transaction{
 		Ins:  []*core.TxIn{},
 		Outs: []*core.TxOut{},
 	}
 
-	p := 0
-	inputSize := IntFromBytes(buf[:8])
+	r.version()
 
-	p += 8
-	txIns := bytes.Split(buf[8:], SEP)
+	inputSize := r.count(S_TXIN_MIN)
 	for i := 0; i < inputSize; i++ {
-		tx.Ins = append(tx.Ins, DeserializeTxIn(txIns[i]))
-		p += len(txIns[i])
-		p += 4 // separator
+		tx.Ins = append(tx.Ins, readTxIn(r))
 	}
 
-	outputSize := IntFromBytes(buf[p : p+8])
-
-	p += 8
+	outputSize := r.count(S_TXOUT_MIN)
 	for i := 0; i < outputSize; i++ {
-		tx.Outs = append(tx.Outs, DeserializeTxOut(buf[p:p+24]))
-		p += 24
+		tx.Outs = append(tx.Outs, readTxOut(r))
+	}
+
+	if r.ver >= 5 {
+		tx.LockTime = r.uint32()
 	}
 
 	return tx
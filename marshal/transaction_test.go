@@ -13,7 +13,10 @@ func TestDeserializeTransaction(t *testing.T) {
 	tx := core2.NewCoinBaseTransaction([]byte("coin!"), core2.RandomHash160(), 1000, 10)
 
 	buf := Transaction(tx)
-	txDes := UTransaction(buf)
+	txDes, err := UTransaction(buf)
+	if err != nil {
+		t.Fatalf("UTransaction: %s", err)
+	}
 
 	t.Logf("%s", spew.Sdump(tx))
 	t.Logf("%s", spew.Sdump(txDes))
@@ -25,14 +28,17 @@ func TestDeserializeTransaction(t *testing.T) {
 	// --- General Transaction ---
 
 	tx = core2.NewTransactionBuilder().
-		AddInputFrom(USET.First(TXID[1]), PK[0]).
-		AddInputFrom(USET.First(TXID[0]), PK[0]).
+		AddInputFrom(USET.First(TXID[1])).
+		AddInputFrom(USET.First(TXID[0])).
 		AddOutput(50, ADDR[2]).
-		AddChange(1).
+		AddChange(core2.NewP2PKHScript(ADDR[0]), 1).
 		Sign(SK[0])
 
 	buf = Transaction(tx)
-	txDes = UTransaction(buf)
+	txDes, err = UTransaction(buf)
+	if err != nil {
+		t.Fatalf("UTransaction: %s", err)
+	}
 
 	t.Logf("%s", spew.Sdump(tx))
 	t.Logf("%s", spew.Sdump(txDes))
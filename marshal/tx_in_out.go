@@ -1,44 +1,73 @@
 package marshal
 
 import (
-	"crypto/rsa"
+	"fmt"
 	"gocoin/core"
-	"math/big"
+	"math"
 )
 
-func SerializeScriptSig(ss *core.ScriptSig) []byte {
-	var buf []byte
+const (
+	S_TXIN_MIN  = 37 // TxId, vOut and an empty ScriptSig of versions before 5
+	S_TXOUT_MIN = 5  // empty ScriptPubKey and a 4-byte Value of versions before 4
+	S_UXTO_MIN  = 42 // version, TxId, N and the smallest TxOut
+)
 
-	pknB := ss.PK.N.Bytes()
-	pknSizeB := IntToBytes(len(pknB))
+func SerializeScriptSig(ss *core.ScriptSig) []byte {
+	return ss.Script // Script, variable
+}
 
-	buf = append(buf, pknSizeB...)            // PK.N GetBlockFileSize, 8
-	buf = append(buf, ss.PK.N.Bytes()...)     // PK.N, variable
-	buf = append(buf, IntToBytes(ss.PK.E)...) // PK.E, 8
-	buf = append(buf, ss.Signature...)        // Signature, variable
+func DeserializeScriptSig(buf []byte) (*core.ScriptSig, error) {
+	r := newReader(buf)
+	ss := readScriptSig(r)
+	if err := r.finish(); err != nil {
+		return nil, fmt.Errorf("cannot decode script sig: %w", err)
+	}
 
-	return buf
+	return ss, nil
 }
 
-func DeserializeScriptSig(buf []byte) *core.ScriptSig {
+// readScriptSig reads a script, or turns the key and signature of versions before scripts into the
+// equivalent P2PKH ScriptSig.
+func readScriptSig(r *reader) *core.ScriptSig {
 	ss := &core.ScriptSig{
-		PK: &rsa.PublicKey{
-			N: big.NewInt(0),
-			E: 0,
-		},
-		Signature: []byte{},
-	}
-
-	p := 0
-	pknSize := IntFromBytes(buf[:8])
-	p += 8
-	ss.PK.N.SetBytes(buf[p : p+pknSize])
-	p += pknSize
-	ss.PK.E = IntFromBytes(buf[p : p+8])
-	p += 8
-	sig := make([]byte, len(buf)-p)
-	copy(sig, buf[p:])
-	ss.Signature = sig
+		Script: core.Script{},
+	}
+
+	if r.ver >= 3 {
+		ss.Script = r.bytes(r.remaining())
+		return ss
+	}
+
+	var keyType byte
+	var key []byte
+	if r.ver == 1 { // RSA only
+		n := r.varBytes()
+		if r.err == nil && len(n) > 0 && n[0] == 0 {
+			r.fail(fmt.Errorf("%w: modulus has leading zeros", ErrNonCanonical))
+			return ss
+		}
+		e := r.varInt()
+		if r.err == nil && e > math.MaxUint32 {
+			r.fail(fmt.Errorf("RSA exponent %d out of range", e))
+			return ss
+		}
+		keyType = core.KEY_RSA
+		key = append(n, Uint32ToBytes(uint32(e))...)
+	} else {
+		keyType = r.byte()
+		key = r.varBytes()
+	}
+	sig := r.varBytes()
+	if r.err != nil {
+		return ss
+	}
+
+	pk, err := core.ParsePublicKey(keyType, key)
+	if err != nil {
+		r.fail(err)
+		return ss
+	}
+	ss.Script = core.NewP2PKHScriptSig(sig, pk)
 
 	return ss
 }
@@ -52,17 +81,26 @@ func SerializeTxIn(txIn *core.TxIn) []byte {
 	} else {
 		dataScriptSig = SerializeScriptSig(&txIn.ScriptSig)
 	}
-	sizeScriptSig := IntToBytes(len(dataScriptSig))
 
-	data = append(data, txIn.PrevTxId[:]...)      // TxId, 32
-	data = append(data, Uint32ToBytes(txIn.N)...) // vOut, 4
-	data = append(data, sizeScriptSig...)         // ScriptSig GetBlockFileSize, 8
-	data = append(data, dataScriptSig...)         // ScriptSig, variable
+	data = append(data, txIn.PrevTxId[:]...)             // TxId, 32
+	data = append(data, Uint32ToBytes(txIn.N)...)        // vOut, 4
+	data = append(data, VarBytes(dataScriptSig)...)      // ScriptSig, variable
+	data = append(data, Uint32ToBytes(txIn.Sequence)...) // Sequence, 4
 
 	return data
 }
 
-func DeserializeTxIn(buf []byte) *core.TxIn {
+func DeserializeTxIn(buf []byte) (*core.TxIn, error) {
+	r := newReader(buf)
+	txIn := readTxIn(r)
+	if err := r.finish(); err != nil {
+		return nil, fmt.Errorf("cannot decode txIn: %w", err)
+	}
+
+	return txIn, nil
+}
+
+func readTxIn(r *reader) *core.TxIn {
 	txIn := &core.TxIn{
 		PrevTxId:  core.Hash256{},
 		N:         0,
@@ -70,86 +108,191 @@ func DeserializeTxIn(buf []byte) *core.TxIn {
 		Coinbase:  nil,
 	}
 
-	p := 0
-
-	txIn.PrevTxId = core.Hash256FromSlice(buf[p : p+32])
-	p += 32
-
-	txIn.N = Uint32FromBytes(buf[p : p+4])
-	p += 4
-
-	scripSigSize := IntFromBytes(buf[p : p+8])
-	p += 8
+	txIn.PrevTxId = r.hash256()
+	txIn.N = r.uint32()
+	scriptSig := r.varBytes()
+	txIn.Sequence = core.SEQUENCE_FINAL
+	if r.ver >= 5 {
+		txIn.Sequence = r.uint32()
+	}
+	if r.err != nil {
+		return txIn
+	}
 
 	if txIn.PrevTxId != core.EmptyHash256() { // read to scripSig
-		txIn.ScriptSig = *DeserializeScriptSig(buf[p : p+scripSigSize])
+		sub := r.sub(scriptSig)
+		ss := readScriptSig(sub)
+		if err := sub.finish(); err != nil {
+			r.fail(fmt.Errorf("cannot decode script sig: %w", err))
+			return txIn
+		}
+		txIn.ScriptSig = *ss
 	} else { // read to Coinbase
-		scriptSig := make([]byte, scripSigSize)
-		copy(scriptSig, buf[p:p+scripSigSize])
 		txIn.Coinbase = scriptSig
 	}
-	p += scripSigSize
 
 	return txIn
 }
 
 func SerializeScriptPubKey(skp *core.ScriptPubKey) []byte {
-	return skp.PubKeyHash[:] // PubKeyHash, 20
+	return skp.Script // Script, variable
+}
+
+func DeserializeScriptPubKey(buf []byte) (*core.ScriptPubKey, error) {
+	r := newReader(buf)
+	spk := readScriptPubKey(r)
+	if err := r.finish(); err != nil {
+		return nil, fmt.Errorf("cannot decode script pubkey: %w", err)
+	}
+
+	return spk, nil
 }
 
-func DeserializeScriptPubKey(buf []byte) *core.ScriptPubKey {
-	return &core.ScriptPubKey{PubKeyHash: core.Hash160FromSlice(buf)}
+// readScriptPubKey reads a script, or turns the address of versions before scripts into a P2PKH script.
+func readScriptPubKey(r *reader) *core.ScriptPubKey {
+	if r.ver >= 3 {
+		return &core.ScriptPubKey{Script: r.bytes(r.remaining())}
+	}
+
+	spk := core.NewP2PKHScriptPubKey(r.hash160())
+	return &spk
 }
 
 func SerializeTxOut(txOut *core.TxOut) []byte {
 	var buf []byte
 
-	buf = append(buf, SerializeScriptPubKey(&txOut.ScriptPubKey)...) // ScriptPubKey, 20
-	buf = append(buf, Uint32ToBytes(txOut.Value)...)                 // Value, 4
+	buf = append(buf, VarBytes(SerializeScriptPubKey(&txOut.ScriptPubKey))...) // ScriptPubKey, variable
+	buf = append(buf, Uint64ToBytes(uint64(txOut.Value))...)                   // Value, 8
 
 	return buf
 }
 
-func DeserializeTxOut(buf []byte) *core.TxOut {
+func DeserializeTxOut(buf []byte) (*core.TxOut, error) {
+	r := newReader(buf)
+	txOut := readTxOut(r)
+	if err := r.finish(); err != nil {
+		return nil, fmt.Errorf("cannot decode txOut: %w", err)
+	}
+
+	return txOut, nil
+}
+
+func readTxOut(r *reader) *core.TxOut {
 	txOut := core.TxOut{
 		Value:        0,
 		ScriptPubKey: core.ScriptPubKey{},
 	}
 
-	p := 0
-	txOut.ScriptPubKey = *DeserializeScriptPubKey(buf[:20])
+	scriptPubKey := r.varBytes()
+	txOut.Value = readAmount(r)
+	if r.err != nil {
+		return &txOut
+	}
 
-	p += 20
-	txOut.Value = Uint32FromBytes(buf[p : p+4])
+	sub := r.sub(scriptPubKey)
+	spk := readScriptPubKey(sub)
+	if err := sub.finish(); err != nil {
+		r.fail(fmt.Errorf("cannot decode script pubkey: %w", err))
+		return &txOut
+	}
+	txOut.ScriptPubKey = *spk
 
 	return &txOut
 }
 
+// readAmount reads a value, which took 4 bytes before version 4.
+func readAmount(r *reader) core.Amount {
+	if r.ver < 4 {
+		return core.Amount(r.uint32())
+	}
+
+	v := r.uint64()
+	if r.err == nil && v > uint64(core.MAX_MONEY) {
+		r.fail(fmt.Errorf("amount %d out of range", v))
+		return 0
+	}
+
+	return core.Amount(v)
+}
+
 func SerializeUXTO(u *core.UXTO) []byte {
 	var buf []byte
 
+	var coinbase byte
+	if u.Coinbase {
+		coinbase = 1
+	}
+
+	buf = append(buf, FORMAT_VERSION)             // Version, 1
 	buf = append(buf, u.TxId[:]...)               // TxId, 32
 	buf = append(buf, Uint32ToBytes(u.N)...)      // N, 4
-	buf = append(buf, SerializeTxOut(u.TxOut)...) // TxOut (PubKey and Value), 24
+	buf = append(buf, Uint32ToBytes(u.Height)...) // Height, 4
+	buf = append(buf, coinbase)                   // Coinbase, 1
+	buf = append(buf, SerializeTxOut(u.TxOut)...) // TxOut (PubKey and Value), variable
 
 	return buf
 }
 
-func DeserializeUXTO(buf []byte) *core.UXTO {
+func DeserializeUXTO(buf []byte) (*core.UXTO, error) {
+	r := newReader(buf)
+	u := readUXTO(r)
+	if err := r.finish(); err != nil {
+		return nil, fmt.Errorf("cannot decode UXTO: %w", err)
+	}
+
+	return u, nil
+}
+
+func readUXTO(r *reader) *core.UXTO {
 	u := &core.UXTO{
 		TxId:  core.Hash256{},
 		N:     0,
 		TxOut: nil,
 	}
 
-	p := 0
-	u.TxId = core.Hash256FromSlice(buf[:32])
+	r.version()
+	u.TxId = r.hash256()
+	u.N = r.uint32()
+	if r.ver >= 5 { // unknown before, read as 0
+		u.Height = r.uint32()
+	}
+	if r.ver >= 6 { // unknown before, read as not coinbase
+		switch r.byte() {
+		case 0:
+		case 1:
+			u.Coinbase = true
+		default:
+			r.fail(fmt.Errorf("invalid coinbase flag"))
+		}
+	}
+	u.TxOut = readTxOut(r)
+
+	return u
+}
 
-	p += 32
-	u.N = Uint32FromBytes(buf[p : p+4])
+// SerializeUXTOs encodes a list of UXTOs, e.g. the undo data of a block.
+func SerializeUXTOs(uxtos []*core.UXTO) []byte {
+	buf := VarIntToBytes(uint64(len(uxtos))) // Count, variable
 
-	p += 4
-	u.TxOut = DeserializeTxOut(buf[p : p+24])
+	for _, u := range uxtos {
+		buf = append(buf, SerializeUXTO(u)...) // UXTO, variable
+	}
 
-	return u
+	return buf
+}
+
+func DeserializeUXTOs(buf []byte) ([]*core.UXTO, error) {
+	r := newReader(buf)
+	uxtos := make([]*core.UXTO, 0)
+
+	count := r.count(S_UXTO_MIN)
+	for i := 0; i < count; i++ {
+		uxtos = append(uxtos, readUXTO(r))
+	}
+
+	if err := r.finish(); err != nil {
+		return nil, fmt.Errorf("cannot decode UXTOs: %w", err)
+	}
+
+	return uxtos, nil
 }
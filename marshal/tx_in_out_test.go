@@ -1,9 +1,9 @@
 package marshal
 
 import (
-	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
+	"errors"
 	"github.com/davecgh/go-spew/spew"
 	core2 "gocoin/core"
 	"reflect"
@@ -11,35 +11,141 @@ import (
 )
 
 func TestDeserializeScriptSig(t *testing.T) {
-	sk, _ := rsa.GenerateKey(rand.Reader, 512)
-	digest := core2.RandomHash256()
-	sig, _ := sk.Sign(rand.Reader, digest[:], crypto.SHA256)
+	secpKey, _ := core2.GenerateSecp256k1Key()
+	schnorrKey, _ := core2.GenerateSchnorrKey()
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 512)
 
-	ss := &core2.ScriptSig{
-		PK:        &sk.PublicKey,
-		Signature: sig,
+	for _, sk := range []core2.PrivateKey{secpKey, schnorrKey, core2.NewRSAPrivateKey(rsaKey)} {
+		digest := core2.RandomHash256()
+		sig, _ := sk.Sign(digest[:])
+
+		ss := &core2.ScriptSig{
+			Script: core2.NewP2PKHScriptSig(sig, sk.PublicKey()),
+		}
+
+		var buf []byte
+		buf = SerializeScriptSig(ss)
+		ssDes, err := DeserializeScriptSig(buf)
+		if err != nil {
+			t.Fatalf("DeserializeScriptSig: %s", err)
+		}
+
+		t.Logf("%-v", ss)
+		t.Logf("%-v", ssDes)
+
+		if !reflect.DeepEqual(ss, ssDes) {
+			t.Fatalf("Objects are not equal")
+		}
 	}
+}
 
-	var buf []byte
-	buf = SerializeScriptSig(ss)
-	ssDes := DeserializeScriptSig(buf)
+// encodeTxV2 encodes a transaction spending one input in format version 2, where a ScriptSig was a key type,
+// a key and a signature.
+func encodeTxV2(prevTxId core2.Hash256, keyType byte, key []byte, sig []byte, to core2.Hash160) []byte {
+	var scriptSig []byte
+	scriptSig = append(scriptSig, keyType)
+	scriptSig = append(scriptSig, VarBytes(key)...)
+	scriptSig = append(scriptSig, VarBytes(sig)...)
+
+	buf := []byte{2, 1}
+	buf = append(buf, prevTxId[:]...)
+	buf = append(buf, Uint32ToBytes(0)...)
+	buf = append(buf, VarBytes(scriptSig)...)
+	buf = append(buf, 1)
+	buf = append(buf, VarBytes(to[:])...)
+	buf = append(buf, Uint32ToBytes(100)...)
+
+	return buf
+}
 
-	t.Logf("%-v", ss)
-	t.Logf("%-v", ssDes)
+// Transactions encoded before scripts existed decode into P2PKH scripts.
+func TestDeserializeTransactionVersion2(t *testing.T) {
+	sk, _ := core2.GenerateSecp256k1Key()
+	pk := sk.PublicKey()
+	sig := []byte("signature")
+	prevTxId := core2.RandomHash256()
+	to := core2.RandomHash160()
 
-	if !reflect.DeepEqual(ss, ssDes) {
-		t.Fatalf("Objects are not equal")
+	tx, err := UTransaction(encodeTxV2(prevTxId, core2.KEY_SECP256K1, pk.Bytes(), sig, to))
+	if err != nil {
+		t.Fatalf("UTransaction: %s", err)
+	}
+
+	if !reflect.DeepEqual(tx.Ins[0].Script, core2.NewP2PKHScriptSig(sig, pk)) {
+		t.Errorf("script sig is %s", tx.Ins[0].Script)
+	}
+	if !reflect.DeepEqual(tx.Outs[0].Script, core2.NewP2PKHScript(to)) {
+		t.Errorf("script pubkey is %s", tx.Outs[0].Script)
+	}
+
+	// inputs encoded before sequences existed are final, so no relative lock applies to them
+	if tx.Ins[0].Sequence != core2.SEQUENCE_FINAL || tx.LockTime != 0 {
+		t.Errorf("sequence %x and lock time %d of a legacy transaction", tx.Ins[0].Sequence, tx.LockTime)
+	}
+	if err := tx.CheckLocks(nil, 1, nil); err != nil {
+		t.Errorf("legacy transaction is locked: %s", err)
+	}
+
+	txDes, err := UTransaction(Transaction(tx))
+	if err != nil {
+		t.Fatalf("UTransaction: %s", err)
+	}
+	if !reflect.DeepEqual(tx, txDes) {
+		t.Errorf("Objects are not equal")
+	}
+
+	if _, err := UTransaction(encodeTxV2(prevTxId, 0xff, pk.Bytes(), sig, to)); err == nil {
+		t.Fatalf("decoded unknown key type")
 	}
 }
 
-func TestDeserializeTxIn(t *testing.T) {
+// Transactions encoded before key types existed carry RSA keys as N and E.
+func TestDeserializeTransactionVersion1(t *testing.T) {
 	sk, _ := rsa.GenerateKey(rand.Reader, 512)
+	sig := []byte("signature")
+	prevTxId := core2.RandomHash256()
+
+	var scriptSig []byte
+	scriptSig = append(scriptSig, VarBytes(sk.PublicKey.N.Bytes())...)
+	scriptSig = append(scriptSig, VarIntToBytes(uint64(sk.PublicKey.E))...)
+	scriptSig = append(scriptSig, VarBytes(sig)...)
+
+	buf := []byte{1, 1}
+	buf = append(buf, prevTxId[:]...)
+	buf = append(buf, Uint32ToBytes(3)...)
+	buf = append(buf, VarBytes(scriptSig)...)
+	buf = append(buf, 0)
+
+	tx, err := UTransaction(buf)
+	if err != nil {
+		t.Fatalf("UTransaction: %s", err)
+	}
+
+	pk := core2.NewRSAPublicKey(&sk.PublicKey)
+	if !reflect.DeepEqual(tx.Ins[0].Script, core2.NewP2PKHScriptSig(sig, pk)) {
+		t.Errorf("RSA key not preserved")
+	}
+	if tx.Ins[0].PrevTxId != prevTxId || tx.Ins[0].N != 3 {
+		t.Errorf("txIn not preserved")
+	}
+
+	// re-encoding upgrades the transaction to the current version
+	txDes, err := UTransaction(Transaction(tx))
+	if err != nil {
+		t.Fatalf("UTransaction: %s", err)
+	}
+	if !reflect.DeepEqual(tx, txDes) {
+		t.Errorf("Objects are not equal")
+	}
+}
+
+func TestDeserializeTxIn(t *testing.T) {
+	sk, _ := core2.GenerateSecp256k1Key()
 	digest := core2.RandomHash256()
-	sig, _ := sk.Sign(rand.Reader, digest[:], crypto.SHA256)
+	sig, _ := sk.Sign(digest[:])
 
 	ss := &core2.ScriptSig{
-		PK:        &sk.PublicKey,
-		Signature: sig,
+		Script: core2.NewP2PKHScriptSig(sig, sk.PublicKey()),
 	}
 
 	txIn := &core2.TxIn{
@@ -51,7 +157,10 @@ func TestDeserializeTxIn(t *testing.T) {
 
 	var buf []byte
 	buf = SerializeTxIn(txIn)
-	txInDes := DeserializeTxIn(buf)
+	txInDes, err := DeserializeTxIn(buf)
+	if err != nil {
+		t.Fatalf("DeserializeTxIn: %s", err)
+	}
 
 	t.Logf("%-v", txIn)
 	t.Logf("%-v", txInDes)
@@ -69,7 +178,10 @@ func TestDeserializeTxIn(t *testing.T) {
 	}
 
 	buf = SerializeTxIn(txIn)
-	txInDes = DeserializeTxIn(buf)
+	txInDes, err = DeserializeTxIn(buf)
+	if err != nil {
+		t.Fatalf("DeserializeTxIn: %s", err)
+	}
 
 	t.Logf("%-v", txIn)
 	t.Logf("%-v", txInDes)
@@ -81,14 +193,15 @@ func TestDeserializeTxIn(t *testing.T) {
 
 func TestDeserializeTxOut(t *testing.T) {
 	txOut := &core2.TxOut{
-		Value: 100000,
-		ScriptPubKey: core2.ScriptPubKey{
-			PubKeyHash: core2.RandomHash160(),
-		},
+		Value:        100000,
+		ScriptPubKey: core2.NewP2PKHScriptPubKey(core2.RandomHash160()),
 	}
 
 	buf := SerializeTxOut(txOut)
-	txOutDes := DeserializeTxOut(buf)
+	txOutDes, err := DeserializeTxOut(buf)
+	if err != nil {
+		t.Fatalf("DeserializeTxOut: %s", err)
+	}
 
 	t.Logf("%-v", txOut)
 	t.Logf("%-v", txOutDes)
@@ -105,13 +218,16 @@ func TestDeserializeUXTO(t *testing.T) {
 		TxOut: &core2.TxOut{
 			Value: 100000,
 			ScriptPubKey: core2.ScriptPubKey{
-				PubKeyHash: core2.RandomHash160(),
+				Script: core2.NewScriptBuilder().AddInt(2).AddOp(core2.OP_EQUAL).Script(),
 			},
 		},
 	}
 
 	buf := SerializeUXTO(u)
-	uDes := DeserializeUXTO(buf)
+	uDes, err := DeserializeUXTO(buf)
+	if err != nil {
+		t.Fatalf("DeserializeUXTO: %s", err)
+	}
 
 	t.Logf(spew.Sdump(u))
 	t.Logf(spew.Sdump(uDes))
@@ -120,3 +236,100 @@ func TestDeserializeUXTO(t *testing.T) {
 		t.Fatalf("Objects not equal")
 	}
 }
+
+func TestDeserializeUXTOAmount(t *testing.T) {
+	txId, script := core2.RandomHash256(), core2.NewP2PKHScript(core2.RandomHash160())
+
+	// before version 4, values take 4 bytes
+	var buf []byte
+	buf = append(buf, 3)
+	buf = append(buf, txId[:]...)
+	buf = append(buf, Uint32ToBytes(0)...)
+	buf = append(buf, VarBytes(script)...)
+	buf = append(buf, Uint32ToBytes(0xffff_ffff)...)
+
+	u, err := DeserializeUXTO(buf)
+	if err != nil {
+		t.Fatalf("DeserializeUXTO: %s", err)
+	}
+	if u.Value != 0xffff_ffff {
+		t.Fatalf("value is %d; want %d", u.Value, uint32(0xffff_ffff))
+	}
+
+	u.Value = core2.MAX_MONEY
+	if u, err = DeserializeUXTO(SerializeUXTO(u)); err != nil || u.Value != core2.MAX_MONEY {
+		t.Fatalf("failed to round trip MAX_MONEY: %v", err)
+	}
+
+	u.Value = core2.MAX_MONEY + 1
+	if _, err := DeserializeUXTO(SerializeUXTO(u)); err == nil {
+		t.Fatalf("decoded a value above MAX_MONEY")
+	}
+}
+
+func TestDeserializeUXTOCoinbase(t *testing.T) {
+	u := &core2.UXTO{
+		TxId:     core2.RandomHash256(),
+		N:        0,
+		Height:   10,
+		Coinbase: true,
+		TxOut:    &core2.TxOut{Value: 100, ScriptPubKey: core2.NewP2PKHScriptPubKey(core2.RandomHash160())},
+	}
+
+	buf := SerializeUXTO(u)
+	if got, err := DeserializeUXTO(buf); err != nil || !got.Coinbase {
+		t.Fatalf("failed to round trip coinbase flag: %v", err)
+	}
+
+	buf[1+32+4+4] = 2
+	if _, err := DeserializeUXTO(buf); err == nil {
+		t.Fatalf("decoded an invalid coinbase flag")
+	}
+}
+
+func TestDeserializeUXTOs(t *testing.T) {
+	PopulateTestData()
+
+	uxtos := []*core2.UXTO{USET.First(TXID[0]), USET.First(TXID[1]), USET.First(TXID[2])}
+
+	buf := SerializeUXTOs(uxtos)
+	uxtosDes, err := DeserializeUXTOs(buf)
+	if err != nil {
+		t.Fatalf("DeserializeUXTOs: %s", err)
+	}
+
+	if !reflect.DeepEqual(uxtos, uxtosDes) {
+		t.Fatalf("Objects not equal")
+	}
+
+	if empty, err := DeserializeUXTOs(SerializeUXTOs(nil)); err != nil || len(empty) != 0 {
+		t.Fatalf("got %d UXTOs, %v; want 0", len(empty), err)
+	}
+}
+
+func TestDeserializeUXTOMalformed(t *testing.T) {
+	u := &core2.UXTO{
+		TxId: core2.RandomHash256(),
+		N:    1,
+		TxOut: &core2.TxOut{
+			Value:        100,
+			ScriptPubKey: core2.NewP2PKHScriptPubKey(core2.RandomHash160()),
+		},
+	}
+	buf := SerializeUXTO(u)
+
+	for i := 0; i < len(buf); i++ {
+		if _, err := DeserializeUXTO(buf[:i]); !errors.Is(err, ErrTruncated) {
+			t.Errorf("DeserializeUXTO(buf[:%d]) error = %v; want ErrTruncated", i, err)
+		}
+	}
+
+	if _, err := DeserializeUXTO(append(buf, 0)); !errors.Is(err, ErrTrailingBytes) {
+		t.Errorf("error = %v; want ErrTrailingBytes", err)
+	}
+
+	// claims far more UXTOs than the buffer can hold
+	if _, err := DeserializeUXTOs(VarIntToBytes(1 << 40)); !errors.Is(err, ErrOversizedCount) {
+		t.Errorf("error = %v; want ErrOversizedCount", err)
+	}
+}
@@ -1,6 +1,7 @@
 package p2p
 
 import (
+	"fmt"
 	"gocoin/core"
 	"gocoin/marshal"
 )
@@ -9,6 +10,10 @@ const (
 	S_HEADER  = 20
 	S_COMMAND = 12
 
+	// MAX_PAYLOAD bounds the payload a header may announce, as it is allocated before it is read: a few times the size
+	// of the largest block.
+	MAX_PAYLOAD = 4 * 1024 * 1024
+
 	CMD_GETADDR   = "getaddr"
 	CMD_ADDR      = "addr"
 	CMD_GETBLOCKS = "getblocks"
@@ -16,6 +21,7 @@ const (
 	CMD_GETDATA   = "getdata"
 	CMD_BLOCK     = "block"
 	CMD_TX        = "tx"
+	CMD_PRUNED    = "pruned"
 
 	INV_TX    = 1
 	INV_BLOCK = 2
@@ -38,7 +44,11 @@ func (h *Header) ToBytes() []byte {
 	return buf
 }
 
-func (h *Header) SetBytes(buf []byte) {
+func (h *Header) SetBytes(buf []byte) error {
+	if len(buf) < S_HEADER {
+		return fmt.Errorf("cannot decode header: %w", marshal.ErrTruncated)
+	}
+
 	copy(h.Magic[:], buf[0:4])
 
 	ptr := 4
@@ -51,13 +61,23 @@ func (h *Header) SetBytes(buf []byte) {
 	h.Command = string(buf[4:ptr])
 
 	h.SPayload = marshal.Uint32FromBytes(buf[16:20])
+
+	return nil
 }
 
-func ReceiveHeader(data []byte) Header {
+func ReceiveHeader(data []byte) (Header, error) {
 	var h Header
-	h.SetBytes(data)
+	if err := h.SetBytes(data); err != nil {
+		return Header{}, err
+	}
+	if h.Magic != HEADER_MAGIC {
+		return Header{}, fmt.Errorf("cannot decode header: bad magic %X", h.Magic)
+	}
+	if h.SPayload > MAX_PAYLOAD {
+		return Header{}, fmt.Errorf("cannot decode header: payload of %d bytes exceeds %d", h.SPayload, MAX_PAYLOAD)
+	}
 
-	return h
+	return h, nil
 }
 
 func SendGetAddr() []byte {
@@ -92,17 +112,35 @@ func (m *MsgAddr) ToBytes() []byte {
 	return buf
 }
 
-func (m *MsgAddr) SetBytes(buf []byte) {
+func (m *MsgAddr) SetBytes(buf []byte) error {
+	if len(buf) < 4 {
+		return fmt.Errorf("cannot decode addr: %w", marshal.ErrTruncated)
+	}
 	m.NAddr = marshal.Uint32FromBytes(buf[0:4])
 	buf = buf[4:]
 
+	if uint64(m.NAddr) > uint64(len(buf)/4) {
+		return fmt.Errorf("cannot decode addr: %w: %d", marshal.ErrOversizedCount, m.NAddr)
+	}
 	for i := uint32(0); i < m.NAddr; i++ {
+		if len(buf) < 4 {
+			return fmt.Errorf("cannot decode addr: %w", marshal.ErrTruncated)
+		}
 		saddr := marshal.Uint32FromBytes(buf[0:4])
+		if uint64(saddr) > uint64(len(buf)-4) {
+			return fmt.Errorf("cannot decode addr: %w", marshal.ErrTruncated)
+		}
 		addr := string(buf[4 : 4+saddr])
 
 		m.Addrs = append(m.Addrs, MultiAddr{SAddr: saddr, Addr: addr})
 		buf = buf[4+saddr:]
 	}
+
+	if len(buf) != 0 {
+		return fmt.Errorf("cannot decode addr: %w", marshal.ErrTrailingBytes)
+	}
+
+	return nil
 }
 
 func SendAddr(addrs []string) []byte {
@@ -127,17 +165,19 @@ func SendAddr(addrs []string) []byte {
 	return append(h.ToBytes(), buf...)
 }
 
-func ReceiveAddr(data []byte) []string {
+func ReceiveAddr(data []byte) ([]string, error) {
 	var addrs []string
 
 	payload := MsgAddr{}
-	payload.SetBytes(data[:])
+	if err := payload.SetBytes(data[:]); err != nil {
+		return nil, err
+	}
 
 	for _, addr := range payload.Addrs {
 		addrs = append(addrs, addr.Addr)
 	}
 
-	return addrs
+	return addrs, nil
 }
 
 type MsgGetBlocks struct {
@@ -158,10 +198,19 @@ func (m *MsgGetBlocks) ToBytes() []byte {
 	return buf
 }
 
-func (m *MsgGetBlocks) SetBytes(buf []byte) {
+func (m *MsgGetBlocks) SetBytes(buf []byte) error {
+	if len(buf) < 4 {
+		return fmt.Errorf("cannot decode getblocks: %w", marshal.ErrTruncated)
+	}
 	m.NBlocks = marshal.Uint32FromBytes(buf[0:4])
 	buf = buf[4:]
 
+	if uint64(len(buf)) < (uint64(m.NBlocks)+1)*32 {
+		return fmt.Errorf("cannot decode getblocks: %w: %d", marshal.ErrOversizedCount, m.NBlocks)
+	}
+	if uint64(len(buf)) > (uint64(m.NBlocks)+1)*32 {
+		return fmt.Errorf("cannot decode getblocks: %w", marshal.ErrTrailingBytes)
+	}
 	for i := uint32(0); i < m.NBlocks; i++ {
 		var hash core.Hash256
 		copy(hash[:], buf[0:32])
@@ -170,6 +219,8 @@ func (m *MsgGetBlocks) SetBytes(buf []byte) {
 	}
 
 	copy(m.EndHash[:], buf[0:32])
+
+	return nil
 }
 
 func SendGetBlocks(payload MsgGetBlocks) []byte {
@@ -185,11 +236,13 @@ func SendGetBlocks(payload MsgGetBlocks) []byte {
 	return append(h.ToBytes(), buf...)
 }
 
-func ReceiveGetBlocks(data []byte) MsgGetBlocks {
+func ReceiveGetBlocks(data []byte) (MsgGetBlocks, error) {
 	payload := MsgGetBlocks{}
-	payload.SetBytes(data[:])
+	if err := payload.SetBytes(data[:]); err != nil {
+		return MsgGetBlocks{}, err
+	}
 
-	return payload
+	return payload, nil
 }
 
 type Inventory struct {
@@ -214,10 +267,19 @@ func (m *MsgInv) ToBytes() []byte {
 	return buf
 }
 
-func (m *MsgInv) SetBytes(buf []byte) {
+func (m *MsgInv) SetBytes(buf []byte) error {
+	if len(buf) < 4 {
+		return fmt.Errorf("cannot decode inv: %w", marshal.ErrTruncated)
+	}
 	m.NInv = marshal.Uint32FromBytes(buf[0:4])
 	buf = buf[4:]
 
+	if uint64(len(buf)) < uint64(m.NInv)*36 {
+		return fmt.Errorf("cannot decode inv: %w: %d", marshal.ErrOversizedCount, m.NInv)
+	}
+	if uint64(len(buf)) > uint64(m.NInv)*36 {
+		return fmt.Errorf("cannot decode inv: %w", marshal.ErrTrailingBytes)
+	}
 	for i := uint32(0); i < m.NInv; i++ {
 		var inv Inventory
 		inv.TypeId = marshal.Uint32FromBytes(buf[0:4])
@@ -226,6 +288,8 @@ func (m *MsgInv) SetBytes(buf []byte) {
 		m.InvList = append(m.InvList, inv)
 		buf = buf[36:]
 	}
+
+	return nil
 }
 
 func SendInv(invList []Inventory) []byte {
@@ -246,17 +310,19 @@ func SendInv(invList []Inventory) []byte {
 	return append(h.ToBytes(), buf...)
 }
 
-func ReceiveInv(data []byte) []Inventory {
+func ReceiveInv(data []byte) ([]Inventory, error) {
 	var invList []Inventory
 
 	payload := MsgInv{}
-	payload.SetBytes(data[:])
+	if err := payload.SetBytes(data[:]); err != nil {
+		return nil, err
+	}
 
 	for _, inv := range payload.InvList {
 		invList = append(invList, inv)
 	}
 
-	return invList
+	return invList, nil
 }
 
 type MsgGetData MsgInv
@@ -279,7 +345,32 @@ func SendGetData(invList []Inventory) []byte {
 	return append(h.ToBytes(), buf...)
 }
 
-func ReceiveGetData(data []byte) []Inventory {
+func ReceiveGetData(data []byte) ([]Inventory, error) {
+	return ReceiveInv(data)
+}
+
+// MsgPruned answers a getdata for blocks whose data the peer pruned, listing the ones that were not sent.
+type MsgPruned MsgInv
+
+func SendPruned(invList []Inventory) []byte {
+	buf := make([]byte, 0)
+
+	payload := MsgInv{
+		NInv:    uint32(len(invList)),
+		InvList: invList,
+	}
+
+	buf = append(buf, payload.ToBytes()...)
+	h := Header{
+		Magic:    HEADER_MAGIC,
+		Command:  CMD_PRUNED,
+		SPayload: uint32(len(buf)),
+	}
+
+	return append(h.ToBytes(), buf...)
+}
+
+func ReceivePruned(data []byte) ([]Inventory, error) {
 	return ReceiveInv(data)
 }
 
@@ -296,7 +387,7 @@ func SendBlock(block *core.Block) []byte {
 	return append(h.ToBytes(), buf...)
 }
 
-func ReceiveBlock(data []byte) *core.Block {
+func ReceiveBlock(data []byte) (*core.Block, error) {
 	return marshal.UBlock(data)
 }
 
@@ -313,6 +404,6 @@ func SendTx(tx *core.Transaction) []byte {
 	return append(h.ToBytes(), buf...)
 }
 
-func ReceiveTx(data []byte) *core.Transaction {
+func ReceiveTx(data []byte) (*core.Transaction, error) {
 	return marshal.UTransaction(data)
 }
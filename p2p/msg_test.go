@@ -1,7 +1,10 @@
 package p2p
 
 import (
+	"errors"
 	"github.com/davecgh/go-spew/spew"
+	"gocoin/core"
+	"gocoin/marshal"
 	"reflect"
 	"testing"
 )
@@ -15,7 +18,9 @@ func TestHeader(t *testing.T) {
 
 	data := h.ToBytes()
 	h2 := Header{}
-	h2.SetBytes(data)
+	if err := h2.SetBytes(data); err != nil {
+		t.Fatal(err)
+	}
 
 	if !reflect.DeepEqual(h, h2) {
 		t.Error("Header does not match")
@@ -28,7 +33,10 @@ func TestAddr(t *testing.T) {
 
 	sent := []string{s1, s2}
 	data := SendAddr(sent)
-	recv := ReceiveAddr(data)
+	recv, err := ReceiveAddr(data[S_HEADER:])
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	if !reflect.DeepEqual(recv, sent) {
 		spew.Dump(recv)
@@ -36,3 +44,54 @@ func TestAddr(t *testing.T) {
 		t.Error("Addr does not match")
 	}
 }
+
+func TestPruned(t *testing.T) {
+	sent := []Inventory{{TypeId: INV_BLOCK, Hash: core.RandomHash256()}, {TypeId: INV_BLOCK, Hash: core.RandomHash256()}}
+	data := SendPruned(sent)
+
+	h, err := ReceiveHeader(data[:S_HEADER])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Command != CMD_PRUNED || int(h.SPayload) != len(data)-S_HEADER {
+		t.Fatalf("unexpected header %+v", h)
+	}
+
+	recv, err := ReceivePruned(data[S_HEADER:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(recv, sent) {
+		t.Error("Pruned does not match")
+	}
+}
+
+func TestReceiveMalformed(t *testing.T) {
+	if _, err := ReceiveHeader(make([]byte, S_HEADER-1)); !errors.Is(err, marshal.ErrTruncated) {
+		t.Errorf("short header: error = %v; want ErrTruncated", err)
+	}
+	if _, err := ReceiveHeader(make([]byte, S_HEADER)); err == nil {
+		t.Errorf("bad magic: expected error")
+	}
+	huge := Header{Magic: HEADER_MAGIC, Command: CMD_BLOCK, SPayload: MAX_PAYLOAD + 1}
+	if _, err := ReceiveHeader(huge.ToBytes()); err == nil {
+		t.Errorf("oversized payload: expected error")
+	}
+
+	// address length runs past the payload
+	data := SendAddr([]string{"/ip4/127.0.0.1/tcp/8844"})[S_HEADER:]
+	if _, err := ReceiveAddr(data[:len(data)-1]); !errors.Is(err, marshal.ErrTruncated) {
+		t.Errorf("truncated addr: error = %v; want ErrTruncated", err)
+	}
+
+	// more inventories announced than sent
+	inv := SendInv([]Inventory{{TypeId: INV_BLOCK}})[S_HEADER:]
+	inv[0] = 2
+	if _, err := ReceiveInv(inv); !errors.Is(err, marshal.ErrOversizedCount) {
+		t.Errorf("oversized inv: error = %v; want ErrOversizedCount", err)
+	}
+
+	if _, err := ReceiveGetBlocks(SendGetBlocks(MsgGetBlocks{})[S_HEADER:][:20]); !errors.Is(err, marshal.ErrOversizedCount) {
+		t.Errorf("short getblocks: error = %v; want ErrOversizedCount", err)
+	}
+}
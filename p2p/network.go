@@ -19,7 +19,7 @@ import (
 	mrand "math/rand"
 )
 
-const PROTOCOL = "/gocoin/1.0.0"
+const PROTOCOL = "/gocoin/7.0.0" // 7.x: format version 6, for coinbase flags on UXTOs
 
 type Network struct {
 	host.Host
@@ -111,6 +111,14 @@ func (n *Network) ListKnownAddrs() []string {
 	return ret
 }
 
+// DropPeer disconnects from a misbehaving peer and forgets its addresses
+func (n *Network) DropPeer(id peer.ID) {
+	log.Warnf("Dropping peer %s", id)
+	_ = n.Host.Network().ClosePeer(id)
+	n.Host.Peerstore().ClearAddrs(id)
+	n.Host.Peerstore().RemovePeer(id)
+}
+
 func (n *Network) StartListening(handler network.StreamHandler) {
 	n.Host.SetStreamHandler(PROTOCOL, handler)
 }
@@ -137,7 +145,14 @@ func (n *Network) GetAddr(id peer.ID) ([]string, error) {
 
 	buf := make([]byte, S_HEADER)
 	_, err = io.ReadFull(rw, buf)
-	h := ReceiveHeader(buf)
+	if err != nil {
+		return nil, fmt.Errorf("error reading header: %s", err)
+	}
+	h, err := ReceiveHeader(buf)
+	if err != nil {
+		n.DropPeer(id)
+		return nil, fmt.Errorf("malformed header: %w", err)
+	}
 
 	if h.Command != CMD_ADDR {
 		return nil, fmt.Errorf("unexpected response: %s", h.Command)
@@ -145,7 +160,14 @@ func (n *Network) GetAddr(id peer.ID) ([]string, error) {
 
 	buf = make([]byte, h.SPayload)
 	_, err = io.ReadFull(rw, buf)
-	addrs := ReceiveAddr(buf)
+	if err != nil {
+		return nil, fmt.Errorf("error reading payload: %s", err)
+	}
+	addrs, err := ReceiveAddr(buf)
+	if err != nil {
+		n.DropPeer(id)
+		return nil, fmt.Errorf("malformed addr: %w", err)
+	}
 
 	return addrs, nil
 }
@@ -185,7 +207,12 @@ func (n *Network) GetBlocks(peer peer.ID, knownHashes []core.Hash256, endHash co
 		log.Errorf("Error reading header: %s", err)
 		return nil
 	}
-	h := ReceiveHeader(buf)
+	h, err := ReceiveHeader(buf)
+	if err != nil {
+		log.Errorf("Malformed header from %s: %s", peer, err)
+		n.DropPeer(peer)
+		return nil
+	}
 
 	if h.Command != CMD_INV {
 		log.Errorf("Unexpected response: %s", h.Command)
@@ -201,7 +228,15 @@ func (n *Network) GetBlocks(peer peer.ID, knownHashes []core.Hash256, endHash co
 		return nil
 	}
 
-	invs := ReceiveInv(buf)
+	invs, err := ReceiveInv(buf)
+	if err != nil {
+		log.Errorf("Malformed inv from %s: %s", peer, err)
+		n.DropPeer(peer)
+		return nil
+	}
+	if len(invs) == 0 {
+		return nil
+	}
 	log.Infof("Received %d inventories of type %d", len(invs), invs[0].TypeId)
 
 	return invs
@@ -213,6 +248,7 @@ func (n *Network) GetBlocks(peer peer.ID, knownHashes []core.Hash256, endHash co
 // L <----  block  ----- R
 // ....
 // L <----  block  ----- R
+// L <---- pruned ------ R (only if R pruned the remaining blocks)
 func (n *Network) DownloadBlocks(peer peer.ID, invs []Inventory) []*core.Block {
 	log.Infof("GetData(block) request to %s", peer)
 	s, err := n.Host.NewStream(context.Background(), peer, PROTOCOL)
@@ -238,8 +274,13 @@ func (n *Network) DownloadBlocks(peer peer.ID, invs []Inventory) []*core.Block {
 			log.Errorf("Error reading header: %s", err)
 			break
 		}
-		h := ReceiveHeader(buf)
-		if h.Command != CMD_BLOCK {
+		h, err := ReceiveHeader(buf)
+		if err != nil {
+			log.Errorf("Malformed header from %s: %s", peer, err)
+			n.DropPeer(peer)
+			break
+		}
+		if h.Command != CMD_BLOCK && h.Command != CMD_PRUNED {
 			log.Errorf("Unexpected response: %s", h.Command)
 			break
 		}
@@ -254,7 +295,23 @@ func (n *Network) DownloadBlocks(peer peer.ID, invs []Inventory) []*core.Block {
 			break
 		}
 
-		block := ReceiveBlock(buf)
+		if h.Command == CMD_PRUNED {
+			pruned, err := ReceivePruned(buf)
+			if err != nil {
+				log.Errorf("Malformed pruned from %s: %s", peer, err)
+				n.DropPeer(peer)
+				break
+			}
+			log.Infof("Peer %s pruned the data of %d requested blocks", peer, len(pruned))
+			break
+		}
+
+		block, err := ReceiveBlock(buf)
+		if err != nil {
+			log.Errorf("Malformed block from %s: %s", peer, err)
+			n.DropPeer(peer)
+			break
+		}
 		log.Infof("Received block %s of height %d", block.Hash, block.Height)
 		blocks = append(blocks, block)
 	}
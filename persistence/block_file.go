@@ -2,24 +2,33 @@ package persistence
 
 import (
 	"bytes"
-	"encoding/binary"
+	"errors"
 	"fmt"
 	"gocoin/core"
 	"gocoin/marshal"
+	"hash/crc32"
+	"io"
 	"os"
 )
 
-const (
-	S_UXTO                 = 60 // size of an UXTO
-	MAGIC_DIV_BLOCK uint64 = 0x11_22_33_44_55_66_77_88
+// S_RECORD_HEADER is the size of the header before every record of a blk or rev file: RECORD_MAGIC, 4 | size of the
+// payload, 4 | CRC-32C checksum of the payload, 4.
+const S_RECORD_HEADER = 12
+
+// RECORD_MAGIC starts every record, so that the records after a damaged one can be found again.
+var RECORD_MAGIC = [4]byte{0x67, 0x63, 0x62, 0x6b}
+
+var (
+	ErrCorrupt = errors.New("corrupt record")
+	ErrPruned  = errors.New("block data pruned")
 )
 
-var DIV_BLOCK []byte
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
 
-func init() {
-	buf := [8]byte{}
-	binary.BigEndian.PutUint64(buf[:], MAGIC_DIV_BLOCK)
-	DIV_BLOCK = buf[:]
+// FilePos locates a record of a blk or rev file by the offset and the size of its payload, after its header.
+type FilePos struct {
+	Offset uint32
+	Size   uint32
 }
 
 type BlockFile struct {
@@ -28,143 +37,178 @@ type BlockFile struct {
 	undoFileSize int
 	bf           *os.File
 	rf           *os.File
-	Revs         [][]*core.UXTO
-	Blocks       []*core.Block // in-memory cache
 }
 
-// NewBlockFile creates or opens a block file and the corresponding rev file
+// NewBlockFile creates or opens a block file and the corresponding rev file to append blocks to.
+// Records are read on demand instead, see BlockReader.
 func NewBlockFile(rootDir string, id uint32) (*BlockFile, error) {
-	blkFilePath := fmt.Sprintf("%s/data/blk_%06d.dat", rootDir, id)
-	revFilePath := fmt.Sprintf("%s/data/rev_%06d.dat", rootDir, id)
-	bf, err := os.OpenFile(blkFilePath, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0600)
+	bf, err := os.OpenFile(blkFilePath(rootDir, id), os.O_CREATE|os.O_APPEND|os.O_RDWR, 0600)
 	if err != nil {
 		return nil, fmt.Errorf("cannot open file: %w", err)
 	}
-	rf, err := os.OpenFile(revFilePath, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0600)
+	rf, err := os.OpenFile(revFilePath(rootDir, id), os.O_CREATE|os.O_APPEND|os.O_RDWR, 0600)
 	if err != nil {
+		_ = bf.Close()
 		return nil, fmt.Errorf("cannot open file: %w", err)
 	}
 
 	blockFile := &BlockFile{
-		Id:           id,
-		blkFileSize:  0,
-		undoFileSize: 0,
-		bf:           bf,
-		rf:           rf,
-		Blocks:       make([]*core.Block, 0),
-		Revs:         make([][]*core.UXTO, 0),
-	}
-
-	var buf [100_000]byte
-	var pos int64
-
-	// Read blk files
-	for {
-		n, _ := bf.ReadAt(buf[:], pos)
-		if n == 0 { // no more reads
-			break
-		}
-		blockFile.blkFileSize += n
+		Id: id,
+		bf: bf,
+		rf: rf,
+	}
 
-		slices := bytes.Split(buf[:], DIV_BLOCK)
+	// an incomplete record at the end of a file (e.g. an interrupted write) is left alone: records are appended after
+	// it and located by their position, see VerifyDataDir to cut it off
+	if blockFile.blkFileSize, err = fileSize(bf); err != nil {
+		_ = blockFile.Close()
+		return nil, err
+	}
+	if blockFile.undoFileSize, err = fileSize(rf); err != nil {
+		_ = blockFile.Close()
+		return nil, err
+	}
 
-		for i, slice := range slices {
-			if i != len(slices)-1 { // last slice may be incomplete
-				blockFile.Blocks = append(blockFile.Blocks, marshal.UBlock(slice))
-				pos += int64(len(slice))
-			}
+	return blockFile, nil
+}
 
-			pos += 8 // separator
-		}
-	}
+func blkFilePath(rootDir string, id uint32) string {
+	return fmt.Sprintf("%s/data/blk_%06d.dat", rootDir, id)
+}
 
-	// Read rev file
-	buf = [100_000]byte{}
-	pos = 0
+func revFilePath(rootDir string, id uint32) string {
+	return fmt.Sprintf("%s/data/rev_%06d.dat", rootDir, id)
+}
 
-	for {
-		n, _ := rf.ReadAt(buf[:], pos)
-		if n == 0 {
-			break
-		}
-		blockFile.undoFileSize += n
-
-		blockUXTOs := bytes.Split(buf[:], DIV_BLOCK) // UXTO for each block
-
-		for i, uxtos := range blockUXTOs {
-			if i != len(blockUXTOs)-1 { // discard the last one
-				count := len(uxtos) / S_UXTO
-				blockFile.Revs = append(blockFile.Revs, []*core.UXTO{}) // initialize the slice
-				for j := 0; j < count; j++ {
-					blockFile.Revs[i] = append(blockFile.Revs[i], marshal.DeserializeUXTO(uxtos[S_UXTO*j:S_UXTO+S_UXTO*j]))
-					pos += S_UXTO
-				}
-				pos += 8 // separator
-			}
-		}
+func fileSize(f *os.File) (int, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("cannot stat file: %w", err)
 	}
 
-	return blockFile, nil
+	return int(info.Size()), nil
 }
 
-func (blockFile *BlockFile) WriteBlock(b *core.Block, uxtos []*core.UXTO) error {
-	blockData := marshal.Block(b)
-	blockData = append(blockData, DIV_BLOCK...)
-	if _, err := blockFile.bf.Write(blockData); err != nil {
-		return fmt.Errorf("failed to write to block file %d: %w", blockFile.Id, err)
+// WriteBlock appends a block to the block file and the UXTOs it spent to the rev file, and returns their positions.
+func (blockFile *BlockFile) WriteBlock(b *core.Block, uxtos []*core.UXTO) (FilePos, FilePos, error) {
+	blockPos, err := appendRecord(blockFile.bf, &blockFile.blkFileSize, marshal.Block(b))
+	if err != nil {
+		return FilePos{}, FilePos{}, fmt.Errorf("failed to write to block file %d: %w", blockFile.Id, err)
 	}
-	blockFile.blkFileSize += len(blockData)
 
-	var uxtoData []byte
-	for _, u := range uxtos {
-		uxtoData = append(uxtoData, marshal.SerializeUXTO(u)...)
+	undoPos, err := blockFile.WriteUndo(uxtos)
+	if err != nil {
+		return FilePos{}, FilePos{}, err
 	}
-	uxtoData = append(uxtoData, DIV_BLOCK...)
-	if _, err := blockFile.rf.Write(uxtoData); err != nil {
-		return fmt.Errorf("failed to write to rev file: %w", err)
+
+	return blockPos, undoPos, nil
+}
+
+// WriteUndo appends the UXTOs a block spent to the rev file, and returns their position. It is used alone for a block
+// whose data is already in the block file.
+func (blockFile *BlockFile) WriteUndo(uxtos []*core.UXTO) (FilePos, error) {
+	undoPos, err := appendRecord(blockFile.rf, &blockFile.undoFileSize, marshal.SerializeUXTOs(uxtos))
+	if err != nil {
+		return FilePos{}, fmt.Errorf("failed to write to rev file %d: %w", blockFile.Id, err)
 	}
-	blockFile.undoFileSize += len(uxtoData)
 
-	blockFile.Blocks = append(blockFile.Blocks, b)
-	blockFile.Revs = append(blockFile.Revs, uxtos)
-	return nil
+	return undoPos, nil
 }
 
-func (blockFile *BlockFile) Close() error {
-	return blockFile.bf.Close()
+func appendRecord(f *os.File, size *int, record []byte) (FilePos, error) {
+	data := frameRecord(record)
+	if _, err := f.Write(data); err != nil {
+		return FilePos{}, err
+	}
+	pos := FilePos{Offset: uint32(*size + len(data) - len(record)), Size: uint32(len(record))}
+	*size += len(data)
+
+	return pos, nil
 }
 
-func (blockFile *BlockFile) GetBlockFileSize() int {
-	return blockFile.blkFileSize
+// readFileRecord reads the record at pos of a blk or rev file, without opening it for writing.
+func readFileRecord(path string, pos FilePos) ([]byte, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%s: %w", path, ErrNotFound)
+	} else if err != nil {
+		return nil, fmt.Errorf("cannot open file: %w", err)
+	}
+	defer f.Close()
+
+	record, err := readRecord(f, pos)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read %s: %w", path, err)
+	}
+
+	return record, nil
 }
 
-func (blockFile *BlockFile) GetUndoFileSize() int {
-	return blockFile.undoFileSize
+// readRecord reads the record at pos and checks it against its header.
+func readRecord(f io.ReaderAt, pos FilePos) ([]byte, error) {
+	if pos.Offset < S_RECORD_HEADER {
+		return nil, fmt.Errorf("record at %d: %w", pos.Offset, ErrCorrupt)
+	}
+
+	data := make([]byte, S_RECORD_HEADER+int(pos.Size))
+	if _, err := f.ReadAt(data, int64(pos.Offset-S_RECORD_HEADER)); err == io.EOF {
+		return nil, fmt.Errorf("record at %d: %w", pos.Offset, ErrNotFound)
+	} else if err != nil {
+		return nil, err
+	}
+
+	size, checksum, ok := uRecordHeader(data[:S_RECORD_HEADER])
+	record := data[S_RECORD_HEADER:]
+	if !ok || size != pos.Size || crc32.Checksum(record, crcTable) != checksum {
+		return nil, fmt.Errorf("record at %d: %w", pos.Offset, ErrCorrupt)
+	}
+
+	return record, nil
 }
 
-func (blockFile *BlockFile) GetBlockCount() int {
-	return len(blockFile.Blocks)
+// frameRecord prefixes a record with its header.
+func frameRecord(record []byte) []byte {
+	buf := make([]byte, 0, S_RECORD_HEADER+len(record))
+	buf = append(buf, RECORD_MAGIC[:]...)
+	buf = append(buf, marshal.Uint32ToBytes(uint32(len(record)))...)
+	buf = append(buf, marshal.Uint32ToBytes(crc32.Checksum(record, crcTable))...)
+
+	return append(buf, record...)
 }
 
-func GetBlock(rootDir string, blkRec BlockIndexRecord) (*core.Block, error) {
-	bf, err := NewBlockFile(rootDir, blkRec.BlockFileID)
-	defer bf.Close()
+// uRecordHeader returns the payload size and checksum of a record header, and false if it does not start with
+// RECORD_MAGIC.
+func uRecordHeader(head []byte) (uint32, uint32, bool) {
+	if len(head) < S_RECORD_HEADER || !bytes.Equal(head[0:4], RECORD_MAGIC[:]) {
+		return 0, 0, false
+	}
 
-	if err != nil {
-		return nil, fmt.Errorf("cannot open block file: %w", err)
+	return marshal.Uint32FromBytes(head[4:8]), marshal.Uint32FromBytes(head[8:12]), true
+}
+
+// DeleteBlockFile deletes a block file and the corresponding rev file, if they exist.
+func DeleteBlockFile(rootDir string, id uint32) error {
+	for _, path := range []string{blkFilePath(rootDir, id), revFilePath(rootDir, id)} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("cannot delete file: %w", err)
+		}
 	}
 
-	return bf.Blocks[blkRec.Offset], nil
+	return nil
 }
 
-func GetTransaction(rootDir string, txRec *TransactionRecord) (*core.Transaction, error) {
-	bf, err := NewBlockFile(rootDir, txRec.BlockFileID)
-	defer bf.Close()
-	if err != nil {
-		return nil, fmt.Errorf("cannot open block file: %w", err)
+func (blockFile *BlockFile) Close() error {
+	if err := blockFile.bf.Close(); err != nil {
+		return err
 	}
 
-	tx := bf.Blocks[txRec.BlockOffset].Transactions[txRec.TxOffset]
+	return blockFile.rf.Close()
+}
 
-	return tx, nil
+func (blockFile *BlockFile) GetBlockFileSize() int {
+	return blockFile.blkFileSize
+}
+
+func (blockFile *BlockFile) GetUndoFileSize() int {
+	return blockFile.undoFileSize
 }
@@ -1,35 +1,45 @@
 package persistence
 
 import (
+	"errors"
+	"fmt"
 	"github.com/davecgh/go-spew/spew"
 	core2 "gocoin/core"
+	"os"
+	"reflect"
 	"testing"
 )
 
 func TestOpenAndWriteBlockFile(t *testing.T) {
 	PopulateTestData()
 
-	bf, err := NewBlockFile("", 0)
+	rootDir := fmt.Sprintf("/tmp/blockfile_%s", core2.RandomHash256().String())
+	if err := os.MkdirAll(rootDir+"/data", os.ModePerm); err != nil {
+		t.Fatalf("cannot create data directory: %s", err)
+	}
+	defer os.RemoveAll(rootDir)
+
+	bf, err := NewBlockFile(rootDir, 0)
 	if err != nil {
 		t.Fatalf("canont open Blockfile: %s", err)
 	}
 
 	tx0 := core2.NewCoinBaseTransaction([]byte("coinbase"), core2.RandomHash160(), 100, 1)
 	tx1 := core2.NewTransactionBuilder().
-		AddInputFrom(USET.First(TXID[1]), PK[0]).
-		AddInputFrom(USET.First(TXID[0]), PK[0]).
+		AddInputFrom(USET.First(TXID[1])).
+		AddInputFrom(USET.First(TXID[0])).
 		AddOutput(100, ADDR[2]).
-		AddChange(50).
+		AddChange(core2.NewP2PKHScript(ADDR[0]), 50).
 		Sign(SK[0])
 	tx2 := core2.NewTransactionBuilder().
-		AddInputFrom(USET.First(TXID[2]), PK[1]).
-		AddInputFrom(USET.First(TXID[3]), PK[1]).
+		AddInputFrom(USET.First(TXID[2])).
+		AddInputFrom(USET.First(TXID[3])).
 		AddOutput(100, ADDR[5]).
-		AddChange(50).
+		AddChange(core2.NewP2PKHScript(ADDR[1]), 50).
 		Sign(SK[0])
 	b := core2.NewBlockBuilder().
 		BaseOn(core2.EmptyHash256(), 1000).
-		SetNBits(20).
+		SetNBits(0x1f7fffff).
 		AddTransaction(tx0).
 		AddTransaction(tx1).
 		AddTransaction(tx2).
@@ -41,16 +51,125 @@ func TestOpenAndWriteBlockFile(t *testing.T) {
 		USET.First(TXID[3]),
 	}
 
-	if err := bf.WriteBlock(b, spent); err != nil {
+	if _, _, err := bf.WriteBlock(b, nil); err != nil {
 		t.Fatalf("failed to write block: %s", err)
 	}
+	_ = bf.Close()
 
+	bf, err = NewBlockFile(rootDir, 0)
+	if err != nil {
+		t.Fatalf("canont re-open Blockfile: %s", err)
+	}
+
+	// a torn record at the end of the file does not shift the blocks appended after it
+	if _, err := bf.bf.Write([]byte{0xfd, 0xff}); err != nil {
+		t.Fatalf("cannot write torn record: %s", err)
+	}
+	bf.blkFileSize += 2
+	blockPos, undoPos, err := bf.WriteBlock(b, spent)
+	if err != nil {
+		t.Fatalf("failed to write block: %s", err)
+	}
 	_ = bf.Close()
 
-	bf, err = NewBlockFile("", 0)
+	t.Logf(spew.Sdump(blockPos, undoPos))
+
+	reader := NewBlockReader(rootDir, 1)
+	rec := &BlockIndexRecord{BlockHeader: b.BlockHeader, Height: b.Height, BlockPos: blockPos, UndoPos: undoPos}
+	if got, err := reader.GetBlock(rec); err != nil || !reflect.DeepEqual(got, b) {
+		t.Fatalf("block read back does not match what was written: %v", err)
+	}
+	if got, err := reader.GetUndo(rec); err != nil || !reflect.DeepEqual(got, spent) {
+		t.Fatalf("undo record read back does not match what was written: %v", err)
+	}
+	if got, err := reader.GetTransaction(&TransactionRecord{BlockPos: blockPos, TxOffset: 2}); err != nil || got.Hash() != b.Transactions[2].Hash() {
+		t.Fatalf("transaction read back does not match what was written: %v", err)
+	}
+
+	// the undo data of a block already stored is written alone
+	bf, err = NewBlockFile(rootDir, 0)
 	if err != nil {
 		t.Fatalf("canont re-open Blockfile: %s", err)
 	}
+	undoPos, err = bf.WriteUndo(spent[:1])
+	if err != nil {
+		t.Fatalf("failed to write undo record: %s", err)
+	}
+	_ = bf.Close()
+	if got, err := reader.GetUndo(&BlockIndexRecord{UndoPos: undoPos}); err != nil || !reflect.DeepEqual(got, spent[:1]) {
+		t.Fatalf("undo record read back does not match what was written: %v", err)
+	}
+
+	if _, err := reader.GetBlock(&BlockIndexRecord{BlockFileID: 1, BlockPos: blockPos}); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("read a block of a missing file: %v", err)
+	}
 
-	t.Logf(spew.Sdump(bf))
+	// a damaged record does not match its checksum
+	f, err := os.OpenFile(blkFilePath(rootDir, 0), os.O_RDWR, 0600)
+	if err != nil {
+		t.Fatalf("cannot open block file: %s", err)
+	}
+	if _, err := f.WriteAt([]byte{0xff}, int64(blockPos.Offset+blockPos.Size/2)); err != nil {
+		t.Fatalf("cannot damage record: %s", err)
+	}
+	_ = f.Close()
+	if _, err := NewBlockReader(rootDir, 1).GetBlock(rec); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("read a damaged block: %v", err)
+	}
+}
+
+func TestBlockReader_Cache(t *testing.T) {
+	rootDir := fmt.Sprintf("/tmp/blockfile_%s", core2.RandomHash256().String())
+	if err := os.MkdirAll(rootDir+"/data", os.ModePerm); err != nil {
+		t.Fatalf("cannot create data directory: %s", err)
+	}
+	defer os.RemoveAll(rootDir)
+
+	bf, err := NewBlockFile(rootDir, 0)
+	if err != nil {
+		t.Fatalf("canont open Blockfile: %s", err)
+	}
+	defer bf.Close()
+
+	var recs []*BlockIndexRecord
+	for i := 0; i < 3; i++ {
+		b := core2.NewBlockBuilder().
+			BaseOn(core2.RandomHash256(), uint32(i)).
+			SetNBits(0x1f7fffff).
+			AddTransaction(core2.NewCoinBaseTransaction([]byte("coinbase"), core2.RandomHash160(), 100, 0)).
+			Build()
+		blockPos, _, err := bf.WriteBlock(b, nil)
+		if err != nil {
+			t.Fatalf("failed to write block: %s", err)
+		}
+		recs = append(recs, &BlockIndexRecord{BlockHeader: b.BlockHeader, Height: b.Height, BlockPos: blockPos})
+	}
+
+	reader := NewBlockReader(rootDir, 2)
+	read := func(i int) *core2.Block {
+		t.Helper()
+		block, err := reader.GetBlock(recs[i])
+		if err != nil {
+			t.Fatalf("cannot read block %d: %s", i, err)
+		}
+		return block
+	}
+
+	b0, b1 := read(0), read(1)
+	if read(0) != b0 {
+		t.Fatalf("cached block decoded again")
+	}
+	read(2) // evicts block 1, the least recently used
+	if read(0) != b0 || read(1) == b1 {
+		t.Fatalf("cache does not evict the least recently used block")
+	}
+
+	// cached blocks of a pruned file are not returned either
+	reader.SetPruned(0)
+	if _, err := reader.GetBlock(recs[0]); !errors.Is(err, ErrPruned) {
+		t.Fatalf("read a block of a pruned file: %v", err)
+	}
+	if _, err := reader.GetUndo(recs[1]); !errors.Is(err, ErrPruned) {
+		t.Fatalf("read undo data of a pruned file: %v", err)
+	}
 }
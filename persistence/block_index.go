@@ -1,20 +1,68 @@
 package persistence
 
 import (
+	"bytes"
+	"encoding/binary"
 	"fmt"
 	"github.com/boltdb/bolt"
+	log "github.com/sirupsen/logrus"
 	"gocoin/core"
 	"gocoin/marshal"
+	"math/big"
 	"os"
 	"time"
 )
 
+const (
+	S_BLOCK_INDEX_RECORD = marshal.S_BLOCKHEADER + 28 + S_CHAIN_WORK + 1
+	S_CHAIN_WORK         = 32
+	S_FILE_INFO_RECORD   = 13
+	S_TRANSACTION_RECORD = 16
+)
+
+// BlockStatus tells how far a block of the block tree has been processed.
+type BlockStatus byte
+
+const (
+	BLOCK_HEADER_ONLY    BlockStatus = iota // the header is known but the data is not stored
+	BLOCK_DATA_AVAILABLE                    // the data is stored but has not been verified against the UXTOs
+	BLOCK_STALE                             // the block was disconnected from the active chain; its undo data is stored
+	BLOCK_INVALID                           // the block, or one of its ancestors, failed verification
+	BLOCK_ACTIVE                            // the block is on the active chain
+)
+
+func (s BlockStatus) String() string {
+	switch s {
+	case BLOCK_HEADER_ONLY:
+		return "headers-only"
+	case BLOCK_DATA_AVAILABLE:
+		return "data-available"
+	case BLOCK_STALE:
+		return "stale"
+	case BLOCK_INVALID:
+		return "invalid"
+	case BLOCK_ACTIVE:
+		return "active"
+	default:
+		return fmt.Sprintf("unknown(%d)", byte(s))
+	}
+}
+
+// HasData reports whether the data of a block with status s is stored. Blocks of the active chain keep their status
+// when their block file is pruned, see BlockTree.PruneFile.
+func (s BlockStatus) HasData() bool {
+	return s == BLOCK_DATA_AVAILABLE || s == BLOCK_STALE || s == BLOCK_ACTIVE
+}
+
 type BlockIndexRecord struct {
 	core.BlockHeader
 	Height      uint32
 	TxCount     uint32
 	BlockFileID uint32
-	Offset      uint32
+	BlockPos    FilePos  // position of the block in its blk file
+	UndoPos     FilePos  // position of the UXTOs it spent in its rev file
+	ChainWork   *big.Int // work of the chain up to and including the block, see core.BlockHeader.Work
+	Status      BlockStatus
 }
 
 func (b *BlockIndexRecord) Marshall() []byte {
@@ -24,22 +72,49 @@ func (b *BlockIndexRecord) Marshall() []byte {
 	buf = append(buf, marshal.Uint32ToBytes(b.Height)...)
 	buf = append(buf, marshal.Uint32ToBytes(b.TxCount)...)
 	buf = append(buf, marshal.Uint32ToBytes(b.BlockFileID)...)
-	buf = append(buf, marshal.Uint32ToBytes(b.Offset)...)
+	buf = append(buf, b.BlockPos.marshall()...)
+	buf = append(buf, b.UndoPos.marshall()...)
+
+	chainWork := make([]byte, S_CHAIN_WORK)
+	if b.ChainWork != nil {
+		b.ChainWork.FillBytes(chainWork)
+	}
+	buf = append(buf, chainWork...)
+	buf = append(buf, byte(b.Status))
 
 	return buf
 }
 
-func UBlockIndexRecord(buf []byte) *BlockIndexRecord {
+// Hash returns the hash of the indexed block.
+func (b *BlockIndexRecord) Hash() core.Hash256 {
+	return b.HashAtHeight(b.Height)
+}
+
+// Tip returns the indexed block as the tip of its chain.
+func (b *BlockIndexRecord) Tip() core.ChainTip {
+	return core.ChainTip{Hash: b.Hash(), ChainWork: b.ChainWork}
+}
+
+func UBlockIndexRecord(buf []byte) (*BlockIndexRecord, error) {
+	if len(buf) != S_BLOCK_INDEX_RECORD {
+		return nil, fmt.Errorf("invalid block index record size %d", len(buf))
+	}
+
 	record := &BlockIndexRecord{
 		BlockHeader: core.BlockHeader{},
 		Height:      0,
 		TxCount:     0,
 		BlockFileID: 0,
-		Offset:      0,
+		ChainWork:   new(big.Int),
+	}
+
+	header, err := marshal.UBlockHeader(buf[:marshal.S_BLOCKHEADER])
+	if err != nil {
+		return nil, err
 	}
 
 	p := 0
-	record.BlockHeader = *marshal.UBlockHeader(buf[:marshal.S_BLOCKHEADER])
+	record.BlockHeader = *header
 
 	p += marshal.S_BLOCKHEADER
 	record.Height = marshal.Uint32FromBytes(buf[p : p+4])
@@ -51,15 +126,39 @@ func UBlockIndexRecord(buf []byte) *BlockIndexRecord {
 	record.BlockFileID = marshal.Uint32FromBytes(buf[p : p+4])
 
 	p += 4
-	record.Offset = marshal.Uint32FromBytes(buf[p : p+4])
+	record.BlockPos = uFilePos(buf[p : p+8])
+
+	p += 8
+	record.UndoPos = uFilePos(buf[p : p+8])
 
-	return record
+	p += 8
+	record.ChainWork.SetBytes(buf[p : p+S_CHAIN_WORK])
+
+	p += S_CHAIN_WORK
+	record.Status = BlockStatus(buf[p])
+	if record.Status > BLOCK_ACTIVE {
+		return nil, fmt.Errorf("invalid block status %d", record.Status)
+	}
+
+	return record, nil
+}
+
+func (pos FilePos) marshall() []byte {
+	return append(marshal.Uint32ToBytes(pos.Offset), marshal.Uint32ToBytes(pos.Size)...)
+}
+
+func uFilePos(buf []byte) FilePos {
+	return FilePos{
+		Offset: marshal.Uint32FromBytes(buf[:4]),
+		Size:   marshal.Uint32FromBytes(buf[4:8]),
+	}
 }
 
 type FileInfoRecord struct {
 	BlockCount    uint32
 	BlockFileSize uint32
 	UndoFileSize  uint32
+	Pruned        bool // the files were deleted, and the blocks stored in them have no data
 }
 
 func (r *FileInfoRecord) Marshall() []byte {
@@ -68,11 +167,21 @@ func (r *FileInfoRecord) Marshall() []byte {
 	buf = append(buf, marshal.Uint32ToBytes(r.BlockCount)...)
 	buf = append(buf, marshal.Uint32ToBytes(r.BlockFileSize)...)
 	buf = append(buf, marshal.Uint32ToBytes(r.UndoFileSize)...)
+	if r.Pruned {
+		buf = append(buf, 1)
+	} else {
+		buf = append(buf, 0)
+	}
 
 	return buf
 }
 
-func UFileInfoRecord(buf []byte) *FileInfoRecord {
+// UFileInfoRecord decodes a file info record, also one written before pruning, which lacks the last byte.
+func UFileInfoRecord(buf []byte) (*FileInfoRecord, error) {
+	if len(buf) != S_FILE_INFO_RECORD && len(buf) != S_FILE_INFO_RECORD-1 {
+		return nil, fmt.Errorf("invalid file info record size %d", len(buf))
+	}
+
 	record := &FileInfoRecord{
 		BlockCount:    0,
 		BlockFileSize: 0,
@@ -88,29 +197,35 @@ func UFileInfoRecord(buf []byte) *FileInfoRecord {
 	p += 4
 	record.UndoFileSize = marshal.Uint32FromBytes(buf[p : p+4])
 
-	return record
+	p += 4
+	record.Pruned = len(buf) > p && buf[p] != 0
+
+	return record, nil
 }
 
 type TransactionRecord struct {
 	BlockFileID uint32
-	BlockOffset uint32
-	TxOffset    uint32
+	BlockPos    FilePos // position of the block in its blk file
+	TxOffset    uint32  // index of the transaction in the block
 }
 
 func (r *TransactionRecord) Marshall() []byte {
 	var buf []byte
 
 	buf = append(buf, marshal.Uint32ToBytes(r.BlockFileID)...)
-	buf = append(buf, marshal.Uint32ToBytes(r.BlockOffset)...)
+	buf = append(buf, r.BlockPos.marshall()...)
 	buf = append(buf, marshal.Uint32ToBytes(r.TxOffset)...)
 
 	return buf
 }
 
-func UTransactionRecord(buf []byte) *TransactionRecord {
+func UTransactionRecord(buf []byte) (*TransactionRecord, error) {
+	if len(buf) != S_TRANSACTION_RECORD {
+		return nil, fmt.Errorf("invalid transaction record size %d", len(buf))
+	}
+
 	record := &TransactionRecord{
 		BlockFileID: 0,
-		BlockOffset: 0,
 		TxOffset:    0,
 	}
 
@@ -118,12 +233,48 @@ func UTransactionRecord(buf []byte) *TransactionRecord {
 	record.BlockFileID = marshal.Uint32FromBytes(buf[p : p+4])
 
 	p += 4
-	record.BlockOffset = marshal.Uint32FromBytes(buf[p : p+4])
+	record.BlockPos = uFilePos(buf[p : p+8])
 
-	p += 4
+	p += 8
 	record.TxOffset = marshal.Uint32FromBytes(buf[p : p+4])
 
-	return record
+	return record, nil
+}
+
+// DataRecord locates a data output by its payload, see core.NewDataScript.
+type DataRecord struct {
+	Data   []byte
+	TxId   core.Hash256
+	N      uint32
+	Height uint32
+}
+
+// key orders data records by payload, so that a prefix of the payload finds them with a cursor.
+// The txid and the output index follow, so that equal payloads in different outputs have different keys.
+func (r *DataRecord) key() []byte {
+	var buf []byte
+
+	buf = append(buf, r.Data...)
+	buf = append(buf, r.TxId[:]...)
+	buf = append(buf, marshal.Uint32ToBytes(r.N)...)
+
+	return buf
+}
+
+func uDataRecord(k, v []byte) (*DataRecord, error) {
+	if len(k) < 32+4 || len(v) != 4 {
+		return nil, fmt.Errorf("invalid data record size %d, %d", len(k), len(v))
+	}
+
+	p := len(k) - 32 - 4
+	record := &DataRecord{
+		Data:   append([]byte{}, k[:p]...),
+		TxId:   core.Hash256FromSlice(k[p : p+32]),
+		N:      marshal.Uint32FromBytes(k[p+32:]),
+		Height: marshal.Uint32FromBytes(v),
+	}
+
+	return record, nil
 }
 
 type BlockIndexRepo struct {
@@ -133,7 +284,7 @@ type BlockIndexRepo struct {
 func NewBlockIndexRepo(rootDir string) (*BlockIndexRepo, error) {
 	repo := &BlockIndexRepo{db: nil}
 
-	if err := os.Mkdir(rootDir+"/db", os.ModePerm); !os.IsExist(err) {
+	if err := os.MkdirAll(rootDir+"/db", os.ModePerm); err != nil {
 		return nil, fmt.Errorf("cannot create db directory: %v", err)
 	}
 
@@ -144,7 +295,7 @@ func NewBlockIndexRepo(rootDir string) (*BlockIndexRepo, error) {
 
 	repo.db = db
 
-	// create four buckets
+	// create six buckets
 	err = db.Update(func(tx *bolt.Tx) error {
 		if _, err := tx.CreateBucketIfNotExists([]byte("b")); err != nil {
 			return fmt.Errorf("cannot create 'b': %w", err)
@@ -155,9 +306,23 @@ func NewBlockIndexRepo(rootDir string) (*BlockIndexRepo, error) {
 		if _, err := tx.CreateBucketIfNotExists([]byte("t")); err != nil {
 			return fmt.Errorf("cannot create 't': %w", err)
 		} // Transaction Index
-		if _, err := tx.CreateBucketIfNotExists([]byte("l")); err != nil {
+		if _, err := tx.CreateBucketIfNotExists([]byte("d")); err != nil {
+			return fmt.Errorf("cannot create 'd': %w", err)
+		} // Data Index
+		l, err := tx.CreateBucketIfNotExists([]byte("l"))
+		if err != nil {
 			return fmt.Errorf("cannot create 'l': %w", err)
 		} // Counter
+		if tx.Bucket([]byte("h")) == nil {
+			if err := createHeightIndex(tx); err != nil {
+				return fmt.Errorf("cannot create 'h': %w", err)
+			}
+		} // Active Chain Height Index
+
+		// a new index is written in the current format; an index with blocks but no version is legacy
+		if k, _ := tx.Bucket([]byte("b")).Cursor().First(); l.Get([]byte("v")) == nil && k == nil {
+			return l.Put([]byte("v"), marshal.Uint32ToBytes(DATA_VERSION))
+		}
 		return nil
 	})
 	if err != nil {
@@ -167,6 +332,30 @@ func NewBlockIndexRepo(rootDir string) (*BlockIndexRepo, error) {
 	return repo, nil
 }
 
+// createHeightIndex creates the height index of the active chain from the block index, which may predate it.
+func createHeightIndex(tx *bolt.Tx) error {
+	h, err := tx.CreateBucket([]byte("h"))
+	if err != nil {
+		return err
+	}
+
+	return tx.Bucket([]byte("b")).ForEach(func(k, v []byte) error {
+		rec, err := UBlockIndexRecord(v)
+		if err != nil || rec.Status != BLOCK_ACTIVE {
+			return nil
+		}
+		return h.Put(heightKey(rec.Height), k)
+	})
+}
+
+// heightKey is the key of a height in the height index. It is big-endian so that the keys sort by height.
+func heightKey(height uint32) []byte {
+	key := make([]byte, 4)
+	binary.BigEndian.PutUint32(key, height)
+
+	return key
+}
+
 func (repo *BlockIndexRepo) PutTransactionRecord(txId core.Hash256, r *TransactionRecord) error {
 	err := repo.db.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte("t"))
@@ -187,9 +376,10 @@ func (repo *BlockIndexRepo) GetTransactionRecord(txId core.Hash256) (*Transactio
 			return fmt.Errorf("record not found")
 		}
 
-		tr = UTransactionRecord(ret)
+		var err error
+		tr, err = UTransactionRecord(ret)
 
-		return nil
+		return err
 	})
 
 	if err != nil {
@@ -199,26 +389,79 @@ func (repo *BlockIndexRepo) GetTransactionRecord(txId core.Hash256) (*Transactio
 	return tr, nil
 }
 
-func (repo *BlockIndexRepo) PutBlockIndexRecord(blkId core.Hash256, r *BlockIndexRecord) error {
+func (repo *BlockIndexRepo) PutDataRecord(r *DataRecord) error {
 	err := repo.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("b"))
-		err := b.Put(blkId[:], r.Marshall())
+		b := tx.Bucket([]byte("d"))
+		err := b.Put(r.key(), marshal.Uint32ToBytes(r.Height))
 		return err
 	})
 
 	return err
 }
 
-func (repo *BlockIndexRepo) DeleteBlockIndexRecord(blkId core.Hash256) error {
+func (repo *BlockIndexRepo) DeleteDataRecord(r *DataRecord) error {
 	err := repo.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("b"))
-		err := b.Delete(blkId[:])
+		b := tx.Bucket([]byte("d"))
+		err := b.Delete(r.key())
 		return err
 	})
 
 	return err
 }
 
+// FindDataRecords returns at most limit data records whose payload starts with prefix.
+// Records come in key order, which sorts equal payloads by txid but may put a payload before a shorter one it
+// extends.
+func (repo *BlockIndexRepo) FindDataRecords(prefix []byte, limit int) ([]*DataRecord, error) {
+	var records []*DataRecord
+
+	err := repo.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte("d")).Cursor()
+
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix) && len(records) < limit; k, v = c.Next() {
+			rec, err := uDataRecord(k, v)
+			if err != nil {
+				log.Warnf("Skipped unreadable data record %X: %s", k, err)
+				continue
+			}
+			// the prefix may run into the txid of a shorter payload
+			if bytes.HasPrefix(rec.Data, prefix) {
+				records = append(records, rec)
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return records, nil
+}
+
+// PutBlockIndexRecord stores the record of a block, and keeps the height index in step with its status: the height
+// of an active block maps to it, and the height of a block leaving the active chain maps to nothing.
+func (repo *BlockIndexRepo) PutBlockIndexRecord(blkId core.Hash256, r *BlockIndexRecord) error {
+	err := repo.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("b"))
+		if err := b.Put(blkId[:], r.Marshall()); err != nil {
+			return err
+		}
+
+		h := tx.Bucket([]byte("h"))
+		if r.Status == BLOCK_ACTIVE {
+			return h.Put(heightKey(r.Height), blkId[:])
+		}
+		if bytes.Equal(h.Get(heightKey(r.Height)), blkId[:]) {
+			return h.Delete(heightKey(r.Height))
+		}
+		return nil
+	})
+
+	return err
+}
+
 func (repo *BlockIndexRepo) GetBlockIndexRecord(blkId core.Hash256) (*BlockIndexRecord, error) {
 	var tr *BlockIndexRecord
 
@@ -228,9 +471,10 @@ func (repo *BlockIndexRepo) GetBlockIndexRecord(blkId core.Hash256) (*BlockIndex
 		if ret == nil {
 			return ErrNotFound
 		}
-		tr = UBlockIndexRecord(ret)
+		var err error
+		tr, err = UBlockIndexRecord(ret)
 
-		return nil
+		return err
 	})
 
 	if err != nil {
@@ -240,22 +484,23 @@ func (repo *BlockIndexRepo) GetBlockIndexRecord(blkId core.Hash256) (*BlockIndex
 	return tr, nil
 }
 
+// GetBlockIndexRecordOfHeight returns the record of the block at height on the active chain.
 func (repo *BlockIndexRepo) GetBlockIndexRecordOfHeight(height uint32) (*BlockIndexRecord, error) {
-	// TODO: inefficient! need proper index
 	var tr *BlockIndexRecord
 
 	err := repo.db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("b"))
-		c := b.Cursor()
-
-		for k, v := c.First(); k != nil; k, v = c.Next() {
-			tr = UBlockIndexRecord(v)
-			if tr.Height == height {
-				return nil
-			}
+		blkId := tx.Bucket([]byte("h")).Get(heightKey(height))
+		if blkId == nil {
+			return ErrNotFound
 		}
+		ret := tx.Bucket([]byte("b")).Get(blkId)
+		if ret == nil {
+			return fmt.Errorf("block %X of height %d: %w", blkId, height, ErrNotFound)
+		}
+		var err error
+		tr, err = UBlockIndexRecord(ret)
 
-		return ErrNotFound
+		return err
 	})
 
 	if err != nil {
@@ -265,6 +510,45 @@ func (repo *BlockIndexRepo) GetBlockIndexRecordOfHeight(height uint32) (*BlockIn
 	return tr, nil
 }
 
+// IterateActiveChain calls fn with the records of the blocks of the active chain from height from to height to, both
+// included, in order of height. It stops early once fn returns false.
+func (repo *BlockIndexRepo) IterateActiveChain(from, to uint32, fn func(blkId core.Hash256, r *BlockIndexRecord) bool) error {
+	return repo.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("b"))
+		c := tx.Bucket([]byte("h")).Cursor()
+
+		for k, v := c.Seek(heightKey(from)); k != nil && binary.BigEndian.Uint32(k) <= to; k, v = c.Next() {
+			ret := b.Get(v)
+			if ret == nil {
+				return fmt.Errorf("block %X of height %d: %w", v, binary.BigEndian.Uint32(k), ErrNotFound)
+			}
+			rec, err := UBlockIndexRecord(ret)
+			if err != nil {
+				return fmt.Errorf("unreadable block index record %X: %w", v, err)
+			}
+			if !fn(core.Hash256FromSlice(v), rec) {
+				return nil
+			}
+		}
+
+		return nil
+	})
+}
+
+// ForEachBlockIndexRecord calls fn with every block index record, whichever branch it is on.
+func (repo *BlockIndexRepo) ForEachBlockIndexRecord(fn func(blkId core.Hash256, r *BlockIndexRecord) error) error {
+	return repo.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("b")).ForEach(func(k, v []byte) error {
+			rec, err := UBlockIndexRecord(v)
+			if err != nil {
+				log.Warnf("Skipped unreadable block index record %X: %s", k, err)
+				return nil
+			}
+			return fn(core.Hash256FromSlice(k), rec)
+		})
+	})
+}
+
 func (repo *BlockIndexRepo) PutFileInfoRecord(fileId uint32, r *FileInfoRecord) error {
 	err := repo.db.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte("f"))
@@ -282,11 +566,12 @@ func (repo *BlockIndexRepo) GetFileInfoRecord(fileId uint32) (*FileInfoRecord, e
 		b := tx.Bucket([]byte("f"))
 		ret := b.Get(marshal.Uint32ToBytes(fileId))
 		if ret == nil {
-			return fmt.Errorf("record not found")
+			return ErrNotFound
 		}
-		tr = UFileInfoRecord(ret)
+		var err error
+		tr, err = UFileInfoRecord(ret)
 
-		return nil
+		return err
 	})
 
 	if err != nil {
@@ -340,3 +625,85 @@ func (repo *BlockIndexRepo) GetCurrentFileId() (uint32, error) {
 
 	return id, nil
 }
+
+// GetDataVersion returns the format version of the block files. Legacy data directories have version 0.
+func (repo *BlockIndexRepo) GetDataVersion() (uint32, error) {
+	var version uint32
+
+	err := repo.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("l"))
+		if ret := b.Get([]byte("v")); ret != nil {
+			version = marshal.Uint32FromBytes(ret)
+		}
+		return nil
+	})
+
+	return version, err
+}
+
+func (repo *BlockIndexRepo) PutDataVersion(version uint32) error {
+	err := repo.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("l"))
+		return b.Put([]byte("v"), marshal.Uint32ToBytes(version))
+	})
+
+	return err
+}
+
+// PrunedFiles returns the ids of the block files that were pruned.
+func (repo *BlockIndexRepo) PrunedFiles() ([]uint32, error) {
+	var ids []uint32
+
+	err := repo.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("f")).ForEach(func(k, v []byte) error {
+			info, err := UFileInfoRecord(v)
+			if err != nil {
+				return err
+			}
+			if info.Pruned {
+				ids = append(ids, marshal.Uint32FromBytes(k))
+			}
+			return nil
+		})
+	})
+
+	return ids, err
+}
+
+// GetReindexPos returns the position in the block files being reindexed of the next block to process, see
+// ForEachReindexBlock.
+func (repo *BlockIndexRepo) GetReindexPos() (ReindexPos, error) {
+	var pos ReindexPos
+
+	err := repo.db.View(func(tx *bolt.Tx) error {
+		ret := tx.Bucket([]byte("l")).Get([]byte("r"))
+		if ret == nil {
+			return ErrNotFound
+		}
+		if len(ret) != 8 {
+			return fmt.Errorf("invalid reindex position size %d", len(ret))
+		}
+		pos.FileId = marshal.Uint32FromBytes(ret[0:4])
+		pos.Offset = marshal.Uint32FromBytes(ret[4:8])
+		return nil
+	})
+
+	return pos, err
+}
+
+func (repo *BlockIndexRepo) PutReindexPos(pos ReindexPos) error {
+	err := repo.db.Update(func(tx *bolt.Tx) error {
+		v := append(marshal.Uint32ToBytes(pos.FileId), marshal.Uint32ToBytes(pos.Offset)...)
+		return tx.Bucket([]byte("l")).Put([]byte("r"), v)
+	})
+
+	return err
+}
+
+func (repo *BlockIndexRepo) DeleteReindexPos() error {
+	err := repo.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("l")).Delete([]byte("r"))
+	})
+
+	return err
+}
@@ -2,7 +2,9 @@ package persistence
 
 import (
 	"fmt"
+	"github.com/boltdb/bolt"
 	core2 "gocoin/core"
+	"math/big"
 	"os"
 	"reflect"
 	"testing"
@@ -21,7 +23,7 @@ func TestAllBlockFile(t *testing.T) {
 	txId := core2.RandomHash256()
 	txRec := &TransactionRecord{
 		BlockFileID: 123,
-		BlockOffset: 12,
+		BlockPos:    FilePos{Offset: 12, Size: 345},
 		TxOffset:    2,
 	}
 
@@ -37,7 +39,9 @@ func TestAllBlockFile(t *testing.T) {
 		Height:      123,
 		TxCount:     12,
 		BlockFileID: 12,
-		Offset:      2,
+		BlockPos:    FilePos{Offset: 2, Size: 345},
+		UndoPos:     FilePos{Offset: 6, Size: 78},
+		ChainWork:   big.NewInt(123456789),
 	}
 
 	fileId := uint32(12)
@@ -92,6 +96,20 @@ func TestAllBlockFile(t *testing.T) {
 		t.Fatalf("records not equal")
 	}
 
+	// records written before pruning lack the pruned flag
+	legacy, err := UFileInfoRecord(fileRec.Marshall()[:S_FILE_INFO_RECORD-1])
+	if err != nil || !reflect.DeepEqual(fileRec, legacy) {
+		t.Fatalf("cannot decode legacy record: %v", err)
+	}
+
+	fileRec.Pruned = true
+	if err := repo.PutFileInfoRecord(fileId, fileRec); err != nil {
+		t.Errorf("cannot put record: %s", err)
+	}
+	if pruned, err := repo.PrunedFiles(); err != nil || len(pruned) != 1 || pruned[0] != fileId {
+		t.Fatalf("pruned files = %v, %v; want [%d]", pruned, err, fileId)
+	}
+
 	// File Id
 
 	if err := repo.PutCurrentFileId(fileId); err != nil {
@@ -107,3 +125,157 @@ func TestAllBlockFile(t *testing.T) {
 		t.Errorf("failed to increment file Id: got %d", gotFileId)
 	}
 }
+
+func TestBlockIndexRepo_FindDataRecords(t *testing.T) {
+	tmpPath := fmt.Sprintf("/tmp/blk_%x.index", core2.RandomHash256().String())
+
+	repo, err := NewBlockIndexRepo(tmpPath)
+	if err != nil {
+		t.Fatalf("cannot open repo: %s", err)
+	}
+	defer os.RemoveAll(tmpPath)
+
+	short := &DataRecord{Data: []byte("doc"), TxId: core2.RandomHash256(), N: 0, Height: 1}
+	long := &DataRecord{Data: []byte("document"), TxId: core2.RandomHash256(), N: 1, Height: 2}
+	other := &DataRecord{Data: []byte("other"), TxId: core2.RandomHash256(), N: 0, Height: 3}
+	for _, r := range []*DataRecord{short, long, other} {
+		if err := repo.PutDataRecord(r); err != nil {
+			t.Fatalf("cannot put record: %s", err)
+		}
+	}
+
+	tests := []struct {
+		prefix string
+		want   []*DataRecord
+	}{
+		{"doc", []*DataRecord{short, long}},
+		{"docu", []*DataRecord{long}},
+		{"x", nil},
+		{"", []*DataRecord{short, long, other}},
+	}
+
+	for _, tt := range tests {
+		got, err := repo.FindDataRecords([]byte(tt.prefix), 10)
+		if err != nil {
+			t.Fatalf("cannot find records: %s", err)
+		}
+
+		// the order of "doc" and "document" depends on the txid of "doc"
+		found := make(map[core2.Hash256]*DataRecord)
+		for _, r := range got {
+			found[r.TxId] = r
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("prefix %q: got %d records; want %d", tt.prefix, len(got), len(tt.want))
+		}
+		for _, r := range tt.want {
+			if !reflect.DeepEqual(found[r.TxId], r) {
+				t.Errorf("prefix %q: record %q not found", tt.prefix, r.Data)
+			}
+		}
+	}
+
+	if got, _ := repo.FindDataRecords(nil, 1); len(got) != 1 {
+		t.Errorf("got %d records; want the limit of 1", len(got))
+	}
+
+	_ = repo.DeleteDataRecord(long)
+	if got, _ := repo.FindDataRecords([]byte("docu"), 10); len(got) != 0 {
+		t.Errorf("found a deleted record")
+	}
+}
+
+func TestBlockIndexRepo_ActiveChain(t *testing.T) {
+	tmpPath := fmt.Sprintf("/tmp/blk_%x.index", core2.RandomHash256().String())
+	repo, err := NewBlockIndexRepo(tmpPath)
+	if err != nil {
+		t.Fatalf("cannot open repo: %s", err)
+	}
+	defer os.RemoveAll(tmpPath)
+
+	tree, err := NewBlockTree(repo)
+	if err != nil {
+		t.Fatalf("cannot load tree: %s", err)
+	}
+
+	// a stale block shares height 2 with an active one
+	active := putBranch(t, tree, core2.Hash256{}, EASY_BITS, 5, BLOCK_ACTIVE)
+	stale := putBranch(t, tree, active[1], EASY_BITS, 1, BLOCK_STALE)
+
+	expectActive := func(want []core2.Hash256) {
+		t.Helper()
+		for height, blkId := range want {
+			if rec, err := repo.GetBlockIndexRecordOfHeight(uint32(height)); err != nil || rec.Hash() != blkId {
+				t.Fatalf("block of height %d = %v, %v; want %s", height, rec, err, blkId)
+			}
+		}
+		if _, err := repo.GetBlockIndexRecordOfHeight(uint32(len(want))); err != ErrNotFound {
+			t.Fatalf("block above the tip: %v", err)
+		}
+	}
+	expectActive(active)
+
+	var got []core2.Hash256
+	err = repo.IterateActiveChain(1, 3, func(blkId core2.Hash256, r *BlockIndexRecord) bool {
+		got = append(got, blkId)
+		return true
+	})
+	if err != nil || !reflect.DeepEqual(got, active[1:4]) {
+		t.Fatalf("iterated %v, %v; want %v", got, err, active[1:4])
+	}
+
+	// disconnecting the tip and connecting the stale block in its place
+	for _, blkId := range []core2.Hash256{active[4], active[3], active[2]} {
+		if err := tree.SetStatus(blkId, BLOCK_STALE); err != nil {
+			t.Fatalf("cannot set status: %s", err)
+		}
+	}
+	if err := tree.SetStatus(stale[0], BLOCK_ACTIVE); err != nil {
+		t.Fatalf("cannot set status: %s", err)
+	}
+	expectActive([]core2.Hash256{active[0], active[1], stale[0]})
+
+	// an index predating the height index is indexed on opening
+	err = repo.db.Update(func(tx *bolt.Tx) error {
+		return tx.DeleteBucket([]byte("h"))
+	})
+	if err != nil {
+		t.Fatalf("cannot delete height index: %s", err)
+	}
+	repo.db.Close()
+	if repo, err = NewBlockIndexRepo(tmpPath); err != nil {
+		t.Fatalf("cannot reopen repo: %s", err)
+	}
+	expectActive([]core2.Hash256{active[0], active[1], stale[0]})
+}
+
+func TestBlockIndexRepo_ReindexPos(t *testing.T) {
+	tmpPath := fmt.Sprintf("/tmp/blk_%x.index", core2.RandomHash256().String())
+	repo, err := NewBlockIndexRepo(tmpPath)
+	if err != nil {
+		t.Fatalf("cannot open repo: %s", err)
+	}
+	defer os.RemoveAll(tmpPath)
+
+	if _, err := repo.GetReindexPos(); err != ErrNotFound {
+		t.Fatalf("reindex position of a new repo: %v", err)
+	}
+	pos := ReindexPos{FileId: 3, Offset: 120}
+	if err := repo.PutReindexPos(pos); err != nil {
+		t.Fatalf("cannot put reindex position: %s", err)
+	}
+	if got, err := repo.GetReindexPos(); err != nil || got != pos {
+		t.Fatalf("reindex position = %v, %v; want %v", got, err, pos)
+	}
+
+	// a damaged record is an error, not a panic
+	err = repo.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("l")).Put([]byte("r"), []byte{1, 2, 3})
+	})
+	if err != nil {
+		t.Fatalf("cannot damage reindex position: %s", err)
+	}
+	if _, err := repo.GetReindexPos(); err == nil || err == ErrNotFound {
+		t.Fatalf("read a damaged reindex position: %v", err)
+	}
+}
@@ -0,0 +1,143 @@
+package persistence
+
+import (
+	"container/list"
+	"fmt"
+	"gocoin/core"
+	"gocoin/marshal"
+	"sync"
+)
+
+// S_BLOCK_CACHE is the number of blocks a BlockReader keeps in memory.
+const S_BLOCK_CACHE = 64
+
+// BlockReader reads single blocks, transactions and undo records from the block files of a data directory.
+// The blocks read last are cached, which saves decoding them again when peers or RPC clients ask for the same blocks;
+// cached blocks are shared, so callers must not modify them. Reading from a pruned block file fails with ErrPruned.
+type BlockReader struct {
+	rootDir string
+	size    int
+	blocks  map[blockKey]*list.Element
+	lru     list.List // of *cachedBlock, the most recently used first
+	pruned  map[uint32]bool
+	mutex   sync.Mutex
+}
+
+// blockKey identifies a block by where it is stored, which transaction records also know.
+type blockKey struct {
+	fileId uint32
+	offset uint32
+}
+
+type cachedBlock struct {
+	key   blockKey
+	block *core.Block
+}
+
+func NewBlockReader(rootDir string, size int) *BlockReader {
+	return &BlockReader{
+		rootDir: rootDir,
+		size:    size,
+		blocks:  make(map[blockKey]*list.Element),
+		pruned:  make(map[uint32]bool),
+	}
+}
+
+// SetPruned marks a block file as pruned, before it is deleted.
+func (r *BlockReader) SetPruned(fileId uint32) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.pruned[fileId] = true
+	for e := r.lru.Front(); e != nil; {
+		next := e.Next()
+		if key := e.Value.(*cachedBlock).key; key.fileId == fileId {
+			r.lru.Remove(e)
+			delete(r.blocks, key)
+		}
+		e = next
+	}
+}
+
+func (r *BlockReader) isPruned(fileId uint32) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.pruned[fileId]
+}
+
+// GetBlock returns the block of a block index record.
+func (r *BlockReader) GetBlock(rec *BlockIndexRecord) (*core.Block, error) {
+	block, err := r.readBlock(rec.BlockFileID, rec.BlockPos)
+	if err != nil {
+		return nil, err
+	}
+	if block.Hash != rec.Hash() {
+		return nil, fmt.Errorf("block %d:%d is %s, not %s", rec.BlockFileID, rec.BlockPos.Offset, block.Hash, rec.Hash())
+	}
+
+	return block, nil
+}
+
+// GetUndo returns the UXTOs the block of a block index record spent, as stored when it was connected.
+func (r *BlockReader) GetUndo(rec *BlockIndexRecord) ([]*core.UXTO, error) {
+	if r.isPruned(rec.BlockFileID) {
+		return nil, fmt.Errorf("undo data of block %s: %w", rec.Hash(), ErrPruned)
+	}
+	record, err := readFileRecord(revFilePath(r.rootDir, rec.BlockFileID), rec.UndoPos)
+	if err != nil {
+		return nil, err
+	}
+
+	return marshal.DeserializeUXTOs(record)
+}
+
+// GetTransaction returns the transaction of a transaction record.
+func (r *BlockReader) GetTransaction(txRec *TransactionRecord) (*core.Transaction, error) {
+	block, err := r.readBlock(txRec.BlockFileID, txRec.BlockPos)
+	if err != nil {
+		return nil, err
+	}
+	if int(txRec.TxOffset) >= len(block.Transactions) {
+		return nil, fmt.Errorf("transaction %d of block %s: %w", txRec.TxOffset, block.Hash, ErrNotFound)
+	}
+
+	return block.Transactions[txRec.TxOffset], nil
+}
+
+func (r *BlockReader) readBlock(fileId uint32, pos FilePos) (*core.Block, error) {
+	key := blockKey{fileId: fileId, offset: pos.Offset}
+
+	r.mutex.Lock()
+	if r.pruned[fileId] {
+		r.mutex.Unlock()
+		return nil, fmt.Errorf("block file %d: %w", fileId, ErrPruned)
+	}
+	if e, ok := r.blocks[key]; ok {
+		r.lru.MoveToFront(e)
+		r.mutex.Unlock()
+		return e.Value.(*cachedBlock).block, nil
+	}
+	r.mutex.Unlock()
+
+	record, err := readFileRecord(blkFilePath(r.rootDir, fileId), pos)
+	if err != nil {
+		return nil, err
+	}
+	block, err := marshal.UBlock(record)
+	if err != nil {
+		return nil, fmt.Errorf("block %d:%d: %w", fileId, pos.Offset, err)
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if _, ok := r.blocks[key]; !ok {
+		r.blocks[key] = r.lru.PushFront(&cachedBlock{key: key, block: block})
+		for r.lru.Len() > r.size {
+			oldest := r.lru.Remove(r.lru.Back()).(*cachedBlock)
+			delete(r.blocks, oldest.key)
+		}
+	}
+
+	return block, nil
+}
@@ -0,0 +1,375 @@
+package persistence
+
+import (
+	"fmt"
+	"gocoin/core"
+	"math/big"
+	"sync"
+)
+
+// S_ORPHAN_POOL bounds the number of orphans kept until their parents arrive.
+const S_ORPHAN_POOL = 100
+
+// BlockTree is an in-memory view of the block index. It holds every block whose ancestry is known, whichever branch
+// it is on, and writes its records through to the repo so that it can be rebuilt from there on restart.
+// Orphans, whose parent has not been seen yet, are kept in memory only, keyed by that parent.
+type BlockTree struct {
+	repo       *BlockIndexRepo
+	records    map[core.Hash256]*BlockIndexRecord
+	children   map[core.Hash256][]core.Hash256
+	orphans    map[core.Hash256][]*core.Block
+	orphanList []*core.Block // orphans in the order they were added
+	mutex      sync.Mutex
+}
+
+// NewBlockTree loads every record of repo into a new tree.
+func NewBlockTree(repo *BlockIndexRepo) (*BlockTree, error) {
+	t := &BlockTree{
+		repo:     repo,
+		records:  make(map[core.Hash256]*BlockIndexRecord),
+		children: make(map[core.Hash256][]core.Hash256),
+		orphans:  make(map[core.Hash256][]*core.Block),
+	}
+
+	err := repo.ForEachBlockIndexRecord(func(blkId core.Hash256, r *BlockIndexRecord) error {
+		t.index(blkId, r)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot load block index: %w", err)
+	}
+
+	return t, nil
+}
+
+func (t *BlockTree) index(blkId core.Hash256, r *BlockIndexRecord) {
+	if _, ok := t.records[blkId]; !ok {
+		t.children[r.HashPrevBlock] = append(t.children[r.HashPrevBlock], blkId)
+	}
+	t.records[blkId] = r
+}
+
+// Get returns a copy of the record of a block in the tree.
+func (t *BlockTree) Get(blkId core.Hash256) (*BlockIndexRecord, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	r, ok := t.records[blkId]
+	if !ok {
+		return nil, false
+	}
+	rec := *r
+
+	return &rec, true
+}
+
+// Put adds or replaces the record of a block. A block whose parent is invalid is stored as invalid.
+func (t *BlockTree) Put(blkId core.Hash256, r *BlockIndexRecord) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	rec := *r
+	if parent, ok := t.records[rec.HashPrevBlock]; ok && parent.Status == BLOCK_INVALID {
+		rec.Status = BLOCK_INVALID
+	}
+
+	return t.put(blkId, &rec)
+}
+
+func (t *BlockTree) put(blkId core.Hash256, r *BlockIndexRecord) error {
+	if err := t.repo.PutBlockIndexRecord(blkId, r); err != nil {
+		return fmt.Errorf("failed to save block index record of %s: %w", blkId, err)
+	}
+	t.index(blkId, r)
+
+	return nil
+}
+
+// SetStatus updates the status of a block in the tree.
+func (t *BlockTree) SetStatus(blkId core.Hash256, status BlockStatus) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return t.setStatus(blkId, status)
+}
+
+func (t *BlockTree) setStatus(blkId core.Hash256, status BlockStatus) error {
+	r, ok := t.records[blkId]
+	if !ok {
+		return fmt.Errorf("block %s: %w", blkId, ErrNotFound)
+	}
+	rec := *r
+	rec.Status = status
+
+	return t.put(blkId, &rec)
+}
+
+// Invalidate marks a block and all of its descendants invalid.
+func (t *BlockTree) Invalidate(blkId core.Hash256) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for queue := []core.Hash256{blkId}; len(queue) > 0; queue = queue[1:] {
+		if err := t.setStatus(queue[0], BLOCK_INVALID); err != nil {
+			return err
+		}
+		queue = append(queue, t.children[queue[0]]...)
+	}
+
+	return nil
+}
+
+// FileHeights returns the height of the highest block stored in each block file.
+func (t *BlockTree) FileHeights() map[uint32]uint32 {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	heights := make(map[uint32]uint32)
+	for _, r := range t.records {
+		if r.Status.HasData() && r.Height >= heights[r.BlockFileID] {
+			heights[r.BlockFileID] = r.Height
+		}
+	}
+
+	return heights
+}
+
+// ContenderFiles returns the block files holding the data of blocks off the active chain that lead to a block with at
+// least minWork, which could still become the active tip.
+func (t *BlockTree) ContenderFiles(minWork *big.Int) map[uint32]bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	files := make(map[uint32]bool)
+	visited := make(map[core.Hash256]bool)
+	for blkId, r := range t.records {
+		if r.Status == BLOCK_ACTIVE || r.Status == BLOCK_INVALID || r.ChainWork.Cmp(minWork) < 0 {
+			continue
+		}
+		for h := blkId; !visited[h]; {
+			visited[h] = true
+			p, ok := t.records[h]
+			if !ok || p.Status == BLOCK_ACTIVE {
+				break
+			}
+			if p.Status.HasData() {
+				files[p.BlockFileID] = true
+			}
+			h = p.HashPrevBlock
+		}
+	}
+
+	return files
+}
+
+// PruneFile leaves the blocks stored in a block file that is deleted with their header only. Blocks of the active
+// chain keep their status, see BlockReader.SetPruned.
+func (t *BlockTree) PruneFile(fileId uint32) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for blkId, r := range t.records {
+		if r.BlockFileID != fileId || r.Status == BLOCK_ACTIVE || !r.Status.HasData() {
+			continue
+		}
+		if err := t.setStatus(blkId, BLOCK_HEADER_ONLY); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Tips returns the records of the tips of every branch: the blocks without children, and the tip of the active chain,
+// whose children may be on other branches.
+func (t *BlockTree) Tips() []*BlockIndexRecord {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	var tips []*BlockIndexRecord
+	for blkId, r := range t.records {
+		if t.isTip(blkId, r) {
+			rec := *r
+			tips = append(tips, &rec)
+		}
+	}
+
+	return tips
+}
+
+func (t *BlockTree) isTip(blkId core.Hash256, r *BlockIndexRecord) bool {
+	for _, child := range t.children[blkId] {
+		if r.Status != BLOCK_ACTIVE || t.records[child].Status == BLOCK_ACTIVE {
+			return false
+		}
+	}
+
+	return true
+}
+
+// BranchLength returns the number of blocks between the active chain and a block, 0 if it is on the active chain.
+func (t *BlockTree) BranchLength(blkId core.Hash256) (int, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for n, h := 0, blkId; ; n++ {
+		r, ok := t.records[h]
+		if !ok {
+			return 0, fmt.Errorf("block %s does not branch off the active chain", blkId)
+		}
+		if r.Status == BLOCK_ACTIVE {
+			return n, nil
+		}
+		h = r.HashPrevBlock
+	}
+}
+
+// BestTip returns the block the active chain should end at: the one with the most work, see core.ChainTip.Better,
+// among those whose data and that of their ancestors down to the active chain is stored and not known to be invalid.
+func (t *BlockTree) BestTip() (*BlockIndexRecord, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	var best *BlockIndexRecord
+	var bestTip core.ChainTip
+	for blkId, r := range t.records {
+		tip := core.ChainTip{Hash: blkId, ChainWork: r.ChainWork}
+		if !r.Status.HasData() || (best != nil && !tip.Better(bestTip)) {
+			continue
+		}
+		if _, err := t.path(blkId); err != nil {
+			continue
+		}
+		best, bestTip = r, tip
+	}
+
+	if best == nil {
+		return nil, false
+	}
+	rec := *best
+
+	return &rec, true
+}
+
+// PathFromActive returns the block of the active chain a block branches off from, and the records of the blocks
+// after it up to and including the given one, oldest first. The path is empty if the block is on the active chain.
+func (t *BlockTree) PathFromActive(blkId core.Hash256) (core.Hash256, []*BlockIndexRecord, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	path, err := t.path(blkId)
+	if err != nil {
+		return core.Hash256{}, nil, err
+	}
+
+	fork := blkId
+	records := make([]*BlockIndexRecord, len(path))
+	for i, h := range path {
+		rec := *t.records[h]
+		records[i] = &rec
+	}
+	if len(path) > 0 {
+		fork = records[0].HashPrevBlock
+	}
+
+	return fork, records, nil
+}
+
+// path returns the blocks from the active chain to blkId, failing if one of them cannot be connected.
+func (t *BlockTree) path(blkId core.Hash256) ([]core.Hash256, error) {
+	var path []core.Hash256
+
+	for h := blkId; ; {
+		r, ok := t.records[h]
+		if !ok {
+			return nil, fmt.Errorf("block %s does not branch off the active chain", blkId)
+		}
+		if r.Status == BLOCK_ACTIVE {
+			break
+		}
+		if !r.Status.HasData() {
+			return nil, fmt.Errorf("block %s on the path to %s is %s", h, blkId, r.Status)
+		}
+		path = append(path, h)
+		h = r.HashPrevBlock
+	}
+
+	for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+		path[i], path[j] = path[j], path[i]
+	}
+
+	return path, nil
+}
+
+// AddOrphan keeps a block whose parent is unknown until the parent arrives, see TakeOrphans. When the pool is full,
+// the oldest orphan is evicted. It returns false if the block is already kept.
+func (t *BlockTree) AddOrphan(block *core.Block) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.hasOrphan(block.Hash) {
+		return false
+	}
+	if len(t.orphanList) >= S_ORPHAN_POOL {
+		t.removeOrphan(t.orphanList[0])
+	}
+	t.orphans[block.HashPrevBlock] = append(t.orphans[block.HashPrevBlock], block)
+	t.orphanList = append(t.orphanList, block)
+
+	return true
+}
+
+func (t *BlockTree) removeOrphan(block *core.Block) {
+	siblings := t.orphans[block.HashPrevBlock]
+	for i, b := range siblings {
+		if b == block {
+			siblings = append(siblings[:i:i], siblings[i+1:]...)
+			break
+		}
+	}
+	if len(siblings) == 0 {
+		delete(t.orphans, block.HashPrevBlock)
+	} else {
+		t.orphans[block.HashPrevBlock] = siblings
+	}
+
+	for i, b := range t.orphanList {
+		if b == block {
+			t.orphanList = append(t.orphanList[:i:i], t.orphanList[i+1:]...)
+			break
+		}
+	}
+}
+
+// HasOrphan reports whether a block is waiting in the orphan pool.
+func (t *BlockTree) HasOrphan(blkId core.Hash256) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return t.hasOrphan(blkId)
+}
+
+func (t *BlockTree) hasOrphan(blkId core.Hash256) bool {
+	for _, blocks := range t.orphans {
+		for _, b := range blocks {
+			if b.Hash == blkId {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// TakeOrphans removes the orphans waiting for parent from the pool and returns them.
+func (t *BlockTree) TakeOrphans(parent core.Hash256) []*core.Block {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	blocks := t.orphans[parent]
+	for _, b := range blocks {
+		t.removeOrphan(b)
+	}
+
+	return blocks
+}
@@ -0,0 +1,269 @@
+package persistence
+
+import (
+	"fmt"
+	core2 "gocoin/core"
+	"math/big"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+const (
+	EASY_BITS = 0x1f7fffff
+	HARD_BITS = 0x1e7fffff // 256 times the work of EASY_BITS
+)
+
+// putBranch indexes n blocks of the given difficulty after parent and returns their hashes.
+func putBranch(t *testing.T, tree *BlockTree, parent core2.Hash256, nBits uint32, n int, status BlockStatus) []core2.Hash256 {
+	var hashes []core2.Hash256
+
+	for i := 0; i < n; i++ {
+		height, work := uint32(0), new(big.Int)
+		if p, ok := tree.Get(parent); ok {
+			height, work = p.Height+1, p.ChainWork
+		}
+		rec := &BlockIndexRecord{
+			BlockHeader: core2.BlockHeader{HashPrevBlock: parent, NBits: nBits, Nonce: rand.Uint32()},
+			Height:      height,
+		}
+		rec.ChainWork = new(big.Int).Add(work, rec.Work())
+		rec.Status = status
+
+		if err := tree.Put(rec.Hash(), rec); err != nil {
+			t.Fatalf("cannot put record: %s", err)
+		}
+		parent = rec.Hash()
+		hashes = append(hashes, parent)
+	}
+
+	return hashes
+}
+
+func TestBlockTree_BestTip(t *testing.T) {
+	tmpPath := fmt.Sprintf("/tmp/blk_%x.index", core2.RandomHash256().String())
+	repo, err := NewBlockIndexRepo(tmpPath)
+	if err != nil {
+		t.Fatalf("cannot open repo: %s", err)
+	}
+	defer os.RemoveAll(tmpPath)
+
+	tree, err := NewBlockTree(repo)
+	if err != nil {
+		t.Fatalf("cannot load tree: %s", err)
+	}
+
+	// genesis <- a1 <- a2 is active; a long branch of easy blocks and a short one of hard blocks compete with it
+	active := putBranch(t, tree, core2.Hash256{}, EASY_BITS, 3, BLOCK_ACTIVE)
+	genesis, a1, a2 := active[0], active[1], active[2]
+	easy := putBranch(t, tree, genesis, EASY_BITS, 4, BLOCK_DATA_AVAILABLE)
+	hard := putBranch(t, tree, a1, HARD_BITS, 1, BLOCK_DATA_AVAILABLE)
+
+	expectBest := func(want core2.Hash256) {
+		t.Helper()
+		if best, ok := tree.BestTip(); !ok || best.Hash() != want {
+			t.Fatalf("best tip = %v; want %s", best, want)
+		}
+	}
+
+	expectBest(hard[0])
+	if fork, path, err := tree.PathFromActive(hard[0]); err != nil || fork != a1 || len(path) != 1 {
+		t.Fatalf("path to hard branch: fork %s, %d blocks, %v", fork, len(path), err)
+	}
+
+	// invalid blocks and their descendants are never activated
+	if err := tree.Invalidate(hard[0]); err != nil {
+		t.Fatalf("cannot invalidate: %s", err)
+	}
+	child := putBranch(t, tree, hard[0], HARD_BITS, 1, BLOCK_DATA_AVAILABLE)
+	if rec, _ := tree.Get(child[0]); rec.Status != BLOCK_INVALID {
+		t.Fatalf("child of an invalid block is %s", rec.Status)
+	}
+	expectBest(easy[3])
+	fork, path, err := tree.PathFromActive(easy[3])
+	if err != nil || fork != genesis || len(path) != 4 || path[0].Hash() != easy[0] {
+		t.Fatalf("path to easy branch: fork %s, %d blocks, %v", fork, len(path), err)
+	}
+
+	// neither are blocks whose ancestors have no data
+	if err := tree.SetStatus(easy[1], BLOCK_HEADER_ONLY); err != nil {
+		t.Fatalf("cannot set status: %s", err)
+	}
+	expectBest(a2)
+
+	// the active tip, the easy branch and the invalid block after the hard one
+	if tips := tree.Tips(); len(tips) != 3 {
+		t.Fatalf("found %d tips; want 3", len(tips))
+	}
+
+	// the tree is rebuilt from the repo
+	tree, err = NewBlockTree(repo)
+	if err != nil {
+		t.Fatalf("cannot reload tree: %s", err)
+	}
+	expectBest(a2)
+	if rec, ok := tree.Get(hard[0]); !ok || rec.Status != BLOCK_INVALID {
+		t.Fatalf("status of invalid block not reloaded: %v", rec)
+	}
+}
+
+func TestBlockTree_Tips(t *testing.T) {
+	tmpPath := fmt.Sprintf("/tmp/blk_%x.index", core2.RandomHash256().String())
+	repo, err := NewBlockIndexRepo(tmpPath)
+	if err != nil {
+		t.Fatalf("cannot open repo: %s", err)
+	}
+	defer os.RemoveAll(tmpPath)
+
+	tree, err := NewBlockTree(repo)
+	if err != nil {
+		t.Fatalf("cannot load tree: %s", err)
+	}
+
+	// the active tip is a tip even though an invalid block builds on it
+	active := putBranch(t, tree, core2.Hash256{}, EASY_BITS, 2, BLOCK_ACTIVE)
+	invalid := putBranch(t, tree, active[1], HARD_BITS, 2, BLOCK_INVALID)
+	stale := putBranch(t, tree, active[0], EASY_BITS, 3, BLOCK_STALE)
+
+	tips := make(map[core2.Hash256]BlockStatus)
+	for _, rec := range tree.Tips() {
+		tips[rec.Hash()] = rec.Status
+	}
+	want := map[core2.Hash256]BlockStatus{active[1]: BLOCK_ACTIVE, invalid[1]: BLOCK_INVALID, stale[2]: BLOCK_STALE}
+	if len(tips) != len(want) {
+		t.Fatalf("found %d tips; want %d", len(tips), len(want))
+	}
+	for h, status := range want {
+		if tips[h] != status {
+			t.Fatalf("tip %s is %s; want %s", h, tips[h], status)
+		}
+	}
+
+	for h, n := range map[core2.Hash256]int{active[1]: 0, invalid[1]: 2, stale[2]: 3} {
+		if got, err := tree.BranchLength(h); err != nil || got != n {
+			t.Fatalf("branch length of %s = %d, %v; want %d", h, got, err, n)
+		}
+	}
+	if _, err := tree.BranchLength(core2.RandomHash256()); err == nil {
+		t.Fatalf("branch length of unknown block")
+	}
+}
+
+func TestBlockTree_PruneFile(t *testing.T) {
+	tmpPath := fmt.Sprintf("/tmp/blk_%x.index", core2.RandomHash256().String())
+	repo, err := NewBlockIndexRepo(tmpPath)
+	if err != nil {
+		t.Fatalf("cannot open repo: %s", err)
+	}
+	defer os.RemoveAll(tmpPath)
+
+	tree, err := NewBlockTree(repo)
+	if err != nil {
+		t.Fatalf("cannot load tree: %s", err)
+	}
+
+	// all in block file 0, which also holds a stale branch
+	active := putBranch(t, tree, core2.Hash256{}, EASY_BITS, 4, BLOCK_ACTIVE)
+	stale := putBranch(t, tree, active[1], EASY_BITS, 1, BLOCK_STALE)
+	if heights := tree.FileHeights(); len(heights) != 1 || heights[0] != 3 {
+		t.Fatalf("file heights = %v; want height 3 in file 0", heights)
+	}
+
+	if err := tree.PruneFile(1); err != nil {
+		t.Fatalf("cannot prune file: %s", err)
+	}
+	if rec, _ := tree.Get(stale[0]); rec.Status != BLOCK_STALE {
+		t.Fatalf("block of another file is %s", rec.Status)
+	}
+
+	if err := tree.PruneFile(0); err != nil {
+		t.Fatalf("cannot prune file: %s", err)
+	}
+	if rec, _ := tree.Get(stale[0]); rec.Status != BLOCK_HEADER_ONLY {
+		t.Fatalf("stale block of a pruned file is %s", rec.Status)
+	}
+	if rec, _ := tree.Get(active[3]); rec.Status != BLOCK_ACTIVE {
+		t.Fatalf("active block of a pruned file is %s", rec.Status)
+	}
+	if best, ok := tree.BestTip(); !ok || best.Hash() != active[3] {
+		t.Fatalf("best tip = %v; want %s", best, active[3])
+	}
+}
+
+func TestBlockTree_ContenderFiles(t *testing.T) {
+	tmpPath := fmt.Sprintf("/tmp/blk_%x.index", core2.RandomHash256().String())
+	repo, err := NewBlockIndexRepo(tmpPath)
+	if err != nil {
+		t.Fatalf("cannot open repo: %s", err)
+	}
+	defer os.RemoveAll(tmpPath)
+
+	tree, err := NewBlockTree(repo)
+	if err != nil {
+		t.Fatalf("cannot load tree: %s", err)
+	}
+
+	moveToFile := func(hashes []core2.Hash256, fileId uint32) {
+		for _, h := range hashes {
+			rec, _ := tree.Get(h)
+			rec.BlockFileID = fileId
+			if err := tree.Put(h, rec); err != nil {
+				t.Fatalf("cannot put record: %s", err)
+			}
+		}
+	}
+
+	// the active chain is in file 0; a branch as long as it is in file 1, a short one in file 2, an invalid one in 3
+	active := putBranch(t, tree, core2.Hash256{}, EASY_BITS, 4, BLOCK_ACTIVE)
+	contender := putBranch(t, tree, active[1], EASY_BITS, 2, BLOCK_DATA_AVAILABLE)
+	moveToFile(contender, 1)
+	short := putBranch(t, tree, active[0], EASY_BITS, 1, BLOCK_STALE)
+	moveToFile(short, 2)
+	invalid := putBranch(t, tree, active[0], HARD_BITS, 1, BLOCK_INVALID)
+	moveToFile(invalid, 3)
+
+	tip, _ := tree.Get(active[3])
+	minWork := new(big.Int).Sub(tip.ChainWork, tip.Work())
+	if files := tree.ContenderFiles(minWork); len(files) != 1 || !files[1] {
+		t.Fatalf("contender files = %v; want file 1", files)
+	}
+	if files := tree.ContenderFiles(new(big.Int)); len(files) != 2 || !files[1] || !files[2] {
+		t.Fatalf("contender files = %v; want files 1 and 2", files)
+	}
+}
+
+func TestBlockTree_Orphans(t *testing.T) {
+	tree := &BlockTree{orphans: make(map[core2.Hash256][]*core2.Block)}
+
+	parent := core2.RandomHash256()
+	orphan := &core2.Block{Hash: core2.RandomHash256(), BlockHeader: core2.BlockHeader{HashPrevBlock: parent}}
+	if !tree.AddOrphan(orphan) || tree.AddOrphan(orphan) {
+		t.Fatalf("orphan not added exactly once")
+	}
+	if !tree.HasOrphan(orphan.Hash) {
+		t.Fatalf("orphan not found")
+	}
+
+	// the pool is bounded, the oldest orphan makes room for a new one
+	for i := 1; i < S_ORPHAN_POOL; i++ {
+		tree.AddOrphan(&core2.Block{Hash: core2.RandomHash256(), BlockHeader: core2.BlockHeader{HashPrevBlock: parent}})
+	}
+	other := core2.RandomHash256()
+	newest := &core2.Block{Hash: core2.RandomHash256(), BlockHeader: core2.BlockHeader{HashPrevBlock: other}}
+	if !tree.AddOrphan(newest) {
+		t.Fatalf("orphan not added to a full pool")
+	}
+	if tree.HasOrphan(orphan.Hash) || !tree.HasOrphan(newest.Hash) {
+		t.Fatalf("oldest orphan not evicted")
+	}
+
+	if orphans := tree.TakeOrphans(parent); len(orphans) != S_ORPHAN_POOL-1 {
+		t.Fatalf("took %d orphans; want %d", len(orphans), S_ORPHAN_POOL-1)
+	}
+	if orphans := tree.TakeOrphans(other); len(orphans) != 1 || orphans[0] != newest {
+		t.Fatalf("orphan of another parent not taken")
+	}
+	if len(tree.orphanList) != 0 || len(tree.TakeOrphans(parent)) != 0 {
+		t.Fatalf("orphans kept after they were taken")
+	}
+}
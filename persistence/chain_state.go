@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"github.com/boltdb/bolt"
+	log "github.com/sirupsen/logrus"
 	"gocoin/core"
 	"gocoin/marshal"
 	"os"
@@ -34,9 +35,15 @@ func (ur *UXTORef) Serialize() []byte {
 	return buf
 }
 
-func (ur *UXTORef) SetBytes(buf []byte) {
+func (ur *UXTORef) SetBytes(buf []byte) error {
+	if len(buf) != 36 {
+		return fmt.Errorf("invalid UXTO reference size %d", len(buf))
+	}
+
 	ur.TxId = core.Hash256FromSlice(buf[:32])
 	ur.N = marshal.Uint32FromBytes(buf[32:36])
+
+	return nil
 }
 
 type ChainStateRepo struct {
@@ -46,7 +53,7 @@ type ChainStateRepo struct {
 func NewChainStateRepo(rootDir string) (*ChainStateRepo, error) {
 	repo := &ChainStateRepo{db: nil}
 
-	if err := os.Mkdir(rootDir+"/db", os.ModePerm); !os.IsExist(err) {
+	if err := os.MkdirAll(rootDir+"/db", os.ModePerm); err != nil {
 		return nil, fmt.Errorf("cannot create db directory: %v", err)
 	}
 
@@ -64,17 +71,49 @@ func NewChainStateRepo(rootDir string) (*ChainStateRepo, error) {
 		} // txId:N -> UXTO
 		if _, err := tx.CreateBucketIfNotExists([]byte("B")); err != nil {
 			return fmt.Errorf("cannot create 'B': %w", err)
-		} // "B" -> Hash256 (Terminating Block)
-		return nil
+		} // "B" -> Hash256 (Terminating Block), "V" -> data version, "J" -> journal entry
+		return migrateChainState(tx)
 	})
 
 	if err != nil {
+		_ = db.Close()
 		return nil, fmt.Errorf("cannot create buckets: %w", err)
 	}
 
 	return repo, nil
 }
 
+// migrateChainState re-encodes the UXTOs of a legacy chain state in the current format. An unreadable UXTO fails the
+// migration, which then leaves the chain state as it was.
+func migrateChainState(tx *bolt.Tx) error {
+	b := tx.Bucket([]byte("B"))
+	if b.Get([]byte("V")) != nil {
+		return nil
+	}
+
+	c := tx.Bucket([]byte("C"))
+	var legacy [][]byte
+	err := c.ForEach(func(k, v []byte) error {
+		legacy = append(legacy, append([]byte{}, k...))
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("cannot read UXTOs: %w", err)
+	}
+
+	for _, k := range legacy {
+		u, err := marshal.DeserializeLegacyUXTO(c.Get(k))
+		if err != nil {
+			return fmt.Errorf("cannot migrate UXTO %X: %w", k, err)
+		}
+		if err := c.Put(k, marshal.SerializeUXTO(u)); err != nil {
+			return fmt.Errorf("cannot migrate UXTO: %w", err)
+		}
+	}
+
+	return b.Put([]byte("V"), marshal.Uint32ToBytes(DATA_VERSION))
+}
+
 func (repo *ChainStateRepo) PutUXTO(u *core.UXTO) error {
 	err := repo.db.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte("C"))
@@ -101,8 +140,11 @@ func (repo *ChainStateRepo) GetUXTO(txId core.Hash256, n uint32) *core.UXTO {
 		if ret == nil {
 			return ErrNotFound
 		}
-		uxto = marshal.DeserializeUXTO(ret)
-		return nil
+		var err error
+		if uxto, err = marshal.DeserializeUXTO(ret); err != nil {
+			log.Errorf("Unreadable UXTO %s:%d in chain state: %s", txId, n, err)
+		}
+		return err
 	})
 
 	if err != nil {
@@ -149,3 +191,115 @@ func (repo *ChainStateRepo) SetCurrentBlockHash(hash core.Hash256) error {
 
 	return err
 }
+
+// JournalOp is the change to the active chain a journal entry records.
+type JournalOp byte
+
+const (
+	JOURNAL_CONNECT    JournalOp = iota + 1 // the block was connected as the tip
+	JOURNAL_DISCONNECT                      // the block was disconnected from the tip
+)
+
+func (op JournalOp) String() string {
+	switch op {
+	case JOURNAL_CONNECT:
+		return "connection"
+	case JOURNAL_DISCONNECT:
+		return "disconnection"
+	default:
+		return fmt.Sprintf("unknown(%d)", byte(op))
+	}
+}
+
+// JournalEntry records a block whose change to the chain state is committed, but whose changes to the block index
+// and the wallet may not be yet. It is cleared once they are, so an entry found on startup tells what to repair.
+type JournalEntry struct {
+	Op    JournalOp
+	BlkId core.Hash256
+}
+
+func (e *JournalEntry) Marshall() []byte {
+	return append([]byte{byte(e.Op)}, e.BlkId[:]...)
+}
+
+func UJournalEntry(buf []byte) (*JournalEntry, error) {
+	if len(buf) != 1+32 {
+		return nil, fmt.Errorf("invalid journal entry size %d", len(buf))
+	}
+	e := &JournalEntry{
+		Op:    JournalOp(buf[0]),
+		BlkId: core.Hash256FromSlice(buf[1:]),
+	}
+	if e.Op != JOURNAL_CONNECT && e.Op != JOURNAL_DISCONNECT {
+		return nil, fmt.Errorf("invalid journal operation %d", buf[0])
+	}
+
+	return e, nil
+}
+
+// ChainStateUpdate is the change connecting or disconnecting a block makes to the chain state.
+type ChainStateUpdate struct {
+	Removed []*core.UXTO // only the references are used
+	Added   []*core.UXTO
+	Tip     core.Hash256
+	Journal *JournalEntry
+}
+
+// ApplyUpdate removes and adds the UXTOs of u, moves the tip and records the journal entry in a single transaction,
+// so that the UXTOs always match the tip.
+func (repo *ChainStateRepo) ApplyUpdate(u *ChainStateUpdate) error {
+	return repo.db.Update(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte("C"))
+		for _, uxto := range u.Removed {
+			if err := c.Delete(NewUXTORef(uxto).Serialize()); err != nil {
+				return fmt.Errorf("cannot delete UXTO: %w", err)
+			}
+		}
+		for _, uxto := range u.Added {
+			if err := c.Put(NewUXTORef(uxto).Serialize(), marshal.SerializeUXTO(uxto)); err != nil {
+				return fmt.Errorf("cannot put UXTO: %w", err)
+			}
+		}
+
+		b := tx.Bucket([]byte("B"))
+		if err := b.Put([]byte("B"), u.Tip[:]); err != nil {
+			return fmt.Errorf("cannot put tip: %w", err)
+		}
+		if u.Journal != nil {
+			if err := b.Put([]byte("J"), u.Journal.Marshall()); err != nil {
+				return fmt.Errorf("cannot put journal entry: %w", err)
+			}
+		}
+
+		return nil
+	})
+}
+
+// GetJournal returns the journal entry of the last block connected or disconnected, or ErrNotFound if its changes
+// are complete.
+func (repo *ChainStateRepo) GetJournal() (*JournalEntry, error) {
+	var e *JournalEntry
+
+	err := repo.db.View(func(tx *bolt.Tx) error {
+		ret := tx.Bucket([]byte("B")).Get([]byte("J"))
+		if ret == nil {
+			return ErrNotFound
+		}
+		var err error
+		e, err = UJournalEntry(ret)
+
+		return err
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return e, nil
+}
+
+func (repo *ChainStateRepo) ClearJournal() error {
+	return repo.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("B")).Delete([]byte("J"))
+	})
+}
@@ -51,3 +51,51 @@ func TestAllChainState(t *testing.T) {
 		t.Errorf("ids not equal")
 	}
 }
+
+func TestChainStateRepo_ApplyUpdate(t *testing.T) {
+	PopulateTestData()
+
+	tmpPath := fmt.Sprintf("/tmp/chainstate_%x.index", core.RandomHash256().String())
+
+	repo, err := NewChainStateRepo(tmpPath)
+	if err != nil {
+		t.Fatalf("cannot open repo: %s", err)
+	}
+	defer os.RemoveAll(tmpPath)
+
+	spent, created := USET.First(TXID[0]), USET.First(TXID[1])
+	if err := repo.PutUXTO(spent); err != nil {
+		t.Fatalf("failed to put: %s", err)
+	}
+	if _, err := repo.GetJournal(); err != ErrNotFound {
+		t.Fatalf("journal of a new chain state: %v", err)
+	}
+
+	entry := &JournalEntry{Op: JOURNAL_CONNECT, BlkId: core.RandomHash256()}
+	err = repo.ApplyUpdate(&ChainStateUpdate{
+		Removed: []*core.UXTO{spent},
+		Added:   []*core.UXTO{created},
+		Tip:     entry.BlkId,
+		Journal: entry,
+	})
+	if err != nil {
+		t.Fatalf("failed to apply update: %s", err)
+	}
+
+	if repo.GetUXTO(spent.TxId, spent.N) != nil || !reflect.DeepEqual(repo.GetUXTO(created.TxId, created.N), created) {
+		t.Errorf("UXTOs not updated")
+	}
+	if tip, err := repo.GetCurrentBlockHash(); err != nil || tip != entry.BlkId {
+		t.Errorf("tip = %s, %v; want %s", tip, err, entry.BlkId)
+	}
+	if e, err := repo.GetJournal(); err != nil || !reflect.DeepEqual(e, entry) {
+		t.Errorf("journal = %v, %v; want %v", e, err, entry)
+	}
+
+	if err := repo.ClearJournal(); err != nil {
+		t.Fatalf("failed to clear journal: %s", err)
+	}
+	if _, err := repo.GetJournal(); err != ErrNotFound {
+		t.Errorf("journal not cleared: %v", err)
+	}
+}
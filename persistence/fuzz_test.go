@@ -0,0 +1,31 @@
+package persistence
+
+import (
+	"bytes"
+	"gocoin/core"
+	"testing"
+)
+
+// The seed corpus lives in testdata/fuzz; run `go test -fuzz=FuzzUBlockIndexRecord ./persistence` to extend it.
+func FuzzUBlockIndexRecord(f *testing.F) {
+	rec := BlockIndexRecord{
+		BlockHeader: core.BlockHeader{HashPrevBlock: core.Hash256{0x01}, Time: 1, NBits: 0x1f7fffff},
+		Height:      1,
+		TxCount:     2,
+		BlockFileID: 3,
+		BlockPos:    FilePos{Offset: 4, Size: 5},
+		UndoPos:     FilePos{Offset: 6, Size: 7},
+	}
+	f.Add(rec.Marshall())
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		rec, err := UBlockIndexRecord(data)
+		if err != nil {
+			return
+		}
+
+		if !bytes.Equal(rec.Marshall(), data) {
+			t.Fatalf("record changed after round trip")
+		}
+	})
+}
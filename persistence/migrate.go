@@ -0,0 +1,548 @@
+package persistence
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/boltdb/bolt"
+	log "github.com/sirupsen/logrus"
+	"gocoin/core"
+	"gocoin/marshal"
+	"os"
+	"time"
+)
+
+// DATA_VERSION is the on-disk format version of blk/rev files and bolt records.
+// Version 0 is the legacy separator-based format. Version 1 located blocks by their ordinal in their block file;
+// version 2 locates them by byte position. Version 3 frames records with a header instead of their length only.
+const DATA_VERSION uint32 = 3
+
+const LEGACY_MAGIC_DIV_BLOCK uint64 = 0x11_22_33_44_55_66_77_88
+
+var LEGACY_DIV_BLOCK []byte
+
+func init() {
+	buf := [8]byte{}
+	binary.BigEndian.PutUint64(buf[:], LEGACY_MAGIC_DIV_BLOCK)
+	LEGACY_DIV_BLOCK = buf[:]
+}
+
+// MigrateBlockFiles brings the blk/rev files and the block index of an older data directory to DATA_VERSION, one
+// version at a time, so that a migration interrupted by a crash resumes from the last version completed.
+// It must run before the block index is read.
+func MigrateBlockFiles(rootDir string, repo *BlockIndexRepo) error {
+	version, err := repo.GetDataVersion()
+	if err != nil {
+		return fmt.Errorf("cannot get data version: %w", err)
+	}
+
+	lastId, err := repo.GetCurrentFileId()
+	if err == ErrNotFound {
+		lastId = 0
+	} else if err != nil {
+		return fmt.Errorf("cannot get current block file id: %w", err)
+	}
+
+	if version < 1 {
+		if err := migrateLegacyBlockFiles(rootDir, repo, lastId); err != nil {
+			return err
+		}
+	}
+	// the block index refers to the migrated files as soon as it records version 1
+	if err := replaceSideFiles(rootDir, lastId, migratedPath); err != nil {
+		return fmt.Errorf("cannot replace block files: %w", err)
+	}
+	if version < 2 {
+		if err := migrateBlockPositions(rootDir, repo, lastId); err != nil {
+			return fmt.Errorf("cannot migrate block index: %w", err)
+		}
+	}
+	if version < 3 {
+		if err := reframeBlockFiles(rootDir, repo, lastId); err != nil {
+			return fmt.Errorf("cannot reframe block files: %w", err)
+		}
+	}
+
+	// the block index refers to the reframed files as soon as it records version 3
+	if err := replaceSideFiles(rootDir, lastId, reframedPath); err != nil {
+		return fmt.Errorf("cannot replace block files: %w", err)
+	}
+
+	return nil
+}
+
+// migrateLegacyBlockFiles rewrites the blk and rev files of data version 0 with records prefixed by their length.
+// The new files are written next to the old ones and replace them once the block index records version 1, so that a
+// migration interrupted by a crash starts over from the legacy files.
+// A record that cannot be read fails the migration, which then leaves the block index and the files in use as they
+// were.
+func migrateLegacyBlockFiles(rootDir string, repo *BlockIndexRepo, lastId uint32) error {
+	sizes := make(map[uint32]*FileInfoRecord)
+	for id := uint32(0); id <= lastId; id++ {
+		size, err := migrateBlockFile(rootDir, id)
+		if err != nil {
+			return fmt.Errorf("cannot migrate block file %d: %w", id, err)
+		}
+		sizes[id] = size
+	}
+
+	err := repo.db.Update(func(tx *bolt.Tx) error {
+		f := tx.Bucket([]byte("f"))
+		for id, size := range sizes {
+			v := f.Get(marshal.Uint32ToBytes(id))
+			if v == nil {
+				continue
+			}
+			info, err := UFileInfoRecord(v)
+			if err != nil {
+				return err
+			}
+			info.BlockFileSize, info.UndoFileSize = size.BlockFileSize, size.UndoFileSize
+			if err := f.Put(marshal.Uint32ToBytes(id), info.Marshall()); err != nil {
+				return err
+			}
+		}
+
+		return tx.Bucket([]byte("l")).Put([]byte("v"), marshal.Uint32ToBytes(1))
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Migrated block files to data version 1")
+
+	return nil
+}
+
+// migrateBlockFile writes the records of a blk and rev file of data version 0 prefixed by their length next to them,
+// and returns the sizes of the new files.
+func migrateBlockFile(rootDir string, id uint32) (*FileInfoRecord, error) {
+	blkFilePath := blkFilePath(rootDir, id)
+	revFilePath := revFilePath(rootDir, id)
+
+	blkData, err := os.ReadFile(blkFilePath)
+	if os.IsNotExist(err) {
+		return &FileInfoRecord{}, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("cannot read file: %w", err)
+	}
+	revData, err := os.ReadFile(revFilePath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("cannot read file: %w", err)
+	}
+
+	// records of data version 1 are prefixed with their length
+	var newBlkData, newRevData []byte
+
+	slices := bytes.Split(blkData, LEGACY_DIV_BLOCK)
+	for i, slice := range slices[:len(slices)-1] { // last slice is empty or incomplete
+		block, err := marshal.ULegacyBlock(slice)
+		if err != nil {
+			return nil, fmt.Errorf("block %d: %w", i, err)
+		}
+		newBlkData = append(newBlkData, marshal.VarBytes(marshal.Block(block))...)
+	}
+
+	slices = bytes.Split(revData, LEGACY_DIV_BLOCK)
+	for i, slice := range slices[:len(slices)-1] {
+		if len(slice)%marshal.LEGACY_S_UXTO != 0 {
+			return nil, fmt.Errorf("undo record %d: invalid size %d", i, len(slice))
+		}
+		var uxtos []*core.UXTO
+		for j := 0; j < len(slice); j += marshal.LEGACY_S_UXTO {
+			u, err := marshal.DeserializeLegacyUXTO(slice[j : j+marshal.LEGACY_S_UXTO])
+			if err != nil {
+				return nil, fmt.Errorf("undo record %d: %w", i, err)
+			}
+			uxtos = append(uxtos, u)
+		}
+		newRevData = append(newRevData, marshal.VarBytes(marshal.SerializeUXTOs(uxtos))...)
+	}
+
+	if err := os.WriteFile(migratedPath(blkFilePath), newBlkData, 0600); err != nil {
+		return nil, fmt.Errorf("cannot write file: %w", err)
+	}
+	if err := os.WriteFile(migratedPath(revFilePath), newRevData, 0600); err != nil {
+		return nil, fmt.Errorf("cannot write file: %w", err)
+	}
+
+	return &FileInfoRecord{BlockFileSize: uint32(len(newBlkData)), UndoFileSize: uint32(len(newRevData))}, nil
+}
+
+func migratedPath(path string) string {
+	return path + ".v1"
+}
+
+// migrateBlockPositions replaces the ordinals that the block index and transaction records of data version 1 locate
+// blocks with by the positions of the records in the blk and rev files.
+// A record that cannot be read, or that refers to a record missing from its blk or rev file, fails the migration,
+// which then leaves the block index as it was.
+func migrateBlockPositions(rootDir string, repo *BlockIndexRepo, lastId uint32) error {
+	blkPositions := make(map[uint32][]FilePos)
+	revPositions := make(map[uint32][]FilePos)
+	for id := uint32(0); id <= lastId; id++ {
+		var err error
+		if blkPositions[id], err = v1FilePositions(blkFilePath(rootDir, id)); err != nil {
+			return err
+		}
+		if revPositions[id], err = v1FilePositions(revFilePath(rootDir, id)); err != nil {
+			return err
+		}
+	}
+	position := func(positions map[uint32][]FilePos, id, n uint32) (FilePos, error) {
+		if int(n) >= len(positions[id]) {
+			return FilePos{}, fmt.Errorf("record %d of block file %d: %w", n, id, ErrNotFound)
+		}
+		return positions[id][n], nil
+	}
+
+	tip, err := chainStateTip(rootDir)
+	if err != nil && err != ErrNotFound {
+		return fmt.Errorf("cannot get current block hash: %w", err)
+	}
+
+	err = repo.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("b"))
+		records := make(map[core.Hash256]*BlockIndexRecord)
+		noStatus := make(map[core.Hash256]bool)
+		for _, k := range keysOf(b) {
+			v := b.Get(k)
+			rec, n, err := uV1BlockIndexRecord(v)
+			if err != nil {
+				return fmt.Errorf("block index record %X: %w", k, err)
+			}
+			records[core.Hash256FromSlice(k)] = rec
+			if len(v) < S_V1_STATUS_RECORD {
+				noStatus[core.Hash256FromSlice(k)] = true
+			} else if !rec.Status.HasData() {
+				continue // a block without data has no record to locate
+			}
+			if rec.BlockPos, err = position(blkPositions, rec.BlockFileID, n); err != nil {
+				return fmt.Errorf("block index record %X: %w", k, err)
+			}
+			if rec.UndoPos, err = position(revPositions, rec.BlockFileID, n); err != nil {
+				return fmt.Errorf("block index record %X: %w", k, err)
+			}
+		}
+		fillChainWork(records)
+		fillStatus(records, noStatus, tip)
+		for blkId, rec := range records {
+			if err := b.Put(blkId[:], rec.Marshall()); err != nil {
+				return err
+			}
+		}
+
+		t := tx.Bucket([]byte("t"))
+		for _, k := range keysOf(t) {
+			v := t.Get(k)
+			if len(v) != 12 {
+				return fmt.Errorf("transaction record %X: invalid size %d", k, len(v))
+			}
+			rec := &TransactionRecord{
+				BlockFileID: marshal.Uint32FromBytes(v[0:4]),
+				TxOffset:    marshal.Uint32FromBytes(v[8:12]),
+			}
+			var err error
+			if rec.BlockPos, err = position(blkPositions, rec.BlockFileID, marshal.Uint32FromBytes(v[4:8])); err != nil {
+				return fmt.Errorf("transaction record %X: %w", k, err)
+			}
+			if err := t.Put(k, rec.Marshall()); err != nil {
+				return err
+			}
+		}
+
+		// the height index was built from the records when they could not be read
+		if err := tx.DeleteBucket([]byte("h")); err != nil {
+			return err
+		}
+		if err := createHeightIndex(tx); err != nil {
+			return err
+		}
+
+		return tx.Bucket([]byte("l")).Put([]byte("v"), marshal.Uint32ToBytes(2))
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Migrated block index to data version 2")
+
+	return nil
+}
+
+// Sizes of the block index records of data version 1, which grew without a version of their own: the chain work and
+// then the status were appended to the header, the height, the transaction count, the block file id and the ordinal
+// of the block in its block file.
+const (
+	S_V1_BLOCK_INDEX_RECORD = marshal.S_BLOCKHEADER + 16
+	S_V1_CHAIN_WORK_RECORD  = S_V1_BLOCK_INDEX_RECORD + S_CHAIN_WORK
+	S_V1_STATUS_RECORD      = S_V1_CHAIN_WORK_RECORD + 1
+)
+
+// uV1BlockIndexRecord decodes a block index record of data version 1, returning the ordinal of the block in its block
+// file separately. The chain work of a record written before it existed is nil, see fillChainWork, and so is its
+// status BLOCK_HEADER_ONLY, see fillStatus.
+func uV1BlockIndexRecord(buf []byte) (*BlockIndexRecord, uint32, error) {
+	if len(buf) != S_V1_BLOCK_INDEX_RECORD && len(buf) != S_V1_CHAIN_WORK_RECORD && len(buf) != S_V1_STATUS_RECORD {
+		return nil, 0, fmt.Errorf("invalid block index record size %d", len(buf))
+	}
+
+	p := marshal.S_BLOCKHEADER + 12
+	n := marshal.Uint32FromBytes(buf[p : p+4])
+
+	v2 := make([]byte, 0, S_BLOCK_INDEX_RECORD)
+	v2 = append(v2, buf[:p]...)
+	v2 = append(v2, make([]byte, 16)...) // the two positions take the place of the ordinal
+	v2 = append(v2, buf[p+4:]...)
+	v2 = append(v2, make([]byte, S_BLOCK_INDEX_RECORD-len(v2))...)
+	rec, err := UBlockIndexRecord(v2)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(buf) < S_V1_CHAIN_WORK_RECORD {
+		rec.ChainWork = nil
+	}
+
+	return rec, n, nil
+}
+
+// fillChainWork computes the chain work of the records that lack it from their ancestors, down to genesis or the first
+// one that has it.
+func fillChainWork(records map[core.Hash256]*BlockIndexRecord) {
+	for _, rec := range records {
+		var path []*BlockIndexRecord
+		for r := rec; r != nil && r.ChainWork == nil; r = records[r.HashPrevBlock] {
+			path = append(path, r)
+		}
+
+		for i := len(path) - 1; i >= 0; i-- {
+			work := path[i].Work()
+			if parent, ok := records[path[i].HashPrevBlock]; ok {
+				work.Add(work, parent.ChainWork)
+			}
+			path[i].ChainWork = work
+		}
+	}
+}
+
+// fillStatus sets the status of the records written before blocks had one: the blocks on the chain down from tip are
+// active, and the others, which were stored on another branch, have data available.
+func fillStatus(records map[core.Hash256]*BlockIndexRecord, noStatus map[core.Hash256]bool, tip core.Hash256) {
+	active := make(map[core.Hash256]bool)
+	for blkId := tip; records[blkId] != nil && !active[blkId]; blkId = records[blkId].HashPrevBlock {
+		active[blkId] = true
+	}
+
+	for blkId := range noStatus {
+		if active[blkId] {
+			records[blkId].Status = BLOCK_ACTIVE
+		} else {
+			records[blkId].Status = BLOCK_DATA_AVAILABLE
+		}
+	}
+}
+
+// chainStateTip returns the tip of the active chain recorded in the chain state of a data directory, which must not be
+// open.
+func chainStateTip(rootDir string) (core.Hash256, error) {
+	path := rootDir + "/db/chain_state.dat"
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return core.Hash256{}, ErrNotFound
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 10 * time.Second, ReadOnly: true})
+	if err != nil {
+		return core.Hash256{}, fmt.Errorf("cannot open db: %w", err)
+	}
+	defer db.Close()
+
+	tip := core.Hash256{}
+	err = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("B"))
+		if b == nil || b.Get([]byte("B")) == nil {
+			return ErrNotFound
+		}
+		tip = core.Hash256FromSlice(b.Get([]byte("B")))
+		return nil
+	})
+
+	return tip, err
+}
+
+// v1FilePositions returns the positions of the records of a blk or rev file of data version 1 or 2, none if it does
+// not exist.
+func v1FilePositions(path string) ([]FilePos, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("cannot read file: %w", err)
+	}
+
+	return v1RecordPositions(data), nil
+}
+
+// v1RecordPositions returns the positions of the length-prefixed records of data version 1 or 2, in order.
+// An incomplete record at the end (e.g. an interrupted write) is ignored.
+func v1RecordPositions(data []byte) []FilePos {
+	var positions []FilePos
+
+	for p := 0; p < len(data); {
+		length, m, err := marshal.VarIntFromBytes(data[p:])
+		if err != nil || uint64(len(data)-p-m) < length {
+			break
+		}
+
+		positions = append(positions, FilePos{Offset: uint32(p + m), Size: uint32(length)})
+		p += m + int(length)
+	}
+
+	return positions
+}
+
+// reframeBlockFiles rewrites the records of the blk and rev files of data version 2 with a record header, and moves
+// the positions of the block index and transaction records along.
+// The new files are written next to the old ones and replace them once the block index refers to them.
+// A record that cannot be read, or that refers to a record missing from its blk or rev file, fails the migration,
+// which then leaves the block index and the files in use as they were.
+func reframeBlockFiles(rootDir string, repo *BlockIndexRepo, lastId uint32) error {
+	blkPositions := make(map[blockKey]FilePos)
+	revPositions := make(map[blockKey]FilePos)
+	sizes := make(map[uint32]*FileInfoRecord)
+	for id := uint32(0); id <= lastId; id++ {
+		blkSize, err := reframeFile(blkFilePath(rootDir, id), id, blkPositions)
+		if err != nil {
+			return err
+		}
+		undoSize, err := reframeFile(revFilePath(rootDir, id), id, revPositions)
+		if err != nil {
+			return err
+		}
+		sizes[id] = &FileInfoRecord{BlockFileSize: blkSize, UndoFileSize: undoSize}
+	}
+	position := func(positions map[blockKey]FilePos, id uint32, pos FilePos) (FilePos, error) {
+		if pos == (FilePos{}) { // a block without data
+			return pos, nil
+		}
+		newPos, ok := positions[blockKey{fileId: id, offset: pos.Offset}]
+		if !ok {
+			return FilePos{}, fmt.Errorf("record at %d of block file %d: %w", pos.Offset, id, ErrNotFound)
+		}
+		return newPos, nil
+	}
+
+	err := repo.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("b"))
+		for _, k := range keysOf(b) {
+			rec, err := UBlockIndexRecord(b.Get(k))
+			if err != nil {
+				return fmt.Errorf("block index record %X: %w", k, err)
+			}
+			if rec.BlockPos, err = position(blkPositions, rec.BlockFileID, rec.BlockPos); err != nil {
+				return fmt.Errorf("block index record %X: %w", k, err)
+			}
+			if rec.UndoPos, err = position(revPositions, rec.BlockFileID, rec.UndoPos); err != nil {
+				return fmt.Errorf("block index record %X: %w", k, err)
+			}
+			if err := b.Put(k, rec.Marshall()); err != nil {
+				return err
+			}
+		}
+
+		t := tx.Bucket([]byte("t"))
+		for _, k := range keysOf(t) {
+			rec, err := UTransactionRecord(t.Get(k))
+			if err != nil {
+				return fmt.Errorf("transaction record %X: %w", k, err)
+			}
+			if rec.BlockPos, err = position(blkPositions, rec.BlockFileID, rec.BlockPos); err != nil {
+				return fmt.Errorf("transaction record %X: %w", k, err)
+			}
+			if err := t.Put(k, rec.Marshall()); err != nil {
+				return err
+			}
+		}
+
+		f := tx.Bucket([]byte("f"))
+		for id, size := range sizes {
+			v := f.Get(marshal.Uint32ToBytes(id))
+			if v == nil {
+				continue
+			}
+			info, err := UFileInfoRecord(v)
+			if err != nil {
+				return err
+			}
+			info.BlockFileSize, info.UndoFileSize = size.BlockFileSize, size.UndoFileSize
+			if err := f.Put(marshal.Uint32ToBytes(id), info.Marshall()); err != nil {
+				return err
+			}
+		}
+
+		return tx.Bucket([]byte("l")).Put([]byte("v"), marshal.Uint32ToBytes(3))
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Migrated block files to data version 3")
+
+	return nil
+}
+
+// reframeFile writes the records of a blk or rev file of data version 2 with a record header next to it, and
+// returns the size of the new file. It records the new position of every record by its old offset.
+func reframeFile(path string, id uint32, positions map[blockKey]FilePos) (uint32, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, fmt.Errorf("cannot read file: %w", err)
+	}
+
+	var newData []byte
+	for _, pos := range v1RecordPositions(data) {
+		positions[blockKey{fileId: id, offset: pos.Offset}] = FilePos{
+			Offset: uint32(len(newData) + S_RECORD_HEADER),
+			Size:   pos.Size,
+		}
+		newData = append(newData, frameRecord(data[pos.Offset:pos.Offset+pos.Size])...)
+	}
+
+	if err := os.WriteFile(reframedPath(path), newData, 0600); err != nil {
+		return 0, fmt.Errorf("cannot write file: %w", err)
+	}
+
+	return uint32(len(newData)), nil
+}
+
+func reframedPath(path string) string {
+	return path + ".reframed"
+}
+
+// replaceSideFiles moves the files written next to the blk and rev files by a migration over them, finishing a
+// migration that was interrupted after the block index had been updated. sidePath names the file written for a path.
+func replaceSideFiles(rootDir string, lastId uint32, sidePath func(string) string) error {
+	for id := uint32(0); id <= lastId; id++ {
+		for _, path := range []string{blkFilePath(rootDir, id), revFilePath(rootDir, id)} {
+			if _, err := os.Stat(sidePath(path)); os.IsNotExist(err) {
+				continue
+			}
+			if err := os.Rename(sidePath(path), path); err != nil {
+				return fmt.Errorf("cannot replace file: %w", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func keysOf(b *bolt.Bucket) [][]byte {
+	var keys [][]byte
+
+	c := b.Cursor()
+	for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		keys = append(keys, append([]byte{}, k...))
+	}
+
+	return keys
+}
@@ -0,0 +1,442 @@
+package persistence
+
+import (
+	"fmt"
+	"github.com/boltdb/bolt"
+	"gocoin/core"
+	"gocoin/marshal"
+	"math/big"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestMigrateChainState(t *testing.T) {
+	PopulateTestData()
+
+	tmpPath := fmt.Sprintf("/tmp/migrate_%s", core.RandomHash256().String())
+	defer os.RemoveAll(tmpPath)
+
+	u := USET.First(TXID[0])
+
+	// write a chain state in the legacy format: TxId, 32 | N, 4 | PubKeyHash, 20 | Value, 4
+	var legacy []byte
+	legacy = append(legacy, u.TxId[:]...)
+	legacy = append(legacy, marshal.Uint32ToBytes(u.N)...)
+	addr := u.AddressedTo()
+	legacy = append(legacy, addr[:]...)
+	legacy = append(legacy, marshal.Uint32ToBytes(uint32(u.Value))...)
+
+	if err := os.MkdirAll(tmpPath+"/db", os.ModePerm); err != nil {
+		t.Fatalf("cannot create directory: %s", err)
+	}
+	db, err := bolt.Open(tmpPath+"/db/chain_state.dat", 0600, nil)
+	if err != nil {
+		t.Fatalf("cannot open db: %s", err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("C"))
+		if err != nil {
+			return err
+		}
+		return b.Put(NewUXTORef(u).Serialize(), legacy)
+	})
+	if err != nil {
+		t.Fatalf("cannot write legacy record: %s", err)
+	}
+	_ = db.Close()
+
+	repo, err := NewChainStateRepo(tmpPath)
+	if err != nil {
+		t.Fatalf("cannot open repo: %s", err)
+	}
+
+	if got := repo.GetUXTO(u.TxId, u.N); !reflect.DeepEqual(got, u) {
+		t.Fatalf("migrated UXTO does not match: got %v; want %v", got, u)
+	}
+}
+
+func TestMigrateChainState_Unreadable(t *testing.T) {
+	tmpPath := fmt.Sprintf("/tmp/migrate_%s", core.RandomHash256().String())
+	defer os.RemoveAll(tmpPath)
+
+	if err := os.MkdirAll(tmpPath+"/db", os.ModePerm); err != nil {
+		t.Fatalf("cannot create directory: %s", err)
+	}
+	db, err := bolt.Open(tmpPath+"/db/chain_state.dat", 0600, nil)
+	if err != nil {
+		t.Fatalf("cannot open db: %s", err)
+	}
+	k, v := []byte("k"), []byte{0xff}
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("C"))
+		if err != nil {
+			return err
+		}
+		return b.Put(k, v)
+	})
+	if err != nil {
+		t.Fatalf("cannot write legacy record: %s", err)
+	}
+	_ = db.Close()
+
+	// the migration fails instead of dropping the UXTO
+	if _, err := NewChainStateRepo(tmpPath); err == nil {
+		t.Fatalf("migrated an unreadable UXTO")
+	}
+	db, err = bolt.Open(tmpPath+"/db/chain_state.dat", 0600, nil)
+	if err != nil {
+		t.Fatalf("cannot open db: %s", err)
+	}
+	defer db.Close()
+	err = db.View(func(tx *bolt.Tx) error {
+		if got := tx.Bucket([]byte("C")).Get(k); !reflect.DeepEqual(got, v) {
+			return fmt.Errorf("record changed to %X", got)
+		}
+		if b := tx.Bucket([]byte("B")); b != nil && b.Get([]byte("V")) != nil {
+			return fmt.Errorf("data version recorded")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unreadable UXTO not kept: %s", err)
+	}
+}
+
+func TestMigrateBlockFiles_Interrupted(t *testing.T) {
+	PopulateTestData()
+
+	// a rev file of data version 0 holding one record of a legacy UXTO, and an empty blk file
+	u := USET.First(TXID[0])
+	var legacy []byte
+	legacy = append(legacy, u.TxId[:]...)
+	legacy = append(legacy, marshal.Uint32ToBytes(u.N)...)
+	addr := u.AddressedTo()
+	legacy = append(legacy, addr[:]...)
+	legacy = append(legacy, marshal.Uint32ToBytes(uint32(u.Value))...)
+	legacy = append(legacy, LEGACY_DIV_BLOCK...)
+
+	migrate := func(interrupted bool) []byte {
+		tmpPath := fmt.Sprintf("/tmp/migrate_%s", core.RandomHash256().String())
+		defer os.RemoveAll(tmpPath)
+
+		repo, err := NewBlockIndexRepo(tmpPath)
+		if err != nil {
+			t.Fatalf("cannot open repo: %s", err)
+		}
+		err = repo.db.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket([]byte("l")).Delete([]byte("v"))
+		})
+		if err != nil {
+			t.Fatalf("cannot delete data version: %s", err)
+		}
+		if err := os.MkdirAll(tmpPath+"/data", os.ModePerm); err != nil {
+			t.Fatalf("cannot create directory: %s", err)
+		}
+		if err := os.WriteFile(blkFilePath(tmpPath, 0), nil, 0600); err != nil {
+			t.Fatalf("cannot write blk file: %s", err)
+		}
+		if err := os.WriteFile(revFilePath(tmpPath, 0), legacy, 0600); err != nil {
+			t.Fatalf("cannot write rev file: %s", err)
+		}
+
+		// a crash before the block index records version 1 leaves the legacy files in use
+		if interrupted {
+			if _, err := migrateBlockFile(tmpPath, 0); err != nil {
+				t.Fatalf("cannot migrate block file: %s", err)
+			}
+		}
+
+		if err := MigrateBlockFiles(tmpPath, repo); err != nil {
+			t.Fatalf("cannot migrate: %s", err)
+		}
+		data, err := os.ReadFile(revFilePath(tmpPath, 0))
+		if err != nil {
+			t.Fatalf("cannot read rev file: %s", err)
+		}
+		if _, err := os.Stat(migratedPath(revFilePath(tmpPath, 0))); !os.IsNotExist(err) {
+			t.Fatalf("migrated rev file left behind: %v", err)
+		}
+
+		return data
+	}
+
+	want := migrate(false)
+	if got := migrate(true); len(want) == 0 || !reflect.DeepEqual(got, want) {
+		t.Fatalf("rev file after an interrupted migration = %X; want %X", got, want)
+	}
+}
+
+func TestMigrateBlockFiles_Unreadable(t *testing.T) {
+	tmpPath := fmt.Sprintf("/tmp/migrate_%s", core.RandomHash256().String())
+	defer os.RemoveAll(tmpPath)
+
+	repo, err := NewBlockIndexRepo(tmpPath)
+	if err != nil {
+		t.Fatalf("cannot open repo: %s", err)
+	}
+	err = repo.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("l")).Delete([]byte("v"))
+	})
+	if err != nil {
+		t.Fatalf("cannot delete data version: %s", err)
+	}
+	if err := os.MkdirAll(tmpPath+"/data", os.ModePerm); err != nil {
+		t.Fatalf("cannot create directory: %s", err)
+	}
+	if err := os.WriteFile(blkFilePath(tmpPath, 0), nil, 0600); err != nil {
+		t.Fatalf("cannot write blk file: %s", err)
+	}
+	legacy := append(make([]byte, marshal.LEGACY_S_UXTO-1), LEGACY_DIV_BLOCK...)
+	if err := os.WriteFile(revFilePath(tmpPath, 0), legacy, 0600); err != nil {
+		t.Fatalf("cannot write rev file: %s", err)
+	}
+
+	// the migration fails instead of dropping the undo record
+	if err := MigrateBlockFiles(tmpPath, repo); err == nil {
+		t.Fatalf("migrated an unreadable undo record")
+	}
+	if data, err := os.ReadFile(revFilePath(tmpPath, 0)); err != nil || !reflect.DeepEqual(data, legacy) {
+		t.Fatalf("unreadable rev file not kept: %v", err)
+	}
+	if version, _ := repo.GetDataVersion(); version != 0 {
+		t.Fatalf("data version %d after a failed migration", version)
+	}
+}
+
+func TestMigrateBlockPositions(t *testing.T) {
+	tmpPath := fmt.Sprintf("/tmp/migrate_%s", core.RandomHash256().String())
+	defer os.RemoveAll(tmpPath)
+	if err := os.MkdirAll(tmpPath+"/data", os.ModePerm); err != nil {
+		t.Fatalf("cannot create directory: %s", err)
+	}
+
+	// write blk and rev files of data version 1, whose records are prefixed with their length: three blocks of the
+	// active chain and one branching off after the first
+	var blocks []*core.Block
+	var blkData, revData []byte
+	prev := core.Hash256{}
+	for i := 0; i < 4; i++ {
+		if i == 3 {
+			prev = blocks[0].Hash
+		}
+		b := core.NewBlockBuilder().
+			BaseOn(prev, uint32(i%3)).
+			SetNBits(0x1f7fffff).
+			AddTransaction(core.NewCoinBaseTransaction([]byte("coinbase"), core.RandomHash160(), 100, 0)).
+			Build()
+		blkData = append(blkData, marshal.VarBytes(marshal.Block(b))...)
+		revData = append(revData, marshal.VarBytes(marshal.SerializeUXTOs(nil))...)
+		blocks = append(blocks, b)
+		prev = b.Hash
+	}
+	if err := os.WriteFile(blkFilePath(tmpPath, 0), blkData, 0600); err != nil {
+		t.Fatalf("cannot write block file: %s", err)
+	}
+	if err := os.WriteFile(revFilePath(tmpPath, 0), revData, 0600); err != nil {
+		t.Fatalf("cannot write rev file: %s", err)
+	}
+
+	// write records of data version 1, which locate a block by its ordinal in its block file; the last two were written
+	// before the chain work and the status were added to the records, which leaves the chain state to tell the active one
+	cs, err := NewChainStateRepo(tmpPath)
+	if err != nil {
+		t.Fatalf("cannot open chain state: %s", err)
+	}
+	if err := cs.SetCurrentBlockHash(blocks[2].Hash); err != nil {
+		t.Fatalf("cannot set tip: %s", err)
+	}
+	_ = cs.db.Close()
+
+	repo, err := NewBlockIndexRepo(tmpPath)
+	if err != nil {
+		t.Fatalf("cannot open repo: %s", err)
+	}
+	chainWork := new(big.Int)
+	err = repo.db.Update(func(tx *bolt.Tx) error {
+		for i, b := range blocks {
+			chainWork = new(big.Int).Add(chainWork, b.Work())
+			rec := &BlockIndexRecord{BlockHeader: b.BlockHeader, Height: b.Height, TxCount: 1, ChainWork: chainWork, Status: BLOCK_ACTIVE}
+			v2 := rec.Marshall()
+			p := marshal.S_BLOCKHEADER + 12
+			v1 := append(append(append([]byte{}, v2[:p]...), marshal.Uint32ToBytes(uint32(i))...), v2[p+16:]...)
+			if i >= 2 {
+				v1 = v1[:S_V1_BLOCK_INDEX_RECORD]
+			}
+			if err := tx.Bucket([]byte("b")).Put(b.Hash[:], v1); err != nil {
+				return err
+			}
+
+			txId := b.Transactions[0].Hash()
+			v1 = append(append(marshal.Uint32ToBytes(0), marshal.Uint32ToBytes(uint32(i))...), marshal.Uint32ToBytes(0)...)
+			if err := tx.Bucket([]byte("t")).Put(txId[:], v1); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("cannot write records: %s", err)
+	}
+	if err := repo.PutDataVersion(1); err != nil {
+		t.Fatalf("cannot put data version: %s", err)
+	}
+
+	if err := MigrateBlockFiles(tmpPath, repo); err != nil {
+		t.Fatalf("cannot migrate: %s", err)
+	}
+
+	reader := NewBlockReader(tmpPath, S_BLOCK_CACHE)
+	for i, b := range blocks {
+		rec, err := repo.GetBlockIndexRecord(b.Hash)
+		if err != nil {
+			t.Fatalf("cannot get record %d: %s", i, err)
+		}
+		if got, err := reader.GetBlock(rec); err != nil || !reflect.DeepEqual(got, b) {
+			t.Fatalf("block %d not found at its migrated position: %v", i, err)
+		}
+		if _, err := reader.GetUndo(rec); err != nil {
+			t.Fatalf("undo record %d not found at its migrated position: %s", i, err)
+		}
+
+		txRec, err := repo.GetTransactionRecord(b.Transactions[0].Hash())
+		if err != nil {
+			t.Fatalf("cannot get transaction record: %s", err)
+		}
+		if txRec.BlockPos != rec.BlockPos {
+			t.Fatalf("transaction record of block %d at %v; want %v", i, txRec.BlockPos, rec.BlockPos)
+		}
+	}
+
+	for _, b := range blocks[:3] {
+		if rec, err := repo.GetBlockIndexRecordOfHeight(b.Height); err != nil || rec.Hash() != b.Hash {
+			t.Fatalf("record of height %d not indexed as active: %v", b.Height, err)
+		}
+	}
+	branchWork := new(big.Int).Add(blocks[0].Work(), blocks[3].Work())
+	if rec, err := repo.GetBlockIndexRecord(blocks[3].Hash); err != nil || rec.Status != BLOCK_DATA_AVAILABLE {
+		t.Fatalf("record of another branch without a status: %v, %v", rec, err)
+	} else if rec.ChainWork.Cmp(branchWork) != 0 {
+		t.Fatalf("chain work of a record without it is %s; want %s", rec.ChainWork, branchWork)
+	}
+	activeWork := new(big.Int).Add(new(big.Int).Add(blocks[0].Work(), blocks[1].Work()), blocks[2].Work())
+	if rec, err := repo.GetBlockIndexRecord(blocks[2].Hash); err != nil || rec.ChainWork.Cmp(activeWork) != 0 {
+		t.Fatalf("chain work of a record without it not computed: %v", err)
+	}
+
+	if version, _ := repo.GetDataVersion(); version != DATA_VERSION {
+		t.Fatalf("data version %d after migration", version)
+	}
+	if _, err := os.Stat(reframedPath(blkFilePath(tmpPath, 0))); !os.IsNotExist(err) {
+		t.Fatalf("reframed block file not moved into place: %v", err)
+	}
+}
+
+func TestMigrateBlockPositions_Unreadable(t *testing.T) {
+	tmpPath := fmt.Sprintf("/tmp/migrate_%s", core.RandomHash256().String())
+	defer os.RemoveAll(tmpPath)
+
+	repo, err := NewBlockIndexRepo(tmpPath)
+	if err != nil {
+		t.Fatalf("cannot open repo: %s", err)
+	}
+	blkId := core.RandomHash256()
+	err = repo.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("b")).Put(blkId[:], make([]byte, S_V1_BLOCK_INDEX_RECORD+1))
+	})
+	if err != nil {
+		t.Fatalf("cannot write record: %s", err)
+	}
+	if err := repo.PutDataVersion(1); err != nil {
+		t.Fatalf("cannot put data version: %s", err)
+	}
+
+	// the migration fails instead of dropping the record
+	if err := MigrateBlockFiles(tmpPath, repo); err == nil {
+		t.Fatalf("migrated an unreadable record")
+	}
+	err = repo.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket([]byte("b")).Get(blkId[:]); len(v) != S_V1_BLOCK_INDEX_RECORD+1 {
+			return fmt.Errorf("record changed to %X", v)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unreadable record not kept: %s", err)
+	}
+	if version, _ := repo.GetDataVersion(); version != 1 {
+		t.Fatalf("data version %d after a failed migration", version)
+	}
+}
+
+func TestMigrateBlockPositions_Missing(t *testing.T) {
+	tmpPath := fmt.Sprintf("/tmp/migrate_%s", core.RandomHash256().String())
+	defer os.RemoveAll(tmpPath)
+
+	repo, err := NewBlockIndexRepo(tmpPath)
+	if err != nil {
+		t.Fatalf("cannot open repo: %s", err)
+	}
+	// a record of the first block of block file 0, which is missing
+	blkId := core.RandomHash256()
+	v1 := make([]byte, S_V1_BLOCK_INDEX_RECORD)
+	err = repo.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("b")).Put(blkId[:], v1)
+	})
+	if err != nil {
+		t.Fatalf("cannot write record: %s", err)
+	}
+	if err := repo.PutDataVersion(1); err != nil {
+		t.Fatalf("cannot put data version: %s", err)
+	}
+
+	// the migration fails instead of leaving the block without a position
+	if err := MigrateBlockFiles(tmpPath, repo); err == nil {
+		t.Fatalf("migrated a record of a missing block")
+	}
+	err = repo.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket([]byte("b")).Get(blkId[:]); !reflect.DeepEqual(v, v1) {
+			return fmt.Errorf("record changed to %X", v)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("record not kept: %s", err)
+	}
+	if version, _ := repo.GetDataVersion(); version != 1 {
+		t.Fatalf("data version %d after a failed migration", version)
+	}
+}
+
+func TestReframeBlockFiles_Missing(t *testing.T) {
+	tmpPath := fmt.Sprintf("/tmp/migrate_%s", core.RandomHash256().String())
+	defer os.RemoveAll(tmpPath)
+
+	repo, err := NewBlockIndexRepo(tmpPath)
+	if err != nil {
+		t.Fatalf("cannot open repo: %s", err)
+	}
+	// a record of data version 2 of a block in block file 0, which is missing
+	blkId := core.RandomHash256()
+	rec := &BlockIndexRecord{ChainWork: new(big.Int), Status: BLOCK_ACTIVE, BlockPos: FilePos{Offset: 1, Size: 5}}
+	err = repo.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("b")).Put(blkId[:], rec.Marshall())
+	})
+	if err != nil {
+		t.Fatalf("cannot write record: %s", err)
+	}
+	if err := repo.PutDataVersion(2); err != nil {
+		t.Fatalf("cannot put data version: %s", err)
+	}
+
+	// the migration fails instead of leaving the block without a position
+	if err := MigrateBlockFiles(tmpPath, repo); err == nil {
+		t.Fatalf("reframed a record of a missing block")
+	}
+	if got, err := repo.GetBlockIndexRecord(blkId); err != nil || got.BlockPos != rec.BlockPos {
+		t.Fatalf("record not kept: %v", err)
+	}
+	if version, _ := repo.GetDataVersion(); version != 2 {
+		t.Fatalf("data version %d after a failed migration", version)
+	}
+}
@@ -1,29 +1,27 @@
 package persistence
 
 import (
-	"crypto/rand"
-	"crypto/rsa"
 	core2 "gocoin/core"
 )
 
-var SK []*rsa.PrivateKey
-var PK []*rsa.PublicKey
+var SK []core2.PrivateKey
+var PK []core2.PublicKey
 var ADDR []core2.Hash160
 
 var TXID []core2.Hash256
 var USET *core2.InMemUXTOSet
 
 func PopulateTestData() {
-	SK = []*rsa.PrivateKey{}
-	PK = []*rsa.PublicKey{}
+	SK = []core2.PrivateKey{}
+	PK = []core2.PublicKey{}
 	ADDR = []core2.Hash160{}
 	TXID = []core2.Hash256{}
 	USET = core2.NewUXTOSet()
 
 	// 10 accounts
 	for i := 0; i < 10; i++ {
-		sk, _ := rsa.GenerateKey(rand.Reader, 512)
-		pk := &sk.PublicKey
+		sk, _ := core2.GenerateSecp256k1Key()
+		pk := sk.PublicKey()
 		addr := core2.HashPubKey(pk)
 
 		SK = append(SK, sk)
@@ -41,13 +39,13 @@ func PopulateTestData() {
 	}
 }
 
-func NewUXTO(to core2.Hash160, v uint32) *core2.UXTO {
+func NewUXTO(to core2.Hash160, v core2.Amount) *core2.UXTO {
 	return &core2.UXTO{
 		TxId: core2.RandomHash256(),
 		N:    0,
 		TxOut: &core2.TxOut{
 			Value:        v,
-			ScriptPubKey: core2.ScriptPubKey{PubKeyHash: to},
+			ScriptPubKey: core2.NewP2PKHScriptPubKey(to),
 		},
 	}
 }
@@ -0,0 +1,143 @@
+package persistence
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"gocoin/core"
+	"gocoin/marshal"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// ReindexPos is a position in the block files being reindexed: the offset of a record in the block file with an id.
+type ReindexPos struct {
+	FileId uint32
+	Offset uint32
+}
+
+// reindexDir holds the block files of a data directory while their blocks are processed again.
+func reindexDir(rootDir string) string {
+	return rootDir + "/data/reindex"
+}
+
+// ReindexInProgress reports whether PrepareReindex has started on a data directory and FinishReindex has not run.
+func ReindexInProgress(rootDir string) bool {
+	for _, dir := range []string{reindexDir(rootDir), reindexDir(rootDir) + ".tmp"} {
+		if _, err := os.Stat(dir); err == nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// PrepareReindex moves the blk and rev files of a data directory aside and deletes the block index and the chain
+// state built from them, so that both are rebuilt from genesis while the blocks are processed again, see
+// ForEachReindexBlock. The block files must be of DATA_VERSION.
+// It completes a preparation that was interrupted, and does nothing once a reindex is in progress. A data directory
+// whose oldest block files were pruned cannot be reindexed.
+func PrepareReindex(rootDir string) error {
+	dir := reindexDir(rootDir)
+	if _, err := os.Stat(dir); err == nil {
+		return nil
+	}
+
+	// pruning deletes the oldest files first, file 0 included
+	if _, err := os.Stat(dir + ".tmp"); os.IsNotExist(err) {
+		paths, err := filepath.Glob(rootDir + "/data/blk_*.dat")
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stat(blkFilePath(rootDir, 0)); len(paths) > 0 && os.IsNotExist(err) {
+			return fmt.Errorf("cannot reindex: %w", ErrPruned)
+		}
+	}
+
+	// the files are moved to a temporary directory first, which only takes the place of dir when the databases are gone
+	tmpDir := dir + ".tmp"
+	if err := os.MkdirAll(tmpDir, os.ModePerm); err != nil {
+		return fmt.Errorf("cannot create directory: %w", err)
+	}
+	for _, pattern := range []string{"blk_*.dat", "rev_*.dat"} {
+		paths, err := filepath.Glob(rootDir + "/data/" + pattern)
+		if err != nil {
+			return err
+		}
+		for _, path := range paths {
+			if err := os.Rename(path, tmpDir+"/"+filepath.Base(path)); err != nil {
+				return fmt.Errorf("cannot move file: %w", err)
+			}
+		}
+	}
+
+	for _, path := range []string{rootDir + "/db/block_index.dat", rootDir + "/db/chain_state.dat"} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("cannot delete database: %w", err)
+		}
+	}
+
+	if err := os.Rename(tmpDir, dir); err != nil {
+		return fmt.Errorf("cannot move directory: %w", err)
+	}
+
+	return nil
+}
+
+// ForEachReindexBlock calls fn with every block of the block files moved aside by PrepareReindex, from the one at
+// from on, in the order they were written, and with the position of the block after it. Damaged records are skipped.
+func ForEachReindexBlock(rootDir string, from ReindexPos, fn func(block *core.Block, next ReindexPos) error) error {
+	paths, err := filepath.Glob(reindexDir(rootDir) + "/blk_*.dat")
+	if err != nil {
+		return err
+	}
+	sort.Strings(paths)
+
+	for i, path := range paths {
+		var id uint32
+		if _, err := fmt.Sscanf(filepath.Base(path), "blk_%06d.dat", &id); err != nil || id < from.FileId {
+			continue
+		}
+		log.Infof("Reindexing block file %d of %d...", i+1, len(paths))
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("cannot read file: %w", err)
+		}
+		records, damaged := scanRecords(data)
+		for _, d := range damaged {
+			log.Warnf("Skipped bytes %d to %d of %s, which hold no valid record", d.start, d.end, path)
+		}
+
+		for j, pos := range records {
+			if id == from.FileId && pos.Offset < from.Offset {
+				continue
+			}
+
+			next := ReindexPos{FileId: id + 1}
+			if j+1 < len(records) {
+				next = ReindexPos{FileId: id, Offset: records[j+1].Offset}
+			}
+
+			block, err := marshal.UBlock(data[pos.Offset : pos.Offset+pos.Size])
+			if err != nil {
+				log.Warnf("Skipped unreadable block at %d of %s: %s", pos.Offset, path, err)
+				continue
+			}
+			if err := fn(block, next); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// FinishReindex deletes the block files moved aside by PrepareReindex once all of their blocks have been processed.
+func FinishReindex(rootDir string) error {
+	if err := os.RemoveAll(reindexDir(rootDir)); err != nil {
+		return fmt.Errorf("cannot delete directory: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,110 @@
+package persistence
+
+import (
+	"errors"
+	"fmt"
+	"gocoin/core"
+	"os"
+	"testing"
+)
+
+func TestReindex(t *testing.T) {
+	rootDir := fmt.Sprintf("/tmp/reindex_%s", core.RandomHash256().String())
+	if err := os.MkdirAll(rootDir+"/data", os.ModePerm); err != nil {
+		t.Fatalf("cannot create data directory: %s", err)
+	}
+	defer os.RemoveAll(rootDir)
+
+	repo, err := NewBlockIndexRepo(rootDir)
+	if err != nil {
+		t.Fatalf("cannot open repo: %s", err)
+	}
+	_ = repo.db.Close()
+
+	// two blocks in the first block file, one in the second
+	var blocks []core.Hash256
+	for id, n := range []int{2, 1} {
+		bf, err := NewBlockFile(rootDir, uint32(id))
+		if err != nil {
+			t.Fatalf("cannot open block file: %s", err)
+		}
+		for i := 0; i < n; i++ {
+			b := core.NewBlockBuilder().
+				BaseOn(core.RandomHash256(), uint32(i)).
+				SetNBits(0x1f7fffff).
+				AddTransaction(core.NewCoinBaseTransaction([]byte("coinbase"), core.RandomHash160(), 100, 0)).
+				Build()
+			if _, _, err := bf.WriteBlock(b, nil); err != nil {
+				t.Fatalf("failed to write block: %s", err)
+			}
+			blocks = append(blocks, b.Hash)
+		}
+		_ = bf.Close()
+	}
+
+	if ReindexInProgress(rootDir) {
+		t.Fatalf("reindex in progress before it was prepared")
+	}
+
+	// not without the blocks of a pruned file
+	blk0 := blkFilePath(rootDir, 0)
+	if err := os.Rename(blk0, blk0+".bak"); err != nil {
+		t.Fatalf("cannot move block file: %s", err)
+	}
+	if err := PrepareReindex(rootDir); !errors.Is(err, ErrPruned) || ReindexInProgress(rootDir) {
+		t.Fatalf("prepared reindex of a pruned data directory: %v", err)
+	}
+	if err := os.Rename(blk0+".bak", blk0); err != nil {
+		t.Fatalf("cannot move block file back: %s", err)
+	}
+
+	for i := 0; i < 2; i++ { // preparing again does nothing
+		if err := PrepareReindex(rootDir); err != nil {
+			t.Fatalf("cannot prepare reindex: %s", err)
+		}
+	}
+	if !ReindexInProgress(rootDir) {
+		t.Fatalf("reindex not in progress after it was prepared")
+	}
+	for _, path := range []string{blkFilePath(rootDir, 0), revFilePath(rootDir, 1), rootDir + "/db/block_index.dat"} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Fatalf("%s not moved aside: %v", path, err)
+		}
+	}
+
+	var nexts []ReindexPos
+	forEach := func(from ReindexPos) []core.Hash256 {
+		t.Helper()
+		var got []core.Hash256
+		err := ForEachReindexBlock(rootDir, from, func(block *core.Block, next ReindexPos) error {
+			got = append(got, block.Hash)
+			nexts = append(nexts, next)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("cannot iterate blocks: %s", err)
+		}
+		return got
+	}
+
+	if got := forEach(ReindexPos{}); len(got) != 3 || got[0] != blocks[0] || got[2] != blocks[2] {
+		t.Fatalf("got blocks %v; want %v", got, blocks)
+	}
+	// resuming after the first and the second block
+	if got := forEach(nexts[0]); len(got) != 2 || got[0] != blocks[1] {
+		t.Fatalf("resumed after the first block with %v", got)
+	}
+	if nexts[1] != (ReindexPos{FileId: 1}) {
+		t.Fatalf("block after the end of the first file is at %v", nexts[1])
+	}
+	if got := forEach(nexts[1]); len(got) != 1 || got[0] != blocks[2] {
+		t.Fatalf("resumed after the second block with %v", got)
+	}
+
+	if err := FinishReindex(rootDir); err != nil {
+		t.Fatalf("cannot finish reindex: %s", err)
+	}
+	if ReindexInProgress(rootDir) {
+		t.Fatalf("reindex in progress after it finished")
+	}
+}
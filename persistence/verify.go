@@ -0,0 +1,164 @@
+package persistence
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"gocoin/core"
+	"hash/crc32"
+	"os"
+)
+
+// VerifyReport is the outcome of VerifyDataDir.
+type VerifyReport struct {
+	Records   int      // valid records in the blk and rev files
+	Blocks    int      // blocks of the block index whose records were checked
+	Problems  []string // corrupt or missing records, and damaged ranges of the files
+	Truncated int      // bytes cut off the end of the files
+}
+
+func (r *VerifyReport) problemf(format string, args ...interface{}) {
+	r.Problems = append(r.Problems, fmt.Sprintf(format, args...))
+}
+
+// VerifyDataDir walks every blk and rev file of a data directory, reporting the ranges that hold no valid record, and
+// checks that the block and undo record of every block of the block index with data can be read, unless its block file
+// was pruned.
+// If truncate is set, an incomplete or damaged range at the end of a file, as left by a crash during a write, is cut
+// off instead of reported. The data directory must not be in use by a node.
+func VerifyDataDir(rootDir string, repo *BlockIndexRepo, truncate bool) (*VerifyReport, error) {
+	report := &VerifyReport{}
+
+	lastId, err := repo.GetCurrentFileId()
+	if err == ErrNotFound {
+		lastId = 0
+	} else if err != nil {
+		return nil, fmt.Errorf("cannot get current block file id: %w", err)
+	}
+
+	for id := uint32(0); id <= lastId; id++ {
+		for _, path := range []string{blkFilePath(rootDir, id), revFilePath(rootDir, id)} {
+			if err := verifyFile(path, truncate, report); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	reader := NewBlockReader(rootDir, 1)
+	pruned, err := repo.PrunedFiles()
+	if err != nil {
+		return nil, fmt.Errorf("cannot read file info: %w", err)
+	}
+	for _, id := range pruned {
+		reader.SetPruned(id)
+	}
+
+	err = repo.ForEachBlockIndexRecord(func(blkId core.Hash256, r *BlockIndexRecord) error {
+		if !r.Status.HasData() || reader.isPruned(r.BlockFileID) {
+			return nil
+		}
+		report.Blocks++
+
+		if _, err := reader.GetBlock(r); err != nil {
+			report.problemf("block %s at height %d: %s", blkId, r.Height, describe(err))
+		}
+		if _, err := reader.GetUndo(r); err != nil {
+			report.problemf("undo data of block %s at height %d: %s", blkId, r.Height, describe(err))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot read block index: %w", err)
+	}
+
+	return report, nil
+}
+
+// describe tells missing records from corrupt ones.
+func describe(err error) string {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return fmt.Sprintf("missing (%s)", err)
+	case errors.Is(err, ErrCorrupt):
+		return fmt.Sprintf("corrupt (%s)", err)
+	default:
+		return err.Error()
+	}
+}
+
+func verifyFile(path string, truncate bool, report *VerifyReport) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil // blocks stored in it are reported missing
+	} else if err != nil {
+		return fmt.Errorf("cannot read file: %w", err)
+	}
+
+	records, damaged := scanRecords(data)
+	report.Records += len(records)
+
+	for i, d := range damaged {
+		if truncate && i == len(damaged)-1 && d.end == len(data) {
+			if err := os.Truncate(path, int64(d.start)); err != nil {
+				return fmt.Errorf("cannot truncate file: %w", err)
+			}
+			report.Truncated += d.end - d.start
+			continue
+		}
+		report.problemf("%s: bytes %d to %d hold no valid record", path, d.start, d.end)
+	}
+
+	return nil
+}
+
+// span is a range of bytes of a file.
+type span struct {
+	start, end int
+}
+
+// scanRecords returns the positions of the valid records of a blk or rev file and the ranges between them that hold
+// none. After a damaged record, scanning resumes at the next RECORD_MAGIC.
+func scanRecords(data []byte) ([]FilePos, []span) {
+	var records []FilePos
+	var damaged []span
+
+	for p := 0; p < len(data); {
+		if n, ok := validRecordAt(data, p); ok {
+			records = append(records, FilePos{Offset: uint32(p + S_RECORD_HEADER), Size: uint32(n - S_RECORD_HEADER)})
+			p += n
+			continue
+		}
+
+		next := len(data)
+		for q := p + 1; q < len(data); {
+			i := bytes.Index(data[q:], RECORD_MAGIC[:])
+			if i < 0 {
+				break
+			}
+			if _, ok := validRecordAt(data, q+i); ok {
+				next = q + i
+				break
+			}
+			q += i + 1
+		}
+		damaged = append(damaged, span{start: p, end: next})
+		p = next
+	}
+
+	return records, damaged
+}
+
+// validRecordAt returns the size of the record starting at p, header included, if it is complete and matches its
+// checksum.
+func validRecordAt(data []byte, p int) (int, bool) {
+	size, checksum, ok := uRecordHeader(data[p:])
+	if !ok || uint64(len(data)-p-S_RECORD_HEADER) < uint64(size) {
+		return 0, false
+	}
+	n := S_RECORD_HEADER + int(size)
+	if crc32.Checksum(data[p+S_RECORD_HEADER:p+n], crcTable) != checksum {
+		return 0, false
+	}
+
+	return n, true
+}
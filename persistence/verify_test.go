@@ -0,0 +1,107 @@
+package persistence
+
+import (
+	"fmt"
+	"gocoin/core"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestVerifyDataDir(t *testing.T) {
+	rootDir := fmt.Sprintf("/tmp/verify_%s", core.RandomHash256().String())
+	if err := os.MkdirAll(rootDir+"/data", os.ModePerm); err != nil {
+		t.Fatalf("cannot create data directory: %s", err)
+	}
+	defer os.RemoveAll(rootDir)
+
+	repo, err := NewBlockIndexRepo(rootDir)
+	if err != nil {
+		t.Fatalf("cannot open repo: %s", err)
+	}
+	bf, err := NewBlockFile(rootDir, 0)
+	if err != nil {
+		t.Fatalf("cannot open block file: %s", err)
+	}
+
+	var recs []*BlockIndexRecord
+	for i := 0; i < 3; i++ {
+		b := core.NewBlockBuilder().
+			BaseOn(core.RandomHash256(), uint32(i)).
+			SetNBits(0x1f7fffff).
+			AddTransaction(core.NewCoinBaseTransaction([]byte("coinbase"), core.RandomHash160(), 100, 0)).
+			Build()
+		blockPos, undoPos, err := bf.WriteBlock(b, nil)
+		if err != nil {
+			t.Fatalf("failed to write block: %s", err)
+		}
+		recs = append(recs, &BlockIndexRecord{
+			BlockHeader: b.BlockHeader,
+			Height:      b.Height,
+			BlockPos:    blockPos,
+			UndoPos:     undoPos,
+			Status:      BLOCK_ACTIVE,
+		})
+	}
+	_ = bf.Close()
+
+	// the last block is indexed in a block file that does not exist
+	recs[2].BlockFileID = 1
+	for _, rec := range recs {
+		if err := repo.PutBlockIndexRecord(rec.Hash(), rec); err != nil {
+			t.Fatalf("cannot put record: %s", err)
+		}
+	}
+
+	// damage the first block and leave a torn record at the end of the block file
+	blkPath := blkFilePath(rootDir, 0)
+	f, err := os.OpenFile(blkPath, os.O_RDWR, 0600)
+	if err != nil {
+		t.Fatalf("cannot open block file: %s", err)
+	}
+	if _, err := f.WriteAt([]byte{0xff}, int64(recs[0].BlockPos.Offset+recs[0].BlockPos.Size/2)); err != nil {
+		t.Fatalf("cannot damage record: %s", err)
+	}
+	size, _ := fileSize(f)
+	if _, err := f.WriteAt(frameRecord([]byte("torn record"))[:S_RECORD_HEADER+4], int64(size)); err != nil {
+		t.Fatalf("cannot write torn record: %s", err)
+	}
+	_ = f.Close()
+
+	damaged := fmt.Sprintf("%s: bytes 0 to %d hold no valid record", blkPath, recs[1].BlockPos.Offset-S_RECORD_HEADER)
+	torn := fmt.Sprintf("%s: bytes %d to %d hold no valid record", blkPath, size, size+S_RECORD_HEADER+4)
+	corrupt := fmt.Sprintf("block %s at height %d: corrupt", recs[0].Hash(), recs[0].Height)
+	missing := fmt.Sprintf("block %s at height %d: missing", recs[2].Hash(), recs[2].Height)
+	missingUndo := fmt.Sprintf("undo data of block %s at height %d: missing", recs[2].Hash(), recs[2].Height)
+
+	verify := func(truncate bool, truncated int, problems ...string) {
+		t.Helper()
+		report, err := VerifyDataDir(rootDir, repo, truncate)
+		if err != nil {
+			t.Fatalf("cannot verify: %s", err)
+		}
+		// the blocks after the damaged one and every undo record
+		if report.Records != 5 || report.Blocks != 3 || report.Truncated != truncated {
+			t.Fatalf("verified %d records and %d blocks, truncated %d bytes", report.Records, report.Blocks, report.Truncated)
+		}
+		if len(report.Problems) != len(problems) {
+			t.Fatalf("found problems %q; want %q", report.Problems, problems)
+		}
+		for _, want := range problems {
+			found := false
+			for _, got := range report.Problems {
+				found = found || strings.HasPrefix(got, want)
+			}
+			if !found {
+				t.Fatalf("problem %q not found in %q", want, report.Problems)
+			}
+		}
+	}
+
+	verify(false, 0, damaged, torn, corrupt, missing, missingUndo)
+	verify(true, S_RECORD_HEADER+4, damaged, corrupt, missing, missingUndo)
+	if info, err := os.Stat(blkPath); err != nil || info.Size() != int64(size) {
+		t.Fatalf("torn record not cut off: %v", err)
+	}
+	verify(true, 0, damaged, corrupt, missing, missingUndo)
+}
@@ -3,7 +3,9 @@ package controllers
 import (
 	"context"
 	"encoding/base64"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"github.com/gin-gonic/gin"
 	log "github.com/sirupsen/logrus"
 	"gocoin/blockchain"
@@ -11,6 +13,7 @@ import (
 	"gocoin/marshal"
 	"gocoin/persistence"
 	"net/http"
+	"sort"
 )
 
 type BlockchainController struct {
@@ -18,27 +21,40 @@ type BlockchainController struct {
 }
 
 type sendFromForm struct {
-	From   string `json:"from" binding:"required"`
-	To     string `json:"to" binding:"required"`
-	Amount uint32 `json:"amount" binding:"required"`
-	Fee    uint32 `json:"fee" binding:"required"`
+	From   string      `json:"from"` // optional; without it, any of the wallet's UXTOs may be spent
+	To     string      `json:"to" binding:"required"`
+	Amount core.Amount `json:"amount" binding:"required"`
+	Fee    core.Amount `json:"fee" binding:"required"`
 }
 
+type sendDataForm struct {
+	From string      `json:"from"` // optional, as in sendFromForm
+	Data string      `json:"data" binding:"required"`
+	Fee  core.Amount `json:"fee" binding:"required"`
+}
+
+// MAX_DATA_RESULTS bounds the records returned by a data lookup, whose prefix may be short.
+const MAX_DATA_RESULTS = 100
+
 type TxInDTO struct {
 	PrevTxid  string
 	Vout      uint32
 	ScriptSig string // encoded bytes for coinbase or ScripSig
+	Sequence  uint32
 }
 
 type TxOutDTO struct {
-	Address string
-	Amount  uint32
+	Address string // empty unless the output is P2PKH or P2SH
+	Script  string // disassembled ScriptPubKey
+	Amount  core.Amount
 }
 
 type TransactionDTO struct {
-	TxId    string
-	Inputs  []TxInDTO
-	Outputs []TxOutDTO
+	TxId     string
+	WTxId    string
+	Inputs   []TxInDTO
+	Outputs  []TxOutDTO
+	LockTime uint32
 }
 
 func (b *BlockchainController) GetTransaction(c *gin.Context) {
@@ -54,9 +70,12 @@ func (b *BlockchainController) GetTransaction(c *gin.Context) {
 		return
 	}
 
-	tx, err := persistence.GetTransaction(b.Blockchain.RootDir, txRecord)
-
-	if err != nil {
+	tx, err := b.BlockReader.GetTransaction(txRecord)
+	if errors.Is(err, persistence.ErrPruned) {
+		// the transaction is known, but the block holding it is no longer stored
+		SendError(c, http.StatusGone, err)
+		return
+	} else if err != nil {
 		SendError(c, http.StatusInternalServerError, err)
 		return
 	}
@@ -74,25 +93,29 @@ func (b *BlockchainController) GetTransaction(c *gin.Context) {
 			PrevTxid:  txIn.PrevTxId.String(),
 			Vout:      txIn.N,
 			ScriptSig: base64.StdEncoding.EncodeToString(raw),
+			Sequence:  txIn.Sequence,
 		}
 	}
 
 	txOutDTOs := make([]TxOutDTO, len(tx.Outs))
 	for i, txOut := range tx.Outs {
 		txOutDTOs[i] = TxOutDTO{
-			Address: txOut.PubKeyHash.String(),
+			Address: txOut.Script.Address(),
+			Script:  txOut.Script.String(),
 			Amount:  txOut.Value,
 		}
 	}
 
 	c.JSON(http.StatusOK, TransactionDTO{
-		TxId:    tx.Hash().String(),
-		Inputs:  txInDTOs,
-		Outputs: txOutDTOs,
+		TxId:     tx.Hash().String(),
+		WTxId:    tx.WitnessHash().String(),
+		Inputs:   txInDTOs,
+		Outputs:  txOutDTOs,
+		LockTime: tx.LockTime,
 	})
 }
 
-// SendFrom sends an amount from the given address to the given address.
+// SendFrom sends an amount from the given address, or from the whole wallet if it is omitted, to the given address.
 // From implementation's perspective, this is blockchain-level concern; but from client's perspective, this is wallet-level concern.
 // So, this method is implemented in the blockchain controller and exposed as a wallet controller.
 //
@@ -113,32 +136,80 @@ func (b *BlockchainController) SendFrom(c *gin.Context) {
 		return
 	}
 
-	fromAddr := core.Hash160{}
-	err := fromAddr.ParseAddress(form.From)
+	var from []core.Hash160
+	if form.From != "" {
+		fromAddr, err := parseAddress(form.From)
+		if err != nil {
+			SendError(c, http.StatusBadRequest, err)
+			return
+		}
+		from = append(from, fromAddr)
+	}
+
+	toScript, err := core.ParseAddressScript(form.To)
 	if err != nil {
 		SendError(c, http.StatusBadRequest, err)
 		return
 	}
 
-	toAddr := core.Hash160{}
-	err = toAddr.ParseAddress(form.To)
+	transaction, err := b.DiskWallet.CreateTransaction(from, toScript, form.Amount, form.Fee)
 	if err != nil {
+		SendError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	b.submit(c, transaction)
+}
+
+// SendData anchors hex-encoded data of up to 80 bytes, e.g. a document hash, in a data output paid for by the
+// given address or by the whole wallet.
+//
+// POST /wallet/sendData
+//
+//	{
+//		"from": "1JwSSubhmg6iPtRjtyqhUYYH7bZg3Lfy1T",
+//		"data": "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08",
+//		"fee": 50
+//	}
+func (b *BlockchainController) SendData(c *gin.Context) {
+	var form sendDataForm
+	if err := c.ShouldBindJSON(&form); err != nil {
 		SendError(c, http.StatusBadRequest, err)
 		return
 	}
 
-	transaction, err := b.DiskWallet.CreateTransaction(fromAddr, toAddr, form.Amount, form.Fee)
+	var from []core.Hash160
+	if form.From != "" {
+		fromAddr, err := parseAddress(form.From)
+		if err != nil {
+			SendError(c, http.StatusBadRequest, err)
+			return
+		}
+		from = append(from, fromAddr)
+	}
+
+	data, err := hex.DecodeString(form.Data)
 	if err != nil {
-		SendError(c, http.StatusInternalServerError, err)
+		SendError(c, http.StatusBadRequest, fmt.Errorf("failed to decode data: %w", err))
 		return
 	}
 
-	err = b.ReceiveTransaction(transaction)
+	transaction, err := b.DiskWallet.CreateDataTransaction(from, data, form.Fee)
 	if err != nil {
 		SendError(c, http.StatusInternalServerError, err)
 		return
 	}
 
+	b.submit(c, transaction)
+}
+
+// submit adds a transaction of the wallet to the mempool and broadcasts it.
+func (b *BlockchainController) submit(c *gin.Context, transaction *core.Transaction) {
+	if err := b.ReceiveTransaction(transaction); err != nil {
+		SendError(c, http.StatusInternalServerError, err)
+		return
+	}
+
 	// broadcast
 	go b.BroadcastTx(transaction)
 
@@ -147,6 +218,101 @@ func (b *BlockchainController) SendFrom(c *gin.Context) {
 	})
 }
 
+type dataDTO struct {
+	TxId   string `json:"txid"`
+	Vout   uint32 `json:"vout"`
+	Height uint32 `json:"height"`
+	Data   string `json:"data"`
+}
+
+// FindData lists the data outputs in the active chain whose payload starts with the given hex prefix.
+// GET /blockchain/data?prefix=9f86d0
+func (b *BlockchainController) FindData(c *gin.Context) {
+	prefix, err := hex.DecodeString(c.Query("prefix"))
+	if err != nil {
+		SendError(c, http.StatusBadRequest, fmt.Errorf("failed to decode prefix: %w", err))
+		return
+	}
+
+	records, err := b.FindDataRecords(prefix, MAX_DATA_RESULTS)
+	if err != nil {
+		SendError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	rets := make([]dataDTO, len(records))
+	for i, r := range records {
+		rets[i] = dataDTO{
+			TxId:   r.TxId.String(),
+			Vout:   r.N,
+			Height: r.Height,
+			Data:   hex.EncodeToString(r.Data),
+		}
+	}
+
+	c.JSON(http.StatusOK, rets)
+}
+
+type supplyDTO struct {
+	Height    uint32      `json:"height"`
+	Subsidy   core.Amount `json:"subsidy"`   // subsidy of the next block
+	MaxIssued core.Amount `json:"maxIssued"` // sum of the subsidies up to the tip; miners may have claimed less
+	SupplyCap core.Amount `json:"supplyCap"` // sum of the subsidies of every height
+}
+
+// GetSupply returns the block subsidy and the most coins the active chain can have issued so far.
+// GET /blockchain/supply
+func (b *BlockchainController) GetSupply(c *gin.Context) {
+	tipHash, err := b.GetCurrentBlockHash()
+	if err != nil {
+		SendError(c, http.StatusInternalServerError, fmt.Errorf("failed to get tip: %w", err))
+		return
+	}
+	tipRec, err := b.GetBlockIndexRecord(tipHash)
+	if err != nil {
+		SendError(c, http.StatusInternalServerError, fmt.Errorf("failed to get tip record: %w", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, supplyDTO{
+		Height:    tipRec.Height,
+		Subsidy:   core.Subsidy(tipRec.Height + 1),
+		MaxIssued: core.Params.MaxIssuedCoins(tipRec.Height),
+		SupplyCap: core.Params.SupplyCap(),
+	})
+}
+
+type chainTipDTO struct {
+	Height    uint32 `json:"height"`
+	Hash      string `json:"hash"`
+	BranchLen int    `json:"branchlen"` // blocks between the active chain and the tip
+	Status    string `json:"status"`
+}
+
+// GetChainTips lists the tips of every known branch, including the active one, highest first.
+// GET /blockchain/chainTips
+func (b *BlockchainController) GetChainTips(c *gin.Context) {
+	tips := b.Tree.Tips()
+	sort.Slice(tips, func(i, j int) bool { return tips[i].Height > tips[j].Height })
+
+	rets := make([]chainTipDTO, len(tips))
+	for i, r := range tips {
+		branchLen, err := b.Tree.BranchLength(r.Hash())
+		if err != nil {
+			SendError(c, http.StatusInternalServerError, err)
+			return
+		}
+		rets[i] = chainTipDTO{
+			Height:    r.Height,
+			Hash:      r.Hash().String(),
+			BranchLen: branchLen,
+			Status:    r.Status.String(),
+		}
+	}
+
+	c.JSON(http.StatusOK, rets)
+}
+
 type MiningCtxDTO struct {
 	MinerAddress string `json:"minerAddress"`
 	PrevHash     string `json:"prevHash"`
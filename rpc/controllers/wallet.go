@@ -1,9 +1,11 @@
 package controllers
 
 import (
+	"encoding/hex"
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"gocoin/core"
+	"gocoin/marshal"
 	"gocoin/wallet"
 	"net/http"
 )
@@ -12,26 +14,37 @@ type WalletController struct {
 	*wallet.DiskWallet
 }
 
-// map of address to balance
-type walletInfo map[string]uint32
+// maps of address to balance
+type walletInfo struct {
+	Balances map[string]core.Amount `json:"balances"`
+	Immature map[string]core.Amount `json:"immature"` // coinbase outputs that cannot be spent yet
+}
 
 // GetWalletInfo returns overview of the wallet
 // GET /wallet/info
 func (t *WalletController) GetWalletInfo(c *gin.Context) {
-	balances := t.DiskWallet.GetBalances()
-	info := make(walletInfo, len(balances))
-	for addr, balance := range balances {
-		info[addr.String()] = balance
+	info := walletInfo{
+		Balances: t.formatBalances(t.DiskWallet.GetBalances()),
+		Immature: t.formatBalances(t.DiskWallet.GetImmatureBalances()),
 	}
 
 	c.JSON(http.StatusOK, info)
 }
 
+func (t *WalletController) formatBalances(balances map[core.Hash160]core.Amount) map[string]core.Amount {
+	ret := make(map[string]core.Amount, len(balances))
+	for addr, balance := range balances {
+		ret[t.FormatAddress(addr)] = balance
+	}
+
+	return ret
+}
+
 func (t *WalletController) ListAddresses(c *gin.Context) {
 	addresses := t.DiskWallet.ListAddresses()
 	rets := make([]string, len(addresses))
 	for i, addr := range addresses {
-		rets[i] = addr.String()
+		rets[i] = t.FormatAddress(addr)
 	}
 
 	c.JSON(http.StatusOK, rets)
@@ -51,19 +64,80 @@ func (t *WalletController) GetNewAddress(c *gin.Context) {
 	})
 }
 
+type newMultiSigAddressForm struct {
+	Required  int      `json:"required" binding:"required"`
+	Addresses []string `json:"addresses" binding:"required"`
+}
+
+// GetNewMultiSigAddress creates a P2SH address requiring signatures by some of the keys of the given
+// wallet addresses
+// POST /wallet/newMultiSigAddress
+//
+//	{
+//		"required": 2,
+//		"addresses": ["1JwSSubhmg6iPtRjtyqhUYYH7bZg3Lfy1T", "1FQc5LdgGHMHEN9nwkjmz6tWkxhPpxBvBU", "1BoatSLRHtKNngkdXEeobR76b53LETtpyT"]
+//	}
+func (t *WalletController) GetNewMultiSigAddress(c *gin.Context) {
+	var form newMultiSigAddressForm
+	if err := c.ShouldBindJSON(&form); err != nil {
+		SendError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	pks := make([]core.PublicKey, len(form.Addresses))
+	for i, str := range form.Addresses {
+		addr := core.Hash160{}
+		if err := addr.ParseAddress(str); err != nil {
+			SendError(c, http.StatusBadRequest, fmt.Errorf("failed to parse address %s: %w", str, err))
+			return
+		}
+
+		pk, err := t.PublicKey(addr)
+		if err != nil {
+			SendError(c, http.StatusBadRequest, fmt.Errorf("no key for address %s: %w", str, err))
+			return
+		}
+		pks[i] = pk
+	}
+
+	address, err := t.NewMultiSigAddress(form.Required, pks)
+	if err != nil {
+		SendError(c, http.StatusBadRequest, fmt.Errorf("failed to create multisig address: %w", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"address": address.P2SHString(),
+	})
+}
+
+// parseAddress decodes a P2PKH address into its key hash or a P2SH address into its script hash.
+func parseAddress(str string) (core.Hash160, error) {
+	script, err := core.ParseAddressScript(str)
+	if err != nil {
+		return core.Hash160{}, err
+	}
+	if h, ok := script.P2SHHash(); ok {
+		return h, nil
+	}
+	addr, _ := script.P2PKHAddress()
+
+	return addr, nil
+}
+
 type uxtoDTO struct {
-	TxId    string `json:"txid"`
-	Vout    uint32 `json:"vout"`
-	Address string `json:"address"`
-	Amount  uint32 `json:"amount"`
+	TxId    string      `json:"txid"`
+	Vout    uint32      `json:"vout"`
+	Address string      `json:"address"`
+	Script  string      `json:"scriptPubKey"`
+	Amount  core.Amount `json:"amount"`
 }
 
 // ListUnspent lists all unspent outputs for the given address
 // GET /wallet/listUnspent?address=1JwSSubhmg6iPtRjtyqhUYYH7bZg3Lfy1T
 func (t *WalletController) ListUnspent(c *gin.Context) {
-	address := core.Hash160{}
-
-	if err := address.ParseAddress(c.Query("address")); err != nil {
+	address, err := parseAddress(c.Query("address"))
+	if err != nil {
 		SendError(c, http.StatusBadRequest, fmt.Errorf("failed to parse address: %w", err))
 		return
 	}
@@ -78,7 +152,8 @@ func (t *WalletController) ListUnspent(c *gin.Context) {
 		rets[i] = uxtoDTO{
 			TxId:    u.TxId.String(),
 			Vout:    u.N,
-			Address: u.PubKeyHash.String(),
+			Address: u.Script.Address(),
+			Script:  u.Script.String(),
 			Amount:  u.Value,
 		}
 	}
@@ -92,9 +167,56 @@ func (t *WalletController) CreateRawTransaction(c *gin.Context) {
 	})
 }
 
+type signRawTransactionForm struct {
+	Hex     string `json:"hex" binding:"required"`
+	SigHash string `json:"sighash"`
+}
+
+// SignRawTransaction signs the inputs of a serialized transaction that spend outputs of the wallet.
+// The hash type defaults to ALL; NONE, SINGLE and their "|ANYONECANPAY" forms leave parts of the transaction
+// open for others to complete.
+// POST /wallet/signRawTransaction
+//
+//	{
+//		"hex": "...",
+//		"sighash": "SINGLE|ANYONECANPAY"
+//	}
 func (t *WalletController) SignRawTransaction(c *gin.Context) {
+	var form signRawTransactionForm
+	if err := c.ShouldBindJSON(&form); err != nil {
+		SendError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	hashType := core.SIGHASH_ALL
+	if form.SigHash != "" {
+		var err error
+		if hashType, err = core.ParseSigHashType(form.SigHash); err != nil {
+			SendError(c, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	buf, err := hex.DecodeString(form.Hex)
+	if err != nil {
+		SendError(c, http.StatusBadRequest, fmt.Errorf("failed to decode hex: %w", err))
+		return
+	}
+	tx, err := marshal.UTransaction(buf)
+	if err != nil {
+		SendError(c, http.StatusBadRequest, fmt.Errorf("failed to parse transaction: %w", err))
+		return
+	}
+
+	signed, err := t.SignTransaction(tx, hashType)
+	if err != nil {
+		SendError(c, http.StatusInternalServerError, err)
+		return
+	}
+
 	c.JSON(http.StatusOK, gin.H{
-		"message": "pong",
+		"hex":    hex.EncodeToString(marshal.Transaction(tx)),
+		"signed": signed,
 	})
 }
 
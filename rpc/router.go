@@ -28,11 +28,17 @@ func NewRouter(bc *blockchain.Blockchain) *gin.Engine {
 	router.GET("/blockchain/miningContext", bcController.GetMiningContext)
 	router.POST("/blockchain/miningContext", bcController.SetMiningContext)
 	router.GET("/blockchain/transactions", bcController.GetTransaction)
+	router.GET("/blockchain/data", bcController.FindData)
+	router.GET("/blockchain/supply", bcController.GetSupply)
+	router.GET("/blockchain/chainTips", bcController.GetChainTips)
 	router.GET("/wallet/info", wallet.GetWalletInfo)
 	router.GET("/wallet/newAddress", wallet.GetNewAddress)
+	router.POST("/wallet/newMultiSigAddress", wallet.GetNewMultiSigAddress)
 	router.GET("/wallet/listAddress", wallet.ListAddresses)
 	router.GET("/wallet/listUnspent", wallet.ListUnspent)
+	router.POST("/wallet/signRawTransaction", wallet.SignRawTransaction)
 	router.POST("/wallet/sendFrom", bcController.SendFrom)
+	router.POST("/wallet/sendData", bcController.SendData)
 
 	return router
 }
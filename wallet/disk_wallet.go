@@ -1,8 +1,6 @@
 package wallet
 
 import (
-	"crypto/rand"
-	"crypto/rsa"
 	"crypto/x509"
 	"fmt"
 	"github.com/boltdb/bolt"
@@ -32,8 +30,10 @@ func NewDiskWallet(rootDir string) (*DiskWallet, error) {
 	bucketKeys := [][]byte{
 		[]byte("addresses"),    // address -> 0
 		[]byte("keys"),         // address -> sk
+		[]byte("scripts"),      // script hash -> redeem script
 		[]byte("uxtos"),        // uRef -> UXTO
 		[]byte("transactions"), // txid -> transactions
+		[]byte("meta"),         // "version" -> data version, "height" -> height of the last processed block
 	}
 
 	err = db.Update(func(tx *bolt.Tx) error {
@@ -44,28 +44,77 @@ func NewDiskWallet(rootDir string) (*DiskWallet, error) {
 			}
 		}
 
-		return nil
+		return migrate(tx)
 	})
 
 	if err != nil {
+		_ = db.Close()
 		return nil, fmt.Errorf("cannot create buckets: %w", err)
 	}
 
 	return w, nil
 }
 
+// migrate re-encodes the UXTOs and transactions of a legacy wallet in the current format. An unreadable record fails
+// the migration, which then leaves the wallet as it was.
+func migrate(tx *bolt.Tx) error {
+	meta := tx.Bucket([]byte("meta"))
+	if meta.Get([]byte("version")) != nil {
+		return nil
+	}
+
+	uxtos := tx.Bucket([]byte("uxtos"))
+	transactions := tx.Bucket([]byte("transactions"))
+
+	for _, k := range keysOf(uxtos) {
+		u, err := marshal.DeserializeLegacyUXTO(uxtos.Get(k))
+		if err != nil {
+			return fmt.Errorf("failed to migrate uxto %X: %w", k, err)
+		}
+		if err := uxtos.Put(k, marshal.SerializeUXTO(u)); err != nil {
+			return fmt.Errorf("failed to migrate uxto: %w", err)
+		}
+	}
+
+	for _, k := range keysOf(transactions) {
+		t, err := marshal.ULegacyTransaction(transactions.Get(k))
+		if err != nil {
+			return fmt.Errorf("failed to migrate transaction %X: %w", k, err)
+		}
+		if err := transactions.Put(k, marshal.Transaction(t)); err != nil {
+			return fmt.Errorf("failed to migrate transaction: %w", err)
+		}
+	}
+
+	return meta.Put([]byte("version"), marshal.Uint32ToBytes(persistence.DATA_VERSION))
+}
+
+func keysOf(b *bolt.Bucket) [][]byte {
+	var keys [][]byte
+
+	c := b.Cursor()
+	for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		keys = append(keys, append([]byte{}, k...))
+	}
+
+	return keys
+}
+
 func (w *DiskWallet) NewAddress() (core.Hash160, error) {
-	sk, _ := rsa.GenerateKey(rand.Reader, 512) // TODO: param bit length
-	addr := core.HashPubKey(&sk.PublicKey)
+	sk, err := core.GenerateSecp256k1Key()
+	if err != nil {
+		return [20]byte{}, fmt.Errorf("failed to generate key: %w", err)
+	}
+	addr := core.HashPubKey(sk.PublicKey())
 
-	err := w.db.Update(func(tx *bolt.Tx) error {
+	err = w.db.Update(func(tx *bolt.Tx) error {
 		addresses := tx.Bucket([]byte("addresses"))
 		keys := tx.Bucket([]byte("keys"))
 
 		if err := addresses.Put(addr[:], []byte{}); err != nil {
 			return fmt.Errorf("failed to put address: %w", err)
 		}
-		if err := keys.Put(addr[:], x509.MarshalPKCS1PrivateKey(sk)); err != nil {
+		if err := keys.Put(addr[:], sk.Bytes()); err != nil {
 			return fmt.Errorf("failed to put key: %w", err)
 		}
 
@@ -81,6 +130,66 @@ func (w *DiskWallet) NewAddress() (core.Hash160, error) {
 	return addr, nil
 }
 
+// NewMultiSigAddress adds a P2SH address requiring signatures by m of the given keys.
+// The wallet can spend from it once it holds enough of the keys.
+func (w *DiskWallet) NewMultiSigAddress(m int, pks []core.PublicKey) (core.Hash160, error) {
+	redeemScript, err := core.NewMultiSigScript(m, pks)
+	if err != nil {
+		return [20]byte{}, err
+	}
+	scriptHash := core.HashTo160(redeemScript)
+
+	err = w.db.Update(func(tx *bolt.Tx) error {
+		scripts := tx.Bucket([]byte("scripts"))
+		if err := scripts.Put(scriptHash[:], redeemScript); err != nil {
+			return fmt.Errorf("failed to put script: %w", err)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return [20]byte{}, fmt.Errorf("failed to update db: %w", err)
+	}
+
+	log.Infof("added new multisig address: %s", scriptHash.P2SHString())
+
+	return scriptHash, nil
+}
+
+// getRedeemScript returns the redeem script of a P2SH address, or nil if it is not one of ours.
+func (w *DiskWallet) getRedeemScript(scriptHash core.Hash160) core.Script {
+	var redeemScript core.Script
+
+	_ = w.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket([]byte("scripts")).Get(scriptHash[:]); v != nil {
+			redeemScript = append(core.Script{}, v...)
+		}
+		return nil
+	})
+
+	return redeemScript
+}
+
+// FormatAddress encodes a key hash or, for the wallet's multisig addresses, a script hash.
+func (w *DiskWallet) FormatAddress(addr core.Hash160) string {
+	if w.getRedeemScript(addr) != nil {
+		return addr.P2SHString()
+	}
+
+	return addr.String()
+}
+
+// PublicKey returns the public key of an address, e.g. to build a multisig address.
+func (w *DiskWallet) PublicKey(addr core.Hash160) (core.PublicKey, error) {
+	sk, err := w.getKey(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return sk.PublicKey(), nil
+}
+
 func (w *DiskWallet) ListAddresses() []core.Hash160 {
 	var addresses []core.Hash160
 
@@ -88,6 +197,11 @@ func (w *DiskWallet) ListAddresses() []core.Hash160 {
 		b := tx.Bucket([]byte("addresses"))
 		c := b.Cursor()
 
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			addresses = append(addresses, core.Hash160FromSlice(k))
+		}
+
+		c = tx.Bucket([]byte("scripts")).Cursor()
 		for k, _ := c.First(); k != nil; k, _ = c.Next() {
 			addresses = append(addresses, core.Hash160FromSlice(k))
 		}
@@ -97,8 +211,10 @@ func (w *DiskWallet) ListAddresses() []core.Hash160 {
 	return addresses
 }
 
-func (w *DiskWallet) getKey(address core.Hash160) (*rsa.PrivateKey, error) {
-	var sk *rsa.PrivateKey
+// getKey returns the key of an address.
+// Keys are stored as 32-byte secp256k1 scalars; longer values are legacy PKCS #1 RSA keys.
+func (w *DiskWallet) getKey(address core.Hash160) (core.PrivateKey, error) {
+	var sk core.PrivateKey
 
 	err := w.db.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte("keys"))
@@ -108,11 +224,21 @@ func (w *DiskWallet) getKey(address core.Hash160) (*rsa.PrivateKey, error) {
 			return fmt.Errorf("key not found")
 		}
 
-		var err error
-		sk, err = x509.ParsePKCS1PrivateKey(skBytes)
+		if len(skBytes) == core.S_SECP256K1_PRIVKEY {
+			var err error
+			sk, err = core.ParseSecp256k1PrivateKey(skBytes)
+			if err != nil {
+				return fmt.Errorf("failed to parse key: %w", err)
+			}
+
+			return nil
+		}
+
+		rsaKey, err := x509.ParsePKCS1PrivateKey(skBytes)
 		if err != nil {
 			return fmt.Errorf("failed to parse key: %w", err)
 		}
+		sk = core.NewRSAPrivateKey(rsaKey)
 
 		return nil
 	})
@@ -120,30 +246,52 @@ func (w *DiskWallet) getKey(address core.Hash160) (*rsa.PrivateKey, error) {
 	return sk, err
 }
 
-func (w *DiskWallet) CreateTransaction(from, to core.Hash160, value, fee uint32) (*core.Transaction, error) {
-	var inVal uint32
-	sk, err := w.getKey(from)
+// CreateTransaction pays value to the given script from the UXTOs of the given addresses, or of every address
+// of the wallet if none is given. Change goes back to the first given address, or to a new address.
+func (w *DiskWallet) CreateTransaction(from []core.Hash160, to core.Script, value, fee core.Amount) (*core.Transaction, error) {
+	return w.createTransaction(from, &core.TxOut{Value: value, ScriptPubKey: core.ScriptPubKey{Script: to}}, fee)
+}
+
+// CreateDataTransaction anchors data on chain in a data output, paying only the fee, from the UXTOs of the given
+// addresses as CreateTransaction does.
+func (w *DiskWallet) CreateDataTransaction(from []core.Hash160, data []byte, fee core.Amount) (*core.Transaction, error) {
+	script, err := core.NewDataScript(data)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get key for address %s: %w", from, err)
+		return nil, err
 	}
 
-	txb := core.NewTransactionBuilder()
+	return w.createTransaction(from, &core.TxOut{Value: 0, ScriptPubKey: core.ScriptPubKey{Script: script}}, fee)
+}
+
+func (w *DiskWallet) createTransaction(from []core.Hash160, out *core.TxOut, fee core.Amount) (*core.Transaction, error) {
+	want, err := core.AddAmounts(out.Value, fee)
+	if err != nil {
+		return nil, fmt.Errorf("invalid amount: %w", err)
+	}
+
+	spendable := make(map[core.Hash160]bool, len(from))
+	for _, addr := range from {
+		spendable[addr] = true
+	}
+
+	next := w.Height() + 1
+	var candidates []*core.UXTO
 	err = w.db.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte("uxtos"))
 		c := b.Cursor()
 
 		for k, v := c.First(); k != nil; k, v = c.Next() {
-			uRef := persistence.UXTORef{}
-			uRef.SetBytes(k)
-			uxto := marshal.DeserializeUXTO(v)
-
-			if uxto.PubKeyHash == from {
-				txb.AddInputFrom(uxto, &sk.PublicKey)
+			uxto, err := marshal.DeserializeUXTO(v)
+			if err != nil {
+				log.Warnf("Skipped unreadable wallet UXTO %X: %s", k, err)
+				continue
+			}
 
-				inVal += uxto.Value
-				if inVal >= value+fee {
-					break
-				}
+			if !uxto.MatureAt(next) {
+				continue
+			}
+			if len(from) == 0 || spendable[uxto.AddressedTo()] {
+				candidates = append(candidates, uxto)
 			}
 		}
 
@@ -154,35 +302,201 @@ func (w *DiskWallet) CreateTransaction(from, to core.Hash160, value, fee uint32)
 		return nil, err
 	}
 
-	if inVal < value {
-		return nil, fmt.Errorf("insufficient fund, balance=%d, want=%d", inVal, value)
+	var inVal core.Amount
+	signers := make(map[core.Hash160]core.PrivateKey)
+	txb := core.NewTransactionBuilder()
+	for _, uxto := range candidates {
+		if inVal >= want && len(txb.Ins) > 0 { // a transaction needs an input even if it pays nothing
+			break
+		}
+
+		redeemScript, sks, err := w.signersOf(uxto)
+		if err != nil {
+			log.Debugf("Skipped wallet UXTO %s:%d: %s", uxto.TxId, uxto.N, err)
+			continue
+		}
+		if redeemScript != nil {
+			txb.AddP2SHInputFrom(uxto, redeemScript)
+		} else {
+			txb.AddInputFrom(uxto)
+		}
+		for _, sk := range sks {
+			signers[core.HashPubKey(sk.PublicKey())] = sk
+		}
+
+		inVal += uxto.Value // stays below want + MAX_MONEY
+	}
+
+	if inVal < want || len(txb.Ins) == 0 {
+		return nil, fmt.Errorf("insufficient fund, balance=%d, want=%d", inVal, want)
+	}
+	txb.AddScriptOutput(out.Value, out.Script)
+
+	if inVal > want {
+		changeTo, err := w.changeScript(from)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get change address: %w", err)
+		}
+		txb.AddChange(changeTo, fee)
+	}
+	if err := txb.Err(); err != nil {
+		return nil, fmt.Errorf("invalid amount: %w", err)
+	}
+
+	for _, sk := range signers {
+		txb.Sign(sk)
+	}
+
+	return txb.Build(), nil
+}
+
+// SignTransaction signs the inputs of tx that spend P2PKH outputs of the wallet, committing to the parts of tx
+// selected by hashType. Other inputs are left for their owners to sign. It returns the number of inputs signed.
+func (w *DiskWallet) SignTransaction(tx *core.Transaction, hashType core.SigHashType) (int, error) {
+	if !hashType.Valid() {
+		return 0, fmt.Errorf("invalid hash type %s", hashType)
+	}
+
+	var owned []*core.UXTO
+	err := w.db.View(func(btx *bolt.Tx) error {
+		b := btx.Bucket([]byte("uxtos"))
+
+		for _, in := range tx.Ins {
+			uRef := persistence.UXTORef{
+				TxId: in.PrevTxId,
+				N:    in.N,
+			}
+
+			uxtoBytes := b.Get(uRef.Serialize())
+			if uxtoBytes == nil {
+				continue
+			}
+			uxto, err := marshal.DeserializeUXTO(uxtoBytes)
+			if err != nil {
+				return fmt.Errorf("failed to read uxto %s:%d: %w", uRef.TxId, uRef.N, err)
+			}
+			owned = append(owned, uxto)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	signed := 0
+	for _, uxto := range owned {
+		addr, ok := uxto.Script.P2PKHAddress()
+		if !ok {
+			log.Debugf("Skipped input %s:%d: not a P2PKH output", uxto.TxId, uxto.N)
+			continue
+		}
+
+		sk, err := w.getKey(addr)
+		if err != nil {
+			return signed, fmt.Errorf("no key for input %s:%d: %w", uxto.TxId, uxto.N, err)
+		}
+		if err := tx.SignTxIn(uxto, sk, hashType); err != nil {
+			return signed, fmt.Errorf("failed to sign input %s:%d: %w", uxto.TxId, uxto.N, err)
+		}
+		signed++
 	}
-	txb.AddOutput(value, to)
-	txb.AddChange(fee)
 
-	return txb.Sign(sk), nil
+	return signed, nil
 }
 
-// GetBalances sums up all the UXTOS for all addresses.
-func (w *DiskWallet) GetBalances() map[core.Hash160]uint32 {
-	balances := make(map[core.Hash160]uint32)
+// signersOf returns the keys needed to spend uxto, and its redeem script if it is a P2SH output.
+func (w *DiskWallet) signersOf(uxto *core.UXTO) (core.Script, []core.PrivateKey, error) {
+	if addr, ok := uxto.Script.P2PKHAddress(); ok {
+		sk, err := w.getKey(addr)
+		if err != nil {
+			return nil, nil, err
+		}
+		return nil, []core.PrivateKey{sk}, nil
+	}
+
+	h, _ := uxto.Script.P2SHHash()
+	redeemScript := w.getRedeemScript(h)
+	if redeemScript == nil {
+		return nil, nil, fmt.Errorf("unknown script")
+	}
+
+	m, pks, _ := redeemScript.MultiSigKeys()
+	var sks []core.PrivateKey
+	for _, pk := range pks {
+		if sk, err := w.getKey(core.HashTo160(pk)); err == nil {
+			sks = append(sks, sk)
+		}
+	}
+	if len(sks) < m {
+		return nil, nil, fmt.Errorf("holding %d of %d required keys", len(sks), m)
+	}
+
+	return redeemScript, sks, nil
+}
+
+// changeScript locks the change of a transaction drawn from the given addresses.
+func (w *DiskWallet) changeScript(from []core.Hash160) (core.Script, error) {
+	if len(from) == 0 {
+		addr, err := w.NewAddress()
+		if err != nil {
+			return nil, err
+		}
+		return core.NewP2PKHScript(addr), nil
+	}
+
+	if w.getRedeemScript(from[0]) != nil {
+		return core.NewP2SHScript(from[0]), nil
+	}
+
+	return core.NewP2PKHScript(from[0]), nil
+}
+
+// GetBalances sums up the UXTOs that can be spent in the next block for all addresses.
+func (w *DiskWallet) GetBalances() map[core.Hash160]core.Amount {
+	balances, _ := w.balances()
+	return balances
+}
+
+// GetImmatureBalances sums up the coinbase outputs that are not deep enough to be spent in the next block,
+// see core.UXTO.MatureAt.
+func (w *DiskWallet) GetImmatureBalances() map[core.Hash160]core.Amount {
+	_, immature := w.balances()
+	return immature
+}
+
+func (w *DiskWallet) balances() (map[core.Hash160]core.Amount, map[core.Hash160]core.Amount) {
+	balances := make(map[core.Hash160]core.Amount)
+	immature := make(map[core.Hash160]core.Amount)
 	for _, addr := range w.ListAddresses() {
 		balances[addr] = 0
+		immature[addr] = 0
 	}
 
+	next := w.Height() + 1
 	_ = w.db.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte("uxtos"))
 		c := b.Cursor()
 
 		for k, v := c.First(); k != nil; k, v = c.Next() {
-			uxto := marshal.DeserializeUXTO(v)
-			balances[uxto.PubKeyHash] += uxto.Value
+			uxto, err := marshal.DeserializeUXTO(v)
+			if err != nil {
+				log.Warnf("Skipped unreadable wallet UXTO %X: %s", k, err)
+				continue
+			}
+
+			if uxto.MatureAt(next) {
+				balances[uxto.AddressedTo()] += uxto.Value
+			} else {
+				immature[uxto.AddressedTo()] += uxto.Value
+			}
 		}
 
 		return nil
 	})
 
-	return balances
+	return balances, immature
 }
 
 func (w *DiskWallet) ListUnspent(addr core.Hash160) ([]*core.UXTO, error) {
@@ -193,11 +507,13 @@ func (w *DiskWallet) ListUnspent(addr core.Hash160) ([]*core.UXTO, error) {
 		c := b.Cursor()
 
 		for k, v := c.First(); k != nil; k, v = c.Next() {
-			uRef := persistence.UXTORef{}
-			uRef.SetBytes(k)
-			uxto := marshal.DeserializeUXTO(v)
+			uxto, err := marshal.DeserializeUXTO(v)
+			if err != nil {
+				log.Warnf("Skipped unreadable wallet UXTO %X: %s", k, err)
+				continue
+			}
 
-			if uxto.PubKeyHash == addr {
+			if uxto.AddressedTo() == addr {
 				uxtoList = append(uxtoList, uxto)
 			}
 		}
@@ -220,7 +536,11 @@ func (w *DiskWallet) ListTransactions() ([]*core.Transaction, error) {
 		c := b.Cursor()
 
 		for k, v := c.First(); k != nil; k, v = c.Next() {
-			tx := marshal.UTransaction(v)
+			tx, err := marshal.UTransaction(v)
+			if err != nil {
+				log.Warnf("Skipped unreadable wallet transaction %X: %s", k, err)
+				continue
+			}
 			txList = append(txList, tx)
 		}
 
@@ -234,91 +554,151 @@ func (w *DiskWallet) ListTransactions() ([]*core.Transaction, error) {
 	return txList, nil
 }
 
-func (w *DiskWallet) ProcessTransaction(tx *core.Transaction) error {
+// ProcessTransaction records the outputs tx pays to the wallet and deletes the UXTOs it spends, as of its
+// inclusion in a block at height.
+func (w *DiskWallet) ProcessTransaction(tx *core.Transaction, height uint32) error {
+	return w.db.Update(func(btx *bolt.Tx) error {
+		return processTransaction(btx, tx, height)
+	})
+}
+
+func processTransaction(btx *bolt.Tx, tx *core.Transaction, height uint32) error {
 	txId := tx.Hash()
 
-	err := w.db.Update(func(btx *bolt.Tx) error {
-		relevant := false // whether the database is updated
-		uxtos := btx.Bucket([]byte("uxtos"))
-		addresses := btx.Bucket([]byte("addresses"))
-		transactions := btx.Bucket([]byte("transactions"))
+	relevant := false // whether the database is updated
+	uxtos := btx.Bucket([]byte("uxtos"))
+	addresses := btx.Bucket([]byte("addresses"))
+	scripts := btx.Bucket([]byte("scripts"))
+	transactions := btx.Bucket([]byte("transactions"))
+
+	// if an uxto occurs in input set, delete it
+	log.Debugf("Processing inputs of transaction %s", txId)
+	for _, in := range tx.Ins {
+		uRef := persistence.UXTORef{
+			TxId: in.PrevTxId,
+			N:    in.N,
+		}
+
+		log.Debugf("Processsing input %s:%d", uRef.TxId, uRef.N)
+
+		uxtoBytes := uxtos.Get(uRef.Serialize())
+		if uxtoBytes == nil {
+			continue
+		}
+		relevant = true
+
+		if err := uxtos.Delete(uRef.Serialize()); err != nil {
+			return fmt.Errorf("failed to delete uxto: %w", err)
+		}
+
+		log.Infof("Deleted uxto: txId=%s, vout=%d", uRef.TxId, uRef.N)
+	}
+
+	log.Debugf("Processing outputs of transaction %s", txId)
+	// if output contains one of our addresses, add it
+	for i, out := range tx.Outs {
+		if isMine(out, addresses, scripts) {
+			relevant = true
 
-		// if an uxto occurs in input set, delete it
-		log.Debugf("Processing inputs of transaction %s", txId)
-		for _, in := range tx.Ins {
 			uRef := persistence.UXTORef{
-				TxId: in.PrevTxId,
-				N:    in.N,
+				TxId: txId,
+				N:    uint32(i),
 			}
 
-			log.Debugf("Processsing input %s:%d", uRef.TxId, uRef.N)
-
-			uxtoBytes := uxtos.Get(uRef.Serialize())
-			if uxtoBytes == nil {
-				continue
+			newUXTO := &core.UXTO{
+				TxId:     txId,
+				N:        uint32(i),
+				Height:   height,
+				Coinbase: tx.IsCoinbaseTx(),
+				TxOut:    out,
 			}
-			relevant = true
 
-			if err := uxtos.Delete(uRef.Serialize()); err != nil {
-				return fmt.Errorf("failed to delete uxto: %w", err)
+			if err := uxtos.Put(uRef.Serialize(), marshal.SerializeUXTO(newUXTO)); err != nil {
+				return fmt.Errorf("failed to put uxto: %w", err)
 			}
 
-			log.Infof("Deleted uxto: txId=%s, vout=%d", uRef.TxId, uRef.N)
+			log.Infof("Added uxto: txId=%s, vout=%d, value=%d", uRef.TxId, uRef.N, out.Value)
 		}
+	}
 
-		log.Debugf("Processing outputs of transaction %s", txId)
-		// if output contains one of our addresses, add it
-		for i, out := range tx.Outs {
-			if addresses.Get(out.PubKeyHash[:]) != nil {
-				relevant = true
+	// record this transaction
+	if relevant {
+		if err := transactions.Put(txId[:], marshal.Transaction(tx)); err != nil {
+			return fmt.Errorf("failed to put transaction: %w", err)
+		}
+	}
 
-				uRef := persistence.UXTORef{
-					TxId: txId,
-					N:    uint32(i),
-				}
+	return nil
+}
 
-				newUXTO := &core.UXTO{
-					TxId:  txId,
-					N:     uint32(i),
-					TxOut: out,
-				}
+// isMine checks whether an output pays to one of our keys or to one of our multisig scripts.
+func isMine(out *core.TxOut, addresses, scripts *bolt.Bucket) bool {
+	if addr, ok := out.Script.P2PKHAddress(); ok {
+		return addresses.Get(addr[:]) != nil
+	}
+	if h, ok := out.Script.P2SHHash(); ok {
+		return scripts.Get(h[:]) != nil
+	}
 
-				if err := uxtos.Put(uRef.Serialize(), marshal.SerializeUXTO(newUXTO)); err != nil {
-					return fmt.Errorf("failed to put uxto: %w", err)
-				}
+	return false
+}
 
-				log.Infof("Added uxto: txId=%s, vout=%d, value=%d", uRef.TxId, uRef.N, out.Value)
+// ProcessBlock processes the transactions of a block connected to the active chain, all at once.
+func (w *DiskWallet) ProcessBlock(block *core.Block) error {
+	err := w.db.Update(func(btx *bolt.Tx) error {
+		for _, tx := range block.Transactions {
+			if err := processTransaction(btx, tx, block.Height); err != nil {
+				return fmt.Errorf("failed to process transaction %s: %w", tx.Hash(), err)
 			}
 		}
+		return btx.Bucket([]byte("meta")).Put([]byte("height"), marshal.Uint32ToBytes(block.Height))
+	})
+	if err != nil {
+		return fmt.Errorf("failed to process block %s: %w", block.Hash, err)
+	}
 
-		// record this transaction
-		if relevant {
-			if err := transactions.Put(txId[:], marshal.Transaction(tx)); err != nil {
-				return fmt.Errorf("failed to put transaction: %w", err)
-			}
-		}
+	return nil
+}
 
+// Height returns the height of the last block processed by the wallet.
+func (w *DiskWallet) Height() uint32 {
+	var height uint32
+
+	_ = w.db.View(func(tx *bolt.Tx) error {
+		if ret := tx.Bucket([]byte("meta")).Get([]byte("height")); ret != nil {
+			height = marshal.Uint32FromBytes(ret)
+		}
 		return nil
 	})
 
-	return err
+	return height
 }
 
-func (w *DiskWallet) ProcessBlock(block *core.Block) {
-	for _, tx := range block.Transactions {
-		if err := w.ProcessTransaction(tx); err != nil {
-			log.Errorf("Failed to process transaction %s: %v", tx.Hash(), err)
+// ResetChainState forgets the UXTOs, the transactions and the height the wallet learned from blocks, keeping its keys
+// and scripts, so that the blocks can be processed again from genesis.
+func (w *DiskWallet) ResetChainState() error {
+	return w.db.Update(func(tx *bolt.Tx) error {
+		for _, bucketKey := range [][]byte{[]byte("uxtos"), []byte("transactions")} {
+			if err := tx.DeleteBucket(bucketKey); err != nil {
+				return fmt.Errorf("failed to delete bucket: %w", err)
+			}
+			if _, err := tx.CreateBucket(bucketKey); err != nil {
+				return fmt.Errorf("failed to create bucket: %w", err)
+			}
 		}
-	}
+		return tx.Bucket([]byte("meta")).Delete([]byte("height"))
+	})
 }
 
-func (w *DiskWallet) RollBack(block *core.Block, spent []*core.UXTO) {
+// RollBack undoes ProcessBlock for a block disconnected from the active chain, all at once.
+func (w *DiskWallet) RollBack(block *core.Block, spent []*core.UXTO) error {
 	err := w.db.Update(func(tx *bolt.Tx) error {
 		uxtos := tx.Bucket([]byte("uxtos"))
 		addresses := tx.Bucket([]byte("addresses"))
+		scripts := tx.Bucket([]byte("scripts"))
 
 		for _, uxto := range spent {
-			if addresses.Get(uxto.TxOut.PubKeyHash[:]) == nil {
+			if !isMine(uxto.TxOut, addresses, scripts) {
 				// not ours
 				continue
 			}
@@ -354,10 +734,14 @@ func (w *DiskWallet) RollBack(block *core.Block, spent []*core.UXTO) {
 			log.Infof("Deleted uxto (Rollback): txId=%s, vout=%d, value=%d", uRef.TxId, uRef.N, uxto.Value)
 		}
 
-		return nil
+		if block.Height == 0 {
+			return nil
+		}
+		return tx.Bucket([]byte("meta")).Put([]byte("height"), marshal.Uint32ToBytes(block.Height-1))
 	})
-
 	if err != nil {
-		log.Errorf("Failed to rollback: %v", err)
+		return fmt.Errorf("failed to roll back block %s: %w", block.Hash, err)
 	}
+
+	return nil
 }